@@ -1,9 +1,11 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
 
 	dalle "github.com/TrueBlocks/trueblocks-dalle/v6"
@@ -14,6 +16,15 @@ type App struct {
 	ValidSeries []string
 	Config      Config
 	Engine      *dalle.Engine
+	Jobs        *JobQueue
+	Batches     *BatchManager
+	Webhooks    *WebhookDispatcher
+	Idempotency *IdempotencyStore
+	Dresses     *DressBuilder
+	Provider    Provider
+	Usage       *UsageLedger
+	Derivatives *DerivativeCache
+	Retention   *Janitor
 }
 
 func NewApp() *App {
@@ -23,11 +34,120 @@ func NewApp() *App {
 		panic(err)
 	}
 	app.Engine = engine
+	provider, err := startProvider(app.Config)
+	if err != nil {
+		panic(err)
+	}
+	app.Provider = provider
+	store, err := NewArtifactStore(app.Config)
+	if err != nil {
+		panic(err)
+	}
+	UseStore(store, app.Config.PresignTTL)
+	UseRateLimits(app.Config.RequestsPerMinute, app.Config.RetryBudget)
+	UseDownloadGuard(app.Config.DownloadHedge, app.Config.DownloadMaxBytes)
+	UseProvider(provider)
+	UseEnhancementFallbacks(app.Config.EnhancementFallbacks)
+	if app.Config.EnhancementIdleTimeout > 0 {
+		enhanceIdleTimeout = app.Config.EnhancementIdleTimeout
+	}
+	GetBreakerRegistry().Configure(app.Config.Breakers)
+	defaultEnhancementSettings().Merge(app.Config.Enhancement).exportToLibrary(provider)
 	_ = os.MkdirAll(storage.OutputDir(), 0o750)
 	app.ValidSeries = dalle.ListSeries()
+	app.Dresses = NewDressBuilder()
+	app.Usage = NewUsageLedger(filepath.Join(storage.OutputDir(), "usage"), app.Config.Rates, app.Config.DailyBudget, app.Config.MonthlyBudget)
+	if model := defaultEnhancementSettings().Merge(app.Config.Enhancement).Model; model != "" {
+		if _, ok := app.Config.Rates.chatRate(model); !ok {
+			logWarn(fmt.Sprintf("no rate for enhancement model %q; its usage will cost $0 and not count toward the budgets (add it with --rate-table)", model))
+		}
+	}
+	app.startWebhooks()
+	if app.Config.AdminToken == "" {
+		logWarn("TB_DALLE_ADMIN_TOKEN not set; /v1/admin/ endpoints are disabled")
+	}
+	app.Idempotency = NewIdempotencyStore(filepath.Join(storage.OutputDir(), "idempotency"), app.Config.IdempotencyTTL)
+	app.Derivatives = NewDerivativeCache(filepath.Join(storage.OutputDir(), "derivatives"), app.Config.DerivativeCacheBytes)
+	app.Retention = NewJanitor(app.Config.Retention, filepath.Join(storage.OutputDir(), "retention"))
+	app.Retention.Start()
+	app.startJobs()
+	app.startBatches()
 	return &app
 }
 
+// startWebhooks loads webhook subscriptions; payloads are unsigned when no secret is configured
+func (a *App) startWebhooks() {
+	a.Webhooks = NewWebhookDispatcher(filepath.Join(storage.OutputDir(), "webhooks"), a.Config.WebhookSecret)
+	if a.Config.WebhookSecret == "" {
+		logWarn("TB_DALLE_WEBHOOK_SECRET not set; webhook payloads will not be signed")
+	}
+}
+
+// startJobs creates the persistent job queue under the output directory and launches its workers
+func (a *App) startJobs() {
+	store := NewJobStore(filepath.Join(storage.OutputDir(), "jobs"))
+	a.Jobs = NewJobQueue(store, a.Config.JobWorkers, a.runJob)
+	a.Jobs.SetClassCaps(a.Config.ClassCaps)
+	a.Jobs.SetMaxQueued(a.Config.MaxQueue)
+	if a.Webhooks != nil {
+		a.Jobs.OnFinish = a.Webhooks.JobFinished
+	}
+	a.Jobs.Admit = func(*Job) error {
+		if a.Usage != nil {
+			if err := a.Usage.CheckBudget(); err != nil {
+				return err
+			}
+		}
+		return a.Retention.CheckQuota(context.Background())
+	}
+	a.Jobs.Start()
+}
+
+// startBatches creates the batch manager; each batch keeps up to twice the worker count in the queue
+func (a *App) startBatches() {
+	store := NewBatchStore(filepath.Join(storage.OutputDir(), "batches"))
+	a.Batches = NewBatchManager(store, a.Jobs, 2*a.Jobs.workers)
+}
+
+// runJob executes a single queued job on behalf of the job queue
+func (a *App) runJob(ctx context.Context, job *Job) (interface{}, error) {
+	switch job.Kind {
+	case JobKindDalle:
+		return a.runDalleJob(ctx, job)
+	case JobKindGenerate:
+		if job.Request == nil {
+			return nil, fmt.Errorf("job %s has no generate request", job.ID)
+		}
+		// The series' enhancement settings apply here as on /dalle/: the engine reuses the
+		// enhanced prompt it finds for the input instead of enhancing with the defaults
+		skip := a.Config.SkipImage || os.Getenv("TB_DALLE_SKIP_IMAGE") == "1"
+		if job.Request.Series != "" && !skip {
+			a.preEnhance(ctx, &Job{ID: job.ID, Kind: job.Kind, RequestID: job.RequestID, Client: job.Client, Series: job.Request.Series, Address: job.Request.Input})
+			defer forgetEnhancement(job.Request.Series, job.Request.Input)
+		}
+		// Engine.Generate takes no context, so this is the last point a cancellation stops it
+		if ctx.Err() != nil {
+			return nil, errJobCancelled
+		}
+		if !skip {
+			if budgetErr := a.checkBudget(); budgetErr != nil {
+				GetMetricsCollector().RecordBudgetRejection("jobs", job.RequestID)
+				return nil, budgetErr
+			}
+		}
+		result, err := a.Engine.Generate(*job.Request)
+		if err == nil && result != nil {
+			a.recordImage(job, job.Request.Series, result.ImagePath)
+			if pubErr := publishFile(result.ImagePath, job.RequestID); pubErr != nil {
+				logError(fmt.Sprintf("[%s] unable to publish %s to %s storage: %v", job.RequestID, result.ImagePath, CurrentStore().Name(), pubErr))
+			}
+		}
+		return result, err
+	default:
+		return nil, fmt.Errorf("unknown job kind %q", job.Kind)
+	}
+}
+
 type Request struct {
 	series    string
 	address   string
@@ -35,6 +155,9 @@ type Request struct {
 	remove    bool
 	app       *App
 	requestID string
+	callback  string
+	priority  PriorityClass
+	client    string
 }
 
 func (r *Request) String() string {
@@ -61,19 +184,21 @@ func (a *App) parseRequest(r *http.Request) (Request, *APIError) {
 	}
 
 	series := strings.ToLower(segments[0])
-	if len(series) == 0 {
-		return Request{}, ErrorMissingRequiredParameter("series").WithRequestID(requestID)
-	}
-	if !dalle.IsValidSeries(series, a.ValidSeries) {
-		return Request{}, ErrorInvalidSeriesName(series).WithRequestID(requestID)
+	address := strings.ToLower(segments[1])
+	if apiErr := a.validateSeriesAddress(series, address); apiErr != nil {
+		return Request{}, apiErr.WithRequestID(requestID)
 	}
 
-	address := strings.ToLower(segments[1])
-	if len(address) == 0 {
-		return Request{}, ErrorMissingRequiredParameter("address").WithRequestID(requestID)
+	callback := r.URL.Query().Get("callback_url")
+	if callback != "" {
+		if err := ValidateWebhookURL(callback); err != nil {
+			return Request{}, NewAPIError(ErrorInvalidRequest, "Invalid callback_url", err.Error()).WithRequestID(requestID)
+		}
 	}
-	if !isValidLegacyID(address) {
-		return Request{}, ErrorInvalidAddressFormat(address).WithRequestID(requestID)
+
+	priority, apiErr := a.requestPriority(r, r.URL.Query().Get("priority"), PriorityInteractive)
+	if apiErr != nil {
+		return Request{}, apiErr.WithRequestID(requestID)
 	}
 
 	return Request{
@@ -83,9 +208,29 @@ func (a *App) parseRequest(r *http.Request) (Request, *APIError) {
 		remove:    r.URL.Query().Has("remove"),
 		app:       a,
 		requestID: requestID,
+		callback:  callback,
+		priority:  priority,
+		client:    requestClient(r),
 	}, nil
 }
 
+// validateSeriesAddress checks a lower-cased (series, address) pair from a request path
+func (a *App) validateSeriesAddress(series, address string) *APIError {
+	if len(series) == 0 {
+		return ErrorMissingRequiredParameter("series")
+	}
+	if !dalle.IsValidSeries(series, a.ValidSeries) {
+		return ErrorInvalidSeriesName(series)
+	}
+	if len(address) == 0 {
+		return ErrorMissingRequiredParameter("address")
+	}
+	if !isValidLegacyID(address) {
+		return ErrorInvalidAddressFormat(address)
+	}
+	return nil
+}
+
 func isValidLegacyID(value string) bool {
 	if len(value) != 42 || !strings.HasPrefix(value, "0x") {
 		return false
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3Config locates a bucket on an S3-compatible object store
+type S3Config struct {
+	// Endpoint is the store's base URL; empty means AWS in Region
+	Endpoint string
+	Bucket   string
+	// Prefix is prepended to every key, e.g. "dalle/"
+	Prefix    string
+	Region    string
+	AccessKey string
+	SecretKey string
+}
+
+const (
+	defaultS3Region = "us-east-1"
+	s3Algorithm     = "AWS4-HMAC-SHA256"
+	s3DateFormat    = "20060102T150405Z"
+	// s3UnsignedPayload marks presigned requests, whose body is not known when signing
+	s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+	// s3MaxPresignTTL is the longest a SigV4 presigned URL may be valid for
+	s3MaxPresignTTL = 7 * 24 * time.Hour
+)
+
+// S3Store keeps artifacts in a bucket on an S3-compatible object store (AWS, MinIO, R2 and
+// the like), addressing it path-style and signing requests with Signature Version 4
+type S3Store struct {
+	endpoint *url.URL
+	cfg      S3Config
+	client   *http.Client
+	now      func() time.Time
+}
+
+// NewS3Store checks cfg and creates the store; nothing is sent until it is used
+func NewS3Store(cfg S3Config) (*S3Store, error) {
+	if cfg.Bucket == "" {
+		return nil, errors.New("s3 storage needs a bucket")
+	}
+	if cfg.AccessKey == "" || cfg.SecretKey == "" {
+		return nil, errors.New("s3 storage needs an access key and secret key")
+	}
+	if cfg.Region == "" {
+		cfg.Region = defaultS3Region
+	}
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = "https://s3." + cfg.Region + ".amazonaws.com"
+	}
+	endpoint, err := url.Parse(strings.TrimSuffix(cfg.Endpoint, "/"))
+	if err != nil || endpoint.Host == "" || (endpoint.Scheme != "http" && endpoint.Scheme != "https") {
+		return nil, fmt.Errorf("invalid s3 endpoint %q", cfg.Endpoint)
+	}
+	cfg.Prefix = strings.Trim(cfg.Prefix, "/")
+	if cfg.Prefix != "" {
+		cfg.Prefix += "/"
+	}
+	return &S3Store{endpoint: endpoint, cfg: cfg, client: &http.Client{Timeout: artifactOpTimeout}, now: time.Now}, nil
+}
+
+func (s *S3Store) Name() string { return StorageS3 }
+
+// Describe names the bucket for logs
+func (s *S3Store) Describe() string {
+	return fmt.Sprintf("s3://%s/%s at %s", s.cfg.Bucket, s.cfg.Prefix, s.endpoint.Host)
+}
+
+// objectURL is the path-style URL of key, without a query
+func (s *S3Store) objectURL(key string) *url.URL {
+	u := *s.endpoint
+	u.Path = s.endpoint.Path + "/" + s.cfg.Bucket + "/" + s.cfg.Prefix + key
+	u.RawPath = s3Escape(s.endpoint.Path, true) + "/" + s3Escape(s.cfg.Bucket, false) + "/" + s3Escape(s.cfg.Prefix+key, true)
+	return &u
+}
+
+func (s *S3Store) bucketURL() *url.URL {
+	u := *s.endpoint
+	u.Path = s.endpoint.Path + "/" + s.cfg.Bucket
+	u.RawPath = ""
+	return &u
+}
+
+func (s *S3Store) Put(ctx context.Context, key string, data []byte, contentType string) error {
+	if err := validateArtifactKey(key); err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, s.objectURL(key).String(), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := s.do(req, data)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	return nil
+}
+
+func (s *S3Store) Open(ctx context.Context, key string) (io.ReadCloser, ArtifactInfo, error) {
+	if err := validateArtifactKey(key); err != nil {
+		return nil, ArtifactInfo{}, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.objectURL(key).String(), nil)
+	if err != nil {
+		return nil, ArtifactInfo{}, err
+	}
+	resp, err := s.do(req, nil)
+	if err != nil {
+		return nil, ArtifactInfo{}, err
+	}
+	return resp.Body, s.infoFrom(key, resp), nil
+}
+
+func (s *S3Store) Stat(ctx context.Context, key string) (ArtifactInfo, error) {
+	if err := validateArtifactKey(key); err != nil {
+		return ArtifactInfo{}, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, s.objectURL(key).String(), nil)
+	if err != nil {
+		return ArtifactInfo{}, err
+	}
+	resp, err := s.do(req, nil)
+	if err != nil {
+		return ArtifactInfo{}, err
+	}
+	_ = resp.Body.Close()
+	return s.infoFrom(key, resp), nil
+}
+
+func (s *S3Store) Delete(ctx context.Context, key string) error {
+	if err := validateArtifactKey(key); err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, s.objectURL(key).String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(req, nil)
+	if errors.Is(err, ErrArtifactNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	return nil
+}
+
+// s3ListResult is the part of a ListObjectsV2 response the store reads
+type s3ListResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		LastModified time.Time `xml:"LastModified"`
+		Size         int64     `xml:"Size"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func (s *S3Store) List(ctx context.Context, prefix string) ([]ArtifactInfo, error) {
+	var out []ArtifactInfo
+	token := ""
+	for {
+		u := s.bucketURL()
+		q := url.Values{"list-type": {"2"}, "prefix": {s.cfg.Prefix + prefix}}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		u.RawQuery = s3CanonicalQuery(q)
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := s.do(req, nil)
+		if err != nil {
+			return nil, err
+		}
+		var page s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&page)
+		_ = resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("s3 list: %w", err)
+		}
+		for _, c := range page.Contents {
+			key := strings.TrimPrefix(c.Key, s.cfg.Prefix)
+			out = append(out, ArtifactInfo{Key: key, Size: c.Size, ModTime: c.LastModified, ContentType: contentTypeFor(key)})
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return out, nil
+		}
+		token = page.NextContinuationToken
+	}
+}
+
+// PresignGet returns a URL anyone can GET key from until ttl elapses
+func (s *S3Store) PresignGet(key string, ttl time.Duration) (string, error) {
+	if err := validateArtifactKey(key); err != nil {
+		return "", err
+	}
+	if ttl <= 0 || ttl > s3MaxPresignTTL {
+		return "", fmt.Errorf("presign ttl %v outside 1s to %v", ttl, s3MaxPresignTTL)
+	}
+	now := s.now().UTC()
+	u := s.objectURL(key)
+	q := url.Values{
+		"X-Amz-Algorithm":     {s3Algorithm},
+		"X-Amz-Credential":    {s.cfg.AccessKey + "/" + s.scope(now)},
+		"X-Amz-Date":          {now.Format(s3DateFormat)},
+		"X-Amz-Expires":       {strconv.Itoa(int(ttl.Seconds()))},
+		"X-Amz-SignedHeaders": {"host"},
+	}
+	u.RawQuery = s3CanonicalQuery(q)
+	header := http.Header{}
+	header.Set("Host", u.Host)
+	signature := s.signature(http.MethodGet, u, header, []string{"host"}, s3UnsignedPayload, now)
+	u.RawQuery += "&X-Amz-Signature=" + signature
+	return u.String(), nil
+}
+
+// do signs and sends req, turning S3 error responses into errors
+func (s *S3Store) do(req *http.Request, body []byte) (*http.Response, error) {
+	s.sign(req, body, s.now().UTC())
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrArtifactNotFound
+	}
+	var s3Err struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	raw, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+	if xml.Unmarshal(raw, &s3Err) == nil && s3Err.Code != "" {
+		return nil, fmt.Errorf("s3 %s %s: %d %s: %s", req.Method, req.URL.Path, resp.StatusCode, s3Err.Code, s3Err.Message)
+	}
+	return nil, fmt.Errorf("s3 %s %s: status %d", req.Method, req.URL.Path, resp.StatusCode)
+}
+
+func (s *S3Store) infoFrom(key string, resp *http.Response) ArtifactInfo {
+	info := ArtifactInfo{Key: key, Size: resp.ContentLength, ContentType: resp.Header.Get("Content-Type")}
+	if at, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		info.ModTime = at
+	}
+	if info.ContentType == "" {
+		info.ContentType = contentTypeFor(key)
+	}
+	return info
+}
+
+// sign adds SigV4 authentication headers to req
+func (s *S3Store) sign(req *http.Request, body []byte, now time.Time) {
+	sum := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(sum[:])
+	req.Header.Set("X-Amz-Date", now.Format(s3DateFormat))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	req.Header.Set("Host", req.URL.Host)
+	signed := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	if req.Header.Get("Content-Type") != "" {
+		signed = append(signed, "content-type")
+		sort.Strings(signed)
+	}
+	signature := s.signature(req.Method, req.URL, req.Header, signed, payloadHash, now)
+	req.Header.Del("Host")
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3Algorithm, s.cfg.AccessKey, s.scope(now), strings.Join(signed, ";"), signature))
+}
+
+func (s *S3Store) scope(now time.Time) string {
+	return now.Format("20060102") + "/" + s.cfg.Region + "/s3/aws4_request"
+}
+
+// signature computes the SigV4 signature of a request over the given signed headers
+func (s *S3Store) signature(method string, u *url.URL, header http.Header, signed []string, payloadHash string, now time.Time) string {
+	var canonicalHeaders strings.Builder
+	for _, name := range signed {
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(header.Get(name)) + "\n")
+	}
+	canonicalRequest := strings.Join([]string{
+		method,
+		u.EscapedPath(),
+		s3CanonicalQuery(u.Query()),
+		canonicalHeaders.String(),
+		strings.Join(signed, ";"),
+		payloadHash,
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{s3Algorithm, now.Format(s3DateFormat), s.scope(now), hex.EncodeToString(requestHash[:])}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.cfg.SecretKey), now.Format("20060102"))
+	key = hmacSHA256(key, s.cfg.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3CanonicalQuery encodes q sorted by key the way SigV4 signs it; X-Amz-Signature is left
+// out since it is not part of what is signed
+func s3CanonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		if k != "X-Amz-Signature" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		values := append([]string(nil), q[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, s3Escape(k, false)+"="+s3Escape(v, false))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3Escape percent-encodes everything but RFC 3986 unreserved characters (and '/' when
+// keepSlash is set), as SigV4 requires
+func s3Escape(s string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && keepSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TrueBlocks/trueblocks-dalle/v6/pkg/storage"
+)
+
+const (
+	StorageLocal = "local"
+	StorageS3    = "s3"
+)
+
+const (
+	// defaultPresignTTL is how long a redirect to a presigned object URL stays valid
+	defaultPresignTTL = 15 * time.Minute
+	// artifactOpTimeout bounds a single store operation made outside a request
+	artifactOpTimeout = 30 * time.Second
+)
+
+// ErrArtifactNotFound is returned for keys the store does not hold
+var ErrArtifactNotFound = errors.New("artifact not found")
+
+// ArtifactInfo describes a stored artifact
+type ArtifactInfo struct {
+	Key         string    `json:"key"`
+	Size        int64     `json:"size"`
+	ModTime     time.Time `json:"modTime"`
+	ContentType string    `json:"contentType,omitempty"`
+}
+
+// ArtifactStore holds the files generations produce. Keys are slash-separated paths
+// relative to the output directory ("<series>/annotated/<address>.png"), so the same key
+// names a file on disk and an object in a bucket.
+type ArtifactStore interface {
+	Name() string
+	Put(ctx context.Context, key string, data []byte, contentType string) error
+	// Open returns the artifact's content; the caller closes it
+	Open(ctx context.Context, key string) (io.ReadCloser, ArtifactInfo, error)
+	Stat(ctx context.Context, key string) (ArtifactInfo, error)
+	// Delete removes key; deleting a missing key is not an error
+	Delete(ctx context.Context, key string) error
+	// List returns every artifact whose key starts with prefix
+	List(ctx context.Context, prefix string) ([]ArtifactInfo, error)
+}
+
+// Presigner is implemented by stores that can hand out time-limited URLs for an artifact,
+// letting clients fetch it without going through the server
+type Presigner interface {
+	PresignGet(key string, ttl time.Duration) (string, error)
+}
+
+// artifactKey joins path elements into a store key
+func artifactKey(elem ...string) string {
+	return path.Join(elem...)
+}
+
+// validateArtifactKey rejects keys that are empty, absolute or climb out of the store
+func validateArtifactKey(key string) error {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, "\\") {
+		return fmt.Errorf("invalid artifact key %q", key)
+	}
+	for _, part := range strings.Split(key, "/") {
+		if part == "" || part == "." || part == ".." {
+			return fmt.Errorf("invalid artifact key %q", key)
+		}
+	}
+	return nil
+}
+
+// contentTypeFor guesses a content type from the key's extension
+func contentTypeFor(key string) string {
+	if ct := mime.TypeByExtension(path.Ext(key)); ct != "" {
+		return ct
+	}
+	return "application/octet-stream"
+}
+
+// LocalStore keeps artifacts on disk under root. It is the default, and with root set to
+// the output directory it is where the library already writes them.
+type LocalStore struct {
+	root    string
+	fileOps *RobustFileOperations
+}
+
+// NewLocalStore creates a store rooted at dir
+func NewLocalStore(dir string) *LocalStore {
+	return &LocalStore{root: dir, fileOps: NewRobustFileOperations()}
+}
+
+func (s *LocalStore) Name() string { return StorageLocal }
+
+// Root is the directory artifacts are kept in
+func (s *LocalStore) Root() string { return s.root }
+
+func (s *LocalStore) path(key string) (string, error) {
+	if err := validateArtifactKey(key); err != nil {
+		return "", err
+	}
+	return filepath.Join(s.root, filepath.FromSlash(key)), nil
+}
+
+func (s *LocalStore) Put(ctx context.Context, key string, data []byte, contentType string) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	return s.fileOps.WriteFile(p, data, "")
+}
+
+func (s *LocalStore) Open(ctx context.Context, key string) (io.ReadCloser, ArtifactInfo, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return nil, ArtifactInfo{}, err
+	}
+	file, err := os.Open(p) // #nosec G304 - key validated above
+	if err != nil {
+		return nil, ArtifactInfo{}, localStoreError(err)
+	}
+	fi, err := file.Stat()
+	if err != nil || fi.IsDir() {
+		_ = file.Close()
+		return nil, ArtifactInfo{}, ErrArtifactNotFound
+	}
+	return file, ArtifactInfo{Key: key, Size: fi.Size(), ModTime: fi.ModTime(), ContentType: contentTypeFor(key)}, nil
+}
+
+func (s *LocalStore) Stat(ctx context.Context, key string) (ArtifactInfo, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return ArtifactInfo{}, err
+	}
+	fi, err := os.Stat(p)
+	if err != nil {
+		return ArtifactInfo{}, localStoreError(err)
+	}
+	if fi.IsDir() {
+		return ArtifactInfo{}, ErrArtifactNotFound
+	}
+	return ArtifactInfo{Key: key, Size: fi.Size(), ModTime: fi.ModTime(), ContentType: contentTypeFor(key)}, nil
+}
+
+func (s *LocalStore) Delete(ctx context.Context, key string) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	return s.fileOps.RemoveFile(p, "")
+}
+
+func (s *LocalStore) List(ctx context.Context, prefix string) ([]ArtifactInfo, error) {
+	var out []ArtifactInfo
+	err := filepath.WalkDir(s.root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || strings.HasSuffix(p, ".tmp") {
+			return nil
+		}
+		rel, err := filepath.Rel(s.root, p)
+		if err != nil {
+			return nil
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		out = append(out, ArtifactInfo{Key: key, Size: info.Size(), ModTime: info.ModTime(), ContentType: contentTypeFor(key)})
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	return out, nil
+}
+
+func localStoreError(err error) error {
+	if errors.Is(err, fs.ErrNotExist) {
+		return ErrArtifactNotFound
+	}
+	return err
+}
+
+var activeStore = struct {
+	sync.RWMutex
+	s          ArtifactStore
+	presignTTL time.Duration
+}{presignTTL: defaultPresignTTL}
+
+// CurrentStore returns the artifact store, the output directory on disk unless another
+// store was configured
+func CurrentStore() ArtifactStore {
+	activeStore.RLock()
+	defer activeStore.RUnlock()
+	if activeStore.s == nil {
+		return NewLocalStore(storage.OutputDir())
+	}
+	return activeStore.s
+}
+
+// UseStore makes s the artifact store; presignTTL bounds the URLs clients are redirected
+// to when s can presign them (0 streams artifacts through the server instead)
+func UseStore(s ArtifactStore, presignTTL time.Duration) {
+	activeStore.Lock()
+	defer activeStore.Unlock()
+	activeStore.s = s
+	activeStore.presignTTL = presignTTL
+}
+
+// storeIsOutputDir reports whether s is the local output directory the library writes to,
+// in which case there is nothing to publish
+func storeIsOutputDir(s ArtifactStore) bool {
+	local, ok := s.(*LocalStore)
+	return ok && filepath.Clean(local.root) == filepath.Clean(storage.OutputDir())
+}
+
+// NewArtifactStore creates the store named by cfg.Storage
+func NewArtifactStore(cfg Config) (ArtifactStore, error) {
+	switch cfg.Storage {
+	case "", StorageLocal:
+		return NewLocalStore(storage.OutputDir()), nil
+	case StorageS3:
+		return NewS3Store(cfg.S3)
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q (want local or s3)", cfg.Storage)
+	}
+}
+
+// artifactPaths lists the files the library writes for (series, address), the same ones
+// dalle.Clean removes, as keys
+func artifactPaths(series, address string) []string {
+	keys := []string{
+		artifactKey(series, "annotated", address+".png"),
+		artifactKey(series, "selector", address+".json"),
+		artifactKey(series, "generated", address+".png"),
+		artifactKey(series, "audio", address+".mp3"),
+	}
+	for _, dir := range []string{"data", "title", "terse", "prompt", "enhanced"} {
+		keys = append(keys, artifactKey(series, dir, address+".txt"))
+	}
+	return keys
+}
+
+// publishArtifacts copies what the library wrote for (series, address) into the store.
+// The library only writes to disk, so this is what makes a generation visible to other
+// replicas sharing an object store.
+func publishArtifacts(series, address, requestID string) error {
+	store := CurrentStore()
+	if storeIsOutputDir(store) {
+		return nil
+	}
+	var firstErr error
+	for _, key := range artifactPaths(series, address) {
+		local := filepath.Join(storage.OutputDir(), filepath.FromSlash(key))
+		if !fileExists(local) {
+			continue
+		}
+		if err := GetFileOperations().PublishArtifact(store, key, local, requestID); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// publishFile copies one file under the output directory into the store; files elsewhere
+// are left alone
+func publishFile(localPath, requestID string) error {
+	store := CurrentStore()
+	if storeIsOutputDir(store) || localPath == "" {
+		return nil
+	}
+	rel, err := filepath.Rel(storage.OutputDir(), localPath)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return nil
+	}
+	return GetFileOperations().PublishArtifact(store, filepath.ToSlash(rel), localPath, requestID)
+}
+
+// removeArtifacts deletes keys from the store when it is not the output directory itself
+func removeArtifacts(requestID string, keys ...string) {
+	store := CurrentStore()
+	if storeIsOutputDir(store) {
+		return
+	}
+	for _, key := range keys {
+		if err := GetFileOperations().RemoveArtifact(store, key, requestID); err != nil {
+			logError(fmt.Sprintf("[%s] unable to remove %s from %s storage: %v", requestID, key, store.Name(), err))
+		}
+	}
+}
+
+// artifactExists reports whether the store holds key
+func artifactExists(ctx context.Context, key string) bool {
+	_, err := CurrentStore().Stat(ctx, key)
+	return err == nil
+}
+
+// serveArtifact answers with the artifact at key in the active store: a redirect to a
+// presigned URL when the store can make one, otherwise its content, honoring Range and
+// conditional requests
+func serveArtifact(w http.ResponseWriter, r *http.Request, key string) {
+	serveArtifactFrom(w, r, CurrentStore(), key, mutableCacheControl)
+}
+
+func writeArtifactError(w http.ResponseWriter, key string, err error) {
+	requestID := GenerateRequestID()
+	if errors.Is(err, ErrArtifactNotFound) {
+		WriteErrorResponse(w, NewAPIError(ErrorFileNotFound, "File not found", key).WithRequestID(requestID), http.StatusNotFound)
+		return
+	}
+	logError(fmt.Sprintf("[%s] unable to read %s: %v", requestID, key, err))
+	WriteErrorResponse(w, NewAPIError(ErrorStorageUnavailable, "Storage unavailable", err.Error()).WithRequestID(requestID), http.StatusBadGateway)
+}
+
+// handleFiles serves /files/<key> from the artifact store
+func (a *App) handleFiles(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		WriteErrorResponse(w, NewAPIError(ErrorInvalidRequest, "Method not allowed", r.Method).WithRequestID(GenerateRequestID()), http.StatusMethodNotAllowed)
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/files/")
+	if err := validateArtifactKey(key); err != nil {
+		WriteErrorResponse(w, NewAPIError(ErrorInvalidRequest, "Invalid file path", err.Error()).WithRequestID(GenerateRequestID()), http.StatusBadRequest)
+		return
+	}
+	serveArtifact(w, r, key)
+}
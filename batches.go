@@ -0,0 +1,505 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	dalle "github.com/TrueBlocks/trueblocks-dalle/v6"
+	"github.com/TrueBlocks/trueblocks-dalle/v6/pkg/progress"
+	"github.com/google/uuid"
+)
+
+// maxBatchItems bounds the number of (series, address) pairs accepted in one batch
+const maxBatchItems = 10000
+
+// batchQueueFullDelay is how long a batch waits before retrying an item the job queue shed
+var batchQueueFullDelay = time.Second
+
+// BatchItemPending marks an item that has not been handed to the job queue yet
+const BatchItemPending JobState = "pending"
+
+// BatchState summarises a batch as a whole
+type BatchState string
+
+const (
+	BatchRunning   BatchState = "running"
+	BatchCompleted BatchState = "completed"
+	BatchCancelled BatchState = "cancelled"
+)
+
+// errBatchFinished is returned when cancelling a batch that has nothing left to run
+var errBatchFinished = errors.New("batch already finished")
+
+// BatchItem is one (series, address) pair in a batch
+type BatchItem struct {
+	Series   string   `json:"series"`
+	Address  string   `json:"address"`
+	State    JobState `json:"state"`
+	JobID    string   `json:"job_id,omitempty"`
+	Joined   bool     `json:"joined,omitempty"` // job was already queued by another caller
+	Percent  float64  `json:"percent,omitempty"`
+	Error    string   `json:"error,omitempty"`
+	ImageURL string   `json:"image_url,omitempty"`
+	BlobURL  string   `json:"blob_url,omitempty"` // immutable URL of the finished image
+}
+
+// BatchCounts tallies items per state
+type BatchCounts struct {
+	Total     int `json:"total"`
+	Pending   int `json:"pending"`
+	Queued    int `json:"queued"`
+	Running   int `json:"running"`
+	Succeeded int `json:"succeeded"`
+	Failed    int `json:"failed"`
+	Cancelled int `json:"cancelled"`
+}
+
+// BatchOptions are the per-batch settings chosen at creation
+type BatchOptions struct {
+	Regenerate bool
+	Priority   PriorityClass
+	Client     string
+}
+
+// Batch is the persisted record of a multi-item generation request
+type Batch struct {
+	ID         string        `json:"id"`
+	State      BatchState    `json:"state"`
+	Regenerate bool          `json:"regenerate,omitempty"`
+	Priority   PriorityClass `json:"priority,omitempty"`
+	Client     string        `json:"client,omitempty"`
+	RequestID  string        `json:"request_id,omitempty"`
+	Counts     BatchCounts   `json:"counts"`
+	Percent    float64       `json:"percent"`
+	Items      []BatchItem   `json:"items"`
+	CreatedAt  time.Time     `json:"created_at"`
+	FinishedAt *time.Time    `json:"finished_at,omitempty"`
+}
+
+// copyBatch returns a deep copy safe to hand outside the manager's lock
+func copyBatch(b *Batch) *Batch {
+	cp := *b
+	cp.Items = append([]BatchItem(nil), b.Items...)
+	return &cp
+}
+
+// summarize recomputes counts, percent and overall state from the items
+func (b *Batch) summarize() {
+	counts := BatchCounts{Total: len(b.Items)}
+	var percent float64
+	for _, item := range b.Items {
+		switch item.State {
+		case BatchItemPending:
+			counts.Pending++
+		case JobQueued:
+			counts.Queued++
+		case JobRunning:
+			counts.Running++
+			percent += item.Percent
+		case JobSucceeded:
+			counts.Succeeded++
+		case JobFailed:
+			counts.Failed++
+		case JobCancelled:
+			counts.Cancelled++
+		}
+		if item.State.IsTerminal() {
+			percent += 100
+		}
+	}
+	b.Counts = counts
+	if counts.Total > 0 {
+		b.Percent = percent / float64(counts.Total)
+	}
+	if b.State != BatchCancelled && counts.Pending+counts.Queued+counts.Running == 0 {
+		b.State = BatchCompleted
+	}
+	if b.State != BatchRunning && b.FinishedAt == nil {
+		now := time.Now()
+		b.FinishedAt = &now
+	}
+}
+
+// BatchStore persists batch records as one JSON file per batch
+type BatchStore struct {
+	dir     string
+	fileOps *RobustFileOperations
+}
+
+// NewBatchStore creates a store rooted at dir
+func NewBatchStore(dir string) *BatchStore {
+	return &BatchStore{dir: dir, fileOps: NewRobustFileOperations()}
+}
+
+// Save writes the batch record atomically
+func (s *BatchStore) Save(batch *Batch) error {
+	data, err := json.MarshalIndent(batch, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal batch %s: %w", batch.ID, err)
+	}
+	return s.fileOps.WriteFile(filepath.Join(s.dir, batch.ID+".json"), data, batch.RequestID)
+}
+
+// LoadAll reads every batch record in the store
+func (s *BatchStore) LoadAll() ([]*Batch, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	batches := make([]*Batch, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(s.dir, entry.Name())) // #nosec G304 - names come from ReadDir
+		if err != nil {
+			logWarn(fmt.Sprintf("[batches] unable to read %s: %v", entry.Name(), err))
+			continue
+		}
+		var batch Batch
+		if err := json.Unmarshal(data, &batch); err != nil || batch.ID == "" {
+			logWarn(fmt.Sprintf("[batches] skipping malformed batch file %s", entry.Name()))
+			continue
+		}
+		batches = append(batches, &batch)
+	}
+	return batches, nil
+}
+
+// BatchManager feeds batch items into the job queue a window at a time so a large batch
+// neither overflows the queue nor starves single requests.
+type BatchManager struct {
+	mu      sync.Mutex
+	store   *BatchStore
+	jobs    *JobQueue
+	window  int
+	batches map[string]*Batch
+	cancels map[string]context.CancelFunc
+}
+
+// NewBatchManager creates a manager that keeps at most window items of a batch in the queue
+func NewBatchManager(store *BatchStore, jobs *JobQueue, window int) *BatchManager {
+	if window <= 0 {
+		window = 1
+	}
+	return &BatchManager{
+		store:   store,
+		jobs:    jobs,
+		window:  window,
+		batches: make(map[string]*Batch),
+		cancels: make(map[string]context.CancelFunc),
+	}
+}
+
+// Create records a new batch for items and starts feeding it
+func (m *BatchManager) Create(items []BatchItem, opts BatchOptions, requestID string) (*Batch, error) {
+	batch := &Batch{
+		ID:         uuid.New().String(),
+		State:      BatchRunning,
+		Regenerate: opts.Regenerate,
+		Priority:   opts.Priority,
+		Client:     opts.Client,
+		RequestID:  requestID,
+		Items:      items,
+		CreatedAt:  time.Now(),
+	}
+	for i := range batch.Items {
+		batch.Items[i].State = BatchItemPending
+	}
+	batch.summarize()
+	if err := m.store.Save(batch); err != nil {
+		return nil, err
+	}
+	m.start(batch)
+	return m.Get(batch.ID), nil
+}
+
+// Recover reloads persisted batches and resumes feeding any that were still running.
+// Call after JobQueue.Recover so items already handed to the queue can be followed.
+func (m *BatchManager) Recover() error {
+	batches, err := m.store.LoadAll()
+	if err != nil {
+		return err
+	}
+	resumed := 0
+	for _, batch := range batches {
+		if batch.State != BatchRunning {
+			m.mu.Lock()
+			m.batches[batch.ID] = batch
+			m.mu.Unlock()
+			continue
+		}
+		m.start(batch)
+		resumed++
+	}
+	logInfo(fmt.Sprintf("[batches] recovered %d batches (%d resumed)", len(batches), resumed))
+	return nil
+}
+
+func (m *BatchManager) start(batch *Batch) {
+	ctx, cancel := context.WithCancel(context.Background())
+	m.mu.Lock()
+	m.batches[batch.ID] = batch
+	m.cancels[batch.ID] = cancel
+	m.mu.Unlock()
+	go m.feed(ctx, batch.ID)
+}
+
+// feed submits pending items while keeping at most m.window of them unfinished
+func (m *BatchManager) feed(ctx context.Context, id string) {
+	slots := make(chan struct{}, m.window)
+	var wg sync.WaitGroup
+	defer func() {
+		wg.Wait()
+		m.mu.Lock()
+		if cancel := m.cancels[id]; cancel != nil {
+			cancel()
+			delete(m.cancels, id)
+		}
+		m.mu.Unlock()
+		m.save(id)
+	}()
+
+	m.mu.Lock()
+	count := len(m.batches[id].Items)
+	m.mu.Unlock()
+
+	for i := 0; i < count; i++ {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+		jobID, ok := m.submit(ctx, id, i)
+		if !ok {
+			<-slots
+			continue
+		}
+		wg.Add(1)
+		go func(i int, jobID string) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			m.follow(id, i, jobID)
+		}(i, jobID)
+	}
+}
+
+// submit hands item i to the job queue (or re-attaches to its recovered job) and
+// returns the job id to follow. While the queue is full it waits rather than failing the item.
+func (m *BatchManager) submit(ctx context.Context, id string, i int) (string, bool) {
+	m.mu.Lock()
+	batch := m.batches[id]
+	item := batch.Items[i]
+	regenerate := batch.Regenerate
+	priority, client := batch.Priority, batch.Client
+	requestID := batch.RequestID
+	m.mu.Unlock()
+
+	switch {
+	case item.State.IsTerminal():
+		return "", false
+	case item.State != BatchItemPending:
+		// Resumed after a restart: the job was recovered by the job queue
+		if item.JobID != "" && m.jobs.Get(item.JobID) != nil {
+			return item.JobID, true
+		}
+		m.update(id, i, func(it *BatchItem) {
+			it.State = JobFailed
+			it.Error = "job record lost across restart"
+		})
+		return "", false
+	}
+
+	job := NewJob(JobKindDalle, requestID)
+	job.Series = item.Series
+	job.Address = item.Address
+	job.BatchID = id
+	job.Priority = priority
+	job.Client = client
+	if regenerate && m.jobs.ActiveFor(item.Series, item.Address) == nil {
+		// Check the budget and quota before discarding an image that could not be replaced
+		if m.jobs.Admit != nil {
+			if err := m.jobs.Admit(job); err != nil {
+				m.update(id, i, func(it *BatchItem) {
+					it.State = JobFailed
+					it.Error = err.Error()
+				})
+				return "", false
+			}
+		}
+		dalle.Clean(item.Series, item.Address)
+	}
+	queued, err := m.jobs.Enqueue(job)
+	for errors.Is(err, errQueueFull) {
+		select {
+		case <-time.After(batchQueueFullDelay):
+		case <-ctx.Done():
+			return "", false
+		}
+		queued, err = m.jobs.Enqueue(job)
+	}
+	if err != nil {
+		m.update(id, i, func(it *BatchItem) {
+			it.State = JobFailed
+			it.Error = err.Error()
+		})
+		return "", false
+	}
+	m.update(id, i, func(it *BatchItem) {
+		it.JobID = queued.ID
+		it.Joined = queued.ID != job.ID
+		it.State = queued.State
+	})
+	m.save(id)
+	return queued.ID, true
+}
+
+// follow waits for item i's job to finish and records the outcome. It outlives a batch
+// cancellation, since a cancelled job that was running finishes only when its call returns.
+func (m *BatchManager) follow(id string, i int, jobID string) {
+	job, err := m.jobs.Wait(context.Background(), jobID)
+	if err != nil || job == nil {
+		return
+	}
+	m.update(id, i, func(it *BatchItem) { applyJobToItem(it, job) })
+	m.save(id)
+}
+
+// Cancel stops feeding the batch and cancels the queued or running jobs it created.
+// Jobs the batch merely joined belong to other callers and are left alone.
+func (m *BatchManager) Cancel(id string, cancelJob func(jobID string)) (*Batch, error) {
+	m.mu.Lock()
+	batch := m.batches[id]
+	if batch == nil {
+		m.mu.Unlock()
+		return nil, fmt.Errorf("batch %s not found", id)
+	}
+	if batch.State != BatchRunning {
+		cp := copyBatch(batch)
+		m.mu.Unlock()
+		return cp, errBatchFinished
+	}
+	batch.State = BatchCancelled
+	if cancel := m.cancels[id]; cancel != nil {
+		cancel()
+	}
+	var owned []int
+	for i := range batch.Items {
+		item := &batch.Items[i]
+		switch {
+		case item.State == BatchItemPending:
+			item.State = JobCancelled
+		case !item.State.IsTerminal() && !item.Joined && item.JobID != "":
+			owned = append(owned, i)
+		}
+	}
+	m.mu.Unlock()
+
+	for _, i := range owned {
+		m.mu.Lock()
+		jobID := batch.Items[i].JobID
+		m.mu.Unlock()
+		cancelJob(jobID)
+		if job := m.jobs.Get(jobID); job != nil {
+			m.update(id, i, func(it *BatchItem) { applyJobToItem(it, job) })
+		}
+	}
+	m.save(id)
+	return m.Get(id), nil
+}
+
+// Get returns a copy of the batch with live progress for running items, or nil
+func (m *BatchManager) Get(id string) *Batch {
+	m.mu.Lock()
+	batch := m.batches[id]
+	if batch == nil {
+		m.mu.Unlock()
+		return nil
+	}
+	cp := copyBatch(batch)
+	m.mu.Unlock()
+
+	for i := range cp.Items {
+		item := &cp.Items[i]
+		if item.JobID == "" || item.State.IsTerminal() {
+			continue
+		}
+		if job := m.jobs.Get(item.JobID); job != nil {
+			applyJobToItem(item, job)
+		}
+		if item.State == JobRunning {
+			if pr := progress.GetProgress(item.Series, item.Address); pr != nil {
+				item.Percent = pr.Percent
+			}
+		}
+	}
+	cp.summarize()
+	return cp
+}
+
+// List returns copies of all batches, newest first, without per-item detail
+func (m *BatchManager) List() []*Batch {
+	m.mu.Lock()
+	ids := make([]string, 0, len(m.batches))
+	for id := range m.batches {
+		ids = append(ids, id)
+	}
+	m.mu.Unlock()
+
+	out := make([]*Batch, 0, len(ids))
+	for _, id := range ids {
+		if batch := m.Get(id); batch != nil {
+			batch.Items = nil
+			out = append(out, batch)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.After(out[j].CreatedAt) })
+	return out
+}
+
+func (m *BatchManager) update(id string, i int, fn func(*BatchItem)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if batch := m.batches[id]; batch != nil && i < len(batch.Items) {
+		fn(&batch.Items[i])
+	}
+}
+
+func (m *BatchManager) save(id string) {
+	m.mu.Lock()
+	batch := m.batches[id]
+	if batch == nil {
+		m.mu.Unlock()
+		return
+	}
+	batch.summarize()
+	snapshot := copyBatch(batch)
+	m.mu.Unlock()
+	if err := m.store.Save(snapshot); err != nil {
+		logWarn(fmt.Sprintf("[%s] unable to persist batch %s: %v", snapshot.RequestID, id, err))
+	}
+}
+
+// applyJobToItem copies the outcome of a job onto a batch item
+func applyJobToItem(item *BatchItem, job *Job) {
+	item.State = job.State
+	item.Error = job.Error
+	if job.State.IsTerminal() {
+		item.Percent = 0
+	}
+	if job.State == JobSucceeded {
+		item.ImageURL = annotatedImageURL(item.Series, item.Address)
+		item.BlobURL = annotatedBlobURL(item.Series, item.Address)
+	}
+}
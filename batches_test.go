@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	dalle "github.com/TrueBlocks/trueblocks-dalle/v6"
+	"github.com/TrueBlocks/trueblocks-dalle/v6/pkg/storage"
+)
+
+func stubGenerator(t *testing.T, fn func(series, addr string) (string, error)) {
+	t.Helper()
+	original := generateAnnotatedImage
+	generateAnnotatedImage = func(series, addr string, skip bool, ttl time.Duration, imageURL string) (string, error) {
+		return fn(series, addr)
+	}
+	t.Cleanup(func() { generateAnnotatedImage = original })
+}
+
+func decodeBatch(t *testing.T, recorder *httptest.ResponseRecorder) *Batch {
+	t.Helper()
+	var response struct {
+		Data Batch `json:"data"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatalf("decode batch: %v\n%s", err, recorder.Body.String())
+	}
+	return &response.Data
+}
+
+func waitForBatch(t *testing.T, app *App, id string, state BatchState) *Batch {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if batch := app.Batches.Get(id); batch != nil && batch.State == state {
+			return batch
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("batch %s never reached %s: %#v", id, state, app.Batches.Get(id))
+	return nil
+}
+
+func TestBatchCrossProductCompletes(t *testing.T) {
+	dalle.SetupTest(t, dalle.SetupTestOptions{Series: []string{"empty", "five"}})
+	app := NewApp()
+	stubGenerator(t, func(series, addr string) (string, error) {
+		if strings.HasSuffix(addr, "bad") {
+			return "", fmt.Errorf("forced failure")
+		}
+		return "", nil
+	})
+
+	body := `{"series":["empty","five"],"addresses":["0x1111111111111111111111111111111111111111","0x2222222222222222222222222222222222222bad","0x1111111111111111111111111111111111111111"]}`
+	recorder := httptest.NewRecorder()
+	app.handleV1Batches(recorder, httptest.NewRequest(http.MethodPost, "/v1/batches", strings.NewReader(body)))
+	if recorder.Code != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	created := decodeBatch(t, recorder)
+	if created.Counts.Total != 4 {
+		t.Fatalf("expected duplicates to be dropped leaving 4 items, got %d", created.Counts.Total)
+	}
+
+	done := waitForBatch(t, app, created.ID, BatchCompleted)
+	if done.Counts.Succeeded != 2 || done.Counts.Failed != 2 || done.Percent != 100 {
+		t.Fatalf("unexpected counts %#v (percent %.1f)", done.Counts, done.Percent)
+	}
+	for _, item := range done.Items {
+		if item.State == JobSucceeded && item.ImageURL != annotatedImageURL(item.Series, item.Address) {
+			t.Fatalf("missing image url on %#v", item)
+		}
+	}
+
+	recorder = httptest.NewRecorder()
+	app.handleV1Batch(recorder, httptest.NewRequest(http.MethodGet, "/v1/batches/"+created.ID, nil))
+	if got := decodeBatch(t, recorder); got.State != BatchCompleted || len(got.Items) != 4 {
+		t.Fatalf("unexpected GET result %#v", got)
+	}
+}
+
+func TestBatchJSONLUploadAndCancel(t *testing.T) {
+	dalle.SetupTest(t, dalle.SetupTestOptions{Series: []string{"empty"}})
+	app := NewApp()
+	release := make(chan struct{})
+	stubGenerator(t, func(series, addr string) (string, error) {
+		<-release
+		return "", nil
+	})
+	defer waitForInflightGenerations(t)
+
+	var upload bytes.Buffer
+	for _, addr := range []string{"0x3333333333333333333333333333333333333333", "0x4444444444444444444444444444444444444444", "0x5555555555555555555555555555555555555555"} {
+		upload.WriteString(`{"series":"empty","address":"` + addr + `"}` + "\n")
+	}
+	app.Batches.window = 1
+	request := httptest.NewRequest(http.MethodPost, "/v1/batches", &upload)
+	request.Header.Set("Content-Type", "application/x-ndjson")
+	recorder := httptest.NewRecorder()
+	app.handleV1Batches(recorder, request)
+	if recorder.Code != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	created := decodeBatch(t, recorder)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for app.Batches.Get(created.ID).Counts.Running == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	recorder = httptest.NewRecorder()
+	app.handleV1Batch(recorder, httptest.NewRequest(http.MethodDelete, "/v1/batches/"+created.ID, nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected 200 from cancel, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	cancelled := decodeBatch(t, recorder)
+	if cancelled.State != BatchCancelled || cancelled.Counts.Cancelled != 2 || cancelled.Counts.Running != 1 {
+		t.Fatalf("expected the running item to await its call, got %#v", cancelled.Counts)
+	}
+	close(release)
+	deadline = time.Now().Add(5 * time.Second)
+	for app.Batches.Get(created.ID).Counts.Cancelled != 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if counts := app.Batches.Get(created.ID).Counts; counts.Cancelled != 3 {
+		t.Fatalf("expected all items cancelled, got %#v", counts)
+	}
+
+	recorder = httptest.NewRecorder()
+	app.handleV1Batch(recorder, httptest.NewRequest(http.MethodDelete, "/v1/batches/"+created.ID, nil))
+	if recorder.Code != http.StatusConflict {
+		t.Fatalf("expected 409 for second cancel, got %d", recorder.Code)
+	}
+}
+
+func TestBatchRejectsInvalidItems(t *testing.T) {
+	dalle.SetupTest(t, dalle.SetupTestOptions{Series: []string{"empty"}})
+	app := NewApp()
+	for _, body := range []string{`{}`, `{"items":[{"series":"empty","address":"0x12"}]}`, `{"series":["nope"],"addresses":["0x1111111111111111111111111111111111111111"]}`} {
+		recorder := httptest.NewRecorder()
+		app.handleV1Batches(recorder, httptest.NewRequest(http.MethodPost, "/v1/batches", strings.NewReader(body)))
+		if recorder.Code != http.StatusBadRequest {
+			t.Fatalf("%s: expected 400, got %d", body, recorder.Code)
+		}
+	}
+
+	// A few thousand series and addresses are refused before the cross product is built
+	many := `"` + strings.Repeat(`x","`, 4000) + `x"`
+	recorder := httptest.NewRecorder()
+	app.handleV1Batches(recorder, httptest.NewRequest(http.MethodPost, "/v1/batches", strings.NewReader(`{"series":[`+many+`],"addresses":[`+many+`]}`)))
+	if recorder.Code != http.StatusBadRequest || !strings.Contains(recorder.Body.String(), "Batch too large") {
+		t.Fatalf("expected an oversized batch to be refused, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	if !tooManyBatchItems(1, maxBatchItems, 1) || tooManyBatchItems(100, 100, 0) || tooManyBatchItems(0, 0, maxBatchItems) {
+		t.Fatalf("tooManyBatchItems misjudged the limit")
+	}
+}
+
+func TestRegenerateBatchKeepsImagesWhenRefused(t *testing.T) {
+	dalle.SetupTest(t, dalle.SetupTestOptions{Series: []string{"empty"}})
+	const addr = "0x7777777777777777777777777777777777777777"
+	annotated := filepath.Join(storage.OutputDir(), "empty", "annotated", addr+".png")
+	_ = os.MkdirAll(filepath.Dir(annotated), 0o750)
+	if err := os.WriteFile(annotated, []byte("existing"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	q := NewJobQueue(NewJobStore(t.TempDir()), 1, func(ctx context.Context, job *Job) (interface{}, error) {
+		return nil, nil
+	})
+	q.Admit = func(*Job) error { return &BudgetError{Period: "daily", LimitUSD: 1, SpentUSD: 2} }
+	q.Start()
+	m := NewBatchManager(NewBatchStore(t.TempDir()), q, 1)
+	batch, err := m.Create([]BatchItem{{Series: "empty", Address: addr}}, BatchOptions{Regenerate: true}, "req-regen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for m.Get(batch.ID).State == BatchRunning && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := m.Get(batch.ID); got.Counts.Failed != 1 {
+		t.Fatalf("expected the refused item to fail, got %#v", got.Counts)
+	}
+	if !fileExists(annotated) {
+		t.Fatalf("a refused regeneration discarded the existing image")
+	}
+}
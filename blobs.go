@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cache policies. Blob URLs name their content, so caches may keep them for good; every
+// other image URL can be overwritten by a regeneration and must be revalidated, which the
+// content-hash ETag makes cheap.
+const (
+	blobCacheControl     = "public, max-age=31536000, immutable"
+	mutableCacheControl  = "public, no-cache"
+	redirectCacheControl = "no-store"
+)
+
+// maxContentDigests bounds the remembered digests; the least recently used go first
+const maxContentDigests = 4096
+
+var blobPathPattern = regexp.MustCompile(`^([0-9a-f]{64})(\.png|\.json|\.txt|\.mp3)$`)
+
+// ContentIndex remembers the sha256 of artifacts by key, size and modification time, so
+// an unchanged file is hashed once, and maps digests back to the key holding that content
+type ContentIndex struct {
+	mu    sync.Mutex
+	byKey map[string]*list.Element
+	order *list.List // of *contentDigest, most recently used first
+	bySum map[string]string
+}
+
+type contentDigest struct {
+	id      string
+	size    int64
+	modTime time.Time
+	sum     string
+}
+
+// NewContentIndex creates an empty index
+func NewContentIndex() *ContentIndex {
+	return &ContentIndex{byKey: map[string]*list.Element{}, order: list.New(), bySum: map[string]string{}}
+}
+
+var contentIndex = NewContentIndex()
+
+// lookup returns the remembered digest of id if it still has this size and time
+func (ci *ContentIndex) lookup(id string, size int64, modTime time.Time) (string, bool) {
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+	el, ok := ci.byKey[id]
+	if !ok {
+		return "", false
+	}
+	d := el.Value.(*contentDigest)
+	if d.size != size || !d.modTime.Equal(modTime) {
+		return "", false
+	}
+	ci.order.MoveToFront(el)
+	return d.sum, true
+}
+
+// remember records the digest of id; only store keys can be found again by digest
+func (ci *ContentIndex) remember(id string, isKey bool, size int64, modTime time.Time, sum string) {
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+	if el, ok := ci.byKey[id]; ok {
+		d := el.Value.(*contentDigest)
+		if ci.bySum[d.sum] == id && d.sum != sum {
+			delete(ci.bySum, d.sum)
+		}
+		d.size, d.modTime, d.sum = size, modTime, sum
+		ci.order.MoveToFront(el)
+	} else {
+		ci.byKey[id] = ci.order.PushFront(&contentDigest{id: id, size: size, modTime: modTime, sum: sum})
+	}
+	if isKey {
+		ci.bySum[sum] = id
+	}
+	for ci.order.Len() > maxContentDigests {
+		d := ci.order.Remove(ci.order.Back()).(*contentDigest)
+		delete(ci.byKey, d.id)
+		if ci.bySum[d.sum] == d.id {
+			delete(ci.bySum, d.sum)
+		}
+	}
+}
+
+// keyFor returns the key last seen holding the content with digest sum
+func (ci *ContentIndex) keyFor(sum string) (string, bool) {
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+	key, ok := ci.bySum[sum]
+	return key, ok
+}
+
+func (ci *ContentIndex) forget(sum string) {
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+	delete(ci.bySum, sum)
+}
+
+// Digest returns the sha256 of src, reading it only when it changed since it was last
+// hashed. The bytes are returned when they had to be read, and are nil otherwise.
+func (ci *ContentIndex) Digest(ctx context.Context, src RenderSource) (string, []byte, error) {
+	size, modTime, err := src.stat(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+	if sum, ok := ci.lookup(src.String(), size, modTime); ok {
+		return sum, nil, nil
+	}
+	data, err := src.read(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+	sum := sha256Hex(data)
+	ci.remember(src.String(), src.Key != "", size, modTime, sum)
+	return sum, data, nil
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// annotatedKey reports whether key is an annotated image, "<series>/annotated/<address>.png"
+func annotatedKey(key string) (series, address string, ok bool) {
+	parts := strings.Split(key, "/")
+	if len(parts) < 3 || parts[len(parts)-2] != "annotated" || path.Ext(key) != ".png" {
+		return "", "", false
+	}
+	return parts[0], strings.TrimSuffix(parts[len(parts)-1], ".png"), true
+}
+
+// blobURL is the immutable URL of the image with digest sum
+func blobURL(sum string) string {
+	return blobURLFor(sum, ".png")
+}
+
+// annotatedBlobURL is the blob URL of the annotated image for (series, address) as it is
+// now, or "" when it cannot be read
+func annotatedBlobURL(series, address string) string {
+	ctx, cancel := context.WithTimeout(context.Background(), artifactOpTimeout)
+	defer cancel()
+	sum, _, err := contentIndex.Digest(ctx, RenderSource{Key: artifactKey(series, "annotated", address+".png")})
+	if err != nil {
+		return ""
+	}
+	return blobURL(sum)
+}
+
+// etagMatches reports whether an If-None-Match header names etag (or is "*")
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// serveArtifactFrom answers with the artifact at key in store, tagged with its content
+// hash. A conditional request naming that hash gets 304; otherwise, when the store can
+// presign, a redirect (unless cacheControl is the immutable blob policy, so caches keep
+// the bytes rather than an expiring redirect), and else the content itself.
+func serveArtifactFrom(w http.ResponseWriter, r *http.Request, store ArtifactStore, key, cacheControl string) {
+	activeStore.RLock()
+	ttl := activeStore.presignTTL
+	activeStore.RUnlock()
+	if presigner, ok := store.(Presigner); ok && ttl > 0 && cacheControl != blobCacheControl {
+		info, err := store.Stat(r.Context(), key)
+		if err != nil {
+			writeArtifactError(w, key, err)
+			return
+		}
+		// Answer revalidations from the index without sending the client to the bucket
+		if sum, ok := contentIndex.lookup(key, info.Size, info.ModTime); ok && etagMatches(r.Header.Get("If-None-Match"), `"`+sum+`"`) {
+			w.Header().Set("ETag", `"`+sum+`"`)
+			w.Header().Set("Cache-Control", cacheControl)
+			w.WriteHeader(http.StatusNotModified)
+			servedIndex.Touch(key)
+			return
+		}
+		url, err := presigner.PresignGet(key, ttl)
+		if err == nil {
+			servedIndex.Touch(key)
+			w.Header().Set("Cache-Control", redirectCacheControl)
+			http.Redirect(w, r, url, http.StatusFound)
+			return
+		}
+		logError("unable to presign " + key + ", serving it directly: " + err.Error())
+	}
+	body, info, err := store.Open(r.Context(), key)
+	if err != nil {
+		writeArtifactError(w, key, err)
+		return
+	}
+	defer func() { _ = body.Close() }()
+	content, ok := body.(io.ReadSeeker)
+	if !ok {
+		data, err := io.ReadAll(body)
+		if err != nil {
+			writeArtifactError(w, key, err)
+			return
+		}
+		content = bytes.NewReader(data)
+	}
+	sum, ok := contentIndex.lookup(key, info.Size, info.ModTime)
+	if !ok {
+		h := sha256.New()
+		if _, err := io.Copy(h, content); err != nil {
+			writeArtifactError(w, key, err)
+			return
+		}
+		if _, err := content.Seek(0, io.SeekStart); err != nil {
+			writeArtifactError(w, key, err)
+			return
+		}
+		sum = hex.EncodeToString(h.Sum(nil))
+		contentIndex.remember(key, storeIsCurrent(store), info.Size, info.ModTime, sum)
+	}
+	if storeIsCurrent(store) {
+		servedIndex.Touch(key)
+	}
+	w.Header().Set("ETag", `"`+sum+`"`)
+	w.Header().Set("Cache-Control", cacheControl)
+	if info.ContentType != "" {
+		w.Header().Set("Content-Type", info.ContentType)
+	}
+	http.ServeContent(w, r, path.Base(key), info.ModTime, content)
+}
+
+// storeIsCurrent reports whether store is (or is the same directory as) the active store,
+// whose keys blob URLs resolve against
+func storeIsCurrent(store ArtifactStore) bool {
+	current := CurrentStore()
+	if store == current {
+		return true
+	}
+	a, ok1 := store.(*LocalStore)
+	b, ok2 := current.(*LocalStore)
+	return ok1 && ok2 && a.root == b.root
+}
+
+// handleV1Blob serves GET /v1/blobs/<sha256>.<ext>: the artifact with that content, under
+// a URL that never changes meaning, so it is cacheable forever. Artifacts recorded in a
+// manifest are kept in the blob store; an annotated image that was not is found through
+// the content index for as long as it is current and remembered.
+func (a *App) handleV1Blob(w http.ResponseWriter, r *http.Request) {
+	requestID := GenerateRequestID()
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		WriteErrorResponse(w, NewAPIError(ErrorInvalidRequest, "Method not allowed", r.Method).WithRequestID(requestID), http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/v1/blobs/")
+	m := blobPathPattern.FindStringSubmatch(name)
+	if m == nil {
+		WriteErrorResponse(w, NewAPIError(ErrorInvalidRequest, "Invalid blob name", "want /v1/blobs/<sha256>.<png|json|txt|mp3>").WithRequestID(requestID), http.StatusBadRequest)
+		return
+	}
+	sum, ext := m[1], m[2]
+	if etagMatches(r.Header.Get("If-None-Match"), `"`+sum+`"`) {
+		w.Header().Set("ETag", `"`+sum+`"`)
+		w.Header().Set("Cache-Control", blobCacheControl)
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	store := CurrentStore()
+	if _, err := store.Stat(r.Context(), blobKey(sum, ext)); err == nil {
+		serveArtifactFrom(w, r, store, blobKey(sum, ext), blobCacheControl)
+		return
+	} else if !errors.Is(err, ErrArtifactNotFound) {
+		writeArtifactError(w, blobKey(sum, ext), err)
+		return
+	}
+	// Not in the blob store: an annotated image this server handed a blob URL out for.
+	// Digests it never computed are not searched for, so a guessed name costs nothing.
+	var key string
+	ok := false
+	if ext == ".png" {
+		key, ok = contentIndex.keyFor(sum)
+	}
+	if ok {
+		// The key may have been regenerated since; its old content is gone
+		current, _, err := contentIndex.Digest(r.Context(), RenderSource{Key: key})
+		if err != nil && !errors.Is(err, ErrArtifactNotFound) {
+			writeArtifactError(w, key, err)
+			return
+		}
+		if current != sum {
+			contentIndex.forget(sum)
+			ok = false
+		}
+	}
+	if !ok {
+		WriteErrorResponse(w, NewAPIError(ErrorFileNotFound, "Blob not found", sum).WithRequestID(requestID), http.StatusNotFound)
+		return
+	}
+	serveArtifactFrom(w, r, store, key, blobCacheControl)
+}
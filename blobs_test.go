@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	dalle "github.com/TrueBlocks/trueblocks-dalle/v6"
+	"github.com/TrueBlocks/trueblocks-dalle/v6/pkg/storage"
+)
+
+func TestContentHashETagsAndBlobs(t *testing.T) {
+	dalle.SetupTest(t, dalle.SetupTestOptions{Series: []string{"empty"}})
+	UseStore(nil, defaultPresignTTL)
+	saved := contentIndex
+	contentIndex = NewContentIndex()
+	t.Cleanup(func() { UseStore(nil, defaultPresignTTL); contentIndex = saved })
+
+	const series, address = "empty", "0x7777777777777777777777777777777777777777"
+	png, _ := mockImagePNG("harbor", 16, 16)
+	local := filepath.Join(storage.OutputDir(), series, "annotated", address+".png")
+	_ = os.MkdirAll(filepath.Dir(local), 0o750)
+	_ = os.WriteFile(local, png, 0o600)
+	etag := `"` + sha256Hex(png) + `"`
+
+	app := &App{}
+	get := func(handler http.HandlerFunc, path, ifNoneMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+		return rr
+	}
+	dalleHandler := func(w http.ResponseWriter, r *http.Request) {
+		req := Request{series: series, address: address, app: app}
+		req.Respond(w, r)
+	}
+
+	for name, handler := range map[string]http.HandlerFunc{"/files/": app.handleFiles, "/dalle/": dalleHandler} {
+		rr := get(handler, annotatedImageURL(series, address), "")
+		if rr.Code != http.StatusOK || rr.Header().Get("ETag") != etag || rr.Header().Get("Cache-Control") != mutableCacheControl {
+			t.Fatalf("%s: %d etag %s cache %s", name, rr.Code, rr.Header().Get("ETag"), rr.Header().Get("Cache-Control"))
+		}
+		if rr := get(handler, annotatedImageURL(series, address), `"other", `+etag); rr.Code != http.StatusNotModified {
+			t.Fatalf("%s: revalidation got %d", name, rr.Code)
+		}
+	}
+
+	blob := annotatedBlobURL(series, address)
+	if blob != blobURL(sha256Hex(png)) {
+		t.Fatalf("blob URL %s", blob)
+	}
+	rr := get(app.handleV1Blob, blob, "")
+	if rr.Code != http.StatusOK || !bytes.Equal(rr.Body.Bytes(), png) || rr.Header().Get("Cache-Control") != blobCacheControl || rr.Header().Get("ETag") != etag {
+		t.Fatalf("blob: %d %s", rr.Code, rr.Header().Get("Cache-Control"))
+	}
+	if rr := get(app.handleV1Blob, blob, etag); rr.Code != http.StatusNotModified {
+		t.Fatalf("blob revalidation: %d", rr.Code)
+	}
+
+	// A regeneration changes the ETag and retires the old blob URL
+	regenerated, _ := mockImagePNG("lighthouse", 16, 16)
+	_ = os.WriteFile(local, regenerated, 0o600)
+	later := time.Now().Add(time.Second)
+	_ = os.Chtimes(local, later, later)
+	if rr := get(app.handleFiles, annotatedImageURL(series, address), etag); rr.Code != http.StatusOK || rr.Header().Get("ETag") != `"`+sha256Hex(regenerated)+`"` {
+		t.Fatalf("regenerated image still matched the old ETag: %d", rr.Code)
+	}
+	if rr := get(app.handleV1Blob, blob, ""); rr.Code != http.StatusNotFound {
+		t.Fatalf("retired blob: %d", rr.Code)
+	}
+
+	// After a restart the index is empty. A digest with no blob is not searched for in the
+	// store; once the blob URL is handed out again it resolves.
+	contentIndex = NewContentIndex()
+	if rr := get(app.handleV1Blob, blobURL(sha256Hex(regenerated)), ""); rr.Code != http.StatusNotFound {
+		t.Fatalf("unindexed blob after restart: %d", rr.Code)
+	}
+	if annotatedBlobURL(series, address) != blobURL(sha256Hex(regenerated)) {
+		t.Fatalf("blob URL after restart")
+	}
+	if rr := get(app.handleV1Blob, blobURL(sha256Hex(regenerated)), ""); rr.Code != http.StatusOK || !bytes.Equal(rr.Body.Bytes(), regenerated) {
+		t.Fatalf("blob after restart: %d", rr.Code)
+	}
+	for path, code := range map[string]int{"/v1/blobs/abc.png": 400, "/v1/blobs/" + strings.Repeat("0", 64) + ".png": 404} {
+		if rr := get(app.handleV1Blob, path, ""); rr.Code != code {
+			t.Fatalf("%s: got %d, want %d", path, rr.Code, code)
+		}
+	}
+
+	// A presigning store answers revalidations itself and streams blobs rather than
+	// redirecting to a URL that expires
+	fake, server := newFakeS3(t)
+	UseStore(fake.store(t, server), time.Minute)
+	if err := publishArtifacts(series, address, "pub"); err != nil {
+		t.Fatal(err)
+	}
+	etag = `"` + sha256Hex(regenerated) + `"`
+	blob = annotatedBlobURL(series, address)
+	if rr := get(app.handleFiles, annotatedImageURL(series, address), etag); rr.Code != http.StatusNotModified {
+		t.Fatalf("presigned revalidation: %d", rr.Code)
+	}
+	if rr := get(app.handleFiles, annotatedImageURL(series, address), ""); rr.Code != http.StatusFound || rr.Header().Get("Cache-Control") != redirectCacheControl {
+		t.Fatalf("presigned redirect: %d %s", rr.Code, rr.Header().Get("Cache-Control"))
+	}
+	if rr := get(app.handleV1Blob, blob, ""); rr.Code != http.StatusOK || !bytes.Equal(rr.Body.Bytes(), regenerated) {
+		t.Fatalf("blob from the bucket: %d", rr.Code)
+	}
+}
+
+func TestContentIndexEvictsLeastRecentlyUsed(t *testing.T) {
+	ci := NewContentIndex()
+	now := time.Now()
+	key := func(i int) string { return fmt.Sprintf("s/annotated/0x%040d.png", i) }
+	for i := 0; i < maxContentDigests; i++ {
+		ci.remember(key(i), true, 1, now, fmt.Sprintf("%064d", i))
+	}
+	// Using the oldest entry keeps it; the next oldest goes when one more arrives
+	if _, ok := ci.lookup(key(0), 1, now); !ok {
+		t.Fatalf("expected the first digest to be remembered")
+	}
+	ci.remember(key(maxContentDigests), true, 1, now, "new")
+	if _, ok := ci.lookup(key(1), 1, now); ok {
+		t.Fatalf("expected the least recently used digest evicted")
+	}
+	if _, ok := ci.keyFor(fmt.Sprintf("%064d", 1)); ok {
+		t.Fatalf("an evicted digest still resolves to its key")
+	}
+	if _, ok := ci.keyFor(fmt.Sprintf("%064d", 0)); !ok || ci.order.Len() != maxContentDigests {
+		t.Fatalf("recently used digest lost, or the index grew to %d", ci.order.Len())
+	}
+}
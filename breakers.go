@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TrueBlocks/trueblocks-dalle/v6/pkg/prompt"
+)
+
+// Names of the breakers guarding the provider calls. Fallback enhancement providers are
+// registered as "chat:<name>".
+const (
+	BreakerChat          = "chat"
+	BreakerImages        = "images"
+	BreakerImageDownload = "image_download"
+)
+
+// fallbackBreakerName is the registry name of a fallback enhancement provider's breaker
+func fallbackBreakerName(provider string) string {
+	return BreakerChat + ":" + provider
+}
+
+// BreakerSettings tunes one circuit breaker; zero values keep the breaker's current setting
+type BreakerSettings struct {
+	FailureThreshold int    `json:"failure_threshold,omitempty"`
+	ResetTimeout     string `json:"reset_timeout,omitempty"`
+	// SuccessThreshold is the number of successful probes that close a half-open circuit
+	SuccessThreshold int `json:"success_threshold,omitempty"`
+	// HalfOpenProbes caps the calls let through at once while half-open; the rest are
+	// rejected as if the circuit were still open
+	HalfOpenProbes int `json:"half_open_probes,omitempty"`
+
+	// Mode is "count" (FailureThreshold consecutive failures) or "window" (the rates below
+	// over a rolling Window, once it holds MinCalls calls). Rates are percentages.
+	Mode                  string  `json:"mode,omitempty"`
+	Window                string  `json:"window,omitempty"`
+	MinCalls              int     `json:"min_calls,omitempty"`
+	FailureRateThreshold  float64 `json:"failure_rate_threshold,omitempty"`
+	SlowCallDuration      string  `json:"slow_call_duration,omitempty"`
+	SlowCallRateThreshold float64 `json:"slow_call_rate_threshold,omitempty"`
+}
+
+// resetTimeout parses ResetTimeout, returning 0 when it is unset or invalid
+func (s BreakerSettings) resetTimeout() time.Duration {
+	return parsePositiveDuration(s.ResetTimeout)
+}
+
+// parsePositiveDuration parses a duration setting, returning 0 when it is unset or invalid
+func parsePositiveDuration(spec string) time.Duration {
+	d, err := time.ParseDuration(spec)
+	if err != nil || d <= 0 {
+		return 0
+	}
+	return d
+}
+
+// validate rejects negative counts, rates outside 0-100 and unparseable durations
+func (s BreakerSettings) validate() error {
+	if s.FailureThreshold < 0 || s.SuccessThreshold < 0 || s.HalfOpenProbes < 0 || s.MinCalls < 0 {
+		return errors.New("thresholds, probes and min_calls must not be negative")
+	}
+	if s.FailureRateThreshold < 0 || s.FailureRateThreshold > 100 || s.SlowCallRateThreshold < 0 || s.SlowCallRateThreshold > 100 {
+		return errors.New("rate thresholds must be percentages between 0 and 100")
+	}
+	switch s.Mode {
+	case "", BreakerModeCount, BreakerModeWindow:
+	default:
+		return fmt.Errorf("unknown mode %q (want %s or %s)", s.Mode, BreakerModeCount, BreakerModeWindow)
+	}
+	for field, spec := range map[string]string{"reset_timeout": s.ResetTimeout, "window": s.Window, "slow_call_duration": s.SlowCallDuration} {
+		if spec != "" && parsePositiveDuration(spec) == 0 {
+			return fmt.Errorf("invalid %s %q", field, spec)
+		}
+	}
+	return nil
+}
+
+// ParseBreakerSettings reads per-breaker settings keyed by breaker name from spec, which
+// is either inline JSON (starting with "{") or the path of a JSON file. Fallback providers
+// take their breaker settings from their own entries instead.
+func ParseBreakerSettings(spec string) (map[string]BreakerSettings, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return nil, nil
+	}
+	data := []byte(spec)
+	if !strings.HasPrefix(spec, "{") {
+		var err error
+		if data, err = os.ReadFile(spec); err != nil {
+			return nil, err
+		}
+	}
+	var settings map[string]BreakerSettings
+	if err := json.Unmarshal(data, &settings); err != nil {
+		return nil, fmt.Errorf("parse breaker settings: %w", err)
+	}
+	for name, s := range settings {
+		switch name {
+		case BreakerChat, BreakerImages, BreakerImageDownload:
+		default:
+			return nil, fmt.Errorf("unknown circuit breaker %q (want %s, %s or %s)", name, BreakerChat, BreakerImages, BreakerImageDownload)
+		}
+		if err := s.validate(); err != nil {
+			return nil, fmt.Errorf("circuit breaker %s: %w", name, err)
+		}
+	}
+	return settings, nil
+}
+
+// BreakerStatus is one registered breaker as reported by /health and the admin endpoint
+type BreakerStatus struct {
+	Name string `json:"name"`
+	// Critical breakers make the server unhealthy when open; the others only degrade it
+	Critical bool   `json:"critical"`
+	State    string `json:"state"`
+	CircuitBreakerMetrics
+}
+
+// BreakerRegistry holds the named circuit breakers guarding outbound calls
+type BreakerRegistry struct {
+	mu      sync.RWMutex
+	entries map[string]*registeredBreaker
+}
+
+type registeredBreaker struct {
+	breaker  *CircuitBreaker
+	critical bool
+}
+
+// NewBreakerRegistry creates an empty registry
+func NewBreakerRegistry() *BreakerRegistry {
+	return &BreakerRegistry{entries: make(map[string]*registeredBreaker)}
+}
+
+// Register adds (or replaces) the breaker under name and returns it
+func (r *BreakerRegistry) Register(name string, cb *CircuitBreaker, critical bool) *CircuitBreaker {
+	cb.mu.Lock()
+	cb.name = name
+	cb.mu.Unlock()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries[name] = &registeredBreaker{breaker: cb, critical: critical}
+	return cb
+}
+
+// Unregister removes the breaker registered under name
+func (r *BreakerRegistry) Unregister(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.entries, name)
+}
+
+// Get returns the breaker registered under name, or nil
+func (r *BreakerRegistry) Get(name string) *CircuitBreaker {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if e := r.entries[name]; e != nil {
+		return e.breaker
+	}
+	return nil
+}
+
+// Status reports the breaker registered under name
+func (r *BreakerRegistry) Status(name string) (BreakerStatus, bool) {
+	r.mu.RLock()
+	e := r.entries[name]
+	r.mu.RUnlock()
+	if e == nil {
+		return BreakerStatus{}, false
+	}
+	m := e.breaker.GetMetrics()
+	return BreakerStatus{Name: name, Critical: e.critical, State: m.State.String(), CircuitBreakerMetrics: m}, true
+}
+
+// Snapshot reports every registered breaker, sorted by name
+func (r *BreakerRegistry) Snapshot() []BreakerStatus {
+	r.mu.RLock()
+	names := make([]string, 0, len(r.entries))
+	for name := range r.entries {
+		names = append(names, name)
+	}
+	r.mu.RUnlock()
+	sort.Strings(names)
+	out := make([]BreakerStatus, 0, len(names))
+	for _, name := range names {
+		if status, ok := r.Status(name); ok {
+			out = append(out, status)
+		}
+	}
+	return out
+}
+
+// Configure applies settings to the breakers they name
+func (r *BreakerRegistry) Configure(settings map[string]BreakerSettings) {
+	for name, s := range settings {
+		if cb := r.Get(name); cb != nil {
+			cb.Configure(s)
+		}
+	}
+}
+
+// defaultBreakerSettings lets a single probe through a half-open circuit; the thresholds
+// keep NewCircuitBreaker's values
+var defaultBreakerSettings = BreakerSettings{HalfOpenProbes: 1}
+
+// Global registry, seeded with the breakers for the primary provider's endpoints
+var globalBreakers = func() *BreakerRegistry {
+	r := NewBreakerRegistry()
+	r.Register(BreakerChat, DefaultOpenAICircuitBreaker.Configure(defaultBreakerSettings), true)
+	r.Register(BreakerImages, NewCircuitBreaker(5, 60*time.Second).WithFaultFilter(isImageFault).Configure(defaultBreakerSettings), true)
+	r.Register(BreakerImageDownload, NewCircuitBreaker(5, 60*time.Second).WithFaultFilter(isImageFault).Configure(defaultBreakerSettings), true)
+	return r
+}()
+
+// GetBreakerRegistry returns the global breaker registry
+func GetBreakerRegistry() *BreakerRegistry {
+	return globalBreakers
+}
+
+// isImageFault narrows IsProviderFault to errors that reached the provider: API errors
+// with a provider status, transport errors and bodies cut off mid-read. Local failures in
+// the library (a missing series, an unwritable file) say nothing about the endpoints.
+func isImageFault(err error) bool {
+	if !IsProviderFault(err) {
+		return false
+	}
+	var apiErr *prompt.OpenAIAPIError
+	if errors.As(err, &apiErr) {
+		return true
+	}
+	var urlErr *url.Error
+	return errors.As(err, &urlErr) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// isDownloadError reports whether a library generation error came from fetching the
+// generated image rather than from the image request itself. The library makes both calls,
+// so they are told apart by the URL a transport error names.
+func isDownloadError(err error, imageURL string) bool {
+	if imageURL == "" {
+		imageURL = "https://api.openai.com/v1/images/generations"
+	}
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return urlErr.URL != imageURL
+	}
+	return errors.Is(err, io.ErrUnexpectedEOF)
+}
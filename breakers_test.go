@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBreakerHalfOpenProbesAndForcing(t *testing.T) {
+	cb := NewCircuitBreaker(1, 20*time.Millisecond).Configure(BreakerSettings{SuccessThreshold: 2, HalfOpenProbes: 1})
+	_ = cb.Execute(func() error { return errors.New("boom") })
+	if _, err := cb.Allow(); err == nil || cb.GetState() != CircuitOpen {
+		t.Fatalf("expected open circuit, got %s", cb.GetState())
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	probe, err := cb.Allow()
+	if err != nil || cb.GetState() != CircuitHalfOpen {
+		t.Fatalf("expected a half-open probe: %v", err)
+	}
+	var cbErr *CircuitBreakerError
+	if _, err := cb.Allow(); !errors.As(err, &cbErr) || cbErr.State != CircuitHalfOpen {
+		t.Fatalf("second probe should be rejected, got %v", err)
+	}
+	probe(nil)
+	_ = cb.Execute(func() error { return nil })
+	if m := cb.GetMetrics(); m.State != CircuitClosed || m.TotalRejections != 2 {
+		t.Fatalf("after probes: %+v", m)
+	}
+
+	// A forced open circuit stays open past its reset timeout
+	cb.ForceOpen()
+	time.Sleep(30 * time.Millisecond)
+	if _, err := cb.Allow(); err == nil || !cb.GetMetrics().Forced {
+		t.Fatalf("forced open circuit let a call through")
+	}
+	// A forced closed circuit counts failures without opening
+	cb.ForceClose()
+	for i := 0; i < 3; i++ {
+		_ = cb.Execute(func() error { return errors.New("boom") })
+	}
+	if m := cb.GetMetrics(); m.State != CircuitClosed || m.TotalFailures != 4 {
+		t.Fatalf("forced closed: %+v", m)
+	}
+	cb.Reset()
+	_ = cb.Execute(func() error { return errors.New("boom") })
+	if cb.GetState() != CircuitOpen || cb.GetMetrics().Forced {
+		t.Fatalf("reset breaker should open on its own again")
+	}
+}
+
+func TestParseBreakerSettings(t *testing.T) {
+	settings, err := ParseBreakerSettings(`{"images":{"failure_threshold":2,"reset_timeout":"5m","half_open_probes":3}}`)
+	if err != nil || settings[BreakerImages].FailureThreshold != 2 || settings[BreakerImages].resetTimeout() != 5*time.Minute {
+		t.Fatalf("parse: %+v %v", settings, err)
+	}
+	for _, bad := range []string{`{"imagez":{}}`, `{"chat":{"reset_timeout":"soon"}}`, `{"chat":{"success_threshold":-1}}`} {
+		if _, err := ParseBreakerSettings(bad); err == nil {
+			t.Fatalf("expected error for %s", bad)
+		}
+	}
+}
+
+func TestGenerationChargesTheFailingBreaker(t *testing.T) {
+	images := GetBreakerRegistry().Get(BreakerImages)
+	downloads := GetBreakerRegistry().Get(BreakerImageDownload)
+	t.Cleanup(func() { images.Reset(); downloads.Reset() })
+	original := generateAnnotatedImage
+	t.Cleanup(func() { generateAnnotatedImage = original })
+
+	const endpoint = "http://provider.test/v1/images/generations"
+	var failWith error
+	generateAnnotatedImage = func(series, addr string, skip bool, ttl time.Duration, imageURL string) (string, error) {
+		return "", failWith
+	}
+
+	before := images.GetMetrics()
+	failWith = &url.Error{Op: "Get", URL: "http://cdn.test/img.png", Err: errors.New("connection reset")}
+	_, _ = generateThroughBreakers("s", "0x1", time.Minute, endpoint)
+	failWith = &url.Error{Op: "Post", URL: endpoint, Err: errors.New("connection refused")}
+	_, _ = generateThroughBreakers("s", "0x1", time.Minute, endpoint)
+	failWith = errors.New("series not found")
+	_, _ = generateThroughBreakers("s", "0x1", time.Minute, endpoint)
+
+	after := images.GetMetrics()
+	if after.TotalFailures != before.TotalFailures+1 || after.TotalSuccesses != before.TotalSuccesses+1 {
+		t.Fatalf("images breaker: before %+v after %+v", before, after)
+	}
+	if m := downloads.GetMetrics(); m.FailureCount != 1 {
+		t.Fatalf("download breaker failures = %d", m.FailureCount)
+	}
+
+	// An open breaker refuses the generation without calling the library
+	images.ForceOpen()
+	called := false
+	generateAnnotatedImage = func(series, addr string, skip bool, ttl time.Duration, imageURL string) (string, error) {
+		called = true
+		return "", nil
+	}
+	var cbErr *CircuitBreakerError
+	if _, err := generateThroughBreakers("s", "0x1", time.Minute, endpoint); !errors.As(err, &cbErr) || called {
+		t.Fatalf("expected rejection, got %v (called=%v)", err, called)
+	}
+	if downloads.GetMetrics().ProbesInFlight != 0 {
+		t.Fatalf("download slot leaked")
+	}
+}
+
+func TestAdminBreakerEndpoint(t *testing.T) {
+	registry := GetBreakerRegistry()
+	registry.Register("test", NewCircuitBreaker(5, time.Minute), false)
+	t.Cleanup(func() { registry.Unregister("test") })
+	app := &App{Config: Config{AdminToken: "s3cret"}}
+
+	call := func(method, path, token string, handler http.HandlerFunc) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+		return rr
+	}
+	status := func(rr *httptest.ResponseRecorder) BreakerStatus {
+		t.Helper()
+		var body struct {
+			Data BreakerStatus `json:"data"`
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil || rr.Code != http.StatusOK {
+			t.Fatalf("breaker status: %d %s", rr.Code, rr.Body.String())
+		}
+		return body.Data
+	}
+	if rr := call(http.MethodPost, "/v1/admin/breakers/test/open", "wrong", app.handleV1AdminBreaker); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d", rr.Code)
+	}
+	// Without a configured token the admin API is closed to everyone
+	open := &App{}
+	if rr := call(http.MethodPost, "/v1/admin/breakers/test/open", "", open.handleV1AdminBreaker); rr.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 without a configured token, got %d", rr.Code)
+	}
+	if s := status(call(http.MethodPost, "/v1/admin/breakers/test/open", "s3cret", app.handleV1AdminBreaker)); s.State != "OPEN" || !s.Forced {
+		t.Fatalf("force open: %+v", s)
+	}
+	if rr := call(http.MethodPost, "/v1/admin/breakers/test/trip", "s3cret", app.handleV1AdminBreaker); rr.Code != http.StatusBadRequest {
+		t.Fatalf("unknown action: %d", rr.Code)
+	}
+	if rr := call(http.MethodGet, "/v1/admin/breakers/missing", "s3cret", app.handleV1AdminBreaker); rr.Code != http.StatusNotFound {
+		t.Fatalf("unknown breaker: %d", rr.Code)
+	}
+	rr := call(http.MethodGet, "/v1/admin/breakers", "s3cret", app.handleV1AdminBreakers)
+	var list struct {
+		Data []BreakerStatus `json:"data"`
+	}
+	_ = json.Unmarshal(rr.Body.Bytes(), &list)
+	names := map[string]bool{}
+	for _, b := range list.Data {
+		names[b.Name] = true
+	}
+	for _, name := range []string{BreakerChat, BreakerImages, BreakerImageDownload, "test"} {
+		if !names[name] {
+			t.Fatalf("breaker %s missing from list: %s", name, rr.Body.String())
+		}
+	}
+
+	// An open non-critical breaker degrades health; /metrics reports it by name
+	hc := NewHealthChecker()
+	hc.SetBreakers(registry)
+	if c := hc.CheckHealth("breakers").Components["circuit_breakers"]; c.Status != HealthStatusDegraded || !strings.Contains(c.Message, "test OPEN") {
+		t.Fatalf("health component: %+v", c)
+	}
+	rr = call(http.MethodGet, "/metrics", "", app.handleMetrics)
+	if !strings.Contains(rr.Body.String(), `dalleserver_breaker_state{breaker="test",state="OPEN"} 1`) {
+		t.Fatalf("breaker missing from metrics")
+	}
+
+	if s := status(call(http.MethodPost, "/v1/admin/breakers/test/reset", "s3cret", app.handleV1AdminBreaker)); s.State != "CLOSED" || s.Forced {
+		t.Fatalf("reset: %+v", s)
+	}
+}
+
+func TestWindowBreakerTripsOnRates(t *testing.T) {
+	settings := BreakerSettings{Mode: BreakerModeWindow, Window: "1m", MinCalls: 4, FailureRateThreshold: 50, SlowCallDuration: "20ms", SlowCallRateThreshold: 60}
+	fail := func() error { return errors.New("boom") }
+	ok := func() error { return nil }
+
+	// Successes between failures do not reset the count, and nothing is judged below min_calls
+	cb := NewCircuitBreaker(3, time.Hour).Configure(settings)
+	for _, op := range []func() error{fail, ok, fail} {
+		_ = cb.Execute(op)
+	}
+	if m := cb.GetMetrics(); m.State != CircuitClosed || m.Mode != BreakerModeWindow || m.Window.Calls != 3 || m.Window.Failures != 2 {
+		t.Fatalf("below min calls: %+v %+v", m, m.Window)
+	}
+	_ = cb.Execute(fail)
+	if m := cb.GetMetrics(); m.State != CircuitOpen || m.Window.Calls != 0 {
+		t.Fatalf("expected open at 75%% failures: %s %+v", m.State, m.Window)
+	}
+
+	// Slow successes trip on the slow-call rate
+	slow := NewCircuitBreaker(3, time.Hour).Configure(settings)
+	for i := 0; i < 4; i++ {
+		_ = slow.Execute(func() error {
+			if i > 0 {
+				time.Sleep(25 * time.Millisecond)
+			}
+			return nil
+		})
+	}
+	if m := slow.GetMetrics(); m.State != CircuitOpen || m.TotalSlowCalls != 3 || m.TotalFailures != 0 {
+		t.Fatalf("expected open on slow calls: %+v", m)
+	}
+
+	// Outcomes age out of the window
+	w := newSlidingWindow(100 * time.Millisecond)
+	start := time.Unix(1000, 0)
+	w.record(start, true, false)
+	w.record(start.Add(60*time.Millisecond), false, true)
+	if calls, failures, slowCalls := w.totals(start.Add(90 * time.Millisecond)); calls != 2 || failures != 1 || slowCalls != 1 {
+		t.Fatalf("totals inside window: %d %d %d", calls, failures, slowCalls)
+	}
+	if calls, failures, _ := w.totals(start.Add(150 * time.Millisecond)); calls != 1 || failures != 0 {
+		t.Fatalf("totals after the failure aged out: %d %d", calls, failures)
+	}
+
+	if _, err := ParseBreakerSettings(`{"chat":{"mode":"window","failure_rate_threshold":150}}`); err == nil {
+		t.Fatalf("expected a rate above 100 to be rejected")
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/TrueBlocks/trueblocks-dalle/v6/pkg/progress"
+)
+
+// defaultGenerationEstimate is assumed for a full generation before the progress
+// package has recorded any phase averages
+const defaultGenerationEstimate = 30 * time.Second
+
+// maxRetryAfter caps the Retry-After hint handed to shed clients
+const maxRetryAfter = 10 * time.Minute
+
+// generationEstimate returns the expected duration of one generation from the phase
+// averages the progress package keeps, falling back to defaultGenerationEstimate
+func generationEstimate(reports []*progress.ProgressReport) time.Duration {
+	for _, pr := range reports {
+		var total time.Duration
+		for _, avg := range pr.PhaseAverages {
+			total += avg
+		}
+		if total > 0 {
+			return total
+		}
+	}
+	return defaultGenerationEstimate
+}
+
+// EstimateWait predicts how long a new job would wait for a worker: until the running
+// generation closest to finishing completes, plus one generation per worker for every
+// job already queued ahead of it
+func (q *JobQueue) EstimateWait() time.Duration {
+	reports := progress.ActiveProgressReports()
+	perJob := generationEstimate(reports)
+
+	soonest := time.Duration(-1)
+	for _, pr := range reports {
+		if pr.Done {
+			continue
+		}
+		eta := time.Duration(pr.ETASeconds * float64(time.Second))
+		if soonest < 0 || eta < soonest {
+			soonest = eta
+		}
+	}
+	if soonest < 0 {
+		soonest = perJob
+	}
+
+	queued := q.sched.Size()
+	rounds := math.Ceil(float64(queued) / float64(q.workers))
+	return soonest + time.Duration(rounds*float64(perJob))
+}
+
+// retryAfterSeconds converts a wait estimate into a Retry-After value of at least one second
+func retryAfterSeconds(wait time.Duration) int {
+	if wait > maxRetryAfter {
+		wait = maxRetryAfter
+	}
+	return max(1, int(math.Ceil(wait.Seconds())))
+}
+
+// writeLoadShed answers 429 with a Retry-After computed from the queue and running ETAs
+func (a *App) writeLoadShed(w http.ResponseWriter, endpoint, requestID string) {
+	seconds := retryAfterSeconds(a.Jobs.EstimateWait())
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	GetMetricsCollector().RecordLoadShed(endpoint, requestID)
+	logWarn(fmt.Sprintf("[%s] generation queue full on %s; shedding with Retry-After %ds", requestID, endpoint, seconds))
+	WriteErrorResponse(w, NewAPIError(
+		ErrorTooManyRequests,
+		"Too many generations in progress",
+		fmt.Sprintf("The generation queue is full; retry in about %d seconds", seconds),
+	).WithRequestID(requestID), http.StatusTooManyRequests)
+}
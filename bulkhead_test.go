@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/TrueBlocks/trueblocks-dalle/v6/pkg/prompt"
+)
+
+func TestGenerateShedsWhenQueueFull(t *testing.T) {
+	release := make(chan struct{})
+	q := NewJobQueue(NewJobStore(t.TempDir()), 1, func(ctx context.Context, job *Job) (interface{}, error) {
+		select {
+		case <-release:
+		case <-ctx.Done():
+		}
+		return nil, nil
+	})
+	q.SetMaxQueued(1)
+	q.Start()
+	// Let both jobs finish writing their records before the temp dir is removed
+	t.Cleanup(func() {
+		close(release)
+		deadline := time.Now().Add(2 * time.Second)
+		for len(q.List(JobSucceeded)) < 2 && time.Now().Before(deadline) {
+			time.Sleep(5 * time.Millisecond)
+		}
+	})
+	app := &App{Jobs: q}
+
+	post := func() *httptest.ResponseRecorder {
+		body := bytes.NewBufferString(`{"input":"Person Tour Coordinates"}`)
+		recorder := httptest.NewRecorder()
+		app.handleV1ImagesGenerate(recorder, httptest.NewRequest(http.MethodPost, "/v1/images/generate?async=1", body))
+		return recorder
+	}
+
+	// One job occupies the worker, one waits in the queue
+	if rr := post(); rr.Code != http.StatusAccepted {
+		t.Fatalf("first: %d %s", rr.Code, rr.Body.String())
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for len(q.List(JobRunning)) == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if rr := post(); rr.Code != http.StatusAccepted {
+		t.Fatalf("second: %d %s", rr.Code, rr.Body.String())
+	}
+
+	before := GetMetricsCollector().GetMetrics().LoadShed
+	rr := post()
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("third: expected 429, got %d %s", rr.Code, rr.Body.String())
+	}
+	if secs, err := strconv.Atoi(rr.Header().Get("Retry-After")); err != nil || secs < 1 {
+		t.Fatalf("Retry-After = %q", rr.Header().Get("Retry-After"))
+	}
+	if response := decodeAPIResponse(t, rr); response.Error == nil || response.Error.Code != ErrorTooManyRequests {
+		t.Fatalf("unexpected error body: %s", rr.Body.String())
+	}
+	if got := len(q.List("")); got != 2 {
+		t.Fatalf("shed request left a job record: %d jobs", got)
+	}
+	if GetMetricsCollector().GetMetrics().LoadShed != before+1 {
+		t.Fatalf("load shed not counted")
+	}
+}
+
+func TestRetryAfterSecondsBounds(t *testing.T) {
+	if got := retryAfterSeconds(0); got != 1 {
+		t.Fatalf("zero wait = %d, want 1", got)
+	}
+	if got := retryAfterSeconds(2500 * time.Millisecond); got != 3 {
+		t.Fatalf("2.5s = %d, want 3", got)
+	}
+	if got := retryAfterSeconds(time.Hour); got != int(maxRetryAfter.Seconds()) {
+		t.Fatalf("hour = %d, want cap", got)
+	}
+}
+
+func TestCircuitBreakerCountsOnlyProviderFaults(t *testing.T) {
+	cb := NewCircuitBreaker(3, time.Minute).WithFaultFilter(IsProviderFault)
+	rejections := []error{
+		&prompt.OpenAIAPIError{StatusCode: http.StatusBadRequest},
+		&prompt.OpenAIAPIError{StatusCode: http.StatusTooManyRequests},
+		fmt.Errorf("wrapped: %w", &prompt.OpenAIAPIError{StatusCode: http.StatusUnauthorized}),
+		context.Canceled,
+		errJobCancelled,
+	}
+	for i := 0; i < 3; i++ {
+		for _, err := range rejections {
+			_ = cb.Execute(func() error { return err })
+		}
+	}
+	if cb.GetState() != CircuitClosed {
+		t.Fatalf("client-side errors opened the breaker")
+	}
+
+	faults := []error{
+		&prompt.OpenAIAPIError{StatusCode: http.StatusServiceUnavailable},
+		&prompt.OpenAIAPIError{StatusCode: 0, Message: "connection reset"},
+		errors.New("unexpected EOF"),
+	}
+	for _, err := range faults {
+		_ = cb.Execute(func() error { return err })
+	}
+	if cb.GetState() != CircuitOpen {
+		t.Fatalf("provider faults did not open the breaker: %s", cb.GetState())
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	dalle "github.com/TrueBlocks/trueblocks-dalle/v6"
+)
+
+// TestCancelDalleGeneration blocks the injected generator and cancels the job through DELETE /dalle/.
+func TestCancelDalleGeneration(t *testing.T) {
+	dalle.SetupTest(t, dalle.SetupTestOptions{Series: []string{"empty"}})
+	app := NewApp()
+	prevDebug := isDebugging
+	isDebugging = false
+	defer func() { isDebugging = prevDebug }()
+
+	release := make(chan struct{})
+	calls := make(chan struct{}, 1)
+	original := generateAnnotatedImage
+	generateAnnotatedImage = func(series, addr string, skip bool, ttl time.Duration, imageURL string) (string, error) {
+		calls <- struct{}{}
+		<-release
+		return "", nil
+	}
+	defer func() { generateAnnotatedImage = original }()
+
+	addr := "0x6666666666666666666666666666666666666666"
+	w := httptest.NewRecorder()
+	app.handleDalleDress(w, httptest.NewRequest(http.MethodGet, "/dalle/empty/"+addr+"?generate=1", nil))
+	jobID := w.Header().Get("X-Job-ID")
+	if jobID == "" {
+		t.Fatalf("expected X-Job-ID header")
+	}
+	<-calls
+
+	before := GetMetricsCollector().GetMetrics().Cancellations
+	w = httptest.NewRecorder()
+	app.handleDalleDress(w, httptest.NewRequest(http.MethodDelete, "/dalle/empty/"+addr, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200 from cancel, got %d: %s", w.Code, w.Body.String())
+	}
+	if after := GetMetricsCollector().GetMetrics().Cancellations; after != before+1 {
+		t.Fatalf("expected cancellation metric to increase, got %d -> %d", before, after)
+	}
+	// The library call is still in flight, so the job keeps its state and its key
+	if job := app.Jobs.Get(jobID); job == nil || job.State != JobRunning || !job.CancelRequested {
+		t.Fatalf("expected a running job awaiting its library call, got %#v", job)
+	}
+	if app.Jobs.ActiveFor("empty", addr) == nil {
+		t.Fatalf("the key was released while the library call was in flight")
+	}
+
+	close(release)
+	if job := waitForJob(t, app.Jobs, jobID); job.State != JobCancelled {
+		t.Fatalf("expected cancelled job, got %#v", job)
+	}
+	waitForInflightGenerations(t)
+
+	w = httptest.NewRecorder()
+	app.handleDalleDress(w, httptest.NewRequest(http.MethodDelete, "/dalle/empty/"+addr, nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 when nothing is active, got %d", w.Code)
+	}
+}
+
+// waitForInflightGenerations blocks until running library calls have returned
+func waitForInflightGenerations(t *testing.T) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		inflightGenerations.Lock()
+		n := len(inflightGenerations.items)
+		inflightGenerations.Unlock()
+		if n == 0 {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("in-flight generations did not unwind")
+}
@@ -1,9 +1,14 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net/http"
 	"sync"
 	"time"
+
+	"github.com/TrueBlocks/trueblocks-dalle/v6/pkg/prompt"
 )
 
 // CircuitState represents the state of a circuit breaker
@@ -31,21 +36,38 @@ func (s CircuitState) String() string {
 // CircuitBreaker implements the circuit breaker pattern
 type CircuitBreaker struct {
 	mu              sync.RWMutex
+	name            string // set by the registry; used in log lines
 	state           CircuitState
+	forced          bool // state was pinned by an operator and does not change on its own
 	failureCount    int
 	successCount    int
+	probesInFlight  int
+	openedAt        time.Time
 	lastFailureTime time.Time
 	lastSuccessTime time.Time
 
 	// Configuration
-	failureThreshold int           // Number of failures before opening
-	resetTimeout     time.Duration // Time to wait before attempting half-open
-	successThreshold int           // Successes needed in half-open to close
+	failureThreshold int              // Number of failures before opening
+	resetTimeout     time.Duration    // Time to wait before attempting half-open
+	successThreshold int              // Successes needed in half-open to close
+	halfOpenProbes   int              // Concurrent requests let through while half-open; 0 means no limit
+	isFault          func(error) bool // Errors it rejects are returned without counting as failures
+
+	// Window mode: trip on failure or slow-call rate over a rolling window instead of on
+	// failureThreshold consecutive failures
+	mode                  string
+	window                *slidingWindow
+	minCalls              int           // Calls the window must hold before rates are judged
+	failureRateThreshold  float64       // Percent of calls failing that opens the circuit
+	slowCallDuration      time.Duration // Calls taking at least this long are slow
+	slowCallRateThreshold float64       // Percent of slow calls that opens the circuit
 
 	// Metrics
-	totalRequests  int64
-	totalFailures  int64
-	totalSuccesses int64
+	totalRequests   int64
+	totalFailures   int64
+	totalSuccesses  int64
+	totalRejections int64
+	totalSlowCalls  int64
 }
 
 // NewCircuitBreaker creates a new circuit breaker with the given configuration
@@ -55,44 +77,231 @@ func NewCircuitBreaker(failureThreshold int, resetTimeout time.Duration) *Circui
 		failureThreshold: failureThreshold,
 		resetTimeout:     resetTimeout,
 		successThreshold: 2, // Require 2 successes to close circuit
+		mode:             BreakerModeCount,
+	}
+}
+
+// Configure applies the non-zero settings to the breaker in place, so clients already
+// holding it pick them up
+func (cb *CircuitBreaker) Configure(s BreakerSettings) *CircuitBreaker {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if s.FailureThreshold > 0 {
+		cb.failureThreshold = s.FailureThreshold
+	}
+	if d := s.resetTimeout(); d > 0 {
+		cb.resetTimeout = d
+	}
+	if s.SuccessThreshold > 0 {
+		cb.successThreshold = s.SuccessThreshold
+	}
+	if s.HalfOpenProbes > 0 {
+		cb.halfOpenProbes = s.HalfOpenProbes
+	}
+	if s.Mode != "" && s.Mode != cb.mode {
+		cb.mode = s.Mode
+		cb.failureCount = 0
+		cb.window = nil
+	}
+	if cb.mode != BreakerModeWindow {
+		return cb
+	}
+	if cb.window == nil {
+		cb.window = newSlidingWindow(defaultWindowSize)
+		cb.minCalls = defaultWindowMinCalls
+		cb.failureRateThreshold = defaultFailureRateThreshold
+		cb.slowCallDuration = defaultSlowCallDuration
+		cb.slowCallRateThreshold = defaultSlowCallRateThreshold
+	}
+	if d := parsePositiveDuration(s.Window); d > 0 && d != cb.window.size {
+		cb.window = newSlidingWindow(d)
+	}
+	if s.MinCalls > 0 {
+		cb.minCalls = s.MinCalls
+	}
+	if s.FailureRateThreshold > 0 {
+		cb.failureRateThreshold = s.FailureRateThreshold
 	}
+	if d := parsePositiveDuration(s.SlowCallDuration); d > 0 {
+		cb.slowCallDuration = d
+	}
+	if s.SlowCallRateThreshold > 0 {
+		cb.slowCallRateThreshold = s.SlowCallRateThreshold
+	}
+	return cb
+}
+
+// WithFaultFilter limits which errors count toward opening the circuit
+func (cb *CircuitBreaker) WithFaultFilter(isFault func(error) bool) *CircuitBreaker {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.isFault = isFault
+	return cb
 }
 
 // DefaultOpenAICircuitBreaker creates a circuit breaker optimized for OpenAI API
-var DefaultOpenAICircuitBreaker = NewCircuitBreaker(5, 60*time.Second)
+var DefaultOpenAICircuitBreaker = NewCircuitBreaker(5, 60*time.Second).WithFaultFilter(IsProviderFault)
+
+// IsProviderFault reports whether err shows the provider itself failing: transport errors,
+// timeouts and 5xx responses. Rejections of the request (4xx, including the provider's own
+// 429 rate limiting) and cancellations by this server say nothing about provider health.
+func IsProviderFault(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, errJobCancelled) {
+		return false
+	}
+	var apiErr *prompt.OpenAIAPIError
+	if errors.As(err, &apiErr) {
+		status := apiErr.StatusCode
+		return status == 0 || status == http.StatusRequestTimeout || status >= 500
+	}
+	return true
+}
+
+// errNotAttempted releases a slot taken with Allow when the guarded call was never made
+var errNotAttempted = errors.New("call not attempted")
 
 // Execute runs the given operation through the circuit breaker
 func (cb *CircuitBreaker) Execute(operation func() error) error {
+	done, err := cb.Allow()
+	if err != nil {
+		return err
+	}
+	// Execute the operation without holding the lock so concurrent callers are not serialized
+	err = operation()
+	done(err)
+	return err
+}
+
+// Allow admits one call, or returns a *CircuitBreakerError when the circuit is open or its
+// half-open probes are all in flight. The caller reports the call's outcome through done;
+// errNotAttempted gives the slot back without counting either way.
+func (cb *CircuitBreaker) Allow() (done func(error), err error) {
 	cb.mu.Lock()
 	defer cb.mu.Unlock()
-
 	cb.totalRequests++
 
 	// Check if circuit should transition from open to half-open
-	if cb.state == CircuitOpen && time.Since(cb.lastFailureTime) > cb.resetTimeout {
+	if cb.state == CircuitOpen && !cb.forced && time.Since(cb.openedAt) > cb.resetTimeout {
 		cb.state = CircuitHalfOpen
 		cb.successCount = 0
-		fmt.Printf("Circuit breaker transitioning to HALF_OPEN after %v\n", cb.resetTimeout)
+		cb.probesInFlight = 0
+		fmt.Printf("Circuit breaker%s transitioning to HALF_OPEN after %v\n", cb.label(), cb.resetTimeout)
 	}
 
 	// Reject requests if circuit is open
 	if cb.state == CircuitOpen {
-		return &CircuitBreakerError{
+		cb.totalRejections++
+		return nil, &CircuitBreakerError{
 			Message: "circuit breaker is OPEN - service unavailable",
-			State:   cb.state,
+			State:   CircuitOpen,
+		}
+	}
+	probe := cb.state == CircuitHalfOpen
+	if probe {
+		if cb.halfOpenProbes > 0 && cb.probesInFlight >= cb.halfOpenProbes {
+			cb.totalRejections++
+			return nil, &CircuitBreakerError{
+				Message: "circuit breaker is HALF_OPEN - probe already in flight",
+				State:   CircuitHalfOpen,
+			}
 		}
+		cb.probesInFlight++
 	}
 
-	// Execute the operation
-	err := operation()
+	var once sync.Once
+	start := time.Now()
+	return func(err error) {
+		once.Do(func() { cb.finish(err, probe, time.Since(start)) })
+	}, nil
+}
 
-	if err != nil {
+// finish records the outcome of a call admitted by Allow
+func (cb *CircuitBreaker) finish(err error, probe bool, elapsed time.Duration) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if probe && cb.probesInFlight > 0 {
+		cb.probesInFlight--
+	}
+	fault := err != nil && (cb.isFault == nil || cb.isFault(err))
+	switch {
+	case errors.Is(err, errNotAttempted):
+	case err != nil && !fault:
+	case cb.mode == BreakerModeWindow:
+		cb.onWindowOutcome(fault, elapsed >= cb.slowCallDuration)
+	case fault:
 		cb.onFailure()
-		return err
+	default:
+		cb.onSuccess()
 	}
+}
+
+// open trips the circuit, starting the reset timeout
+func (cb *CircuitBreaker) open() {
+	cb.state = CircuitOpen
+	cb.openedAt = time.Now()
+	cb.successCount = 0
+	if cb.window != nil {
+		cb.window.reset()
+	}
+}
 
-	cb.onSuccess()
-	return nil
+// onWindowOutcome records a call in window mode. While closed the circuit opens once the
+// window holds minCalls and either rate reaches its threshold; while half-open a failed or
+// slow probe reopens it and successThreshold good probes close it.
+func (cb *CircuitBreaker) onWindowOutcome(failed, slow bool) {
+	now := time.Now()
+	if failed {
+		cb.totalFailures++
+		cb.lastFailureTime = now
+	} else {
+		cb.totalSuccesses++
+		cb.lastSuccessTime = now
+	}
+	if slow {
+		cb.totalSlowCalls++
+	}
+	if cb.forced {
+		return
+	}
+
+	switch cb.state {
+	case CircuitHalfOpen:
+		if failed || slow {
+			cb.open()
+			reason := "failure"
+			if !failed {
+				reason = "slow call"
+			}
+			fmt.Printf("Circuit breaker%s returned to OPEN state after half-open %s\n", cb.label(), reason)
+			return
+		}
+		cb.successCount++
+		if cb.successCount >= cb.successThreshold {
+			cb.state = CircuitClosed
+			cb.successCount = 0
+			cb.window.reset()
+			fmt.Printf("Circuit breaker%s CLOSED after %d successful requests\n", cb.label(), cb.successThreshold)
+		}
+	case CircuitClosed:
+		cb.window.record(now, failed, slow)
+		calls, failures, slowCalls := cb.window.totals(now)
+		if calls < cb.minCalls {
+			return
+		}
+		failureRate, slowRate := percent(failures, calls), percent(slowCalls, calls)
+		if failureRate >= cb.failureRateThreshold || slowRate >= cb.slowCallRateThreshold {
+			cb.open()
+			fmt.Printf("Circuit breaker%s OPENED at %.0f%% failures and %.0f%% slow calls over %d calls\n", cb.label(), failureRate, slowRate, calls)
+		}
+	}
+}
+
+// label names the breaker in log lines
+func (cb *CircuitBreaker) label() string {
+	if cb.name == "" {
+		return ""
+	}
+	return " " + cb.name
 }
 
 // onFailure handles a failure case
@@ -100,16 +309,19 @@ func (cb *CircuitBreaker) onFailure() {
 	cb.totalFailures++
 	cb.failureCount++
 	cb.lastFailureTime = time.Now()
+	if cb.forced {
+		return
+	}
 
 	// Transition to open if failure threshold exceeded
 	if cb.state == CircuitClosed && cb.failureCount >= cb.failureThreshold {
-		cb.state = CircuitOpen
-		fmt.Printf("Circuit breaker OPENED after %d failures\n", cb.failureCount)
+		cb.open()
+		fmt.Printf("Circuit breaker%s OPENED after %d failures\n", cb.label(), cb.failureCount)
 	} else if cb.state == CircuitHalfOpen {
 		// Failed while testing - go back to open
-		cb.state = CircuitOpen
+		cb.open()
 		cb.failureCount = cb.failureThreshold // Reset to threshold
-		fmt.Printf("Circuit breaker returned to OPEN state after half-open failure\n")
+		fmt.Printf("Circuit breaker%s returned to OPEN state after half-open failure\n", cb.label())
 	}
 }
 
@@ -117,6 +329,9 @@ func (cb *CircuitBreaker) onFailure() {
 func (cb *CircuitBreaker) onSuccess() {
 	cb.totalSuccesses++
 	cb.lastSuccessTime = time.Now()
+	if cb.forced {
+		return
+	}
 
 	switch cb.state {
 	case CircuitHalfOpen:
@@ -126,7 +341,7 @@ func (cb *CircuitBreaker) onSuccess() {
 			cb.state = CircuitClosed
 			cb.failureCount = 0
 			cb.successCount = 0
-			fmt.Printf("Circuit breaker CLOSED after %d successful requests\n", cb.successThreshold)
+			fmt.Printf("Circuit breaker%s CLOSED after %d successful requests\n", cb.label(), cb.successThreshold)
 		}
 	case CircuitClosed:
 		// Reset failure count on success
@@ -146,43 +361,108 @@ func (cb *CircuitBreaker) GetMetrics() CircuitBreakerMetrics {
 	cb.mu.RLock()
 	defer cb.mu.RUnlock()
 
-	return CircuitBreakerMetrics{
+	metrics := CircuitBreakerMetrics{
+		Mode:             cb.mode,
 		State:            cb.state,
+		Forced:           cb.forced,
 		TotalRequests:    cb.totalRequests,
 		TotalFailures:    cb.totalFailures,
 		TotalSuccesses:   cb.totalSuccesses,
+		TotalRejections:  cb.totalRejections,
+		TotalSlowCalls:   cb.totalSlowCalls,
 		FailureCount:     cb.failureCount,
 		SuccessCount:     cb.successCount,
+		ProbesInFlight:   cb.probesInFlight,
 		LastFailureTime:  cb.lastFailureTime,
 		LastSuccessTime:  cb.lastSuccessTime,
 		FailureThreshold: cb.failureThreshold,
 		ResetTimeout:     cb.resetTimeout,
+		SuccessThreshold: cb.successThreshold,
+		HalfOpenProbes:   cb.halfOpenProbes,
+	}
+	if cb.window != nil {
+		calls, failures, slow := cb.window.totals(time.Now())
+		metrics.Window = &WindowStats{
+			Window:                cb.window.size,
+			Calls:                 calls,
+			Failures:              failures,
+			SlowCalls:             slow,
+			FailureRate:           percent(failures, calls),
+			SlowCallRate:          percent(slow, calls),
+			MinCalls:              cb.minCalls,
+			FailureRateThreshold:  cb.failureRateThreshold,
+			SlowCallDuration:      cb.slowCallDuration,
+			SlowCallRateThreshold: cb.slowCallRateThreshold,
+		}
 	}
+	return metrics
 }
 
-// Reset manually resets the circuit breaker to closed state
+// Reset manually resets the circuit breaker to closed state, releasing any forced state
 func (cb *CircuitBreaker) Reset() {
 	cb.mu.Lock()
 	defer cb.mu.Unlock()
 
 	cb.state = CircuitClosed
+	cb.forced = false
 	cb.failureCount = 0
 	cb.successCount = 0
-	fmt.Printf("Circuit breaker manually reset to CLOSED state\n")
+	cb.probesInFlight = 0
+	if cb.window != nil {
+		cb.window.reset()
+	}
+	fmt.Printf("Circuit breaker%s manually reset to CLOSED state\n", cb.label())
+}
+
+// ForceOpen pins the circuit open, rejecting every call until ForceClose or Reset
+func (cb *CircuitBreaker) ForceOpen() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.open()
+	cb.forced = true
+	cb.probesInFlight = 0
+	fmt.Printf("Circuit breaker%s forced OPEN\n", cb.label())
+}
+
+// ForceClose pins the circuit closed: failures are still counted but do not open it
+// until Reset hands control back to the breaker
+func (cb *CircuitBreaker) ForceClose() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.state = CircuitClosed
+	cb.forced = true
+	cb.failureCount = 0
+	cb.successCount = 0
+	cb.probesInFlight = 0
+	if cb.window != nil {
+		cb.window.reset()
+	}
+	fmt.Printf("Circuit breaker%s forced CLOSED\n", cb.label())
 }
 
 // CircuitBreakerMetrics holds metrics about circuit breaker performance
 type CircuitBreakerMetrics struct {
+	Mode             string        `json:"mode"`
 	State            CircuitState  `json:"state"`
+	Forced           bool          `json:"forced"`
 	TotalRequests    int64         `json:"total_requests"`
 	TotalFailures    int64         `json:"total_failures"`
 	TotalSuccesses   int64         `json:"total_successes"`
+	TotalRejections  int64         `json:"total_rejections"`
+	TotalSlowCalls   int64         `json:"total_slow_calls"`
 	FailureCount     int           `json:"current_failure_count"`
 	SuccessCount     int           `json:"current_success_count"`
+	ProbesInFlight   int           `json:"probes_in_flight"`
 	LastFailureTime  time.Time     `json:"last_failure_time"`
 	LastSuccessTime  time.Time     `json:"last_success_time"`
 	FailureThreshold int           `json:"failure_threshold"`
 	ResetTimeout     time.Duration `json:"reset_timeout"`
+	SuccessThreshold int           `json:"success_threshold"`
+	HalfOpenProbes   int           `json:"half_open_probes"`
+	// Window is set in window mode
+	Window *WindowStats `json:"window,omitempty"`
 }
 
 // CircuitBreakerError represents an error from circuit breaker
@@ -3,7 +3,9 @@ package main
 import (
 	"bufio"
 	"flag"
+	"math"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -11,9 +13,74 @@ import (
 
 // Config holds runtime configuration.
 type Config struct {
-	Port      string
-	SkipImage bool
-	LockTTL   time.Duration
+	Port       string
+	SkipImage  bool
+	LockTTL    time.Duration
+	JobWorkers int
+	// MaxQueue bounds the generations waiting for a worker; beyond it requests get 429
+	MaxQueue int
+	// IdempotencyTTL is how long Idempotency-Key responses are kept for replay
+	IdempotencyTTL time.Duration
+	// ClassCaps limits concurrent jobs per priority class; unset classes use the defaults
+	ClassCaps map[PriorityClass]int
+	// APIKeyClasses caps the priority a caller may request, keyed by X-API-Key value;
+	// read from TB_DALLE_API_KEY_CLASSES only
+	APIKeyClasses map[string]PriorityClass
+	// Provider selects the image backend: "openai", "mock" (in-process stand-in), or
+	// "record"/"replay" (OpenAI traffic saved to or served from FixturesDir)
+	Provider string
+	// FixturesDir holds the record/replay fixtures
+	FixturesDir string
+	// ReplayUpstream is the API root forwarded to while recording; read from
+	// TB_DALLE_REPLAY_UPSTREAM only
+	ReplayUpstream string
+	// Faults injects latency, 429s, 5xx responses and truncated bodies into the record and
+	// replay providers
+	Faults Faults
+	// Enhancement overrides the default prompt-enhancement settings; series definitions
+	// may override it in turn
+	Enhancement EnhancementSettings
+	// EnhancementIdleTimeout abandons a streamed enhancement that goes this long without data
+	EnhancementIdleTimeout time.Duration
+	// EnhancementFallbacks are tried in order when the provider cannot enhance a prompt
+	EnhancementFallbacks []*EnhancementFallback
+	// Breakers tunes the chat, images and image_download circuit breakers by name
+	Breakers map[string]BreakerSettings
+	// RequestsPerMinute paces chat requests to the provider; 0 follows its rate-limit headers
+	RequestsPerMinute int
+	// RetryBudget caps provider retries as a fraction of provider calls; 0 is unlimited
+	RetryBudget float64
+	// DownloadHedge is the percentile of recent image download times after which a second
+	// request is sent; 0 disables hedging
+	DownloadHedge float64
+	// DownloadMaxBytes is the largest generated image accepted
+	DownloadMaxBytes int64
+	// Storage selects where artifacts are kept and served from: "local" (the output
+	// directory) or "s3"
+	Storage string
+	// S3 locates the bucket for s3 storage; its credentials are read from the environment only
+	S3 S3Config
+	// PresignTTL is how long the presigned URLs clients are redirected to stay valid; 0
+	// streams artifacts through the server instead
+	PresignTTL time.Duration
+	// DerivativeCacheBytes caps the rendered thumbnails and conversions kept on disk
+	DerivativeCacheBytes int64
+	// Retention limits the artifacts kept: total size, age per series and versions per
+	// address, with a hard quota past which generations are refused
+	Retention RetentionConfig
+	// Rates prices provider usage: built-in list prices overlaid with the --rate-table file
+	Rates RateTable
+	// DailyBudget and MonthlyBudget cap spend in USD per UTC day and month; 0 is unlimited
+	DailyBudget   float64
+	MonthlyBudget float64
+	// WebhookSecret signs webhook payloads (HMAC-SHA256); read from TB_DALLE_WEBHOOK_SECRET only
+	WebhookSecret string
+	// WSAllowedOrigins are the browser origins, besides the server's own host, that may open
+	// /v1/ws, e.g. https://app.example.com
+	WSAllowedOrigins []string
+	// AdminToken must accompany /v1/admin/ requests as a bearer token; the admin endpoints are
+	// disabled when it is empty. Read from TB_DALLE_ADMIN_TOKEN only
+	AdminToken string
 }
 
 var loadConfigOnce sync.Once
@@ -27,9 +94,66 @@ func MustLoadConfig() Config {
 		var portFlag string
 		var lockTTLStr string
 		var dataDirFlag string
+		var jobWorkers int
+		var maxQueue int
+		var idempotencyTTLStr string
+		var classCapsStr string
+		var providerFlag string
+		var fixturesDir, faultsSpec string
+		var enhanceModel, enhanceBaseURL, enhanceTemperature, enhanceSeed string
+		var enhanceMaxTokens int
+		var enhanceIdleTimeoutStr, enhanceFallbacks string
+		var breakersFlag string
+		var requestsPerMinute int
+		var retryBudget float64
+		var downloadHedge string
+		var downloadMaxMB int
+		var storageFlag, s3Endpoint, s3Bucket, s3Prefix, s3Region, presignTTLStr string
+		var derivativeCacheMB int
+		var retentionMaxMB, quotaMB, keepVersions int
+		var retentionMaxAge, retentionIntervalStr, retentionArchiveDir string
+		var wsAllowedOrigins string
+		var rateTableFlag string
+		var dailyBudget, monthlyBudget float64
 		flag.StringVar(&portFlag, "port", "8080", "Port to listen on")
 		flag.StringVar(&lockTTLStr, "lock-ttl", "5m", "TTL for request generation lock")
 		flag.StringVar(&dataDirFlag, "data-dir", "", "Base data directory")
+		flag.IntVar(&jobWorkers, "job-workers", 4, "Number of concurrent generation workers")
+		flag.IntVar(&maxQueue, "max-queue", defaultMaxQueuedJobs, "Generations allowed to wait for a worker before shedding with 429")
+		flag.StringVar(&classCapsStr, "class-caps", "", "Per-class worker limits, e.g. batch=3,backfill=1")
+		flag.StringVar(&providerFlag, "provider", ProviderOpenAI, "Image provider: openai, mock, record or replay")
+		flag.StringVar(&fixturesDir, "fixtures-dir", defaultFixturesDir, "Directory of recorded OpenAI exchanges for --provider record/replay")
+		flag.StringVar(&faultsSpec, "faults", "", "Faults injected by --provider record/replay, e.g. latency=200ms,429=0.1,5xx=0.05,truncate=0.02")
+		flag.StringVar(&enhanceModel, "enhancement-model", "", "Chat model used to enhance prompts (default gpt-4)")
+		flag.StringVar(&enhanceBaseURL, "enhancement-base-url", "", "OpenAI-compatible API root for enhancement, e.g. http://localhost:11434/v1")
+		flag.StringVar(&enhanceTemperature, "enhancement-temperature", "", "Sampling temperature for enhancement (default 0.2)")
+		flag.StringVar(&enhanceSeed, "enhancement-seed", "", "Sampling seed for enhancement (default 1337)")
+		flag.IntVar(&enhanceMaxTokens, "enhancement-max-tokens", 0, "Maximum tokens in an enhanced prompt (0 = provider default)")
+		flag.StringVar(&enhanceIdleTimeoutStr, "enhancement-idle-timeout", "15s", "Abandon a streamed prompt enhancement after this long without data")
+		flag.StringVar(&enhanceFallbacks, "enhancement-fallbacks", "", "JSON file (or inline JSON list) of fallback enhancement providers, tried in order")
+		flag.StringVar(&breakersFlag, "breakers", "", "JSON file (or inline JSON object) of circuit breaker settings keyed by breaker name")
+		flag.IntVar(&requestsPerMinute, "requests-per-minute", 0, "Chat requests per minute sent to the provider (0 = follow its rate-limit headers)")
+		flag.Float64Var(&retryBudget, "retry-budget", defaultRetryBudget, "Provider retries allowed as a fraction of provider calls (0 = unlimited)")
+		flag.StringVar(&downloadHedge, "download-hedge", "", "Hedge image downloads slower than this percentile of recent ones, e.g. p95 (empty = off)")
+		flag.IntVar(&downloadMaxMB, "download-max-mb", defaultDownloadMaxBytes>>20, "Largest generated image accepted, in MiB")
+		flag.StringVar(&storageFlag, "storage", StorageLocal, "Artifact storage backend: local or s3")
+		flag.StringVar(&s3Endpoint, "s3-endpoint", "", "S3-compatible endpoint for --storage s3 (default AWS in --s3-region)")
+		flag.StringVar(&s3Bucket, "s3-bucket", "", "Bucket for --storage s3")
+		flag.StringVar(&s3Prefix, "s3-prefix", "", "Key prefix inside the bucket for --storage s3")
+		flag.StringVar(&s3Region, "s3-region", defaultS3Region, "Region used to sign --storage s3 requests")
+		flag.StringVar(&presignTTLStr, "presign-ttl", "15m", "Redirect to presigned URLs valid this long when the store supports them (0 = serve through the server)")
+		flag.IntVar(&derivativeCacheMB, "derivative-cache-mb", defaultDerivativeCacheBytes>>20, "Disk space for rendered image derivatives before the least recently used are evicted, in MiB")
+		flag.IntVar(&retentionMaxMB, "retention-max-mb", 0, "Size the retention janitor keeps the artifact store under, in MiB (0 = unlimited)")
+		flag.IntVar(&quotaMB, "quota-mb", 0, "Artifact store size at which new generations are refused with 507, in MiB (0 = unlimited)")
+		flag.StringVar(&retentionMaxAge, "retention-max-age", "", "Remove generations older than this, e.g. 720h or *=720h,scratch=24h (empty = keep)")
+		flag.IntVar(&keepVersions, "retention-keep-versions", 0, "Manifests kept per address, newest first (0 = all)")
+		flag.StringVar(&retentionIntervalStr, "retention-interval", "1h", "How often the retention janitor runs")
+		flag.StringVar(&retentionArchiveDir, "retention-archive-dir", "", "Move removed artifacts to this directory instead of deleting them")
+		flag.StringVar(&wsAllowedOrigins, "ws-allowed-origins", "", "Comma-separated origins, besides the server's own, allowed to open /v1/ws")
+		flag.StringVar(&rateTableFlag, "rate-table", "", "JSON file of prices overriding the built-in rate table")
+		flag.Float64Var(&dailyBudget, "daily-budget", 0, "Spend in USD per UTC day before generations are refused (0 = unlimited)")
+		flag.Float64Var(&monthlyBudget, "monthly-budget", 0, "Spend in USD per UTC month before generations are refused (0 = unlimited)")
+		flag.StringVar(&idempotencyTTLStr, "idempotency-ttl", "24h", "How long Idempotency-Key responses are replayed")
 		// Ignore errors (e.g., repeated parses in tests)
 		if !flag.Parsed() {
 			_ = flag.CommandLine.Parse(os.Args[1:])
@@ -42,12 +166,159 @@ func MustLoadConfig() Config {
 		if envPort := os.Getenv("TB_DALLE_PORT"); envPort != "" {
 			cfg.Port = ":" + envPort
 		}
+		cfg.Provider = providerFlag
+		if envProvider := os.Getenv("TB_DALLE_PROVIDER"); envProvider != "" {
+			cfg.Provider = envProvider
+		}
+		cfg.Provider = strings.ToLower(strings.TrimSpace(cfg.Provider))
+		cfg.FixturesDir = fixturesDir
+		if envFixtures := os.Getenv("TB_DALLE_FIXTURES_DIR"); envFixtures != "" {
+			cfg.FixturesDir = envFixtures
+		}
+		cfg.ReplayUpstream = os.Getenv("TB_DALLE_REPLAY_UPSTREAM")
+		if envFaults := os.Getenv("TB_DALLE_FAULTS"); envFaults != "" {
+			faultsSpec = envFaults
+		}
+		if cfg.Faults, err = ParseFaults(faultsSpec); err != nil {
+			logWarn("ignoring faults: " + err.Error())
+		}
 		cfg.SkipImage = os.Getenv("TB_DALLE_SKIP_IMAGE") == "1"
-		// Auto-enable skip (mock) if no API key present
-		if os.Getenv("OPENAI_API_KEY") == "" {
+		// Auto-enable skip (mock) if no API key present; the mock and replay providers need none
+		if os.Getenv("OPENAI_API_KEY") == "" && cfg.Provider != ProviderMock && cfg.Provider != ProviderReplay {
 			cfg.SkipImage = true
 		}
 		cfg.LockTTL = ttl
+		cfg.JobWorkers = jobWorkers
+		if envWorkers := os.Getenv("TB_DALLE_JOB_WORKERS"); envWorkers != "" {
+			if n, err := strconv.Atoi(envWorkers); err == nil && n > 0 {
+				cfg.JobWorkers = n
+			}
+		}
+		if cfg.JobWorkers <= 0 {
+			cfg.JobWorkers = 4
+		}
+		cfg.MaxQueue = maxQueue
+		if envQueue := os.Getenv("TB_DALLE_MAX_QUEUE"); envQueue != "" {
+			if n, err := strconv.Atoi(envQueue); err == nil && n > 0 {
+				cfg.MaxQueue = n
+			}
+		}
+		if cfg.MaxQueue <= 0 {
+			cfg.MaxQueue = defaultMaxQueuedJobs
+		}
+		if envCaps := os.Getenv("TB_DALLE_CLASS_CAPS"); envCaps != "" {
+			classCapsStr = envCaps
+		}
+		if caps, err := ParseClassCaps(classCapsStr); err == nil {
+			cfg.ClassCaps = caps
+		} else {
+			logWarn("ignoring class caps: " + err.Error())
+		}
+		cfg.Enhancement = parseEnhancementSettings(enhanceModel, enhanceBaseURL, enhanceTemperature, enhanceSeed, enhanceMaxTokens)
+		if envIdle := os.Getenv("TB_DALLE_ENHANCEMENT_IDLE_TIMEOUT"); envIdle != "" {
+			enhanceIdleTimeoutStr = envIdle
+		}
+		if cfg.EnhancementIdleTimeout = parsePositiveDuration(enhanceIdleTimeoutStr); cfg.EnhancementIdleTimeout == 0 {
+			logWarn("ignoring invalid enhancement idle timeout " + enhanceIdleTimeoutStr)
+			cfg.EnhancementIdleTimeout = 15 * time.Second
+		}
+		if envFallbacks := os.Getenv("TB_DALLE_ENHANCEMENT_FALLBACKS"); envFallbacks != "" {
+			enhanceFallbacks = envFallbacks
+		}
+		if cfg.EnhancementFallbacks, err = ParseEnhancementFallbacks(enhanceFallbacks); err != nil {
+			logWarn("ignoring enhancement fallbacks: " + err.Error())
+		}
+		if envBreakers := os.Getenv("TB_DALLE_BREAKERS"); envBreakers != "" {
+			breakersFlag = envBreakers
+		}
+		if cfg.Breakers, err = ParseBreakerSettings(breakersFlag); err != nil {
+			logWarn("ignoring circuit breaker settings: " + err.Error())
+		}
+		cfg.RequestsPerMinute = requestsPerMinute
+		if envRPM := os.Getenv("TB_DALLE_REQUESTS_PER_MINUTE"); envRPM != "" {
+			if n, err := strconv.Atoi(envRPM); err == nil && n >= 0 {
+				cfg.RequestsPerMinute = n
+			} else {
+				logWarn("ignoring invalid TB_DALLE_REQUESTS_PER_MINUTE " + envRPM)
+			}
+		}
+		cfg.RequestsPerMinute = max(0, cfg.RequestsPerMinute)
+		cfg.RetryBudget = envBudget("TB_DALLE_RETRY_BUDGET", retryBudget)
+		if envHedge := os.Getenv("TB_DALLE_DOWNLOAD_HEDGE"); envHedge != "" {
+			downloadHedge = envHedge
+		}
+		if cfg.DownloadHedge, err = ParseHedgePercentile(downloadHedge); err != nil {
+			logWarn("ignoring download hedge: " + err.Error())
+		}
+		if envMax := os.Getenv("TB_DALLE_DOWNLOAD_MAX_MB"); envMax != "" {
+			if n, err := strconv.Atoi(envMax); err == nil && n > 0 {
+				downloadMaxMB = n
+			} else {
+				logWarn("ignoring invalid TB_DALLE_DOWNLOAD_MAX_MB " + envMax)
+			}
+		}
+		if downloadMaxMB <= 0 {
+			downloadMaxMB = defaultDownloadMaxBytes >> 20
+		}
+		cfg.DownloadMaxBytes = int64(downloadMaxMB) << 20
+		cfg.Storage = strings.ToLower(strings.TrimSpace(envOr("TB_DALLE_STORAGE", storageFlag)))
+		cfg.S3 = S3Config{
+			Endpoint:  envOr("TB_DALLE_S3_ENDPOINT", s3Endpoint),
+			Bucket:    envOr("TB_DALLE_S3_BUCKET", s3Bucket),
+			Prefix:    envOr("TB_DALLE_S3_PREFIX", s3Prefix),
+			Region:    envOr("TB_DALLE_S3_REGION", s3Region),
+			AccessKey: envOr("TB_DALLE_S3_ACCESS_KEY", os.Getenv("AWS_ACCESS_KEY_ID")),
+			SecretKey: envOr("TB_DALLE_S3_SECRET_KEY", os.Getenv("AWS_SECRET_ACCESS_KEY")),
+		}
+		presignTTLStr = envOr("TB_DALLE_PRESIGN_TTL", presignTTLStr)
+		if presignTTLStr == "0" {
+			cfg.PresignTTL = 0
+		} else if cfg.PresignTTL = parsePositiveDuration(presignTTLStr); cfg.PresignTTL == 0 || cfg.PresignTTL > s3MaxPresignTTL {
+			logWarn("ignoring invalid presign ttl " + presignTTLStr)
+			cfg.PresignTTL = defaultPresignTTL
+		}
+		if envCache := os.Getenv("TB_DALLE_DERIVATIVE_CACHE_MB"); envCache != "" {
+			if n, err := strconv.Atoi(envCache); err == nil && n > 0 {
+				derivativeCacheMB = n
+			} else {
+				logWarn("ignoring invalid TB_DALLE_DERIVATIVE_CACHE_MB " + envCache)
+			}
+		}
+		if derivativeCacheMB <= 0 {
+			derivativeCacheMB = defaultDerivativeCacheBytes >> 20
+		}
+		cfg.DerivativeCacheBytes = int64(derivativeCacheMB) << 20
+		cfg.Retention.MaxBytes = int64(envInt("TB_DALLE_RETENTION_MAX_MB", retentionMaxMB)) << 20
+		cfg.Retention.QuotaBytes = int64(envInt("TB_DALLE_QUOTA_MB", quotaMB)) << 20
+		cfg.Retention.KeepVersions = envInt("TB_DALLE_RETENTION_KEEP_VERSIONS", keepVersions)
+		if cfg.Retention.MaxAge, err = ParseRetentionAges(envOr("TB_DALLE_RETENTION_MAX_AGE", retentionMaxAge)); err != nil {
+			logWarn("ignoring retention max age: " + err.Error())
+		}
+		retentionIntervalStr = envOr("TB_DALLE_RETENTION_INTERVAL", retentionIntervalStr)
+		if cfg.Retention.Interval = parsePositiveDuration(retentionIntervalStr); cfg.Retention.Interval == 0 {
+			logWarn("ignoring invalid retention interval " + retentionIntervalStr)
+			cfg.Retention.Interval = defaultRetentionInterval
+		}
+		cfg.Retention.ArchiveDir = envOr("TB_DALLE_RETENTION_ARCHIVE_DIR", retentionArchiveDir)
+		cfg.WSAllowedOrigins = parseOrigins(envOr("TB_DALLE_WS_ALLOWED_ORIGINS", wsAllowedOrigins))
+		if envRates := os.Getenv("TB_DALLE_RATE_TABLE"); envRates != "" {
+			rateTableFlag = envRates
+		}
+		if cfg.Rates, err = LoadRateTable(rateTableFlag); err != nil {
+			logWarn("using built-in rate table: " + err.Error())
+		}
+		cfg.DailyBudget = envBudget("TB_DALLE_DAILY_BUDGET", dailyBudget)
+		cfg.MonthlyBudget = envBudget("TB_DALLE_MONTHLY_BUDGET", monthlyBudget)
+		cfg.APIKeyClasses = parseAPIKeyClasses(os.Getenv("TB_DALLE_API_KEY_CLASSES"))
+		cfg.WebhookSecret = os.Getenv("TB_DALLE_WEBHOOK_SECRET")
+		cfg.AdminToken = os.Getenv("TB_DALLE_ADMIN_TOKEN")
+		if envTTL := os.Getenv("TB_DALLE_IDEMPOTENCY_TTL"); envTTL != "" {
+			idempotencyTTLStr = envTTL
+		}
+		cfg.IdempotencyTTL, err = time.ParseDuration(idempotencyTTLStr)
+		if err != nil || cfg.IdempotencyTTL <= 0 {
+			cfg.IdempotencyTTL = 24 * time.Hour
+		}
 
 		// Set base data directory inside storage lazily via provided flag (environment fallback inside package).
 		// storage.ConfigureDataDir(dataDirFlag)
@@ -57,6 +328,91 @@ func MustLoadConfig() Config {
 	return cachedConfig
 }
 
+// envInt returns the environment variable key as a count when it is set, otherwise value;
+// negative or invalid values are ignored with a warning and count as 0
+func envInt(key string, value int) int {
+	if env := os.Getenv(key); env != "" {
+		if n, err := strconv.Atoi(env); err == nil && n >= 0 {
+			return n
+		}
+		logWarn("ignoring invalid " + key + " " + env)
+	}
+	return max(0, value)
+}
+
+// envOr returns the environment variable key when it is set, otherwise value
+func envOr(key, value string) string {
+	if env := os.Getenv(key); env != "" {
+		return env
+	}
+	return value
+}
+
+// parseEnhancementSettings combines the enhancement flags with their TB_DALLE_ENHANCEMENT_*
+// environment overrides, which are the same variables the library reads. Invalid numbers
+// are ignored with a warning.
+func parseEnhancementSettings(model, baseURL, temperature, seed string, maxTokens int) EnhancementSettings {
+	settings := EnhancementSettings{
+		Model:        envOr("TB_DALLE_ENHANCEMENT_MODEL", model),
+		BaseURL:      envOr("TB_DALLE_ENHANCEMENT_BASE_URL", baseURL),
+		SystemPrompt: os.Getenv("TB_DALLE_ENHANCEMENT_SYSTEM_PROMPT"),
+		MaxTokens:    maxTokens,
+	}
+	if raw := envOr("TB_DALLE_ENHANCEMENT_TEMPERATURE", temperature); raw != "" {
+		if v, err := strconv.ParseFloat(raw, 64); err == nil && v >= 0 {
+			settings.Temperature = &v
+		} else {
+			logWarn("ignoring invalid enhancement temperature " + raw)
+		}
+	}
+	if raw := envOr("TB_DALLE_ENHANCEMENT_SEED", seed); raw != "" {
+		if v, err := strconv.Atoi(raw); err == nil {
+			settings.Seed = &v
+		} else {
+			logWarn("ignoring invalid enhancement seed " + raw)
+		}
+	}
+	if raw := os.Getenv("TB_DALLE_ENHANCEMENT_MAX_TOKENS"); raw != "" {
+		if v, err := strconv.Atoi(raw); err == nil && v >= 0 {
+			settings.MaxTokens = v
+		} else {
+			logWarn("ignoring invalid enhancement max tokens " + raw)
+		}
+	}
+	return settings
+}
+
+// envBudget returns the non-negative amount (a USD budget or a ratio) in the environment
+// variable key, else value
+func envBudget(key string, value float64) float64 {
+	if raw := os.Getenv(key); raw != "" {
+		if v, err := strconv.ParseFloat(raw, 64); err == nil && v >= 0 {
+			return v
+		}
+		logWarn("ignoring invalid " + key + " " + raw)
+	}
+	return math.Max(0, value)
+}
+
+// parseAPIKeyClasses reads "key=class,..." pairs, skipping malformed entries
+func parseAPIKeyClasses(spec string) map[string]PriorityClass {
+	out := make(map[string]PriorityClass)
+	pairs, err := ParseClassMap(spec)
+	if err != nil {
+		logWarn("ignoring TB_DALLE_API_KEY_CLASSES: " + err.Error())
+		return out
+	}
+	for key, name := range pairs {
+		class, err := ParsePriorityClass(name, "")
+		if err != nil || class == "" {
+			logWarn("ignoring API key policy entry: unknown priority " + name)
+			continue
+		}
+		out[key] = class
+	}
+	return out
+}
+
 // loadDotEnv loads key=value pairs from a local .env file (simple parser) if present.
 // Lines beginning with # are ignored. Keys already present in environment are not overwritten.
 func loadDotEnv() {
@@ -85,3 +441,15 @@ func loadDotEnv() {
 		}
 	}
 }
+
+// parseOrigins splits a comma-separated origin list, normalised for comparison with the
+// Origin header
+func parseOrigins(spec string) []string {
+	var origins []string
+	for _, origin := range strings.Split(spec, ",") {
+		if origin = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(origin), "/")); origin != "" {
+			origins = append(origins, origin)
+		}
+	}
+	return origins
+}
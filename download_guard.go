@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Image download defaults
+const (
+	defaultDownloadMaxBytes = 20 << 20
+	// maxDownloadResumes bounds the Range requests made for one download
+	maxDownloadResumes = 3
+	// downloadSamples is how many recent download times the hedge percentile is taken over;
+	// no hedge is sent until minHedgeSamples of them are known
+	downloadSamples = 100
+	minHedgeSamples = 10
+	// downloadURLTTL is how long an image URL handed out by the provider is watched for
+	// (OpenAI's expire after an hour)
+	downloadURLTTL = time.Hour
+)
+
+// DownloadGuard fetches the generated images the library downloads. The library reads the
+// image URL from the generation response and fetches it with http.Get on the default
+// transport, so the guard wraps http.DefaultTransport: it notes the URLs image generation
+// responses hand out and fetches exactly those itself, resuming a body cut short with a
+// Range request, optionally hedging a slow fetch with a second request, and checking the
+// content type and size, before the library sees (and annotates) the bytes. Every other
+// request passes through untouched.
+type DownloadGuard struct {
+	base http.RoundTripper
+
+	mu              sync.Mutex
+	pending         map[string]time.Time // image URLs handed out, with when
+	durations       []time.Duration      // recent successful downloads, oldest overwritten first
+	next            int
+	hedgePercentile float64 // 0 disables hedging
+	maxBytes        int64
+}
+
+// NewDownloadGuard wraps base; hedging is off until Configure turns it on
+func NewDownloadGuard(base http.RoundTripper) *DownloadGuard {
+	return &DownloadGuard{base: base, pending: make(map[string]time.Time), maxBytes: defaultDownloadMaxBytes}
+}
+
+// Configure sets the hedge percentile (0 disables hedging) and the largest image accepted
+func (g *DownloadGuard) Configure(hedgePercentile float64, maxBytes int64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.hedgePercentile = hedgePercentile
+	if maxBytes > 0 {
+		g.maxBytes = maxBytes
+	}
+}
+
+// ParseHedgePercentile reads a hedge percentile such as "p95" or "95"; "" and "0" disable
+// hedging
+func ParseHedgePercentile(spec string) (float64, error) {
+	spec = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(spec)), "p")
+	if spec == "" {
+		return 0, nil
+	}
+	p, err := strconv.ParseFloat(spec, 64)
+	if err != nil || p < 0 || p >= 100 {
+		return 0, fmt.Errorf("invalid hedge percentile %q (want p1 to p99, or 0 to disable)", spec)
+	}
+	return p, nil
+}
+
+// RoundTrip implements http.RoundTripper
+func (g *DownloadGuard) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method == http.MethodGet && g.expected(req.URL.String()) {
+		return g.download(req)
+	}
+	resp, err := g.base.RoundTrip(req)
+	if err == nil && req.Method == http.MethodPost && resp.StatusCode == http.StatusOK && strings.HasSuffix(req.URL.Path, "/images/generations") {
+		g.noteImageURLs(resp)
+	}
+	return resp, err
+}
+
+// noteImageURLs records the image URLs in a generation response, leaving the body readable
+func (g *DownloadGuard) noteImageURLs(resp *http.Response) {
+	body, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		// The library sees the same short body and fails on it
+		resp.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), errReader{err}))
+		return
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	var parsed struct {
+		Data []struct {
+			URL string `json:"url"`
+		} `json:"data"`
+	}
+	if json.Unmarshal(body, &parsed) != nil {
+		return
+	}
+	now := time.Now()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for u, at := range g.pending {
+		if now.Sub(at) > downloadURLTTL {
+			delete(g.pending, u)
+		}
+	}
+	for _, d := range parsed.Data {
+		if d.URL != "" {
+			g.pending[d.URL] = now
+		}
+	}
+}
+
+// errReader replays a read error after the bytes that were read
+type errReader struct{ err error }
+
+func (r errReader) Read([]byte) (int, error) { return 0, r.err }
+
+// expected reports whether rawURL was handed out by a recent image generation
+func (g *DownloadGuard) expected(rawURL string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	at, ok := g.pending[rawURL]
+	return ok && time.Since(at) <= downloadURLTTL
+}
+
+// hedgeDelay returns the configured percentile of recent download times, or 0 when hedging
+// is off or too few downloads have been seen
+func (g *DownloadGuard) hedgeDelay() (time.Duration, float64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.hedgePercentile <= 0 || len(g.durations) < minHedgeSamples {
+		return 0, g.hedgePercentile
+	}
+	sorted := append([]time.Duration(nil), g.durations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[int(g.hedgePercentile*float64(len(sorted))/100)], g.hedgePercentile
+}
+
+func (g *DownloadGuard) recordDuration(d time.Duration) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if len(g.durations) < downloadSamples {
+		g.durations = append(g.durations, d)
+		return
+	}
+	g.durations[g.next] = d
+	g.next = (g.next + 1) % downloadSamples
+}
+
+type downloadResult struct {
+	body        []byte
+	contentType string
+	hedge       bool
+	err         error
+}
+
+// download fetches req's image, sending a hedge when the first fetch outlasts hedgeDelay,
+// and answers with whichever completes first. The loser is cancelled.
+func (g *DownloadGuard) download(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+	results := make(chan downloadResult, 2)
+	fetch := func(hedge bool) {
+		body, contentType, err := g.fetch(ctx, req)
+		results <- downloadResult{body: body, contentType: contentType, hedge: hedge, err: err}
+	}
+	go fetch(false)
+	inFlight := 1
+
+	var hedgeTimer <-chan time.Time
+	delay, percentile := g.hedgeDelay()
+	if delay > 0 {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		hedgeTimer = timer.C
+	}
+	var firstErr error
+	for {
+		select {
+		case <-hedgeTimer:
+			hedgeTimer = nil
+			inFlight++
+			GetMetricsCollector().RecordDownloadHedge()
+			logInfo(fmt.Sprintf("image download slower than p%g (%v), sending a hedged request", percentile, delay))
+			go fetch(true)
+		case r := <-results:
+			inFlight--
+			if r.err == nil {
+				if r.hedge {
+					GetMetricsCollector().RecordDownloadHedgeWin()
+				}
+				g.recordDuration(time.Since(start))
+				return &http.Response{
+					Status:        "200 OK",
+					StatusCode:    http.StatusOK,
+					Proto:         "HTTP/1.1",
+					ProtoMajor:    1,
+					ProtoMinor:    1,
+					Header:        http.Header{"Content-Type": {r.contentType}, "Content-Length": {strconv.Itoa(len(r.body))}},
+					Body:          io.NopCloser(bytes.NewReader(r.body)),
+					ContentLength: int64(len(r.body)),
+					Request:       req,
+				}, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if inFlight == 0 {
+				if errors.Is(firstErr, errImageRejected) {
+					GetMetricsCollector().RecordDownloadRejection()
+				}
+				return nil, firstErr
+			}
+		}
+	}
+}
+
+// errImageRejected marks downloads that arrived but were not an acceptable image
+var errImageRejected = errors.New("image rejected")
+
+// fetch downloads the whole image, resuming with a Range request when the body is cut
+// short, and checks its type and size
+func (g *DownloadGuard) fetch(ctx context.Context, orig *http.Request) ([]byte, string, error) {
+	g.mu.Lock()
+	maxBytes := g.maxBytes
+	g.mu.Unlock()
+
+	var buf bytes.Buffer
+	contentType := ""
+	total := int64(-1)
+	for resumes := 0; ; resumes++ {
+		req := orig.Clone(ctx)
+		// Compressed bodies would make byte offsets meaningless for Range requests
+		req.Header.Set("Accept-Encoding", "identity")
+		if buf.Len() > 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", buf.Len()))
+		}
+		resp, err := g.base.RoundTrip(req)
+		if err != nil {
+			return nil, "", err
+		}
+		switch {
+		case resp.StatusCode == http.StatusPartialContent && buf.Len() > 0:
+			start, size, ok := parseContentRange(resp.Header.Get("Content-Range"))
+			if !ok || start != int64(buf.Len()) {
+				_ = resp.Body.Close()
+				return nil, "", fmt.Errorf("resumed download returned range %q, want bytes from %d", resp.Header.Get("Content-Range"), buf.Len())
+			}
+			total = size
+		case resp.StatusCode == http.StatusOK:
+			// First request, or the server ignored Range and sent everything again
+			buf.Reset()
+			contentType = resp.Header.Get("Content-Type")
+			total = resp.ContentLength
+		default:
+			_ = resp.Body.Close()
+			return nil, "", fmt.Errorf("%w: status %d", errImageRejected, resp.StatusCode)
+		}
+		if total > maxBytes {
+			_ = resp.Body.Close()
+			return nil, "", fmt.Errorf("%w: %d bytes exceeds the %d byte limit", errImageRejected, total, maxBytes)
+		}
+		_, err = io.Copy(&buf, io.LimitReader(resp.Body, maxBytes-int64(buf.Len())+1))
+		_ = resp.Body.Close()
+		if int64(buf.Len()) > maxBytes {
+			return nil, "", fmt.Errorf("%w: more than the %d byte limit", errImageRejected, maxBytes)
+		}
+		if err == nil && total >= 0 && int64(buf.Len()) < total {
+			err = io.ErrUnexpectedEOF
+		}
+		if err == nil {
+			break
+		}
+		if buf.Len() == 0 || resumes >= maxDownloadResumes || ctx.Err() != nil {
+			return nil, "", err
+		}
+		GetMetricsCollector().RecordDownloadResume()
+		logInfo(fmt.Sprintf("image download cut off after %d bytes (%v), resuming", buf.Len(), err))
+	}
+
+	media, _, _ := mime.ParseMediaType(contentType)
+	if media == "" || media == "application/octet-stream" {
+		media, _, _ = mime.ParseMediaType(http.DetectContentType(buf.Bytes()))
+	}
+	if !strings.HasPrefix(media, "image/") {
+		return nil, "", fmt.Errorf("%w: content type %q is not an image", errImageRejected, contentType)
+	}
+	if contentType == "" {
+		contentType = media
+	}
+	return buf.Bytes(), contentType, nil
+}
+
+// parseContentRange reads "bytes start-end/size"; size is -1 when given as "*"
+func parseContentRange(header string) (start, size int64, ok bool) {
+	spec, found := strings.CutPrefix(header, "bytes ")
+	if !found {
+		return 0, 0, false
+	}
+	span, sizeSpec, found := strings.Cut(spec, "/")
+	if !found {
+		return 0, 0, false
+	}
+	first, _, found := strings.Cut(span, "-")
+	if !found {
+		return 0, 0, false
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	size = -1
+	if sizeSpec != "*" {
+		if size, err = strconv.ParseInt(sizeSpec, 10, 64); err != nil {
+			return 0, 0, false
+		}
+	}
+	return start, size, true
+}
+
+// Global guard, installed over http.DefaultTransport once
+var (
+	downloadGuard     *DownloadGuard
+	downloadGuardOnce sync.Once
+)
+
+// UseDownloadGuard installs the download guard over http.DefaultTransport (once) and
+// applies the hedge percentile and size limit
+func UseDownloadGuard(hedgePercentile float64, maxBytes int64) *DownloadGuard {
+	downloadGuardOnce.Do(func() {
+		downloadGuard = NewDownloadGuard(http.DefaultTransport)
+		http.DefaultTransport = downloadGuard
+	})
+	downloadGuard.Configure(hedgePercentile, maxBytes)
+	return downloadGuard
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// guardedClient returns a client whose downloads of server's /cdn/ paths go through a fresh
+// guard, after an image generation response has handed them out
+func guardedClient(t *testing.T, server *httptest.Server, paths ...string) (*http.Client, *DownloadGuard) {
+	t.Helper()
+	// Not http.DefaultTransport, which app tests may already have wrapped in the global guard
+	guard := NewDownloadGuard(&http.Transport{})
+	client := &http.Client{Transport: guard}
+	var data []string
+	for _, p := range paths {
+		data = append(data, fmt.Sprintf(`{"url":"%s%s"}`, server.URL, p))
+	}
+	resp, err := client.Post(server.URL+"/v1/images/generations", "application/json", strings.NewReader(`{"prompt":"x"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if want := `{"data":[` + strings.Join(data, ",") + `]}`; string(body) != want {
+		t.Fatalf("generation body altered: %s", body)
+	}
+	return client, guard
+}
+
+func TestDownloadGuardResumesAndValidates(t *testing.T) {
+	png, _ := mockImagePNG("harbor", 32, 32)
+	var cuts atomic.Int32
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/images/generations":
+			_, _ = w.Write([]byte(`{"data":[{"url":"` + server.URL + `/cdn/cut.png"},{"url":"` + server.URL + `/cdn/page.html"},{"url":"` + server.URL + `/cdn/huge.png"}]}`))
+		case "/cdn/cut.png":
+			// The first response stops halfway; the resume must ask for the rest
+			if rng := r.Header.Get("Range"); rng != "" {
+				var from int
+				_, _ = fmt.Sscanf(rng, "bytes=%d-", &from)
+				w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", from, len(png)-1, len(png)))
+				w.Header().Set("Content-Type", "image/png")
+				w.WriteHeader(http.StatusPartialContent)
+				_, _ = w.Write(png[from:])
+				return
+			}
+			cuts.Add(1)
+			w.Header().Set("Content-Type", "image/png")
+			w.Header().Set("Content-Length", fmt.Sprint(len(png)))
+			_, _ = w.Write(png[:len(png)/2])
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		case "/cdn/page.html":
+			_, _ = w.Write([]byte("<html><body>AccessDenied</body></html>"))
+		case "/cdn/huge.png":
+			w.Header().Set("Content-Type", "image/png")
+			_, _ = w.Write(bytes.Repeat(png, 64))
+		}
+	}))
+	defer server.Close()
+	client, guard := guardedClient(t, server, "/cdn/cut.png", "/cdn/page.html", "/cdn/huge.png")
+	guard.Configure(0, int64(len(png)*4))
+
+	before := GetMetricsCollector().GetMetrics()
+	resp, err := client.Get(server.URL + "/cdn/cut.png")
+	if err != nil {
+		t.Fatalf("resumed download: %v", err)
+	}
+	got, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if !bytes.Equal(got, png) || cuts.Load() != 1 || resp.Header.Get("Content-Type") != "image/png" {
+		t.Fatalf("resumed download: %d of %d bytes after %d cuts", len(got), len(png), cuts.Load())
+	}
+
+	for _, path := range []string{"/cdn/page.html", "/cdn/huge.png"} {
+		if _, err := client.Get(server.URL + path); err == nil || !isDownloadError(err, server.URL+"/v1/images/generations") {
+			t.Fatalf("%s should be rejected as a download error, got %v", path, err)
+		}
+	}
+	after := GetMetricsCollector().GetMetrics()
+	if after.DownloadResumes != before.DownloadResumes+1 || after.DownloadRejections != before.DownloadRejections+2 {
+		t.Fatalf("metrics: before %+v after %+v", before, after)
+	}
+
+	// URLs nobody handed out pass straight through
+	resp, err = client.Get(server.URL + "/cdn/page.html?unlisted")
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("unlisted GET: %v", err)
+	}
+	_ = resp.Body.Close()
+}
+
+func TestDownloadGuardHedgesSlowDownloads(t *testing.T) {
+	png, _ := mockImagePNG("harbor", 16, 16)
+	var requests atomic.Int32
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/images/generations" {
+			_, _ = w.Write([]byte(`{"data":[{"url":"` + server.URL + `/cdn/slow.png"}]}`))
+			return
+		}
+		// The first request lands on a stalled node
+		if requests.Add(1) == 1 {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		_, _ = w.Write(png)
+	}))
+	defer server.Close()
+	client, guard := guardedClient(t, server, "/cdn/slow.png")
+	guard.Configure(95, 0)
+	for i := 0; i < minHedgeSamples; i++ {
+		guard.recordDuration(20 * time.Millisecond)
+	}
+
+	before := GetMetricsCollector().GetMetrics()
+	start := time.Now()
+	resp, err := client.Get(server.URL + "/cdn/slow.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if !bytes.Equal(got, png) || time.Since(start) > 2*time.Second {
+		t.Fatalf("hedged download took %v", time.Since(start))
+	}
+	after := GetMetricsCollector().GetMetrics()
+	if after.DownloadHedges != before.DownloadHedges+1 || after.DownloadHedgeWins != before.DownloadHedgeWins+1 {
+		t.Fatalf("hedge metrics: before %+v after %+v", before, after)
+	}
+
+	if p, err := ParseHedgePercentile("P99"); err != nil || p != 99 {
+		t.Fatalf("parse: %v %v", p, err)
+	}
+	if _, err := ParseHedgePercentile("p100"); err == nil {
+		t.Fatalf("expected p100 to be rejected")
+	}
+}
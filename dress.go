@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	dalle "github.com/TrueBlocks/trueblocks-dalle/v6"
+	"github.com/TrueBlocks/trueblocks-dalle/v6/pkg/model"
+	"github.com/TrueBlocks/trueblocks-dalle/v6/pkg/prompt"
+	"github.com/TrueBlocks/trueblocks-dalle/v6/pkg/storage"
+)
+
+// maxCachedDresses bounds the per-series DalleDress cache kept by each dry-run context
+const maxCachedDresses = 2048
+
+// DressPreview is the fully derived DalleDress for one series and address, computed
+// without enhancement or image generation
+type DressPreview struct {
+	Series          string             `json:"series"`
+	Address         string             `json:"address"`
+	Seed            string             `json:"seed"`
+	SeedChunks      []string           `json:"seedChunks"`
+	SelectedTokens  []string           `json:"selectedTokens"`
+	SelectedRecords []string           `json:"selectedRecords"`
+	Attributes      []prompt.Attribute `json:"attributes"`
+	Prompt          string             `json:"prompt"`
+	DataPrompt      string             `json:"dataPrompt"`
+	TitlePrompt     string             `json:"titlePrompt"`
+	TersePrompt     string             `json:"tersePrompt"`
+	AuthorPrompt    string             `json:"authorPrompt"`
+	Databases       map[string]string  `json:"databases,omitempty"`
+	ContentHash     string             `json:"contentHash"`
+}
+
+// contentHash hashes every derived field, leaving out the database versions and the
+// hash itself, so two previews hash equal exactly when their seed, attributes and
+// prompts match
+func (p *DressPreview) contentHash() string {
+	content := *p
+	content.Databases = nil
+	content.ContentHash = ""
+	data, _ := json.Marshal(content)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// dressContext is a dalle.Context loaded for one series, remembered with the series
+// file's modification time so edits to the series are picked up
+type dressContext struct {
+	ctx      *dalle.Context
+	modTime  time.Time
+	versions map[string]string
+}
+
+// DressBuilder computes DalleDress previews from per-series contexts it builds itself;
+// the engine's contexts are not exported
+type DressBuilder struct {
+	mu       sync.Mutex
+	contexts map[string]*dressContext
+}
+
+// NewDressBuilder creates an empty builder
+func NewDressBuilder() *DressBuilder {
+	return &DressBuilder{contexts: make(map[string]*dressContext)}
+}
+
+// Build derives the DalleDress for address under series
+func (b *DressBuilder) Build(series, address string) (*DressPreview, error) {
+	dc, err := b.context(series)
+	if err != nil {
+		return nil, err
+	}
+	dd, err := dc.ctx.MakeDalleDress(address)
+	if err != nil {
+		return nil, err
+	}
+	author, err := dd.ExecuteTemplate(prompt.AuthorTemplate, nil)
+	if err != nil {
+		return nil, err
+	}
+	preview := &DressPreview{
+		Series:          series,
+		Address:         address,
+		Seed:            dd.Seed,
+		SeedChunks:      dd.SeedChunks,
+		SelectedTokens:  dd.SelectedTokens,
+		SelectedRecords: dd.SelectedRecords,
+		Attributes:      dd.Attribs,
+		Prompt:          dd.Prompt,
+		DataPrompt:      dd.DataPrompt,
+		TitlePrompt:     dd.TitlePrompt,
+		TersePrompt:     dd.TersePrompt,
+		AuthorPrompt:    author,
+		Databases:       dc.versions,
+	}
+	preview.ContentHash = preview.contentHash()
+	return preview, nil
+}
+
+// context returns the loaded context for series, reloading it when the series file has
+// changed and clearing its address cache once it grows past maxCachedDresses
+func (b *DressBuilder) context(series string) (*dressContext, error) {
+	var modTime time.Time
+	if info, err := os.Stat(filepath.Join(storage.SeriesDir(), series+".json")); err == nil {
+		modTime = info.ModTime()
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if dc, ok := b.contexts[series]; ok && dc.modTime.Equal(modTime) {
+		dc.ctx.CacheMutex.Lock()
+		if len(dc.ctx.DalleCache) > maxCachedDresses {
+			dc.ctx.DalleCache = make(map[string]*model.DalleDress)
+		}
+		dc.ctx.CacheMutex.Unlock()
+		return dc, nil
+	}
+
+	ctx := dalle.NewContext()
+	if err := ctx.ReloadDatabases(series); err != nil {
+		return nil, err
+	}
+	dc := &dressContext{ctx: ctx, modTime: modTime, versions: databaseVersions()}
+	b.contexts[series] = dc
+	return dc, nil
+}
+
+// databaseVersions reports the version of each attribute database in the cache
+func databaseVersions() map[string]string {
+	cm := storage.GetCacheManager()
+	versions := make(map[string]string, len(prompt.DatabaseNames))
+	for _, db := range prompt.DatabaseNames {
+		if idx, err := cm.GetDatabase(db); err == nil && idx.Version != "" {
+			versions[db] = idx.Version
+		}
+	}
+	return versions
+}
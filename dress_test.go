@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const dressTestAddress = "0xf503017d7baf7fbc0fff7492b751025c6a78179b"
+
+func TestDressBuilderDeterministicHash(t *testing.T) {
+	first, err := NewDressBuilder().Build("empty", dressTestAddress)
+	if err != nil {
+		t.Fatalf("build: %v", err)
+	}
+	second, err := NewDressBuilder().Build("empty", dressTestAddress)
+	if err != nil {
+		t.Fatalf("rebuild: %v", err)
+	}
+	if first.ContentHash == "" || first.ContentHash != second.ContentHash {
+		t.Fatalf("hash not stable: %q vs %q", first.ContentHash, second.ContentHash)
+	}
+	if first.Seed == "" || len(first.Attributes) == 0 || first.Prompt == "" || first.AuthorPrompt == "" {
+		t.Fatalf("dress not fully derived: %+v", first)
+	}
+
+	changed := *first
+	changed.TersePrompt += " "
+	if changed.contentHash() == first.ContentHash {
+		t.Fatalf("prompt change did not change the hash")
+	}
+	changed = *first
+	changed.Databases = map[string]string{"nouns": "v9.9.9"}
+	if changed.contentHash() != first.ContentHash {
+		t.Fatalf("database versions should not affect the hash")
+	}
+}
+
+func TestHandleV1Dress(t *testing.T) {
+	app := &App{ValidSeries: []string{"empty"}, Dresses: NewDressBuilder()}
+
+	rr := httptest.NewRecorder()
+	app.handleV1Dress(rr, httptest.NewRequest(http.MethodGet, "/v1/dress/empty/0x123", nil))
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("bad address: %d %s", rr.Code, rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	app.handleV1Dress(rr, httptest.NewRequest(http.MethodGet, "/v1/dress/empty/"+dressTestAddress, nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("single: %d %s", rr.Code, rr.Body.String())
+	}
+	var single struct {
+		Data DressPreview `json:"data"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &single); err != nil || single.Data.ContentHash == "" {
+		t.Fatalf("decode single: %v %s", err, rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	app.handleV1Dress(rr, httptest.NewRequest(http.MethodGet, "/v1/dress/"+dressTestAddress+"?all_series=1", nil))
+	var all struct {
+		Data []DressPreview `json:"data"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &all); err != nil || len(all.Data) != 1 {
+		t.Fatalf("decode all: %v %s", err, rr.Body.String())
+	}
+	if all.Data[0].ContentHash != single.Data.ContentHash {
+		t.Fatalf("all_series hash differs from single lookup")
+	}
+}
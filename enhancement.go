@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+
+	"github.com/TrueBlocks/trueblocks-dalle/v6/pkg/storage"
+	"github.com/TrueBlocks/trueblocks-dalle/v6/pkg/utils"
+)
+
+// defaultSystemPrompt mirrors the library's literary enhancement instruction
+const defaultSystemPrompt = `{{if .AuthorType}}{{.AuthorType}}
+
+{{end}}Enhance the following art generation prompt while maintaining this literary perspective. Make it more vivid and evocative while preserving all key attributes. Focus on emotional depth and narrative richness.`
+
+// EnhancementSettings controls the chat-completion call that enhances a prompt. Zero
+// values mean "not set" so settings can be layered; Temperature and Seed are pointers
+// because zero is a meaningful value for both.
+type EnhancementSettings struct {
+	// BaseURL is an OpenAI-compatible API root such as http://localhost:11434/v1; empty
+	// uses the provider's chat endpoint
+	BaseURL     string   `json:"base_url,omitempty"`
+	Model       string   `json:"model,omitempty"`
+	Temperature *float64 `json:"temperature,omitempty"`
+	Seed        *int     `json:"seed,omitempty"`
+	MaxTokens   int      `json:"max_tokens,omitempty"`
+	// SystemPrompt is a text/template rendered with .AuthorType and .Series
+	SystemPrompt string `json:"system_prompt,omitempty"`
+}
+
+// defaultEnhancementSettings are the values the server used before they were configurable
+func defaultEnhancementSettings() EnhancementSettings {
+	temperature, seed := 0.2, 1337
+	return EnhancementSettings{
+		Model:        "gpt-4",
+		Temperature:  &temperature,
+		Seed:         &seed,
+		SystemPrompt: defaultSystemPrompt,
+	}
+}
+
+// Merge returns s with every field set in over replacing its own
+func (s EnhancementSettings) Merge(over EnhancementSettings) EnhancementSettings {
+	if over.BaseURL != "" {
+		s.BaseURL = over.BaseURL
+	}
+	if over.Model != "" {
+		s.Model = over.Model
+	}
+	if over.Temperature != nil {
+		s.Temperature = over.Temperature
+	}
+	if over.Seed != nil {
+		s.Seed = over.Seed
+	}
+	if over.MaxTokens > 0 {
+		s.MaxTokens = over.MaxTokens
+	}
+	if over.SystemPrompt != "" {
+		s.SystemPrompt = over.SystemPrompt
+	}
+	return s
+}
+
+// ChatURL resolves the chat-completions endpoint: BaseURL when set, else the provider's
+func (s EnhancementSettings) ChatURL(provider Provider) string {
+	if s.BaseURL != "" {
+		return strings.TrimRight(s.BaseURL, "/") + "/chat/completions"
+	}
+	return provider.ChatURL()
+}
+
+// RenderSystemPrompt fills the system-prompt template for one request
+func (s EnhancementSettings) RenderSystemPrompt(authorType, series string) (string, error) {
+	text := s.SystemPrompt
+	if text == "" {
+		text = defaultSystemPrompt
+	}
+	tmpl, err := template.New("system").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("parse system prompt: %w", err)
+	}
+	var buf bytes.Buffer
+	data := struct{ AuthorType, Series string }{strings.TrimSpace(authorType), series}
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("render system prompt: %w", err)
+	}
+	return buf.String(), nil
+}
+
+// String summarises the settings for the startup report
+func (s EnhancementSettings) String() string {
+	parts := []string{"model=" + s.Model}
+	if s.BaseURL != "" {
+		parts = append(parts, "base_url="+s.BaseURL)
+	}
+	if s.Temperature != nil {
+		parts = append(parts, "temperature="+strconv.FormatFloat(*s.Temperature, 'g', -1, 64))
+	}
+	if s.Seed != nil {
+		parts = append(parts, "seed="+strconv.Itoa(*s.Seed))
+	}
+	if s.MaxTokens > 0 {
+		parts = append(parts, "max_tokens="+strconv.Itoa(s.MaxTokens))
+	}
+	if s.SystemPrompt != defaultSystemPrompt {
+		parts = append(parts, "system_prompt=custom")
+	}
+	return strings.Join(parts, " ")
+}
+
+// exportToLibrary sets the library's enhancement environment to match s, so generations
+// the library enhances itself use the same deployment settings
+func (s EnhancementSettings) exportToLibrary(provider Provider) {
+	_ = os.Setenv("TB_DALLE_ENHANCEMENT_URL", s.ChatURL(provider))
+	_ = os.Setenv("TB_DALLE_ENHANCEMENT_MODEL", s.Model)
+	if s.Temperature != nil {
+		_ = os.Setenv("TB_DALLE_ENHANCEMENT_TEMPERATURE", strconv.FormatFloat(*s.Temperature, 'g', -1, 64))
+	}
+	if s.Seed != nil {
+		_ = os.Setenv("TB_DALLE_ENHANCEMENT_SEED", strconv.Itoa(*s.Seed))
+	}
+}
+
+// seriesEnhancement reads the optional "enhancement" object from a series definition.
+// The library's Series type has no field for it, so it is read from the same file.
+func seriesEnhancement(series string) (EnhancementSettings, error) {
+	data, err := os.ReadFile(filepath.Join(storage.SeriesDir(), series+".json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return EnhancementSettings{}, nil
+		}
+		return EnhancementSettings{}, err
+	}
+	var def struct {
+		Enhancement EnhancementSettings `json:"enhancement"`
+	}
+	if err := json.Unmarshal(data, &def); err != nil {
+		return EnhancementSettings{}, fmt.Errorf("series %s: %w", series, err)
+	}
+	return def.Enhancement, nil
+}
+
+// enhancementFor returns the effective settings for series: deployment config overlaid
+// with the series definition
+func (a *App) enhancementFor(series string) EnhancementSettings {
+	settings := defaultEnhancementSettings().Merge(a.Config.Enhancement)
+	over, err := seriesEnhancement(series)
+	if err != nil {
+		logWarn(fmt.Sprintf("ignoring enhancement settings for series %s: %v", series, err))
+		return settings
+	}
+	return settings.Merge(over)
+}
+
+// enhancedBy remembers which provider enhanced each series:address prompt so progress
+// snapshots can report it while the job runs; the library's report has no field for it.
+// Entries go when the job finishes, after the manifest has recorded the provider.
+var enhancedBy sync.Map
+
+// enhancementProviderFor returns the provider that enhanced the prompt for (series, address)
+// in a running job, enhancementDegraded when all of them failed, or "" when unknown
+func enhancementProviderFor(series, address string) string {
+	if name, ok := enhancedBy.Load(series + ":" + address); ok {
+		return name.(string)
+	}
+	return ""
+}
+
+// finishedEnhancementProvider is enhancementProviderFor for a finished generation, falling
+// back to the provider its latest manifest recorded
+func finishedEnhancementProvider(series, address string) string {
+	if name := enhancementProviderFor(series, address); name != "" {
+		return name
+	}
+	if m, err := latestManifest(context.Background(), series, address); err == nil && m != nil {
+		return m.EnhancementProvider
+	}
+	return ""
+}
+
+// forgetEnhancement drops what a finished job left in enhancedBy
+func forgetEnhancement(series, address string) {
+	enhancedBy.Delete(series + ":" + address)
+}
+
+// streamingEnhancements holds the enhanced text received so far for prompts still being
+// streamed from the provider, keyed like enhancedBy; entries go when the enhancement ends
+var streamingEnhancements sync.Map
+
+// partialEnhancementFor returns the enhanced text streamed so far for (series, address), or
+// "" when no enhancement is in flight
+func partialEnhancementFor(series, address string) string {
+	if text, ok := streamingEnhancements.Load(series + ":" + address); ok {
+		return text.(string)
+	}
+	return ""
+}
+
+// preEnhance writes the enhanced prompt for a job using the series' settings before the
+// library runs. The library reuses an enhanced prompt it finds on disk instead of calling
+// the provider itself. When every provider fails the original prompt is written, so the
+// library does not retry the provider whose circuit is open. Nothing is written when
+// enhancement is disabled or already done. job.Address may be any library input; the files
+// are named the way the library names them.
+func (a *App) preEnhance(ctx context.Context, job *Job) {
+	if a.Dresses == nil || os.Getenv("TB_DALLE_NO_ENHANCE") == "1" || CurrentProvider().APIKey() == "" {
+		return
+	}
+	name := utils.ValidFilename(job.Address)
+	target := filepath.Join(storage.OutputDir(), job.Series, "enhanced", name+".txt")
+	if fileExists(target) || fileExists(filepath.Join(storage.OutputDir(), job.Series, "annotated", name+".png")) {
+		return
+	}
+	dress, err := a.Dresses.Build(job.Series, job.Address)
+	if err != nil {
+		logWarn(fmt.Sprintf("[%s] unable to build dress for enhancement: %v", job.RequestID, err))
+		return
+	}
+	if ctx.Err() != nil {
+		return
+	}
+	key := job.Series + ":" + job.Address
+	enhanced, usage, _ := GetOpenAIClient().EnhancePromptStreaming(a.enhancementFor(job.Series), dress.Prompt, dress.AuthorPrompt, job.Series, job.RequestID, func(text string) {
+		streamingEnhancements.Store(key, text)
+	})
+	streamingEnhancements.Delete(key)
+	if a.Usage != nil && usage.PromptTokens+usage.CompletionTokens > 0 {
+		a.Usage.RecordChat(job.Series, job.Client, usage.Model, usage.PromptTokens, usage.CompletionTokens)
+	}
+	provider := usage.Provider
+	if provider == "" {
+		provider = enhancementDegraded
+	}
+	enhancedBy.Store(key, provider)
+	if enhanced == "" {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0o750); err != nil {
+		logWarn(fmt.Sprintf("[%s] unable to save enhanced prompt: %v", job.RequestID, err))
+		return
+	}
+	if err := os.WriteFile(target, []byte(enhanced), 0o600); err != nil {
+		logWarn(fmt.Sprintf("[%s] unable to save enhanced prompt: %v", job.RequestID, err))
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	dalle "github.com/TrueBlocks/trueblocks-dalle/v6"
+	"github.com/TrueBlocks/trueblocks-dalle/v6/pkg/progress"
+	"github.com/TrueBlocks/trueblocks-dalle/v6/pkg/storage"
+)
+
+func TestEnhancementSettingsMergeAndRender(t *testing.T) {
+	zero := 0.0
+	merged := defaultEnhancementSettings().Merge(EnhancementSettings{Model: "llama3", Temperature: &zero})
+	if merged.Model != "llama3" || *merged.Temperature != 0 || *merged.Seed != 1337 {
+		t.Fatalf("merge: %s", merged)
+	}
+	if got := merged.Merge(EnhancementSettings{BaseURL: "http://gw:4000/v1/"}).ChatURL(OpenAIProvider{}); got != "http://gw:4000/v1/chat/completions" {
+		t.Fatalf("chat url = %s", got)
+	}
+
+	custom := EnhancementSettings{SystemPrompt: "Write as {{.AuthorType}} for {{.Series}}."}
+	if got, err := custom.RenderSystemPrompt(" a poet ", "five"); err != nil || got != "Write as a poet for five." {
+		t.Fatalf("render: %q %v", got, err)
+	}
+	if got, _ := defaultEnhancementSettings().RenderSystemPrompt("", "s"); strings.HasPrefix(got, "\n") {
+		t.Fatalf("empty author left a blank preamble: %q", got)
+	}
+	if _, err := (EnhancementSettings{SystemPrompt: "{{.Nope"}).RenderSystemPrompt("a", "s"); err == nil {
+		t.Fatalf("expected template error")
+	}
+}
+
+func TestPreEnhanceUsesSeriesSettings(t *testing.T) {
+	series, address := "enhance-settings-test", "0x2f98431c8ad98523631ae4a59f267346ea31f984"
+	dalle.SetupTest(t, dalle.SetupTestOptions{Series: []string{series}})
+	var payload struct {
+		Model       string   `json:"model"`
+		Temperature *float64 `json:"temperature"`
+		Seed        *int     `json:"seed"`
+		MaxTokens   int      `json:"max_tokens"`
+		Messages    []struct {
+			Role    string `json:"role"`
+			Content string `json:"content"`
+		} `json:"messages"`
+	}
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/chat/completions" {
+			http.NotFound(w, r)
+			return
+		}
+		_ = json.NewDecoder(r.Body).Decode(&payload)
+		_, _ = w.Write([]byte(`{"choices":[{"message":{"role":"assistant","content":"gateway enhanced"}}]}`))
+	}))
+	defer gateway.Close()
+	useMockProvider(t)
+	t.Setenv("TB_DALLE_NO_ENHANCE", "")
+
+	definition := `{"suffix":"` + series + `","enhancement":{"model":"series-model","max_tokens":300,"system_prompt":"Persona: {{.AuthorType}}"}}`
+	seriesFile := filepath.Join(storage.SeriesDir(), series+".json")
+	if err := os.WriteFile(seriesFile, []byte(definition), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	seed := 7
+	app := &App{Dresses: NewDressBuilder(), Config: Config{Enhancement: EnhancementSettings{BaseURL: gateway.URL + "/v1", Seed: &seed}}}
+	job := NewJob(JobKindDalle, "enh")
+	job.Series, job.Address = series, address
+	app.preEnhance(context.Background(), job)
+
+	if payload.Model != "series-model" || payload.MaxTokens != 300 || payload.Seed == nil || *payload.Seed != 7 || *payload.Temperature != 0.2 {
+		t.Fatalf("settings not layered: %+v", payload)
+	}
+	if len(payload.Messages) != 2 || !strings.HasPrefix(payload.Messages[0].Content, "Persona: ") || payload.Messages[1].Role != "user" {
+		t.Fatalf("messages: %+v", payload.Messages)
+	}
+	enhanced, err := os.ReadFile(filepath.Join(storage.OutputDir(), series, "enhanced", address+".txt"))
+	if err != nil || string(enhanced) != "gateway enhanced" {
+		t.Fatalf("enhanced prompt not saved: %q %v", enhanced, err)
+	}
+	if got := enhancementProviderFor(series, address); got != ProviderMock {
+		t.Fatalf("enhancement provider = %q", got)
+	}
+
+	// POST /v1/images/generate goes through the same step before the engine runs
+	t.Setenv("TB_DALLE_SKIP_IMAGE", "")
+	engine, err := dalle.New(dalle.Config{DataDir: filepath.Join(t.TempDir(), "dalle-data")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.Engine = engine
+	payload.Model = ""
+	input := "0x3f98431c8ad98523631ae4a59f267346ea31f984"
+	v1 := NewJob(JobKindGenerate, "enh-v1")
+	v1.Request = &dalle.GenerateRequest{Input: input, Series: series}
+	if _, err := app.runJob(context.Background(), v1); err != nil {
+		t.Fatal(err)
+	}
+	if payload.Model != "series-model" || !fileExists(filepath.Join(storage.OutputDir(), series, "enhanced", input+".txt")) {
+		t.Fatalf("v1 generation skipped the series settings: %+v", payload)
+	}
+	if enhancementProviderFor(series, input) != "" {
+		t.Fatalf("a finished v1 job left its enhancement provider behind")
+	}
+}
+
+func TestStreamedEnhancementReportsPartials(t *testing.T) {
+	useMockProvider(t)
+
+	var partials []string
+	enhanced, usage, err := GetOpenAIClient().EnhancePromptStreaming(defaultEnhancementSettings(), "a smiling aardvark", "a poet", "empty", "stream-1", func(text string) {
+		partials = append(partials, text)
+	})
+	if err != nil || !strings.HasSuffix(enhanced, "a smiling aardvark") || usage.CompletionTokens == 0 {
+		t.Fatalf("enhance: %q %+v %v", enhanced, usage, err)
+	}
+	if len(partials) < 2 || partials[len(partials)-1] != enhanced || !strings.HasPrefix(partials[1], partials[0]) {
+		t.Fatalf("partials: %q", partials)
+	}
+
+	// Progress reports the text while no library run exists yet
+	series, address := "stream-test", "0xf503017d7baf7fbc0fff7492b751025c6a78179b"
+	streamingEnhancements.Store(series+":"+address, partials[0])
+	ev, ok := sampleProgress(series, address)
+	streamingEnhancements.Delete(series + ":" + address)
+	if !ok || ev.Phase != progress.PhaseEnhance || ev.EnhancedPromptPartial != partials[0] {
+		t.Fatalf("progress event: %+v", ev)
+	}
+}
+
+func TestStalledEnhancementStreamIsCutOff(t *testing.T) {
+	original := enhanceIdleTimeout
+	enhanceIdleTimeout = 50 * time.Millisecond
+	defer func() { enhanceIdleTimeout = original }()
+	t.Setenv("OPENAI_API_KEY", "sk-test")
+	stalled := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = w.Write([]byte("data: {\"choices\":[{\"delta\":{\"content\":\"A vivid \"}}]}\n\n"))
+		_ = http.NewResponseController(w).Flush()
+		<-r.Context().Done()
+	}))
+	defer stalled.Close()
+
+	settings := defaultEnhancementSettings()
+	settings.BaseURL = stalled.URL + "/v1"
+	var partial string
+	start := time.Now()
+	got, _, _ := replayClient(OpenAIProvider{}, 1, 5).EnhancePromptStreaming(settings, "a quiet harbor", "", "s", "stall-1", func(text string) { partial = text })
+	if got != "a quiet harbor" || partial != "A vivid " {
+		t.Fatalf("expected degraded prompt after a partial, got %q (partial %q)", got, partial)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("stalled stream ran %v, past its idle timeout", elapsed)
+	}
+}
@@ -16,17 +16,41 @@ const (
 	ErrorInvalidSeries    = "INVALID_SERIES"
 	ErrorInvalidAddress   = "INVALID_ADDRESS"
 	ErrorMissingParameter = "MISSING_PARAMETER"
+	ErrorUnauthorized     = "UNAUTHORIZED"
+	ErrorForbidden        = "FORBIDDEN"
+	ErrorRequestTooLarge  = "REQUEST_TOO_LARGE"
+
+	// Idempotency conflicts (409)
+	ErrorIdempotencyMismatch = "IDEMPOTENCY_KEY_MISMATCH"
+	ErrorIdempotencyInFlight = "IDEMPOTENCY_KEY_IN_USE"
+
+	// Load shedding and spending budgets (429)
+	ErrorTooManyRequests = "TOO_MANY_REQUESTS"
+	ErrorBudgetExceeded  = "BUDGET_EXCEEDED"
+
+	// Storage quota (507)
+	ErrorQuotaExceeded = "QUOTA_EXCEEDED"
 
 	// Server errors (500-level)
 	ErrorInternalServer    = "INTERNAL_SERVER_ERROR"
 	ErrorFileSystem        = "FILE_SYSTEM_ERROR"
 	ErrorTemplateExecution = "TEMPLATE_ERROR"
+	ErrorJobQueueFull      = "JOB_QUEUE_FULL"
+	ErrorJobNotFound       = "JOB_NOT_FOUND"
+	ErrorJobNotCancellable = "JOB_NOT_CANCELLABLE"
+	ErrorJobCancelled      = "JOB_CANCELLED"
+	ErrorBatchNotFound     = "BATCH_NOT_FOUND"
+	ErrorBatchFinished     = "BATCH_FINISHED"
+	ErrorWebhookNotFound   = "WEBHOOK_NOT_FOUND"
+	ErrorBreakerNotFound   = "BREAKER_NOT_FOUND"
+	ErrorFileNotFound      = "FILE_NOT_FOUND"
 
 	// External service errors (502-504)
-	ErrorOpenAITimeout     = "OPENAI_TIMEOUT"
-	ErrorOpenAIRateLimit   = "OPENAI_RATE_LIMIT"
-	ErrorOpenAIUnavailable = "OPENAI_UNAVAILABLE"
-	ErrorImageDownload     = "IMAGE_DOWNLOAD_ERROR"
+	ErrorOpenAITimeout      = "OPENAI_TIMEOUT"
+	ErrorOpenAIRateLimit    = "OPENAI_RATE_LIMIT"
+	ErrorOpenAIUnavailable  = "OPENAI_UNAVAILABLE"
+	ErrorImageDownload      = "IMAGE_DOWNLOAD_ERROR"
+	ErrorStorageUnavailable = "STORAGE_UNAVAILABLE"
 
 	// Timeout errors (408)
 	ErrorTimeout           = "TIMEOUT_ERROR"
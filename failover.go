@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EnhancementFallback is an OpenAI-compatible chat endpoint tried, in list order, when the
+// primary provider cannot enhance a prompt. Each one has its own circuit breaker and retry
+// settings so a dead fallback does not slow down the others.
+type EnhancementFallback struct {
+	ProviderName string `json:"name"`
+	BaseURL      string `json:"base_url"`
+	// APIKeyEnv names the environment variable holding the bearer token; keys are never
+	// written in the list itself
+	APIKeyEnv string `json:"api_key_env,omitempty"`
+	// Model replaces the enhancement model, since a gateway rarely serves the primary's
+	Model       string `json:"model,omitempty"`
+	MaxAttempts int    `json:"max_attempts,omitempty"`
+	// The fallback's breaker, registered as "chat:<name>"
+	BreakerSettings
+}
+
+// Name labels the fallback in logs, metrics and progress snapshots. A fallback only serves
+// chat completions but satisfies Provider so an OpenAIClient can be built for it.
+func (f *EnhancementFallback) Name() string { return f.ProviderName }
+
+func (f *EnhancementFallback) ChatURL() string {
+	return strings.TrimRight(f.BaseURL, "/") + "/chat/completions"
+}
+
+func (f *EnhancementFallback) ImageURL() string { return "" }
+
+func (f *EnhancementFallback) APIKey() string {
+	if f.APIKeyEnv == "" {
+		return ""
+	}
+	return os.Getenv(f.APIKeyEnv)
+}
+
+// ParseEnhancementFallbacks reads the fallback list from spec, which is either inline JSON
+// (starting with "[") or the path of a JSON file. Entries are checked and given defaults.
+func ParseEnhancementFallbacks(spec string) ([]*EnhancementFallback, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return nil, nil
+	}
+	data := []byte(spec)
+	if !strings.HasPrefix(spec, "[") {
+		var err error
+		if data, err = os.ReadFile(spec); err != nil {
+			return nil, err
+		}
+	}
+	var list []*EnhancementFallback
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("parse enhancement fallbacks: %w", err)
+	}
+	seen := map[string]bool{}
+	for i, f := range list {
+		if f == nil || f.BaseURL == "" {
+			return nil, fmt.Errorf("enhancement fallback %d has no base_url", i+1)
+		}
+		if f.ProviderName == "" {
+			f.ProviderName = fmt.Sprintf("fallback-%d", i+1)
+		}
+		if seen[f.ProviderName] {
+			return nil, fmt.Errorf("enhancement fallback name %q is used twice", f.ProviderName)
+		}
+		seen[f.ProviderName] = true
+		if err := f.BreakerSettings.validate(); err != nil {
+			return nil, fmt.Errorf("enhancement fallback %s: %w", f.ProviderName, err)
+		}
+	}
+	return list, nil
+}
+
+// retryConfig returns the fallback's retry settings: OpenAIRetryConfig with its own attempt count
+func (f *EnhancementFallback) retryConfig() RetryConfig {
+	cfg := OpenAIRetryConfig
+	if f.MaxAttempts > 0 {
+		cfg.MaxAttempts = f.MaxAttempts
+	}
+	return cfg
+}
+
+// circuitBreaker returns a breaker with the fallback's settings, using the primary's
+// defaults for anything unset
+func (f *EnhancementFallback) circuitBreaker() *CircuitBreaker {
+	return NewCircuitBreaker(5, 60*time.Second).WithFaultFilter(IsProviderFault).Configure(defaultBreakerSettings).Configure(f.BreakerSettings)
+}
+
+// apply points enhancement settings at the fallback's endpoint and model
+func (f *EnhancementFallback) apply(s EnhancementSettings) EnhancementSettings {
+	s.BaseURL = f.BaseURL
+	if f.Model != "" {
+		s.Model = f.Model
+	}
+	return s
+}
+
+// String summarises the fallback for the startup report
+func (f *EnhancementFallback) String() string {
+	out := f.ProviderName + " (" + f.ChatURL()
+	if f.Model != "" {
+		out += " model=" + f.Model
+	}
+	return out + ")"
+}
+
+// enhancementFallbacks holds one client per configured fallback. The clients, and so their
+// circuit breakers, outlive provider changes; only the primary client is rebuilt.
+var enhancementFallbacks = struct {
+	sync.RWMutex
+	clients []*OpenAIClient
+}{}
+
+// UseEnhancementFallbacks replaces the ordered fallback list tried after the primary provider,
+// swapping their breakers in the registry
+func UseEnhancementFallbacks(list []*EnhancementFallback) {
+	clients := make([]*OpenAIClient, 0, len(list))
+	for _, f := range list {
+		clients = append(clients, &OpenAIClient{
+			httpClient:     &http.Client{Timeout: enhanceDeadline + 10*time.Second},
+			circuitBreaker: f.circuitBreaker(),
+			retryConfig:    f.retryConfig(),
+			limiter:        NewTokenBucket(0),
+			provider:       f,
+			fallback:       f,
+		})
+	}
+	enhancementFallbacks.Lock()
+	defer enhancementFallbacks.Unlock()
+	for _, old := range enhancementFallbacks.clients {
+		GetBreakerRegistry().Unregister(fallbackBreakerName(old.provider.Name()))
+	}
+	for _, c := range clients {
+		GetBreakerRegistry().Register(fallbackBreakerName(c.provider.Name()), c.circuitBreaker, false)
+	}
+	enhancementFallbacks.clients = clients
+}
+
+// currentFallbacks returns the fallback clients in the order they are tried
+func currentFallbacks() []*OpenAIClient {
+	enhancementFallbacks.RLock()
+	defer enhancementFallbacks.RUnlock()
+	return append([]*OpenAIClient(nil), enhancementFallbacks.clients...)
+}
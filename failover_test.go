@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseEnhancementFallbacks(t *testing.T) {
+	list, err := ParseEnhancementFallbacks(`[{"base_url":"http://a/v1"},{"name":"local","base_url":"http://b/v1/","model":"llama3","reset_timeout":"10s"}]`)
+	if err != nil || len(list) != 2 {
+		t.Fatalf("parse: %v %v", list, err)
+	}
+	if list[0].Name() != "fallback-1" || list[1].ChatURL() != "http://b/v1/chat/completions" {
+		t.Fatalf("defaults: %s, %s", list[0], list[1])
+	}
+	for _, bad := range []string{
+		`[{"name":"x"}]`,
+		`[{"name":"x","base_url":"http://a"},{"name":"x","base_url":"http://b"}]`,
+		`[{"base_url":"http://a","reset_timeout":"soon"}]`,
+	} {
+		if _, err := ParseEnhancementFallbacks(bad); err == nil {
+			t.Fatalf("expected error for %s", bad)
+		}
+	}
+}
+
+func TestEnhancementFailsOverInOrder(t *testing.T) {
+	chatServer := func(hits *int32, ok *atomic.Bool, check func(r *http.Request)) *httptest.Server {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(hits, 1)
+			if check != nil {
+				check(r)
+			}
+			if !ok.Load() {
+				http.Error(w, `{"error":{"message":"down"}}`, http.StatusServiceUnavailable)
+				return
+			}
+			_, _ = w.Write([]byte(`{"model":"llama3","choices":[{"message":{"content":"local enhanced"}}],"usage":{"prompt_tokens":12,"completion_tokens":3}}`))
+		}))
+		t.Cleanup(srv.Close)
+		return srv
+	}
+	var primaryHits, brokenHits, localHits int32
+	var down, localUp atomic.Bool
+	localUp.Store(true)
+	var localModel, localAuth string
+	primary := chatServer(&primaryHits, &down, nil)
+	broken := chatServer(&brokenHits, &down, nil)
+	local := chatServer(&localHits, &localUp, func(r *http.Request) {
+		var body struct {
+			Model string `json:"model"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		localModel, localAuth = body.Model, r.Header.Get("Authorization")
+	})
+
+	t.Setenv("LOCAL_GATEWAY_KEY", "sk-local")
+	fallbacks, err := ParseEnhancementFallbacks(`[
+		{"name":"broken","base_url":"` + broken.URL + `/v1","max_attempts":1,"failure_threshold":1,"reset_timeout":"1h"},
+		{"name":"local","base_url":"` + local.URL + `/v1","api_key_env":"LOCAL_GATEWAY_KEY","model":"llama3","max_attempts":1}
+	]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	UseEnhancementFallbacks(fallbacks)
+	t.Cleanup(func() { UseEnhancementFallbacks(nil) })
+
+	client := NewOpenAIClient(&EnhancementFallback{ProviderName: "primary", BaseURL: primary.URL + "/v1"})
+	client.circuitBreaker = NewCircuitBreaker(5, time.Hour).WithFaultFilter(IsProviderFault)
+	client.retryConfig = RetryConfig{MaxAttempts: 1, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond, BackoffFactor: 1}
+
+	before := GetMetricsCollector().GetMetrics()
+	enhanced, usage, err := client.EnhancePromptWithResilience(defaultEnhancementSettings(), "a plain prompt", "", "s", "fo-1")
+	if err != nil || enhanced != "local enhanced" || usage.Provider != "local" || usage.PromptTokens != 12 {
+		t.Fatalf("failover: %q %+v %v", enhanced, usage, err)
+	}
+	if localModel != "llama3" || localAuth != "Bearer sk-local" {
+		t.Fatalf("fallback settings not applied: model=%q auth=%q", localModel, localAuth)
+	}
+	after := GetMetricsCollector().GetMetrics()
+	if after.EnhancementsByProvider["local"] != before.EnhancementsByProvider["local"]+1 ||
+		after.EnhancementFailuresByProvider["broken"] != before.EnhancementFailuresByProvider["broken"]+1 {
+		t.Fatalf("provider metrics not recorded: %v %v", after.EnhancementsByProvider, after.EnhancementFailuresByProvider)
+	}
+
+	// The broken fallback's own breaker is now open, so it is skipped without a request
+	if _, usage, _ = client.EnhancePromptWithResilience(defaultEnhancementSettings(), "a plain prompt", "", "s", "fo-2"); usage.Provider != "local" {
+		t.Fatalf("second call served by %q", usage.Provider)
+	}
+	if atomic.LoadInt32(&brokenHits) != 1 || atomic.LoadInt32(&primaryHits) != 2 {
+		t.Fatalf("hits: primary=%d broken=%d", primaryHits, brokenHits)
+	}
+
+	// With every provider failing the original prompt comes back
+	localUp.Store(false)
+	enhanced, usage, err = client.EnhancePromptWithResilience(defaultEnhancementSettings(), "a plain prompt", "", "s", "fo-3")
+	if err != nil || enhanced != "a plain prompt" || usage.Provider != "" {
+		t.Fatalf("degraded: %q %+v %v", enhanced, usage, err)
+	}
+	if got := GetMetricsCollector().GetMetrics().EnhancementsByProvider[enhancementDegraded]; got <= before.EnhancementsByProvider[enhancementDegraded] {
+		t.Fatalf("degraded enhancement not counted")
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"os"
@@ -245,6 +246,53 @@ func (rfo *RobustFileOperations) RemoveFile(filePath, requestID string) error {
 	return RetryWithBackoff(rfo.retryConfig, operation)
 }
 
+// PublishArtifact copies a local file into an artifact store under key with robust error handling
+func (rfo *RobustFileOperations) PublishArtifact(store ArtifactStore, key, localPath, requestID string) error {
+	data, err := rfo.ReadFile(localPath, requestID)
+	if err != nil {
+		return err
+	}
+	return rfo.PutArtifact(store, key, data, requestID)
+}
+
+// PutArtifact writes data into an artifact store under key with robust error handling
+func (rfo *RobustFileOperations) PutArtifact(store ArtifactStore, key string, data []byte, requestID string) error {
+	operation := func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), artifactOpTimeout)
+		defer cancel()
+		if err := store.Put(ctx, key, data, contentTypeFor(key)); err != nil {
+			return &FileSystemError{
+				Operation: store.Name() + "_put",
+				Path:      key,
+				Err:       err,
+				RequestID: requestID,
+			}
+		}
+		return nil
+	}
+
+	return RetryWithBackoff(rfo.retryConfig, operation)
+}
+
+// RemoveArtifact removes key from an artifact store with robust error handling
+func (rfo *RobustFileOperations) RemoveArtifact(store ArtifactStore, key, requestID string) error {
+	operation := func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), artifactOpTimeout)
+		defer cancel()
+		if err := store.Delete(ctx, key); err != nil {
+			return &FileSystemError{
+				Operation: store.Name() + "_delete",
+				Path:      key,
+				Err:       err,
+				RequestID: requestID,
+			}
+		}
+		return nil
+	}
+
+	return RetryWithBackoff(rfo.retryConfig, operation)
+}
+
 // CheckDiskSpace checks available disk space for a given path
 func (rfo *RobustFileOperations) CheckDiskSpace(path, requestID string) (*DiskSpaceInfo, error) {
 	var stat syscall.Statfs_t
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	dalle "github.com/TrueBlocks/trueblocks-dalle/v6"
+	"github.com/TrueBlocks/trueblocks-dalle/v6/pkg/progress"
+	"github.com/TrueBlocks/trueblocks-dalle/v6/pkg/storage"
+)
+
+// inflightGenerations tracks library calls per (series, address). A cancelled job stops
+// before its image request when it can. Once the library call has started it cannot be
+// interrupted and keeps its generation lock until it returns, so the lock is never released
+// early: the job keeps its key and is reported cancelled only after the call has unwound.
+var inflightGenerations = struct {
+	sync.Mutex
+	items map[string]struct{}
+}{items: map[string]struct{}{}}
+
+// runDalleJob runs the library generation for a /dalle/ job. Cancellation is honoured up
+// to the image request; after that the call runs to the end and its output is discarded.
+func (a *App) runDalleJob(ctx context.Context, job *Job) (interface{}, error) {
+	if ctx.Err() != nil {
+		return nil, errJobCancelled
+	}
+	key := job.Series + ":" + job.Address
+	inflightGenerations.Lock()
+	inflightGenerations.items[key] = struct{}{}
+	inflightGenerations.Unlock()
+	defer func() {
+		// Runs after the manifest has recorded the enhancement provider
+		forgetEnhancement(job.Series, job.Address)
+		inflightGenerations.Lock()
+		delete(inflightGenerations.items, key)
+		inflightGenerations.Unlock()
+	}()
+
+	start := time.Now()
+	skip := a.Config.SkipImage || os.Getenv("TB_DALLE_SKIP_IMAGE") == "1"
+	imageURL := CurrentProvider().ImageURL()
+	annotated := fileExists(filepath.Join(storage.OutputDir(), job.Series, "annotated", job.Address+".png"))
+	if !skip {
+		a.preEnhance(ctx, job)
+	}
+	if ctx.Err() != nil {
+		// Nothing has been billed for the image yet
+		a.discardCancelled(job, start, !annotated)
+		return nil, errJobCancelled
+	}
+	if !skip && !annotated {
+		// Jobs admitted just before the budget ran out stop here instead of overspending it
+		if budgetErr := a.checkBudget(); budgetErr != nil {
+			GetMetricsCollector().RecordBudgetRejection("jobs", job.RequestID)
+			a.discardGeneration(job, start, true, budgetErr)
+			return nil, budgetErr
+		}
+	}
+
+	var path string
+	var err error
+	if skip || annotated {
+		path, err = generateAnnotatedImage(job.Series, job.Address, skip, a.Config.LockTTL, imageURL)
+	} else {
+		path, err = generateThroughBreakers(job.Series, job.Address, a.Config.LockTTL, imageURL)
+	}
+	if err == nil && !skip && !annotated {
+		// The provider bills the image even when the job was cancelled meanwhile
+		a.recordImage(job, job.Series, filepath.Join(storage.OutputDir(), job.Series, "generated", job.Address+".png"))
+	}
+	if ctx.Err() != nil {
+		a.discardCancelled(job, start, !annotated)
+		return nil, errJobCancelled
+	}
+	if err != nil {
+		logInfo(fmt.Sprintf("[%s] error generating image:", job.RequestID), err)
+		GetMetricsCollector().RecordError("GENERATION_ERROR", "/dalle/", job.RequestID)
+		return nil, err
+	}
+
+	// The image exists on disk either way; a failed upload only hides it from other replicas
+	if pubErr := publishArtifacts(job.Series, job.Address, job.RequestID); pubErr != nil {
+		logError(fmt.Sprintf("[%s] unable to publish %s/%s to %s storage: %v", job.RequestID, job.Series, job.Address, CurrentStore().Name(), pubErr))
+	}
+	// A manifest describes a generation, so images that were already there get none
+	if !skip && !annotated {
+		if _, mErr := recordManifest(job, start, time.Now()); mErr != nil {
+			logError(fmt.Sprintf("[%s] unable to record the manifest of %s/%s: %v", job.RequestID, job.Series, job.Address, mErr))
+		}
+	}
+	if fileExists(path) {
+		logInfo(fmt.Sprintf("[%s] generated image for %s/%s in %s", job.RequestID, job.Series, job.Address, time.Since(start)))
+	} else {
+		logInfo(fmt.Sprintf("[%s] generation in progress (lock contention) for %s/%s elapsed %s", job.RequestID, job.Series, job.Address, time.Since(start)))
+	}
+	return map[string]string{"path": path}, nil
+}
+
+// discardCancelled ends a cancelled run's progress snapshot and, when the run was making a
+// new image, removes whatever it produced. An image that was already there is kept.
+func (a *App) discardCancelled(job *Job, start time.Time, clean bool) {
+	a.discardGeneration(job, start, clean, errJobCancelled)
+}
+
+// discardGeneration unwinds a generation stopped before it finished, failing its progress
+// report with reason
+func (a *App) discardGeneration(job *Job, start time.Time, clean bool, reason error) {
+	if clean {
+		dalle.Clean(job.Series, job.Address)
+	}
+	progress.GetProgressManager().Fail(job.Series, job.Address, reason)
+	logInfo(fmt.Sprintf("[%s] generation of %s/%s unwound after %s: %v", job.RequestID, job.Series, job.Address, time.Since(start), reason))
+}
+
+// generateThroughBreakers runs a library generation behind the image generation and image
+// download breakers. The library makes both calls itself, so a failure is charged to the
+// breaker of the call that failed and the other one is released without an outcome.
+func generateThroughBreakers(series, address string, lockTTL time.Duration, imageURL string) (string, error) {
+	images := GetBreakerRegistry().Get(BreakerImages)
+	downloads := GetBreakerRegistry().Get(BreakerImageDownload)
+	imagesDone, err := images.Allow()
+	if err != nil {
+		return "", fmt.Errorf("image generation: %w", err)
+	}
+	downloadsDone, err := downloads.Allow()
+	if err != nil {
+		imagesDone(errNotAttempted)
+		return "", fmt.Errorf("image download: %w", err)
+	}
+	path, err := generateAnnotatedImage(series, address, false, lockTTL, imageURL)
+	switch {
+	case err == nil:
+		imagesDone(nil)
+		downloadsDone(nil)
+	case isDownloadError(err, imageURL):
+		imagesDone(nil)
+		downloadsDone(err)
+	default:
+		imagesDone(err)
+		downloadsDone(errNotAttempted)
+	}
+	return path, err
+}
+
+// cancelJob cancels a job. A queued /dalle/ job has its progress snapshot marked cancelled
+// here; a running one does that itself once its library call has unwound.
+func (a *App) cancelJob(id, endpoint, requestID string) (*Job, error) {
+	job, err := a.Jobs.Cancel(id)
+	if err != nil {
+		return job, err
+	}
+	if job.Kind == JobKindDalle && job.State == JobCancelled {
+		progress.GetProgressManager().Fail(job.Series, job.Address, errJobCancelled)
+	}
+	GetMetricsCollector().RecordCancellation(endpoint, requestID)
+	logInfo(fmt.Sprintf("[%s] cancelled job %s (%s)", requestID, job.ID, job.Kind))
+	return job, nil
+}
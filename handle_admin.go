@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+
+	dalle "github.com/TrueBlocks/trueblocks-dalle/v6"
+)
+
+// authorizeAdmin checks the bearer token against TB_DALLE_ADMIN_TOKEN, writing a 401 and
+// returning false when it is missing or wrong. Without a configured token the admin API is
+// disabled and every request gets a 403.
+func (a *App) authorizeAdmin(w http.ResponseWriter, r *http.Request, requestID string) bool {
+	if a.Config.AdminToken == "" {
+		WriteErrorResponse(w, NewAPIError(ErrorForbidden, "Admin API disabled", "set TB_DALLE_ADMIN_TOKEN to enable /v1/admin/ endpoints").WithRequestID(requestID), http.StatusForbidden)
+		return false
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(a.Config.AdminToken)) == 1 {
+		return true
+	}
+	w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+	WriteErrorResponse(w, NewAPIError(ErrorUnauthorized, "Admin token required", "send Authorization: Bearer <TB_DALLE_ADMIN_TOKEN>").WithRequestID(requestID), http.StatusUnauthorized)
+	return false
+}
+
+// handleV1AdminBreakers lists every registered circuit breaker
+func (a *App) handleV1AdminBreakers(w http.ResponseWriter, r *http.Request) {
+	requestID := GenerateRequestID()
+	if r.Method != http.MethodGet {
+		writeV1Error(w, requestID, http.StatusMethodNotAllowed, dalle.ErrInvalidInput, "method not allowed")
+		return
+	}
+	if !a.authorizeAdmin(w, r, requestID) {
+		return
+	}
+	WriteSuccessResponse(w, GetBreakerRegistry().Snapshot(), requestID)
+}
+
+// handleV1AdminBreaker serves GET /v1/admin/breakers/<name> and
+// POST /v1/admin/breakers/<name>/{open,close,reset}
+func (a *App) handleV1AdminBreaker(w http.ResponseWriter, r *http.Request) {
+	requestID := GenerateRequestID()
+	if !a.authorizeAdmin(w, r, requestID) {
+		return
+	}
+	name, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/v1/admin/breakers/"), "/")
+	breaker := GetBreakerRegistry().Get(name)
+	if breaker == nil {
+		WriteErrorResponse(w, NewAPIError(ErrorBreakerNotFound, "Circuit breaker not found", name).WithRequestID(requestID), http.StatusNotFound)
+		return
+	}
+	want := http.MethodPost
+	if action == "" {
+		want = http.MethodGet
+	}
+	if r.Method != want {
+		writeV1Error(w, requestID, http.StatusMethodNotAllowed, dalle.ErrInvalidInput, "method not allowed")
+		return
+	}
+	switch action {
+	case "":
+	case "open":
+		breaker.ForceOpen()
+	case "close":
+		breaker.ForceClose()
+	case "reset":
+		breaker.Reset()
+	default:
+		WriteErrorResponse(w, NewAPIError(ErrorInvalidRequest, "Unknown breaker action", "want open, close or reset").WithRequestID(requestID), http.StatusBadRequest)
+		return
+	}
+	if action != "" {
+		logInfo(fmt.Sprintf("[%s] circuit breaker %s: %s by %s", requestID, name, action, getClientIP(r)))
+	}
+	status, _ := GetBreakerRegistry().Status(name)
+	WriteSuccessResponse(w, status, requestID)
+}
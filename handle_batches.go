@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	dalle "github.com/TrueBlocks/trueblocks-dalle/v6"
+)
+
+// batchRequest is the JSON body of POST /v1/batches. Items are the cross product of
+// Series and Addresses plus any explicit Items.
+type batchRequest struct {
+	Series     []string    `json:"series"`
+	Addresses  []string    `json:"addresses"`
+	Items      []BatchItem `json:"items"`
+	Regenerate bool        `json:"regenerate"`
+	Priority   string      `json:"priority"`
+}
+
+// maxBatchBodyBytes bounds the size of a batch upload
+const maxBatchBodyBytes = 8 << 20
+
+func (a *App) handleV1Batches(w http.ResponseWriter, r *http.Request) {
+	requestID := GenerateRequestID()
+	switch r.Method {
+	case http.MethodGet:
+		WriteSuccessResponse(w, a.Batches.List(), requestID)
+	case http.MethodPost:
+		items, opts, apiErr := a.parseBatchRequest(r)
+		if apiErr != nil {
+			WriteErrorResponse(w, apiErr.WithRequestID(requestID), http.StatusBadRequest)
+			return
+		}
+		batch, err := a.Batches.Create(items, opts, requestID)
+		if err != nil {
+			WriteErrorResponse(w, NewAPIError(ErrorFileSystem, "Unable to record batch", err.Error()).WithRequestID(requestID), http.StatusInternalServerError)
+			return
+		}
+		logInfo(fmt.Sprintf("[%s] created %s batch %s with %d items", requestID, opts.Priority, batch.ID, len(items)))
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Location", "/v1/batches/"+batch.ID)
+		w.WriteHeader(http.StatusAccepted)
+		WriteSuccessResponse(w, batch, requestID)
+	default:
+		writeV1Error(w, requestID, http.StatusMethodNotAllowed, dalle.ErrInvalidInput, "method not allowed")
+	}
+}
+
+func (a *App) handleV1Batch(w http.ResponseWriter, r *http.Request) {
+	requestID := GenerateRequestID()
+	id := strings.TrimPrefix(r.URL.Path, "/v1/batches/")
+	if a.Batches.Get(id) == nil {
+		WriteErrorResponse(w, NewAPIError(ErrorBatchNotFound, "Batch not found", id).WithRequestID(requestID), http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		WriteSuccessResponse(w, a.Batches.Get(id), requestID)
+	case http.MethodDelete:
+		batch, err := a.Batches.Cancel(id, func(jobID string) {
+			_, _ = a.cancelJob(jobID, "/v1/batches/", requestID)
+		})
+		if err != nil {
+			WriteErrorResponse(w, NewAPIError(ErrorBatchFinished, "Batch already finished", err.Error()).WithRequestID(requestID), http.StatusConflict)
+			return
+		}
+		logInfo(fmt.Sprintf("[%s] cancelled batch %s", requestID, id))
+		WriteSuccessResponse(w, batch, requestID)
+	default:
+		writeV1Error(w, requestID, http.StatusMethodNotAllowed, dalle.ErrInvalidInput, "method not allowed")
+	}
+}
+
+// parseBatchRequest reads either a JSON batch request or a JSONL upload of
+// {"series":...,"address":...} lines, validating and de-duplicating the items
+func (a *App) parseBatchRequest(r *http.Request) ([]BatchItem, BatchOptions, *APIError) {
+	var opts BatchOptions
+	body := io.LimitReader(r.Body, maxBatchBodyBytes)
+	var req batchRequest
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/x-ndjson", "application/jsonl", "application/x-jsonlines":
+		req.Regenerate = r.URL.Query().Get("regenerate") == "1"
+		req.Priority = r.URL.Query().Get("priority")
+		scanner := bufio.NewScanner(body)
+		line := 0
+		for scanner.Scan() {
+			line++
+			text := strings.TrimSpace(scanner.Text())
+			if text == "" {
+				continue
+			}
+			var item BatchItem
+			if err := json.Unmarshal([]byte(text), &item); err != nil {
+				return nil, opts, NewAPIError(ErrorInvalidRequest, "Invalid JSONL upload", fmt.Sprintf("line %d: %v", line, err))
+			}
+			req.Items = append(req.Items, item)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, opts, NewAPIError(ErrorInvalidRequest, "Invalid JSONL upload", err.Error())
+		}
+	default:
+		if err := json.NewDecoder(body).Decode(&req); err != nil {
+			return nil, opts, NewAPIError(ErrorInvalidRequest, "Invalid JSON request", err.Error())
+		}
+	}
+
+	// Checked before the cross product is built, so a small body cannot ask for a huge list
+	if tooManyBatchItems(len(req.Series), len(req.Addresses), len(req.Items)) {
+		return nil, opts, NewAPIError(ErrorInvalidRequest, "Batch too large", fmt.Sprintf("%d series x %d addresses plus %d items exceeds the limit of %d", len(req.Series), len(req.Addresses), len(req.Items), maxBatchItems))
+	}
+	candidates := make([]BatchItem, 0, len(req.Series)*len(req.Addresses)+len(req.Items))
+	for _, series := range req.Series {
+		for _, address := range req.Addresses {
+			candidates = append(candidates, BatchItem{Series: series, Address: address})
+		}
+	}
+	candidates = append(candidates, req.Items...)
+
+	seen := make(map[string]bool, len(candidates))
+	items := make([]BatchItem, 0, len(candidates))
+	for _, c := range candidates {
+		series := strings.ToLower(strings.TrimSpace(c.Series))
+		address := strings.ToLower(strings.TrimSpace(c.Address))
+		if apiErr := a.validateSeriesAddress(series, address); apiErr != nil {
+			return nil, opts, apiErr
+		}
+		if key := series + ":" + address; !seen[key] {
+			seen[key] = true
+			items = append(items, BatchItem{Series: series, Address: address})
+		}
+	}
+	if len(items) == 0 {
+		return nil, opts, NewAPIError(ErrorInvalidRequest, "Empty batch", "Provide series and addresses, items, or a JSONL upload")
+	}
+	priority, apiErr := a.requestPriority(r, req.Priority, PriorityBatch)
+	if apiErr != nil {
+		return nil, opts, apiErr
+	}
+	opts = BatchOptions{Regenerate: req.Regenerate, Priority: priority, Client: requestClient(r)}
+	return items, opts, nil
+}
+
+// tooManyBatchItems reports whether series x addresses + items exceeds maxBatchItems,
+// without overflowing on large counts
+func tooManyBatchItems(series, addresses, items int) bool {
+	if items > maxBatchItems {
+		return true
+	}
+	return addresses > 0 && series > (maxBatchItems-items)/addresses
+}
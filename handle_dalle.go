@@ -1,13 +1,14 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
 	"path/filepath"
-	"time"
 
 	dalle "github.com/TrueBlocks/trueblocks-dalle/v6"
 	"github.com/TrueBlocks/trueblocks-dalle/v6/pkg/progress"
@@ -17,7 +18,7 @@ import (
 var isDebugging = false
 
 // indirection for easier test injection of failures
-var generateAnnotatedImage = dalle.GenerateAnnotatedImage
+var generateAnnotatedImage = dalle.GenerateAnnotatedImageWithBaseURL
 
 func (a *App) handleDalleDress(w http.ResponseWriter, r *http.Request) {
 	logInfo(fmt.Sprintf("Received request: %s %s", r.Method, r.URL.Path))
@@ -26,14 +27,58 @@ func (a *App) handleDalleDress(w http.ResponseWriter, r *http.Request) {
 		WriteErrorResponse(w, apiErr, http.StatusBadRequest)
 		return
 	}
+	if r.Method == http.MethodDelete {
+		req.Cancel(w)
+		return
+	}
 	req.Respond(w, r)
 }
 
+// Cancel stops the active generation for the request's series and address
+func (req *Request) Cancel(w http.ResponseWriter) {
+	active := req.app.Jobs.ActiveFor(req.series, req.address)
+	if active == nil {
+		WriteErrorResponse(w, NewAPIError(
+			ErrorJobNotFound,
+			"No active generation",
+			fmt.Sprintf("Nothing is queued or running for %s/%s", req.series, req.address),
+		).WithRequestID(req.requestID), http.StatusNotFound)
+		return
+	}
+	job, err := req.app.cancelJob(active.ID, "/dalle/", req.requestID)
+	if err != nil {
+		WriteErrorResponse(w, NewAPIError(ErrorJobNotCancellable, "Generation already finished", err.Error()).WithRequestID(req.requestID), http.StatusConflict)
+		return
+	}
+	WriteSuccessResponse(w, job, req.requestID)
+}
+
+// dalleProgress is the library's progress report plus what only the server knows about the run
+type dalleProgress struct {
+	*progress.ProgressReport
+	// EnhancementProvider names the provider that enhanced the prompt ("none" when it fell
+	// back to the original prompt)
+	EnhancementProvider string `json:"enhancementProvider,omitempty"`
+	// EnhancedPromptPartial is the enhanced prompt streamed so far, while the provider is
+	// still writing it
+	EnhancedPromptPartial string `json:"enhancedPromptPartial,omitempty"`
+	// BlobURL is the immutable URL of the finished image
+	BlobURL string `json:"blobUrl,omitempty"`
+}
+
 func (req *Request) Respond(w io.Writer, r *http.Request) {
+	ctx := context.Background()
+	if r != nil {
+		ctx = r.Context()
+	}
 	filePath := filepath.Join(storage.OutputDir(), req.series, "annotated", req.address+".png")
-	exists := fileExists(filePath)
+	key := artifactKey(req.series, "annotated", req.address+".png")
+	// Another replica may have generated the image into a shared store
+	stored := artifactExists(ctx, key)
+	exists := stored || fileExists(filePath)
 	if exists && req.remove {
 		_ = os.Remove(filePath)
+		removeArtifacts(req.requestID, key)
 		if _, err := fmt.Fprintln(w, "image removed", filePath); err != nil {
 			// Log error or handle as appropriate for your application
 			_ = err
@@ -42,11 +87,28 @@ func (req *Request) Respond(w io.Writer, r *http.Request) {
 	}
 
 	if req.generate {
+		// Check the budget before discarding an image that could not be replaced
+		if err := req.app.checkBudget(); err != nil {
+			if rw, ok := w.(http.ResponseWriter); ok {
+				writeBudgetExceeded(rw, err, "/dalle/", req.requestID)
+				return
+			}
+		}
+		if err := req.app.checkQuota(); err != nil {
+			if rw, ok := w.(http.ResponseWriter); ok {
+				writeQuotaExceeded(rw, err, "/dalle/", req.requestID)
+				return
+			}
+		}
 		dalle.Clean(req.series, req.address)
+		removeArtifacts(req.requestID, artifactPaths(req.series, req.address)...)
 	} else if exists {
 		if rw, ok := w.(http.ResponseWriter); ok {
-			filePath := filepath.Join(storage.OutputDir(), req.series, "annotated", req.address+".png")
-			http.ServeFile(rw, r, filePath)
+			if stored {
+				serveArtifact(rw, r, key)
+			} else {
+				serveArtifactFrom(rw, r, NewLocalStore(storage.OutputDir()), key, mutableCacheControl)
+			}
 			return
 		}
 	}
@@ -56,33 +118,61 @@ func (req *Request) Respond(w io.Writer, r *http.Request) {
 	}
 
 	pr := progress.GetProgress(req.series, req.address)
-	if !isDebugging {
-		if pr != nil && !pr.Done && !req.generate {
-			logInfo(fmt.Sprintf("[%s] generation already active; not spawning duplicate goroutine", req.requestID))
+	if pr != nil && !pr.Done && !req.generate {
+		logInfo(fmt.Sprintf("[%s] generation already active; not queueing duplicate job", req.requestID))
+	} else {
+		job := NewJob(JobKindDalle, req.requestID)
+		job.Series = req.series
+		job.Address = req.address
+		job.Priority = req.priority
+		job.Client = req.client
+		if req.callback != "" {
+			job.Callbacks = []string{req.callback}
+		}
+		var budgetErr *BudgetError
+		var quotaErr *QuotaError
+		if isDebugging {
+			job = req.app.Jobs.RunInline(job)
+		} else if queued, err := req.app.Jobs.Enqueue(job); errors.Is(err, errQueueFull) {
+			if rw, ok := w.(http.ResponseWriter); ok {
+				req.app.writeLoadShed(rw, "/dalle/", req.requestID)
+				return
+			}
+			job = nil
+		} else if errors.As(err, &budgetErr) {
+			if rw, ok := w.(http.ResponseWriter); ok {
+				writeBudgetExceeded(rw, budgetErr, "/dalle/", req.requestID)
+				return
+			}
+			job = nil
+		} else if errors.As(err, &quotaErr) {
+			if rw, ok := w.(http.ResponseWriter); ok {
+				writeQuotaExceeded(rw, quotaErr, "/dalle/", req.requestID)
+				return
+			}
+			job = nil
+		} else if err != nil {
+			logError(fmt.Sprintf("[%s] unable to queue generation job: %v", req.requestID, err))
+			job = nil
 		} else {
-			logInfo(fmt.Sprintf("[%s] starting generation goroutine (if lock acquired)", req.requestID))
-			go func(series, addr, requestID string) {
-				start := time.Now()
-
-				if path, err := generateAnnotatedImage(series, addr, req.app.Config.SkipImage || os.Getenv("TB_DALLE_SKIP_IMAGE") == "1", req.app.Config.LockTTL); err != nil {
-					logInfo(fmt.Sprintf("[%s] error generating image:", requestID), err)
-					GetMetricsCollector().RecordError("GENERATION_ERROR", "/dalle/", requestID)
-				} else {
-					if fileExists(path) {
-						logInfo(fmt.Sprintf("[%s] generated image for %s/%s in %s", requestID, series, addr, time.Since(start)))
-					} else {
-						logInfo(fmt.Sprintf("[%s] generation in progress (lock contention) for %s/%s elapsed %s", requestID, series, addr, time.Since(start)))
-					}
-				}
-			}(req.series, req.address, req.requestID)
+			if queued.ID != job.ID {
+				logInfo(fmt.Sprintf("[%s] generation job %s already queued for %s/%s", req.requestID, queued.ID, req.series, req.address))
+			} else {
+				logInfo(fmt.Sprintf("[%s] queued generation job %s", req.requestID, queued.ID))
+			}
+			job = queued
 		}
-	} else {
-		if _, err := generateAnnotatedImage(req.series, req.address, req.app.Config.SkipImage || os.Getenv("TB_DALLE_SKIP_IMAGE") == "1", req.app.Config.LockTTL); err != nil {
-			logInfo(fmt.Sprintf("[%s] error generating image:", req.requestID), err)
-			GetMetricsCollector().RecordError("GENERATION_ERROR", "/dalle/", req.requestID)
+		if rw, ok := w.(http.ResponseWriter); ok && job != nil {
+			rw.Header().Set("X-Job-ID", job.ID)
 		}
 	}
 
+	if pr == nil {
+		// The library's run starts after enhancement, so a prompt being streamed is reported on its own
+		if partial := partialEnhancementFor(req.series, req.address); partial != "" {
+			pr = &progress.ProgressReport{Current: progress.PhaseEnhance}
+		}
+	}
 	if pr == nil {
 		// Return empty progress with request ID
 		if rw, ok := w.(http.ResponseWriter); ok {
@@ -96,13 +186,22 @@ func (req *Request) Respond(w io.Writer, r *http.Request) {
 		return
 	}
 
+	snapshot := dalleProgress{
+		ProgressReport:        pr,
+		EnhancementProvider:   enhancementProviderFor(req.series, req.address),
+		EnhancedPromptPartial: partialEnhancementFor(req.series, req.address),
+	}
+	if pr.Done && pr.Error == "" {
+		snapshot.EnhancementProvider = finishedEnhancementProvider(req.series, req.address)
+		snapshot.BlobURL = annotatedBlobURL(req.series, req.address)
+	}
 	// Add request ID to progress response
 	if rw, ok := w.(http.ResponseWriter); ok {
-		WriteSuccessResponse(rw, pr, req.requestID)
+		WriteSuccessResponse(rw, snapshot, req.requestID)
 	} else {
 		// Fallback for non-HTTP writers (tests)
 		enc := json.NewEncoder(w)
 		enc.SetIndent("", "  ")
-		_ = enc.Encode(pr)
+		_ = enc.Encode(snapshot)
 	}
 }
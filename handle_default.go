@@ -19,6 +19,34 @@ func (a *App) handleDefault(w http.ResponseWriter, r *http.Request) {
 		logError("Failed to write response:", err)
 		return
 	}
+	if _, err := fmt.Fprintln(w, "  /v1/dress/<series>/<address>?[all_series=1] - derived DalleDress without calling a provider"); err != nil {
+		logError("Failed to write response:", err)
+		return
+	}
+	if _, err := fmt.Fprintln(w, "  /v1/batches[/<id>] - generate many series/address pairs in one call"); err != nil {
+		logError("Failed to write response:", err)
+		return
+	}
+	if _, err := fmt.Fprintln(w, "  /v1/webhooks[/deliveries] - webhook subscriptions and delivery log"); err != nil {
+		logError("Failed to write response:", err)
+		return
+	}
+	if _, err := fmt.Fprintln(w, "  /v1/progress/<series>/<address>/events - stream generation progress (SSE)"); err != nil {
+		logError("Failed to write response:", err)
+		return
+	}
+	if _, err := fmt.Fprintln(w, "  /v1/ws - WebSocket for multiplexed progress subscriptions"); err != nil {
+		logError("Failed to write response:", err)
+		return
+	}
+	if _, err := fmt.Fprintln(w, "  /v1/usage?[date=YYYY-MM-DD][&month=YYYY-MM] - provider spend and remaining budgets"); err != nil {
+		logError("Failed to write response:", err)
+		return
+	}
+	if _, err := fmt.Fprintln(w, "  /v1/admin/breakers[/<name>[/open|close|reset]] - view and override circuit breakers"); err != nil {
+		logError("Failed to write response:", err)
+		return
+	}
 	if _, err := fmt.Fprintln(w, "  /preview - HTML gallery of generated annotated images"); err != nil {
 		logError("Failed to write response:", err)
 		return
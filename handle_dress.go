@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	dalle "github.com/TrueBlocks/trueblocks-dalle/v6"
+)
+
+// handleV1Dress serves GET /v1/dress/<series>/<address>, or /v1/dress/<address>?all_series=1
+// for every series, computing each DalleDress locally without calling a provider
+func (a *App) handleV1Dress(w http.ResponseWriter, r *http.Request) {
+	requestID := GenerateRequestID()
+	if r.Method != http.MethodGet {
+		writeV1Error(w, requestID, http.StatusMethodNotAllowed, dalle.ErrInvalidInput, "method not allowed")
+		return
+	}
+	path := strings.ToLower(strings.Trim(strings.TrimPrefix(r.URL.Path, "/v1/dress/"), "/"))
+	segments := strings.Split(path, "/")
+
+	if r.URL.Query().Get("all_series") == "1" {
+		address := segments[len(segments)-1]
+		if len(segments) > 2 || !isValidLegacyID(address) {
+			WriteErrorResponse(w, ErrorInvalidAddressFormat(address).WithRequestID(requestID), http.StatusBadRequest)
+			return
+		}
+		previews := make([]*DressPreview, 0, len(a.ValidSeries))
+		for _, series := range a.ValidSeries {
+			preview, err := a.Dresses.Build(series, address)
+			if err != nil {
+				WriteErrorResponse(w, NewAPIError(ErrorInternalServer, "Unable to build DalleDress", err.Error()).WithRequestID(requestID), http.StatusInternalServerError)
+				return
+			}
+			previews = append(previews, preview)
+		}
+		WriteSuccessResponse(w, previews, requestID)
+		return
+	}
+
+	if len(segments) != 2 {
+		WriteErrorResponse(w, NewAPIError(
+			ErrorInvalidRequest,
+			"Invalid request path",
+			"Expected /v1/dress/{series}/{address} or /v1/dress/{address}?all_series=1",
+		).WithRequestID(requestID), http.StatusBadRequest)
+		return
+	}
+	series, address := segments[0], segments[1]
+	if apiErr := a.validateSeriesAddress(series, address); apiErr != nil {
+		WriteErrorResponse(w, apiErr.WithRequestID(requestID), http.StatusBadRequest)
+		return
+	}
+	preview, err := a.Dresses.Build(series, address)
+	if err != nil {
+		WriteErrorResponse(w, NewAPIError(ErrorInternalServer, "Unable to build DalleDress", err.Error()).WithRequestID(requestID), http.StatusInternalServerError)
+		return
+	}
+	WriteSuccessResponse(w, preview, requestID)
+}
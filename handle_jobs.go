@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	dalle "github.com/TrueBlocks/trueblocks-dalle/v6"
+)
+
+func (a *App) handleV1Jobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeV1Error(w, GenerateRequestID(), http.StatusMethodNotAllowed, dalle.ErrInvalidInput, "method not allowed")
+		return
+	}
+	requestID := GenerateRequestID()
+	WriteSuccessResponse(w, a.Jobs.List(JobState(r.URL.Query().Get("state"))), requestID)
+}
+
+func (a *App) handleV1Job(w http.ResponseWriter, r *http.Request) {
+	requestID := GenerateRequestID()
+	if r.Method != http.MethodGet {
+		writeV1Error(w, requestID, http.StatusMethodNotAllowed, dalle.ErrInvalidInput, "method not allowed")
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/v1/jobs/")
+	if id == "queues" {
+		WriteSuccessResponse(w, a.Jobs.Queues(), requestID)
+		return
+	}
+	job := a.Jobs.Get(id)
+	if job == nil {
+		WriteErrorResponse(w, NewAPIError(ErrorJobNotFound, "Job not found", id).WithRequestID(requestID), http.StatusNotFound)
+		return
+	}
+	WriteSuccessResponse(w, job, requestID)
+}
+
+// writeJobAccepted reports a job that has not finished yet
+func writeJobAccepted(w http.ResponseWriter, job *Job, requestID string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/v1/jobs/"+job.ID)
+	w.WriteHeader(http.StatusAccepted)
+	WriteSuccessResponse(w, job, requestID)
+}
+
+// writeJobResult reports a finished generate job the same way a direct engine call would
+func writeJobResult(w http.ResponseWriter, job *Job, requestID string) {
+	switch job.State {
+	case JobSucceeded:
+		WriteSuccessResponse(w, job.Result, requestID)
+	case JobFailed:
+		code := dalle.ErrorCode(job.ErrorCode)
+		writeV1Error(w, requestID, v1StatusForCode(code), code, job.Error)
+	case JobCancelled:
+		WriteErrorResponse(w, NewAPIError(ErrorJobCancelled, "Generation cancelled", job.ID).WithRequestID(requestID), http.StatusConflict)
+	default:
+		writeJobAccepted(w, job, requestID)
+	}
+}
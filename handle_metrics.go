@@ -8,6 +8,7 @@ import (
 // Metrics handler
 func (app *App) handleMetrics(w http.ResponseWriter, r *http.Request) {
 	requestID := GenerateRequestID()
+	GetMetricsCollector().UpdateBreakerMetrics(GetBreakerRegistry().Snapshot())
 
 	if r.URL.Query().Get("format") == "json" {
 		// Return JSON format
@@ -3,20 +3,19 @@ package main
 import (
 	"html/template"
 	"net/http"
-	"os"
-	"path/filepath"
 	"sort"
-	"strings"
 	"time"
-
-	"github.com/TrueBlocks/trueblocks-dalle/v6/pkg/storage"
 )
 
+// previewThumbWidth is the width gallery thumbnails are rendered at, sharp at the default
+// four columns
+const previewThumbWidth = 512
+
 // imageMeta holds minimal data for gallery rendering.
 type imageMeta struct {
 	Series  string
 	Address string
-	Path    string // relative path for <img src>
+	Path    string // artifact key, linked at full size under /files/
 	ModTime time.Time
 }
 
@@ -102,7 +101,7 @@ document.addEventListener('DOMContentLoaded', initializeGridControl);
         {{range $list}}
 						<figure>
 							<div class="figure-img-wrapper">
-								<img loading="lazy" src="/files/{{.Path}}" alt="{{.Series}} {{.Address}}" />
+								<a href="/files/{{.Path}}"><img loading="lazy" src="/v1/images/{{.Series}}:{{.Address}}/render?w={{$.ThumbWidth}}&amp;format=webp" alt="{{.Series}} {{.Address}}" /></a>
 							</div>
 							<figcaption>{{.Address}}<br/><span style="color:#666">{{.ModTime.Format "2006-01-02 15:04:05"}}</span></figcaption>
 						</figure>
@@ -120,36 +119,18 @@ document.addEventListener('DOMContentLoaded', initializeGridControl);
 </body></html>`))
 
 func (a *App) handlePreview(w http.ResponseWriter, r *http.Request) {
-	root := storage.OutputDir()
 	var images []imageMeta
-	_ = filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
-		if err != nil {
-			return nil
-		}
-		if d.IsDir() {
-			return nil
-		}
-		if !strings.HasSuffix(path, ".png") {
-			return nil
-		}
-		if !strings.Contains(path, string(filepath.Separator)+"annotated"+string(filepath.Separator)) {
-			return nil
-		}
-		rel, _ := filepath.Rel(root, path)
-		parts := strings.Split(rel, string(filepath.Separator))
-		if len(parts) < 3 {
-			return nil
-		}
-		series := parts[0]
-		addressFile := parts[len(parts)-1]
-		address := strings.TrimSuffix(addressFile, filepath.Ext(addressFile))
-		info, statErr := os.Stat(path)
-		if statErr != nil {
-			return nil
+	artifacts, err := CurrentStore().List(r.Context(), "")
+	if err != nil {
+		logError("preview: unable to list artifacts: " + err.Error())
+	}
+	for _, artifact := range artifacts {
+		series, address, ok := annotatedKey(artifact.Key)
+		if !ok {
+			continue
 		}
-		images = append(images, imageMeta{Series: series, Address: address, Path: rel, ModTime: info.ModTime()})
-		return nil
-	})
+		images = append(images, imageMeta{Series: series, Address: address, Path: artifact.Key, ModTime: artifact.ModTime})
+	}
 	bySeries := map[string][]imageMeta{}
 	for _, im := range images {
 		bySeries[im.Series] = append(bySeries[im.Series], im)
@@ -165,11 +146,12 @@ func (a *App) handlePreview(w http.ResponseWriter, r *http.Request) {
 	}
 	sort.Strings(keys)
 	data := struct {
-		Images   []imageMeta
-		BySeries map[string][]imageMeta
-		Series   []string
-		Now      time.Time
-	}{Images: images, BySeries: bySeries, Series: keys, Now: time.Now()}
+		Images     []imageMeta
+		BySeries   map[string][]imageMeta
+		Series     []string
+		Now        time.Time
+		ThumbWidth int
+	}{Images: images, BySeries: bySeries, Series: keys, Now: time.Now(), ThumbWidth: previewThumbWidth}
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	if err := previewTpl.Execute(w, data); err != nil {
 		requestID := GenerateRequestID()
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// sseHeartbeatInterval is how often an idle event stream sends a comment line to keep proxies from closing it
+var sseHeartbeatInterval = 15 * time.Second
+
+// handleV1Progress serves GET /v1/progress/<series>/<address>/events as a Server-Sent Events stream
+func (a *App) handleV1Progress(w http.ResponseWriter, r *http.Request) {
+	requestID := GenerateRequestID()
+	if r.Method != http.MethodGet {
+		WriteErrorResponse(w, NewAPIError(ErrorInvalidRequest, "Method not allowed", r.Method).WithRequestID(requestID), http.StatusMethodNotAllowed)
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/v1/progress/")
+	segments := strings.Split(path, "/")
+	if len(segments) != 3 || segments[2] != "events" {
+		WriteErrorResponse(w, NewAPIError(
+			ErrorInvalidRequest,
+			"Invalid request path",
+			fmt.Sprintf("Path '%s' does not match expected format /v1/progress/{series}/{address}/events", r.URL.Path),
+		).WithRequestID(requestID), http.StatusBadRequest)
+		return
+	}
+	series := strings.ToLower(segments[0])
+	address := strings.ToLower(segments[1])
+	if apiErr := a.validateSeriesAddress(series, address); apiErr != nil {
+		WriteErrorResponse(w, apiErr.WithRequestID(requestID), http.StatusBadRequest)
+		return
+	}
+
+	rc := http.NewResponseController(w)
+	// The server's WriteTimeout would otherwise cut long generations off mid-stream
+	_ = rc.SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		logError(fmt.Sprintf("[%s] progress stream not supported by response writer: %v", requestID, err))
+		return
+	}
+
+	events, unsubscribe := GetProgressBroker().Subscribe(series, address)
+	defer unsubscribe()
+
+	collector := GetMetricsCollector()
+	collector.RecordProgressStream(1)
+	defer collector.RecordProgressStream(-1)
+	logInfo(fmt.Sprintf("[%s] progress stream opened for %s/%s", requestID, series, address))
+
+	heartbeat := time.NewTicker(sseHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	seq := 0
+	for {
+		select {
+		case <-r.Context().Done():
+			logInfo(fmt.Sprintf("[%s] progress stream closed by client for %s/%s", requestID, series, address))
+			return
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		case ev, ok := <-events:
+			if !ok {
+				return
+			}
+			seq++
+			if err := writeSSEEvent(w, seq, ev.Type, ev); err != nil {
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+			if ev.IsTerminal() {
+				logInfo(fmt.Sprintf("[%s] progress stream finished for %s/%s (%s)", requestID, series, address, ev.Type))
+				return
+			}
+		}
+	}
+}
+
+// writeSSEEvent writes one Server-Sent Event with a JSON data payload
+func writeSSEEvent(w http.ResponseWriter, id int, event string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", id, event, data)
+	return err
+}
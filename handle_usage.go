@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	dalle "github.com/TrueBlocks/trueblocks-dalle/v6"
+)
+
+// UsageReport is the body of GET /v1/usage
+type UsageReport struct {
+	Day     UsagePeriod  `json:"day"`
+	Month   UsagePeriod  `json:"month"`
+	Budgets BudgetStatus `json:"budgets"`
+}
+
+// handleV1Usage serves GET /v1/usage with spend for a UTC day (?date=2006-01-02, default
+// today) and month (?month=2006-01, default the day's month) plus the remaining budgets
+func (a *App) handleV1Usage(w http.ResponseWriter, r *http.Request) {
+	requestID := GenerateRequestID()
+	if r.Method != http.MethodGet {
+		writeV1Error(w, requestID, http.StatusMethodNotAllowed, dalle.ErrInvalidInput, "method not allowed")
+		return
+	}
+	if a.Usage == nil {
+		WriteErrorResponse(w, NewAPIError(ErrorInternalServer, "Usage accounting unavailable", "").WithRequestID(requestID), http.StatusServiceUnavailable)
+		return
+	}
+	day := a.Usage.now()
+	if raw := r.URL.Query().Get("date"); raw != "" {
+		parsed, err := time.Parse("2006-01-02", raw)
+		if err != nil {
+			WriteErrorResponse(w, NewAPIError(ErrorInvalidRequest, "Invalid date", "Expected date=YYYY-MM-DD").WithRequestID(requestID), http.StatusBadRequest)
+			return
+		}
+		day = parsed
+	}
+	month := day.Format("2006-01")
+	if raw := r.URL.Query().Get("month"); raw != "" {
+		if _, err := time.Parse("2006-01", raw); err != nil {
+			WriteErrorResponse(w, NewAPIError(ErrorInvalidRequest, "Invalid month", "Expected month=YYYY-MM").WithRequestID(requestID), http.StatusBadRequest)
+			return
+		}
+		month = raw
+	}
+	WriteSuccessResponse(w, UsageReport{
+		Day:     a.Usage.Day(day.Format("2006-01-02")),
+		Month:   a.Usage.Month(month),
+		Budgets: a.Usage.Budgets(),
+	}, requestID)
+}
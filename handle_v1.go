@@ -2,6 +2,8 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"io"
 	"net/http"
 	"strconv"
 	"strings"
@@ -15,17 +17,73 @@ func (a *App) handleV1ImagesGenerate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	requestID := GenerateRequestID()
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeV1Error(w, requestID, http.StatusBadRequest, dalle.ErrInvalidInput, "unable to read request body")
+		return
+	}
 	var request dalle.GenerateRequest
-	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+	if err := json.Unmarshal(body, &request); err != nil {
 		writeV1Error(w, requestID, http.StatusBadRequest, dalle.ErrInvalidInput, "invalid JSON request")
 		return
 	}
-	result, err := a.Engine.Generate(request)
+	// callback_url and priority are server-side fields alongside the engine request
+	var options struct {
+		CallbackURL string `json:"callback_url"`
+		Priority    string `json:"priority"`
+	}
+	_ = json.Unmarshal(body, &options)
+	if options.CallbackURL == "" {
+		options.CallbackURL = r.URL.Query().Get("callback_url")
+	}
+	if options.Priority == "" {
+		options.Priority = r.URL.Query().Get("priority")
+	}
+	priority, apiErr := a.requestPriority(r, options.Priority, PriorityInteractive)
+	if apiErr != nil {
+		WriteErrorResponse(w, apiErr.WithRequestID(requestID), http.StatusBadRequest)
+		return
+	}
+	job := NewJob(JobKindGenerate, requestID)
+	job.Request = &request
+	job.Priority = priority
+	job.Client = requestClient(r)
+	if options.CallbackURL != "" {
+		if err := ValidateWebhookURL(options.CallbackURL); err != nil {
+			writeV1Error(w, requestID, http.StatusBadRequest, dalle.ErrInvalidInput, err.Error())
+			return
+		}
+		job.Callbacks = []string{options.CallbackURL}
+	}
+	queued, err := a.Jobs.Enqueue(job)
+	if errors.Is(err, errQueueFull) {
+		a.writeLoadShed(w, "/v1/images/generate", requestID)
+		return
+	}
+	var budgetErr *BudgetError
+	if errors.As(err, &budgetErr) {
+		writeBudgetExceeded(w, budgetErr, "/v1/images/generate", requestID)
+		return
+	}
+	var quotaErr *QuotaError
+	if errors.As(err, &quotaErr) {
+		writeQuotaExceeded(w, quotaErr, "/v1/images/generate", requestID)
+		return
+	}
 	if err != nil {
-		writeV1EngineError(w, requestID, err)
+		WriteErrorResponse(w, NewAPIError(ErrorJobQueueFull, "Unable to queue generation", err.Error()).WithRequestID(requestID), http.StatusServiceUnavailable)
 		return
 	}
-	WriteSuccessResponse(w, result, requestID)
+	if r.URL.Query().Get("async") == "1" {
+		writeJobAccepted(w, queued, requestID)
+		return
+	}
+	finished, err := a.Jobs.Wait(r.Context(), queued.ID)
+	if err != nil {
+		writeJobAccepted(w, finished, requestID)
+		return
+	}
+	writeJobResult(w, finished, requestID)
 }
 
 func (a *App) handleV1ImagesPreview(w http.ResponseWriter, r *http.Request) {
@@ -64,6 +122,24 @@ func (a *App) handleV1Images(w http.ResponseWriter, r *http.Request) {
 func (a *App) handleV1Image(w http.ResponseWriter, r *http.Request) {
 	requestID := GenerateRequestID()
 	id := strings.TrimPrefix(r.URL.Path, "/v1/images/")
+	if strings.HasSuffix(id, "/cancel") {
+		if r.Method != http.MethodPost {
+			writeV1Error(w, requestID, http.StatusMethodNotAllowed, dalle.ErrInvalidInput, "method not allowed")
+			return
+		}
+		id = strings.TrimSuffix(id, "/cancel")
+		if a.Jobs.Get(id) == nil {
+			WriteErrorResponse(w, NewAPIError(ErrorJobNotFound, "Job not found", id).WithRequestID(requestID), http.StatusNotFound)
+			return
+		}
+		job, err := a.cancelJob(id, "/v1/images/cancel", requestID)
+		if err != nil {
+			WriteErrorResponse(w, NewAPIError(ErrorJobNotCancellable, "Generation already finished", err.Error()).WithRequestID(requestID), http.StatusConflict)
+			return
+		}
+		WriteSuccessResponse(w, job, requestID)
+		return
+	}
 	if strings.HasSuffix(id, "/regenerate") {
 		if r.Method != http.MethodPost {
 			writeV1Error(w, requestID, http.StatusMethodNotAllowed, dalle.ErrInvalidInput, "method not allowed")
@@ -99,6 +175,24 @@ func (a *App) handleV1Image(w http.ResponseWriter, r *http.Request) {
 		WriteSuccessResponse(w, result, requestID)
 		return
 	}
+	if strings.HasSuffix(id, "/render") {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			writeV1Error(w, requestID, http.StatusMethodNotAllowed, dalle.ErrInvalidInput, "method not allowed")
+			return
+		}
+		a.handleV1ImageRender(w, r, strings.TrimSuffix(id, "/render"), requestID)
+		return
+	}
+	if strings.HasSuffix(id, "/manifest") || strings.HasSuffix(id, "/manifests") {
+		if r.Method != http.MethodGet {
+			writeV1Error(w, requestID, http.StatusMethodNotAllowed, dalle.ErrInvalidInput, "method not allowed")
+			return
+		}
+		latest := strings.HasSuffix(id, "/manifest")
+		id = strings.TrimSuffix(strings.TrimSuffix(id, "/manifest"), "/manifests")
+		a.handleV1ImageManifests(w, r, id, latest, requestID)
+		return
+	}
 	if r.Method == http.MethodDelete {
 		if err := a.Engine.DeleteImage(id); err != nil {
 			writeV1EngineError(w, requestID, err)
@@ -257,20 +351,23 @@ func (a *App) handleV1Validate(w http.ResponseWriter, r *http.Request) {
 
 func writeV1EngineError(w http.ResponseWriter, requestID string, err error) {
 	code := dalle.ErrorCodeOf(err)
-	status := http.StatusInternalServerError
+	writeV1Error(w, requestID, v1StatusForCode(code), code, err.Error())
+}
+
+func v1StatusForCode(code dalle.ErrorCode) int {
 	switch code {
 	case dalle.ErrInvalidInput, dalle.ErrSeriesInvalid:
-		status = http.StatusBadRequest
+		return http.StatusBadRequest
 	case dalle.ErrSeriesNotFound, dalle.ErrArtifactMissing, dalle.ErrDatabaseVersionUnavailable:
-		status = http.StatusNotFound
+		return http.StatusNotFound
 	case dalle.ErrRegenerationRefused, dalle.ErrDatabaseHashMismatch:
-		status = http.StatusConflict
+		return http.StatusConflict
 	case dalle.ErrProviderUnavailable:
-		status = http.StatusServiceUnavailable
+		return http.StatusServiceUnavailable
 	case dalle.ErrProviderFailed:
-		status = http.StatusBadGateway
+		return http.StatusBadGateway
 	}
-	writeV1Error(w, requestID, status, code, err.Error())
+	return http.StatusInternalServerError
 }
 
 func writeV1Error(w http.ResponseWriter, requestID string, status int, code dalle.ErrorCode, message string) {
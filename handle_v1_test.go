@@ -14,11 +14,15 @@ import (
 
 func newV1TestApp(t *testing.T) *App {
 	t.Helper()
+	// The job store lives under the output directory, which must not be the real one
+	dalle.SetupTest(t, dalle.SetupTestOptions{Series: []string{"empty"}})
 	engine, err := dalle.New(dalle.Config{DataDir: filepath.Join(t.TempDir(), "dalle-data")})
 	if err != nil {
 		t.Fatalf("New engine: %v", err)
 	}
-	return &App{Config: Config{}, Engine: engine}
+	app := &App{Config: Config{}, Engine: engine}
+	app.startJobs()
+	return app
 }
 
 func decodeAPIResponse(t *testing.T, recorder *httptest.ResponseRecorder) APIResponse {
@@ -147,3 +151,32 @@ func TestHandleV1DatabaseRecords(t *testing.T) {
 		t.Fatalf("unexpected records result: %#v", result)
 	}
 }
+
+func TestHandleV1ImagesGenerateAsyncReturnsJob(t *testing.T) {
+	app := newV1TestApp(t)
+	body := bytes.NewBufferString(`{"input":"Person Tour Coordinates"}`)
+	request := httptest.NewRequest(http.MethodPost, "/v1/images/generate?async=1", body)
+	recorder := httptest.NewRecorder()
+
+	app.handleV1ImagesGenerate(recorder, request)
+
+	if recorder.Code != http.StatusAccepted {
+		t.Fatalf("expected status 202, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	response := decodeAPIResponse(t, recorder)
+	encoded, err := json.Marshal(response.Data)
+	if err != nil {
+		t.Fatalf("marshal response data: %v", err)
+	}
+	var job Job
+	if err := json.Unmarshal(encoded, &job); err != nil {
+		t.Fatalf("decode job: %v", err)
+	}
+	if job.ID == "" || job.Kind != JobKindGenerate || recorder.Header().Get("Location") != "/v1/jobs/"+job.ID {
+		t.Fatalf("unexpected job response: %#v", job)
+	}
+	finished := waitForJob(t, app.Jobs, job.ID)
+	if finished.State != JobSucceeded {
+		t.Fatalf("expected job to succeed: %#v", finished)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	dalle "github.com/TrueBlocks/trueblocks-dalle/v6"
+)
+
+// handleV1Webhooks lists (GET) or registers (POST) server-wide webhook subscriptions. They
+// see every job, so they need the admin token.
+func (a *App) handleV1Webhooks(w http.ResponseWriter, r *http.Request) {
+	requestID := GenerateRequestID()
+	if !a.authorizeAdmin(w, r, requestID) {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		WriteSuccessResponse(w, a.Webhooks.Subscriptions(), requestID)
+	case http.MethodPost:
+		var body struct {
+			URL    string   `json:"url"`
+			Events []string `json:"events"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			WriteErrorResponse(w, NewAPIError(ErrorInvalidRequest, "Invalid JSON request", err.Error()).WithRequestID(requestID), http.StatusBadRequest)
+			return
+		}
+		sub, err := a.Webhooks.Subscribe(body.URL, body.Events)
+		if err != nil {
+			WriteErrorResponse(w, NewAPIError(ErrorInvalidRequest, "Invalid webhook subscription", err.Error()).WithRequestID(requestID), http.StatusBadRequest)
+			return
+		}
+		logInfo(fmt.Sprintf("[%s] registered webhook %s -> %s", requestID, sub.ID, sub.URL))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		WriteSuccessResponse(w, sub, requestID)
+	default:
+		writeV1Error(w, requestID, http.StatusMethodNotAllowed, dalle.ErrInvalidInput, "method not allowed")
+	}
+}
+
+// handleV1Webhook serves GET /v1/webhooks/deliveries and DELETE /v1/webhooks/<id>, both
+// behind the admin token
+func (a *App) handleV1Webhook(w http.ResponseWriter, r *http.Request) {
+	requestID := GenerateRequestID()
+	if !a.authorizeAdmin(w, r, requestID) {
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/v1/webhooks/")
+	if id == "deliveries" {
+		if r.Method != http.MethodGet {
+			writeV1Error(w, requestID, http.StatusMethodNotAllowed, dalle.ErrInvalidInput, "method not allowed")
+			return
+		}
+		q := r.URL.Query()
+		WriteSuccessResponse(w, a.Webhooks.Deliveries(q.Get("job_id"), q.Get("state")), requestID)
+		return
+	}
+	if r.Method != http.MethodDelete {
+		writeV1Error(w, requestID, http.StatusMethodNotAllowed, dalle.ErrInvalidInput, "method not allowed")
+		return
+	}
+	found, err := a.Webhooks.Unsubscribe(id)
+	if !found {
+		WriteErrorResponse(w, NewAPIError(ErrorWebhookNotFound, "Webhook not found", id).WithRequestID(requestID), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		WriteErrorResponse(w, NewAPIError(ErrorFileSystem, "Unable to persist webhook subscriptions", err.Error()).WithRequestID(requestID), http.StatusInternalServerError)
+		return
+	}
+	logInfo(fmt.Sprintf("[%s] removed webhook %s", requestID, id))
+	WriteSuccessResponse(w, map[string]string{"id": id}, requestID)
+}
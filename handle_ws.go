@@ -0,0 +1,405 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TrueBlocks/trueblocks-dalle/v6/pkg/progress"
+	"github.com/gorilla/websocket"
+)
+
+// WebSocket tuning; variables so tests can shorten them
+var (
+	wsWriteWait     = 10 * time.Second
+	wsPongWait      = 60 * time.Second
+	wsPingPeriod    = 30 * time.Second
+	wsSendBuffer    = 64
+	wsMaxLagTicks   = 40 // consecutive sample ticks a client may stay backed up before it is dropped
+	wsMaxMessageLen = int64(4096)
+	wsMaxKeys       = 256 // subscriptions one connection may hold; each is checked every tick
+)
+
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 4096,
+}
+
+// checkWSOrigin refuses cross-site WebSocket upgrades. Clients that send no Origin (not
+// browsers) are accepted; a browser must come from the server's own host, as with gorilla's
+// default check, or from one of --ws-allowed-origins.
+func (a *App) checkWSOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	origin = strings.ToLower(strings.TrimSuffix(origin, "/"))
+	for _, allowed := range a.Config.WSAllowedOrigins {
+		if origin == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// WebSocket client operations
+const (
+	WSOpSubscribe      = "subscribe"
+	WSOpUnsubscribe    = "unsubscribe"
+	WSOpSubscribeAll   = "subscribe_all"
+	WSOpUnsubscribeAll = "unsubscribe_all"
+)
+
+// WebSocket server message types
+const (
+	WSMessageAck      = "ack"
+	WSMessageError    = "error"
+	WSMessageProgress = "progress"
+)
+
+// wsCommand is a message sent by a WebSocket client
+type wsCommand struct {
+	Op      string `json:"op"`
+	Series  string `json:"series"`
+	Address string `json:"address"`
+}
+
+// wsMessage is a message sent to a WebSocket client. Progress messages carry only the
+// fields that changed since the last message for that key; completed and failed
+// messages carry the full terminal event.
+type wsMessage struct {
+	Type    string                 `json:"type"`
+	Op      string                 `json:"op,omitempty"`
+	Series  string                 `json:"series,omitempty"`
+	Address string                 `json:"address,omitempty"`
+	Changes map[string]interface{} `json:"changes,omitempty"`
+	Event   *ProgressEvent         `json:"event,omitempty"`
+	Error   string                 `json:"error,omitempty"`
+}
+
+// WSHub multiplexes progress for many (series, address) pairs over WebSocket connections.
+// A single sampler goroutine runs while at least one client is connected.
+type WSHub struct {
+	mu      sync.Mutex
+	clients map[*wsClient]struct{}
+	stop    chan struct{}
+}
+
+type wsClient struct {
+	conn *websocket.Conn
+	send chan wsMessage
+	done chan struct{}
+
+	// guarded by hub.mu
+	keys     map[string]bool           // explicit subscriptions
+	all      bool                      // subscribed to all active runs
+	last     map[string]*ProgressEvent // last state delivered per key
+	lagTicks int
+}
+
+var (
+	wsHub     *WSHub
+	wsHubOnce sync.Once
+)
+
+// GetWSHub returns the global WebSocket hub
+func GetWSHub() *WSHub {
+	wsHubOnce.Do(func() {
+		wsHub = &WSHub{clients: make(map[*wsClient]struct{})}
+	})
+	return wsHub
+}
+
+// handleV1WS upgrades GET /v1/ws to a WebSocket carrying multiplexed progress updates
+func (a *App) handleV1WS(w http.ResponseWriter, r *http.Request) {
+	requestID := GenerateRequestID()
+	upgrader := wsUpgrader
+	upgrader.CheckOrigin = a.checkWSOrigin
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade has already written an HTTP error response
+		logWarn(fmt.Sprintf("[%s] websocket upgrade failed: %v", requestID, err))
+		return
+	}
+	client := &wsClient{
+		conn: conn,
+		send: make(chan wsMessage, wsSendBuffer),
+		done: make(chan struct{}),
+		keys: make(map[string]bool),
+		last: make(map[string]*ProgressEvent),
+	}
+	hub := GetWSHub()
+	hub.register(client)
+	logInfo(fmt.Sprintf("[%s] websocket client connected from %s", requestID, getClientIP(r)))
+
+	go client.writePump()
+	client.readPump(a, hub)
+	hub.unregister(client)
+	logInfo(fmt.Sprintf("[%s] websocket client disconnected", requestID))
+}
+
+func (h *WSHub) register(c *wsClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.clients[c] = struct{}{}
+	if h.stop == nil {
+		h.stop = make(chan struct{})
+		go h.run(h.stop)
+	}
+	GetMetricsCollector().RecordWebSocketClient(1)
+}
+
+func (h *WSHub) unregister(c *wsClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.clients[c]; !ok {
+		return
+	}
+	delete(h.clients, c)
+	close(c.done)
+	if len(h.clients) == 0 && h.stop != nil {
+		close(h.stop)
+		h.stop = nil
+	}
+	GetMetricsCollector().RecordWebSocketClient(-1)
+}
+
+// readPump processes subscription commands until the connection closes
+func (c *wsClient) readPump(a *App, h *WSHub) {
+	defer c.conn.Close()
+	c.conn.SetReadLimit(wsMaxMessageLen)
+	_ = c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+	for {
+		var cmd wsCommand
+		if err := c.conn.ReadJSON(&cmd); err != nil {
+			var syntaxErr *json.SyntaxError
+			var typeErr *json.UnmarshalTypeError
+			if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) {
+				h.reply(c, wsMessage{Type: WSMessageError, Error: "invalid JSON command"})
+				continue
+			}
+			return
+		}
+		h.reply(c, h.apply(a, c, cmd))
+	}
+}
+
+// apply executes a client command and returns the acknowledgement
+func (h *WSHub) apply(a *App, c *wsClient, cmd wsCommand) wsMessage {
+	series := strings.ToLower(cmd.Series)
+	address := strings.ToLower(cmd.Address)
+	switch cmd.Op {
+	case WSOpSubscribe, WSOpUnsubscribe:
+		if apiErr := a.validateSeriesAddress(series, address); apiErr != nil {
+			return wsMessage{Type: WSMessageError, Op: cmd.Op, Series: series, Address: address, Error: apiErr.Details}
+		}
+	case WSOpSubscribeAll, WSOpUnsubscribeAll:
+	default:
+		return wsMessage{Type: WSMessageError, Op: cmd.Op, Error: fmt.Sprintf("unknown op %q", cmd.Op)}
+	}
+
+	key := series + ":" + address
+	h.mu.Lock()
+	switch cmd.Op {
+	case WSOpSubscribe:
+		if !c.keys[key] && len(c.keys) >= wsMaxKeys {
+			h.mu.Unlock()
+			return wsMessage{Type: WSMessageError, Op: cmd.Op, Series: series, Address: address, Error: fmt.Sprintf("at most %d subscriptions per connection; unsubscribe from one first", wsMaxKeys)}
+		}
+		c.keys[key] = true
+	case WSOpUnsubscribe:
+		delete(c.keys, key)
+		delete(c.last, key)
+	case WSOpSubscribeAll:
+		c.all = true
+	case WSOpUnsubscribeAll:
+		c.all = false
+		for k := range c.last {
+			if !c.keys[k] {
+				delete(c.last, k)
+			}
+		}
+	}
+	h.mu.Unlock()
+	return wsMessage{Type: WSMessageAck, Op: cmd.Op, Series: series, Address: address}
+}
+
+// reply queues a control message, dropping it if the client is hopelessly backed up
+func (h *WSHub) reply(c *wsClient, msg wsMessage) {
+	select {
+	case c.send <- msg:
+	case <-c.done:
+	default:
+		logWarn(fmt.Sprintf("websocket client backed up; dropped %s reply", msg.Type))
+	}
+}
+
+// writePump serialises writes to the connection and keeps it alive with pings
+func (c *wsClient) writePump() {
+	ticker := time.NewTicker(wsPingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+	}()
+	for {
+		select {
+		case <-c.done:
+			_ = c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			_ = c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+			return
+		case msg := <-c.send:
+			_ = c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := c.conn.WriteJSON(msg); err != nil {
+				return
+			}
+		case <-ticker.C:
+			_ = c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// run samples progress for every watched key and pushes diffs until stop is closed
+func (h *WSHub) run(stop chan struct{}) {
+	ticker := time.NewTicker(progressPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			h.tick()
+		}
+	}
+}
+
+func (h *WSHub) tick() {
+	h.mu.Lock()
+	watched := map[string][2]string{}
+	wantAll := false
+	for c := range h.clients {
+		wantAll = wantAll || c.all
+		for key := range c.keys {
+			watched[key] = splitProgressKey(key)
+		}
+		// Keys seen through subscribe_all stay watched until their terminal state is delivered
+		for key, ev := range c.last {
+			watched[key] = [2]string{ev.Series, ev.Address}
+		}
+	}
+	h.mu.Unlock()
+
+	// Sample individual keys before ActiveProgressReports, which prunes finished runs
+	states := map[string]ProgressEvent{}
+	for key, sa := range watched {
+		if ev, ok := sampleProgress(sa[0], sa[1]); ok {
+			states[key] = ev
+		}
+	}
+	active := map[string]bool{}
+	if wantAll {
+		for _, pr := range progress.ActiveProgressReports() {
+			key := pr.Series + ":" + pr.Address
+			active[key] = true
+			if _, ok := states[key]; !ok {
+				states[key] = ProgressEvent{
+					Type:       ProgressEventPhase,
+					Series:     pr.Series,
+					Address:    pr.Address,
+					Phase:      pr.Current,
+					Percent:    pr.Percent,
+					ETASeconds: pr.ETASeconds,
+					CacheHit:   pr.CacheHit,
+				}
+			}
+		}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for c := range h.clients {
+		backedUp := false
+		for key, ev := range states {
+			_, tracked := c.last[key]
+			if !c.keys[key] && !(c.all && (active[key] || tracked)) {
+				continue
+			}
+			msg, changed := diffProgress(c.last[key], ev)
+			if !changed {
+				continue
+			}
+			select {
+			case c.send <- msg:
+				ev := ev
+				if ev.IsTerminal() && !c.keys[key] {
+					delete(c.last, key)
+				} else {
+					c.last[key] = &ev
+				}
+			default:
+				// Leave c.last untouched so the next tick re-diffs and coalesces missed updates
+				backedUp = true
+			}
+		}
+		if backedUp {
+			c.lagTicks++
+			if c.lagTicks >= wsMaxLagTicks {
+				logWarn(fmt.Sprintf("websocket client too slow; closing after %d backed-up ticks", c.lagTicks))
+				_ = c.conn.Close()
+			}
+		} else {
+			c.lagTicks = 0
+		}
+	}
+}
+
+// diffProgress builds the message that brings a client from prev to next
+func diffProgress(prev *ProgressEvent, next ProgressEvent) (wsMessage, bool) {
+	if next.IsTerminal() {
+		if prev != nil && prev.Type == next.Type {
+			return wsMessage{}, false
+		}
+		return wsMessage{Type: next.Type, Series: next.Series, Address: next.Address, Event: &next}, true
+	}
+	changes := map[string]interface{}{}
+	if prev == nil || prev.IsTerminal() || prev.Phase != next.Phase {
+		changes["phase"] = next.Phase
+	}
+	percent := math.Round(next.Percent*10) / 10
+	if prev == nil || math.Round(prev.Percent*10)/10 != percent {
+		changes["percent"] = percent
+	}
+	eta := math.Round(next.ETASeconds)
+	if prev == nil || math.Round(prev.ETASeconds) != eta {
+		changes["etaSeconds"] = eta
+	}
+	if prev == nil || prev.CacheHit != next.CacheHit {
+		changes["cacheHit"] = next.CacheHit
+	}
+	if len(changes) == 0 {
+		return wsMessage{}, false
+	}
+	return wsMessage{Type: WSMessageProgress, Series: next.Series, Address: next.Address, Changes: changes}, true
+}
+
+func splitProgressKey(key string) [2]string {
+	parts := strings.SplitN(key, ":", 2)
+	if len(parts) != 2 {
+		return [2]string{key, ""}
+	}
+	return [2]string{parts[0], parts[1]}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	dalle "github.com/TrueBlocks/trueblocks-dalle/v6"
+	"github.com/TrueBlocks/trueblocks-dalle/v6/pkg/model"
+	"github.com/TrueBlocks/trueblocks-dalle/v6/pkg/progress"
+	"github.com/gorilla/websocket"
+)
+
+func dialTestWS(t *testing.T, app *App) *websocket.Conn {
+	t.Helper()
+	server := httptest.NewServer(WrapWithMiddleware(app.handleV1WS, nil))
+	t.Cleanup(server.Close)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/v1/ws", nil)
+	if err != nil {
+		t.Fatalf("dial websocket: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// readWSUntil reads messages until one of the given type arrives
+func readWSUntil(t *testing.T, conn *websocket.Conn, msgType string) wsMessage {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var msg wsMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatalf("waiting for %s: %v", msgType, err)
+		}
+		if msg.Type == msgType {
+			return msg
+		}
+	}
+}
+
+func TestWSSubscribeReceivesDiffsAndCompletion(t *testing.T) {
+	dalle.SetupTest(t, dalle.SetupTestOptions{Series: []string{"empty"}})
+	app := NewApp()
+	original := progressPollInterval
+	progressPollInterval = 5 * time.Millisecond
+	defer func() { progressPollInterval = original }()
+
+	addr := "0x9999999999999999999999999999999999999999"
+	conn := dialTestWS(t, app)
+
+	if err := conn.WriteJSON(wsCommand{Op: WSOpSubscribe, Series: "empty", Address: "0x12"}); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if msg := readWSUntil(t, conn, WSMessageError); msg.Op != WSOpSubscribe {
+		t.Fatalf("expected error for invalid address, got %#v", msg)
+	}
+
+	pm := progress.GetProgressManager()
+	pm.StartRun("empty", addr, &model.DalleDress{})
+	if err := conn.WriteJSON(wsCommand{Op: WSOpSubscribe, Series: "empty", Address: addr}); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	readWSUntil(t, conn, WSMessageAck)
+	if msg := readWSUntil(t, conn, WSMessageProgress); msg.Changes["phase"] != string(progress.PhaseSetup) {
+		t.Fatalf("expected initial setup phase, got %#v", msg)
+	}
+
+	pm.Transition("empty", addr, progress.PhaseEnhance)
+	for {
+		msg := readWSUntil(t, conn, WSMessageProgress)
+		if msg.Changes["phase"] == string(progress.PhaseEnhance) {
+			break
+		}
+		if _, ok := msg.Changes["phase"]; ok {
+			t.Fatalf("unexpected phase change %#v", msg)
+		}
+	}
+
+	pm.Complete("empty", addr)
+	msg := readWSUntil(t, conn, ProgressEventCompleted)
+	if msg.Event == nil || msg.Event.ImageURL != annotatedImageURL("empty", addr) {
+		t.Fatalf("unexpected completion message %#v", msg)
+	}
+}
+
+func TestWSSubscribeAllFollowsActiveRuns(t *testing.T) {
+	dalle.SetupTest(t, dalle.SetupTestOptions{Series: []string{"empty"}})
+	app := NewApp()
+	original := progressPollInterval
+	progressPollInterval = 5 * time.Millisecond
+	defer func() { progressPollInterval = original }()
+
+	conn := dialTestWS(t, app)
+	if err := conn.WriteJSON(wsCommand{Op: WSOpSubscribeAll}); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	readWSUntil(t, conn, WSMessageAck)
+
+	addr := "0xaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	pm := progress.GetProgressManager()
+	pm.StartRun("empty", addr, &model.DalleDress{})
+	if msg := readWSUntil(t, conn, WSMessageProgress); msg.Address != addr {
+		t.Fatalf("expected progress for %s, got %#v", addr, msg)
+	}
+	pm.Fail("empty", addr, errJobCancelled)
+	if msg := readWSUntil(t, conn, ProgressEventFailed); msg.Event == nil || msg.Event.Error != errJobCancelled.Error() {
+		t.Fatalf("unexpected failure message %#v", msg)
+	}
+}
+
+func TestWSCapsSubscriptionsPerConnection(t *testing.T) {
+	dalle.SetupTest(t, dalle.SetupTestOptions{Series: []string{"empty"}})
+	app := NewApp()
+	original := wsMaxKeys
+	wsMaxKeys = 2
+	defer func() { wsMaxKeys = original }()
+
+	conn := dialTestWS(t, app)
+	send := func(op string, n int) wsMessage {
+		t.Helper()
+		if err := conn.WriteJSON(wsCommand{Op: op, Series: "empty", Address: fmt.Sprintf("0x%040d", n)}); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for {
+			var msg wsMessage
+			if err := conn.ReadJSON(&msg); err != nil {
+				t.Fatalf("read: %v", err)
+			}
+			if msg.Type == WSMessageAck || msg.Type == WSMessageError {
+				return msg
+			}
+		}
+	}
+	for n := 1; n <= 2; n++ {
+		if msg := send(WSOpSubscribe, n); msg.Type != WSMessageAck {
+			t.Fatalf("subscription %d refused: %#v", n, msg)
+		}
+	}
+	if msg := send(WSOpSubscribe, 3); msg.Type != WSMessageError || msg.Op != WSOpSubscribe || !strings.Contains(msg.Error, "at most 2") {
+		t.Fatalf("expected the third subscription refused, got %#v", msg)
+	}
+	// Repeating a subscription is not a new one, and unsubscribing frees a place
+	if msg := send(WSOpSubscribe, 2); msg.Type != WSMessageAck {
+		t.Fatalf("repeated subscription refused: %#v", msg)
+	}
+	send(WSOpUnsubscribe, 1)
+	if msg := send(WSOpSubscribe, 3); msg.Type != WSMessageAck {
+		t.Fatalf("subscription after unsubscribing refused: %#v", msg)
+	}
+}
+
+func TestDiffProgressOnlySendsChanges(t *testing.T) {
+	prev := &ProgressEvent{Type: ProgressEventPhase, Phase: progress.PhaseEnhance, Percent: 40.01, ETASeconds: 10.2}
+	if _, changed := diffProgress(prev, ProgressEvent{Type: ProgressEventPhase, Phase: progress.PhaseEnhance, Percent: 40.02, ETASeconds: 10.4}); changed {
+		t.Fatalf("expected sub-resolution changes to be suppressed")
+	}
+	msg, changed := diffProgress(prev, ProgressEvent{Type: ProgressEventPhase, Phase: progress.PhaseImageWait, Percent: 40.01, ETASeconds: 10.2})
+	if !changed || len(msg.Changes) != 1 || msg.Changes["phase"] != progress.PhaseImageWait {
+		t.Fatalf("expected only phase change, got %#v", msg)
+	}
+}
+
+func TestWSRejectsCrossSiteOrigins(t *testing.T) {
+	app := &App{Config: Config{WSAllowedOrigins: parseOrigins(" https://App.example.com/ ")}}
+	server := httptest.NewServer(WrapWithMiddleware(app.handleV1WS, nil))
+	t.Cleanup(server.Close)
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/v1/ws"
+	for origin, ok := range map[string]bool{
+		"":                        true,
+		server.URL:                true,
+		"https://app.example.com": true,
+		"https://evil.example":    false,
+	} {
+		header := http.Header{}
+		if origin != "" {
+			header.Set("Origin", origin)
+		}
+		conn, resp, err := websocket.DefaultDialer.Dial(url, header)
+		if conn != nil {
+			conn.Close()
+		}
+		if ok && err != nil {
+			t.Fatalf("origin %q refused: %v", origin, err)
+		}
+		if !ok && (err == nil || resp == nil || resp.StatusCode != http.StatusForbidden) {
+			t.Fatalf("origin %q accepted: %v", origin, err)
+		}
+	}
+}
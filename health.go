@@ -1,8 +1,10 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"runtime"
+	"strings"
 	"time"
 )
 
@@ -55,6 +57,8 @@ type HealthChecker struct {
 	startTime      time.Time
 	fileOps        *RobustFileOperations
 	circuitBreaker *CircuitBreaker
+	breakers       *BreakerRegistry
+	retention      *Janitor
 }
 
 // NewHealthChecker creates a new health checker
@@ -70,6 +74,16 @@ func (hc *HealthChecker) SetCircuitBreaker(cb *CircuitBreaker) {
 	hc.circuitBreaker = cb
 }
 
+// SetBreakers sets the breaker registry reported as the circuit_breakers component
+func (hc *HealthChecker) SetBreakers(registry *BreakerRegistry) {
+	hc.breakers = registry
+}
+
+// SetRetention sets the janitor whose quota is reported as the storage_quota component
+func (hc *HealthChecker) SetRetention(j *Janitor) {
+	hc.retention = j
+}
+
 // CheckHealth performs a comprehensive health check
 func (hc *HealthChecker) CheckHealth(requestID string) HealthCheck {
 	components := make(map[string]ComponentHealth)
@@ -82,12 +96,22 @@ func (hc *HealthChecker) CheckHealth(requestID string) HealthCheck {
 		components["openai"] = hc.checkOpenAIHealth(requestID)
 	}
 
+	// Check every registered circuit breaker
+	if hc.breakers != nil {
+		components["circuit_breakers"] = hc.checkBreakersHealth(requestID)
+	}
+
 	// Check memory health
 	components["memory"] = hc.checkMemoryHealth(requestID)
 
 	// Check disk space
 	components["disk_space"] = hc.checkDiskSpaceHealth(requestID)
 
+	// Check the artifact store against its quota
+	if hc.retention != nil && hc.retention.cfg.QuotaBytes > 0 {
+		components["storage_quota"] = hc.checkStorageQuotaHealth(requestID)
+	}
+
 	// Determine overall status
 	overallStatus := hc.determineOverallStatus(components)
 
@@ -183,6 +207,55 @@ func (hc *HealthChecker) checkOpenAIHealth(requestID string) ComponentHealth {
 	}
 }
 
+// checkBreakersHealth summarises the registered breakers: an open critical breaker makes the
+// server unhealthy, while a half-open breaker or an open non-critical one degrades it
+func (hc *HealthChecker) checkBreakersHealth(requestID string) ComponentHealth {
+	_ = requestID // delint
+	start := time.Now()
+
+	status := HealthStatusHealthy
+	var tripped []string
+	details := make(map[string]interface{})
+	for _, b := range hc.breakers.Snapshot() {
+		detail := map[string]interface{}{
+			"mode":         b.Mode,
+			"state":        b.State,
+			"forced":       b.Forced,
+			"critical":     b.Critical,
+			"failures":     b.TotalFailures,
+			"successes":    b.TotalSuccesses,
+			"rejections":   b.TotalRejections,
+			"last_failure": b.LastFailureTime,
+		}
+		if b.Window != nil {
+			detail["window"] = b.Window
+		}
+		details[b.Name] = detail
+		if b.CircuitBreakerMetrics.State == CircuitClosed {
+			continue
+		}
+		tripped = append(tripped, b.Name+" "+b.State)
+		if b.CircuitBreakerMetrics.State == CircuitOpen && b.Critical {
+			status = HealthStatusUnhealthy
+		} else if status == HealthStatusHealthy {
+			status = HealthStatusDegraded
+		}
+	}
+
+	message := "All circuit breakers closed"
+	if len(tripped) > 0 {
+		message = "Circuit breakers not closed: " + strings.Join(tripped, ", ")
+	}
+	return ComponentHealth{
+		Name:        "circuit_breakers",
+		Status:      status,
+		LastChecked: time.Now(),
+		Duration:    time.Since(start),
+		Message:     message,
+		Details:     details,
+	}
+}
+
 // checkMemoryHealth checks memory usage
 func (hc *HealthChecker) checkMemoryHealth(requestID string) ComponentHealth {
 	_ = requestID // delint
@@ -274,6 +347,48 @@ func (hc *HealthChecker) checkDiskSpaceHealth(requestID string) ComponentHealth
 	}
 }
 
+// checkStorageQuotaHealth reports the artifact store's size against the hard quota
+func (hc *HealthChecker) checkStorageQuotaHealth(requestID string) ComponentHealth {
+	start := time.Now()
+	used, err := hc.retention.Usage(context.Background())
+	duration := time.Since(start)
+	if err != nil {
+		return ComponentHealth{
+			Name:        "storage_quota",
+			Status:      HealthStatusDegraded,
+			LastChecked: time.Now(),
+			Duration:    duration,
+			Message:     fmt.Sprintf("Failed to measure the artifact store: %v", err),
+		}
+	}
+
+	quota := hc.retention.cfg.QuotaBytes
+	usagePercent := float64(used) / float64(quota) * 100
+	status := HealthStatusHealthy
+	message := fmt.Sprintf("Artifact store within quota: %.1f%% used", usagePercent)
+	if used >= quota {
+		status = HealthStatusUnhealthy
+		message = fmt.Sprintf("Artifact store quota reached; generations are refused: %.1f%% used", usagePercent)
+	} else if usagePercent > 85 {
+		status = HealthStatusDegraded
+		message = fmt.Sprintf("Artifact store near quota: %.1f%% used", usagePercent)
+	}
+
+	return ComponentHealth{
+		Name:        "storage_quota",
+		Status:      status,
+		LastChecked: time.Now(),
+		Duration:    duration,
+		Message:     message,
+		Details: map[string]interface{}{
+			"used_mb":       used >> 20,
+			"quota_mb":      quota >> 20,
+			"max_mb":        hc.retention.cfg.MaxBytes >> 20,
+			"usage_percent": usagePercent,
+		},
+	}
+}
+
 // determineOverallStatus determines the overall health status based on components
 func (hc *HealthChecker) determineOverallStatus(components map[string]ComponentHealth) HealthStatus {
 	hasUnhealthy := false
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// IdempotencyHeader is the request header carrying a client-chosen idempotency key
+const IdempotencyHeader = "Idempotency-Key"
+
+// maxIdempotentResponseBytes bounds the size of a response kept for replay
+const maxIdempotentResponseBytes = 1 << 20
+
+// maxIdempotentRequestBytes bounds the request body read to fingerprint a keyed request
+const maxIdempotentRequestBytes = 1 << 20
+
+// maxIdempotencyKeyLen bounds the accepted key length
+const maxIdempotencyKeyLen = 255
+
+// replayedHeaders are copied from the original response into a replay
+var replayedHeaders = []string{"Content-Type", "Location", "X-Job-ID"}
+
+// IdempotencyRecord is the stored outcome of the first request made with a key
+type IdempotencyRecord struct {
+	Key         string            `json:"key"`
+	Fingerprint string            `json:"fingerprint"`
+	Status      int               `json:"status"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	Body        []byte            `json:"body"`
+	CreatedAt   time.Time         `json:"created_at"`
+}
+
+// IdempotencyStore keeps responses keyed by Idempotency-Key on disk for ttl so that
+// client retries are answered from the record instead of running the request again. Keys
+// are scoped to the caller (see idempotencyScope), so two clients choosing the same key
+// never see each other's responses.
+type IdempotencyStore struct {
+	mu       sync.Mutex
+	dir      string
+	ttl      time.Duration
+	fileOps  *RobustFileOperations
+	inflight map[string]string // key -> fingerprint of the request still being handled
+}
+
+// NewIdempotencyStore creates a store rooted at dir
+func NewIdempotencyStore(dir string, ttl time.Duration) *IdempotencyStore {
+	return &IdempotencyStore{
+		dir:      dir,
+		ttl:      ttl,
+		fileOps:  NewRobustFileOperations(),
+		inflight: make(map[string]string),
+	}
+}
+
+func (s *IdempotencyStore) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:])+".json")
+}
+
+// Lookup returns the unexpired record for key, or nil
+func (s *IdempotencyStore) Lookup(key string) *IdempotencyRecord {
+	data, err := os.ReadFile(s.path(key))
+	if err != nil {
+		return nil
+	}
+	var rec IdempotencyRecord
+	if err := json.Unmarshal(data, &rec); err != nil || rec.Key != key {
+		return nil
+	}
+	if time.Since(rec.CreatedAt) > s.ttl {
+		_ = s.fileOps.RemoveFile(s.path(key), "idempotency")
+		return nil
+	}
+	return &rec
+}
+
+// Save persists the record
+func (s *IdempotencyStore) Save(rec *IdempotencyRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return s.fileOps.WriteFile(s.path(rec.Key), data, "idempotency")
+}
+
+// Prune deletes records older than the ttl and returns how many were removed
+func (s *IdempotencyStore) Prune() int {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return 0
+	}
+	removed := 0
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		path := filepath.Join(s.dir, entry.Name())
+		data, err := os.ReadFile(path) // #nosec G304 - names come from ReadDir
+		if err != nil {
+			continue
+		}
+		var rec IdempotencyRecord
+		if json.Unmarshal(data, &rec) != nil || time.Since(rec.CreatedAt) > s.ttl {
+			if os.Remove(path) == nil {
+				removed++
+			}
+		}
+	}
+	return removed
+}
+
+// begin reserves key for a request with fingerprint. It returns the stored record to
+// replay, an APIError when the key conflicts, or neither when the request should run.
+func (s *IdempotencyStore) begin(key, fingerprint string) (*IdempotencyRecord, *APIError) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if rec := s.Lookup(key); rec != nil {
+		if rec.Fingerprint != fingerprint {
+			return nil, NewAPIError(ErrorIdempotencyMismatch, "Idempotency-Key reused with a different request", key)
+		}
+		return rec, nil
+	}
+	if fp, busy := s.inflight[key]; busy {
+		if fp != fingerprint {
+			return nil, NewAPIError(ErrorIdempotencyMismatch, "Idempotency-Key reused with a different request", key)
+		}
+		return nil, NewAPIError(ErrorIdempotencyInFlight, "A request with this Idempotency-Key is still in progress", key)
+	}
+	s.inflight[key] = fingerprint
+	return nil, nil
+}
+
+func (s *IdempotencyStore) end(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.inflight, key)
+}
+
+// idempotencyScope namespaces a client-chosen key by the caller that sent it
+func idempotencyScope(r *http.Request, key string) string {
+	return requestClient(r) + "\n" + key
+}
+
+// requestFingerprint hashes the method, path, query and body of a request
+func requestFingerprint(r *http.Request, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(r.Method + " " + r.URL.Path + "?" + r.URL.RawQuery + "\n"))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// recordingWriter passes a response through while keeping a copy for replay
+type recordingWriter struct {
+	http.ResponseWriter
+	status   int
+	body     bytes.Buffer
+	overflow bool
+}
+
+func (rw *recordingWriter) WriteHeader(code int) {
+	if rw.status == 0 {
+		rw.status = code
+	}
+	rw.ResponseWriter.WriteHeader(code)
+}
+
+func (rw *recordingWriter) Write(b []byte) (int, error) {
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	if !rw.overflow {
+		if rw.body.Len()+len(b) > maxIdempotentResponseBytes {
+			rw.overflow = true
+			rw.body.Reset()
+		} else {
+			rw.body.Write(b)
+		}
+	}
+	return rw.ResponseWriter.Write(b)
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (rw *recordingWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+// withIdempotency makes POST handlers safe to retry. Requests carrying an Idempotency-Key
+// run once; repeats within the window replay the stored response, a repeat with a
+// different method, path or body gets 409. Server errors and load-shed (429) responses are
+// not stored so they can be retried.
+func (a *App) withIdempotency(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimSpace(r.Header.Get(IdempotencyHeader))
+		if key == "" || r.Method != http.MethodPost || a.Idempotency == nil {
+			next(w, r)
+			return
+		}
+		requestID := getRequestIDFromHeaders(r)
+		if len(key) > maxIdempotencyKeyLen {
+			WriteErrorResponse(w, NewAPIError(ErrorInvalidRequest, "Idempotency-Key too long", fmt.Sprintf("maximum is %d characters", maxIdempotencyKeyLen)).WithRequestID(requestID), http.StatusBadRequest)
+			return
+		}
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxIdempotentRequestBytes))
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			WriteErrorResponse(w, NewAPIError(ErrorRequestTooLarge, "Request body too large", fmt.Sprintf("maximum is %d bytes", maxIdempotentRequestBytes)).WithRequestID(requestID), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			WriteErrorResponse(w, NewAPIError(ErrorInvalidRequest, "Unable to read request body", err.Error()).WithRequestID(requestID), http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		fingerprint := requestFingerprint(r, body)
+		scoped := idempotencyScope(r, key)
+
+		rec, apiErr := a.Idempotency.begin(scoped, fingerprint)
+		if apiErr != nil {
+			WriteErrorResponse(w, apiErr.WithRequestID(requestID), http.StatusConflict)
+			return
+		}
+		if rec != nil {
+			logInfo(fmt.Sprintf("[%s] replaying stored response for Idempotency-Key %q", requestID, key))
+			for name, value := range rec.Headers {
+				w.Header().Set(name, value)
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(rec.Status)
+			_, _ = w.Write(rec.Body)
+			return
+		}
+		defer a.Idempotency.end(scoped)
+
+		recorder := &recordingWriter{ResponseWriter: w}
+		next(recorder, r)
+
+		if recorder.status == 0 || recorder.status >= 500 || recorder.status == http.StatusTooManyRequests || recorder.overflow {
+			return
+		}
+		stored := &IdempotencyRecord{
+			Key:         scoped,
+			Fingerprint: fingerprint,
+			Status:      recorder.status,
+			Headers:     map[string]string{},
+			Body:        recorder.body.Bytes(),
+			CreatedAt:   time.Now(),
+		}
+		for _, name := range replayedHeaders {
+			if value := w.Header().Get(name); value != "" {
+				stored.Headers[name] = value
+			}
+		}
+		if err := a.Idempotency.Save(stored); err != nil {
+			logWarn(fmt.Sprintf("[%s] unable to store Idempotency-Key %q: %v", requestID, key, err))
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func idempotentPost(handler http.HandlerFunc, key, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	if key != "" {
+		req.Header.Set(IdempotencyHeader, key)
+	}
+	rr := httptest.NewRecorder()
+	handler(rr, req)
+	return rr
+}
+
+func TestIdempotencyReplayAndMismatch(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "idempotency")
+	var calls int32
+	next := func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&calls, 1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Job-ID", "job-1")
+		w.WriteHeader(http.StatusAccepted)
+		_, _ = w.Write([]byte(`{"call":` + string(rune('0'+n)) + `}`))
+	}
+
+	app := &App{Idempotency: NewIdempotencyStore(dir, time.Hour)}
+	handler := app.withIdempotency(next)
+
+	first := idempotentPost(handler, "abc", "/v1/images/generate", `{"series":"s","address":"a"}`)
+	if first.Code != http.StatusAccepted || first.Body.String() != `{"call":1}` {
+		t.Fatalf("first: %d %s", first.Code, first.Body.String())
+	}
+
+	replay := idempotentPost(handler, "abc", "/v1/images/generate", `{"series":"s","address":"a"}`)
+	if replay.Code != http.StatusAccepted || replay.Body.String() != `{"call":1}` {
+		t.Fatalf("replay: %d %s", replay.Code, replay.Body.String())
+	}
+	if replay.Header().Get("Idempotent-Replayed") != "true" || replay.Header().Get("X-Job-ID") != "job-1" {
+		t.Fatalf("replay headers: %v", replay.Header())
+	}
+
+	conflict := idempotentPost(handler, "abc", "/v1/images/generate", `{"series":"s","address":"b"}`)
+	if conflict.Code != http.StatusConflict || !strings.Contains(conflict.Body.String(), ErrorIdempotencyMismatch) {
+		t.Fatalf("mismatch: %d %s", conflict.Code, conflict.Body.String())
+	}
+
+	// Without a key every request runs
+	idempotentPost(handler, "", "/v1/images/generate", `{"series":"s","address":"a"}`)
+	if got := atomic.LoadInt32(&calls); got != 2 {
+		t.Fatalf("handler ran %d times, want 2", got)
+	}
+
+	// A fresh store over the same directory (a restart) still replays
+	restarted := (&App{Idempotency: NewIdempotencyStore(dir, time.Hour)}).withIdempotency(next)
+	again := idempotentPost(restarted, "abc", "/v1/images/generate", `{"series":"s","address":"a"}`)
+	if again.Body.String() != `{"call":1}` || atomic.LoadInt32(&calls) != 2 {
+		t.Fatalf("after restart: %s (calls=%d)", again.Body.String(), atomic.LoadInt32(&calls))
+	}
+}
+
+func TestIdempotencyServerErrorsAndExpiry(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "idempotency")
+	var calls int32
+	next := func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	store := NewIdempotencyStore(dir, time.Hour)
+	handler := (&App{Idempotency: store}).withIdempotency(next)
+
+	if rr := idempotentPost(handler, "k", "/v1/images/s/a/regenerate", ""); rr.Code != http.StatusServiceUnavailable {
+		t.Fatalf("first: %d", rr.Code)
+	}
+	if rr := idempotentPost(handler, "k", "/v1/images/s/a/regenerate", ""); rr.Code != http.StatusOK {
+		t.Fatalf("retry after 5xx should run again, got %d", rr.Code)
+	}
+	if atomic.LoadInt32(&calls) != 2 {
+		t.Fatalf("calls = %d, want 2", calls)
+	}
+
+	scoped := idempotencyScope(httptest.NewRequest(http.MethodPost, "/", nil), "k")
+	rec := store.Lookup(scoped)
+	if rec == nil {
+		t.Fatalf("expected stored record")
+	}
+	rec.CreatedAt = time.Now().Add(-2 * time.Hour)
+	if err := store.Save(rec); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	if n := store.Prune(); n != 1 {
+		t.Fatalf("pruned %d, want 1", n)
+	}
+	if store.Lookup(scoped) != nil {
+		t.Fatalf("expired record still present")
+	}
+}
+
+func TestIdempotencyScopedByClientAndBounded(t *testing.T) {
+	var calls int32
+	next := func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&calls, 1)
+		w.Header().Set("X-Job-ID", "job-"+string(rune('0'+n)))
+		w.WriteHeader(http.StatusAccepted)
+	}
+	handler := (&App{Idempotency: NewIdempotencyStore(filepath.Join(t.TempDir(), "idempotency"), time.Hour)}).withIdempotency(next)
+	post := func(apiKey, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/v1/images/generate", strings.NewReader(body))
+		req.Header.Set(IdempotencyHeader, "shared")
+		req.Header.Set(APIKeyHeader, apiKey)
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+		return rr
+	}
+
+	// The same key and body from another caller runs on its own instead of replaying
+	first, other := post("alice", `{"input":"a"}`), post("bob", `{"input":"a"}`)
+	if first.Header().Get("X-Job-ID") != "job-1" || other.Header().Get("X-Job-ID") != "job-2" || other.Header().Get("Idempotent-Replayed") != "" {
+		t.Fatalf("second caller got the first caller's response: %v", other.Header())
+	}
+	if again := post("alice", `{"input":"a"}`); again.Header().Get("X-Job-ID") != "job-1" || again.Header().Get("Idempotent-Replayed") != "true" {
+		t.Fatalf("retry by the first caller was not replayed: %v", again.Header())
+	}
+
+	huge := post("alice", `{"input":"`+strings.Repeat("a", maxIdempotentRequestBytes)+`"}`)
+	if huge.Code != http.StatusRequestEntityTooLarge || !strings.Contains(huge.Body.String(), ErrorRequestTooLarge) || atomic.LoadInt32(&calls) != 2 {
+		t.Fatalf("oversized body: %d %s (calls=%d)", huge.Code, huge.Body.String(), calls)
+	}
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/image/draw"
+
+	dalle "github.com/TrueBlocks/trueblocks-dalle/v6"
+	"github.com/TrueBlocks/trueblocks-dalle/v6/pkg/storage"
+)
+
+const (
+	defaultDerivativeCacheBytes = 256 << 20
+	maxDerivativeWidth          = 2048
+	defaultDerivativeQuality    = 80
+)
+
+// Render output formats
+const (
+	FormatWebP = "webp"
+	FormatJPEG = "jpeg"
+	FormatPNG  = "png"
+)
+
+// errRenderUndecodable marks a source that is not an image we can read
+var errRenderUndecodable = errors.New("source is not a decodable image")
+
+// RenderParams describe a derivative: the width to scale to (0 keeps the source width),
+// the output format and, for jpeg, its quality
+type RenderParams struct {
+	Width   int
+	Format  string
+	Quality int
+}
+
+// ParseRenderParams reads w, format and quality from a render query. Images are never
+// scaled up, and quality only applies to jpeg since webp and png are written lossless.
+func ParseRenderParams(q url.Values) (RenderParams, error) {
+	p := RenderParams{Format: FormatWebP, Quality: defaultDerivativeQuality}
+	if v := q.Get("w"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxDerivativeWidth {
+			return p, fmt.Errorf("w must be between 1 and %d", maxDerivativeWidth)
+		}
+		p.Width = n
+	}
+	if v := strings.ToLower(q.Get("format")); v != "" {
+		switch v {
+		case FormatWebP, FormatPNG:
+			p.Format = v
+		case FormatJPEG, "jpg":
+			p.Format = FormatJPEG
+		default:
+			return p, fmt.Errorf("format must be webp, jpeg or png")
+		}
+	}
+	if v := q.Get("quality"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 100 {
+			return p, fmt.Errorf("quality must be between 1 and 100")
+		}
+		p.Quality = n
+	}
+	if p.Format != FormatJPEG {
+		p.Quality = 0
+	}
+	return p, nil
+}
+
+// ContentType is the media type of the rendered output
+func (p RenderParams) ContentType() string {
+	return "image/" + p.Format
+}
+
+// suffix names the parameters in a cache file name, e.g. "w256_q80.jpeg"
+func (p RenderParams) suffix() string {
+	return fmt.Sprintf("w%d_q%d.%s", p.Width, p.Quality, p.Format)
+}
+
+// RenderSource is the image a derivative is made from: an artifact store key, or a file on
+// disk for images the library wrote outside the output directory
+type RenderSource struct {
+	Key  string
+	Path string
+}
+
+func (s RenderSource) String() string {
+	if s.Key != "" {
+		return s.Key
+	}
+	return s.Path
+}
+
+// resolveRenderSource maps an image id to its source. "<series>:<address>" names the
+// annotated image of that series and address; anything else is a library image id.
+func (a *App) resolveRenderSource(id string) (RenderSource, error) {
+	if series, address, ok := strings.Cut(id, ":"); ok {
+		key := artifactKey(series, "annotated", address+".png")
+		if series == "" || address == "" || validateArtifactKey(key) != nil {
+			return RenderSource{}, fmt.Errorf("invalid image id %q", id)
+		}
+		return RenderSource{Key: key}, nil
+	}
+	record, err := a.Engine.GetImage(id)
+	if err != nil {
+		return RenderSource{}, err
+	}
+	if rel, err := filepath.Rel(storage.OutputDir(), record.ImagePath); err == nil && !strings.HasPrefix(rel, "..") {
+		return RenderSource{Key: filepath.ToSlash(rel)}, nil
+	}
+	return RenderSource{Path: record.ImagePath}, nil
+}
+
+// stat returns the size and modification time of the source
+func (s RenderSource) stat(ctx context.Context) (int64, time.Time, error) {
+	if s.Key != "" {
+		info, err := CurrentStore().Stat(ctx, s.Key)
+		return info.Size, info.ModTime, err
+	}
+	info, err := os.Stat(s.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, time.Time{}, ErrArtifactNotFound
+	}
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	return info.Size(), info.ModTime(), nil
+}
+
+// read returns the source's bytes
+func (s RenderSource) read(ctx context.Context) ([]byte, error) {
+	if s.Key != "" {
+		body, _, err := CurrentStore().Open(ctx, s.Key)
+		if err != nil {
+			return nil, err
+		}
+		defer func() { _ = body.Close() }()
+		return io.ReadAll(body)
+	}
+	data, err := os.ReadFile(s.Path) // #nosec G304 - path comes from the library's own record
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrArtifactNotFound
+	}
+	return data, err
+}
+
+// DerivativeCache keeps rendered derivatives on disk, named by the sha256 of their source
+// and their parameters, and evicts the least recently used once they pass maxBytes.
+// Source hashes come from the content index, so a cache hit does not have to read the
+// source.
+type DerivativeCache struct {
+	dir      string
+	maxBytes int64
+	fileOps  *RobustFileOperations
+
+	mu       sync.Mutex
+	entries  map[string]*list.Element
+	order    *list.List // of *derivativeEntry, most recently used first
+	size     int64
+	inflight map[string]*renderCall
+}
+
+type derivativeEntry struct {
+	name string
+	size int64
+}
+
+// renderCall lets concurrent requests for the same derivative share one render
+type renderCall struct {
+	done chan struct{}
+	path string
+	err  error
+}
+
+// NewDerivativeCache opens the cache in dir, picking up derivatives rendered before a
+// restart in modification-time order; maxBytes <= 0 uses the default cap
+func NewDerivativeCache(dir string, maxBytes int64) *DerivativeCache {
+	if maxBytes <= 0 {
+		maxBytes = defaultDerivativeCacheBytes
+	}
+	c := &DerivativeCache{
+		dir:      dir,
+		maxBytes: maxBytes,
+		fileOps:  GetFileOperations(),
+		entries:  map[string]*list.Element{},
+		order:    list.New(),
+		inflight: map[string]*renderCall{},
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		logError("derivatives: unable to read cache: " + err.Error())
+	}
+	type found struct {
+		name    string
+		size    int64
+		modTime time.Time
+	}
+	var existing []found
+	for _, f := range files {
+		if f.IsDir() || strings.HasSuffix(f.Name(), ".tmp") {
+			continue
+		}
+		if info, err := f.Info(); err == nil {
+			existing = append(existing, found{f.Name(), info.Size(), info.ModTime()})
+		}
+	}
+	sort.Slice(existing, func(i, j int) bool { return existing[i].modTime.Before(existing[j].modTime) })
+	for _, f := range existing {
+		c.entries[f.name] = c.order.PushFront(&derivativeEntry{name: f.name, size: f.size})
+		c.size += f.size
+	}
+	c.mu.Lock()
+	c.evictLocked("")
+	c.mu.Unlock()
+	return c
+}
+
+// Size returns the bytes held and the number of derivatives cached
+func (c *DerivativeCache) Size() (int64, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.size, c.order.Len()
+}
+
+// Render returns the path of the derivative of src described by p, rendering it on a miss
+func (c *DerivativeCache) Render(ctx context.Context, src RenderSource, p RenderParams, requestID string) (string, error) {
+	sum, data, err := contentIndex.Digest(ctx, src)
+	if err != nil {
+		return "", err
+	}
+
+	name := sum + "_" + p.suffix()
+	path := filepath.Join(c.dir, name)
+	c.mu.Lock()
+	if el, ok := c.entries[name]; ok {
+		c.order.MoveToFront(el)
+		c.mu.Unlock()
+		now := time.Now()
+		_ = os.Chtimes(path, now, now) // so a restart keeps the order
+		GetMetricsCollector().RecordDerivative(true)
+		return path, nil
+	}
+	if call, ok := c.inflight[name]; ok {
+		c.mu.Unlock()
+		<-call.done
+		return call.path, call.err
+	}
+	call := &renderCall{done: make(chan struct{})}
+	c.inflight[name] = call
+	c.mu.Unlock()
+
+	GetMetricsCollector().RecordDerivative(false)
+	call.path, call.err = c.render(ctx, src, data, p, path, requestID)
+	c.mu.Lock()
+	delete(c.inflight, name)
+	if call.err == nil {
+		if info, err := os.Stat(path); err == nil {
+			c.entries[name] = c.order.PushFront(&derivativeEntry{name: name, size: info.Size()})
+			c.size += info.Size()
+			c.evictLocked(name)
+		}
+	}
+	c.mu.Unlock()
+	close(call.done)
+	return call.path, call.err
+}
+
+// render decodes the source, scales it and writes the derivative to path
+func (c *DerivativeCache) render(ctx context.Context, src RenderSource, data []byte, p RenderParams, path, requestID string) (string, error) {
+	if data == nil {
+		var err error
+		if data, err = src.read(ctx); err != nil {
+			return "", err
+		}
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errRenderUndecodable, err)
+	}
+	img = scaleToWidth(img, p.Width)
+	var out bytes.Buffer
+	switch p.Format {
+	case FormatWebP:
+		err = encodeWebP(&out, img)
+	case FormatJPEG:
+		err = jpeg.Encode(&out, img, &jpeg.Options{Quality: p.Quality})
+	default:
+		err = (&png.Encoder{CompressionLevel: png.BestCompression}).Encode(&out, img)
+	}
+	if err != nil {
+		return "", err
+	}
+	if err := c.fileOps.WriteFile(path, out.Bytes(), requestID); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// evictLocked removes least recently used derivatives until the cache fits, sparing keep
+func (c *DerivativeCache) evictLocked(keep string) {
+	for c.size > c.maxBytes {
+		el := c.order.Back()
+		if el == nil {
+			return
+		}
+		entry := el.Value.(*derivativeEntry)
+		if entry.name == keep {
+			if el = el.Prev(); el == nil {
+				return
+			}
+			entry = el.Value.(*derivativeEntry)
+		}
+		if err := c.fileOps.RemoveFile(filepath.Join(c.dir, entry.name), "derivatives"); err != nil {
+			logError("derivatives: unable to evict " + entry.name + ": " + err.Error())
+		}
+		c.order.Remove(el)
+		delete(c.entries, entry.name)
+		c.size -= entry.size
+		GetMetricsCollector().RecordDerivativeEviction()
+	}
+}
+
+// scaleToWidth resizes img to width, keeping its aspect ratio; it never scales up
+func scaleToWidth(img image.Image, width int) image.Image {
+	b := img.Bounds()
+	if width <= 0 || width >= b.Dx() {
+		return img
+	}
+	height := max(1, (b.Dy()*width+b.Dx()/2)/b.Dx())
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, b, draw.Src, nil)
+	return dst
+}
+
+// handleV1ImageRender serves GET /v1/images/{id}/render
+func (a *App) handleV1ImageRender(w http.ResponseWriter, r *http.Request, id, requestID string) {
+	params, err := ParseRenderParams(r.URL.Query())
+	if err != nil {
+		writeV1Error(w, requestID, http.StatusBadRequest, dalle.ErrInvalidInput, err.Error())
+		return
+	}
+	src, err := a.resolveRenderSource(id)
+	if err != nil {
+		if dalle.ErrorCodeOf(err) != "" {
+			writeV1EngineError(w, requestID, err)
+		} else {
+			writeV1Error(w, requestID, http.StatusBadRequest, dalle.ErrInvalidInput, err.Error())
+		}
+		return
+	}
+	path, err := a.Derivatives.Render(r.Context(), src, params, requestID)
+	switch {
+	case errors.Is(err, ErrArtifactNotFound):
+		writeV1Error(w, requestID, http.StatusNotFound, dalle.ErrArtifactMissing, "no image for "+id)
+		return
+	case errors.Is(err, errRenderUndecodable):
+		WriteErrorResponse(w, NewAPIError(ErrorInternalServer, "Unable to render image", err.Error()).WithRequestID(requestID), http.StatusInternalServerError)
+		return
+	case err != nil:
+		var fsErr *FileSystemError
+		if errors.As(err, &fsErr) {
+			WriteErrorResponse(w, NewAPIError(ErrorFileSystem, "Unable to cache rendered image", err.Error()).WithRequestID(requestID), http.StatusInternalServerError)
+		} else {
+			WriteErrorResponse(w, NewAPIError(ErrorStorageUnavailable, "Unable to read image", err.Error()).WithRequestID(requestID), http.StatusBadGateway)
+		}
+		return
+	}
+	f, err := os.Open(path) // #nosec G304 - a name the cache built
+	if err != nil {
+		// Evicted between rendering and serving; the next request renders it again
+		WriteErrorResponse(w, NewAPIError(ErrorFileSystem, "Rendered image went missing", err.Error()).WithRequestID(requestID), http.StatusServiceUnavailable)
+		return
+	}
+	defer func() { _ = f.Close() }()
+	info, err := f.Stat()
+	if err != nil {
+		WriteErrorResponse(w, NewAPIError(ErrorFileSystem, "Rendered image went missing", err.Error()).WithRequestID(requestID), http.StatusServiceUnavailable)
+		return
+	}
+	if src.Key != "" {
+		// A thumbnail in the gallery counts as the image being looked at
+		servedIndex.Touch(src.Key)
+	}
+	w.Header().Set("Content-Type", params.ContentType())
+	w.Header().Set("ETag", `"`+strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))+`"`)
+	w.Header().Set("Cache-Control", mutableCacheControl)
+	http.ServeContent(w, r, filepath.Base(path), info.ModTime(), f)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	dalle "github.com/TrueBlocks/trueblocks-dalle/v6"
+	"github.com/TrueBlocks/trueblocks-dalle/v6/pkg/storage"
+	"golang.org/x/image/webp"
+)
+
+func TestEncodeWebPRoundTrip(t *testing.T) {
+	flat, _ := mockImagePNG("harbor", 64, 48)
+	decoded, err := png.Decode(bytes.NewReader(flat))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rng := rand.New(rand.NewPCG(1, 2))
+	noise := image.NewNRGBA(image.Rect(0, 0, 37, 29))
+	for i := range noise.Pix {
+		noise.Pix[i] = byte(rng.IntN(256))
+	}
+	gradient := image.NewNRGBA(image.Rect(0, 0, 300, 7))
+	for y := 0; y < 7; y++ {
+		for x := 0; x < 300; x++ {
+			gradient.SetNRGBA(x, y, color.NRGBA{R: byte(x), G: byte(x * y), B: 200, A: byte(255 - x/2)})
+		}
+	}
+	single := image.NewNRGBA(image.Rect(0, 0, 1, 1))
+	single.SetNRGBA(0, 0, color.NRGBA{R: 9, G: 8, B: 7, A: 255})
+
+	for name, img := range map[string]image.Image{"flat": decoded, "noise": noise, "gradient": gradient, "single": single} {
+		var buf bytes.Buffer
+		if err := encodeWebP(&buf, img); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		got, err := webp.Decode(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatalf("%s: decode: %v", name, err)
+		}
+		b := img.Bounds()
+		if got.Bounds().Dx() != b.Dx() || got.Bounds().Dy() != b.Dy() {
+			t.Fatalf("%s: decoded %v, want %v", name, got.Bounds(), b)
+		}
+		for y := 0; y < b.Dy(); y++ {
+			for x := 0; x < b.Dx(); x++ {
+				want := color.NRGBAModel.Convert(img.At(b.Min.X+x, b.Min.Y+y))
+				if have := color.NRGBAModel.Convert(got.At(x, y)); have != want {
+					t.Fatalf("%s: pixel (%d,%d) is %v, want %v", name, x, y, have, want)
+				}
+			}
+		}
+		if name == "flat" && buf.Len() > len(flat) {
+			t.Fatalf("flat image grew from %d PNG bytes to %d WebP bytes", len(flat), buf.Len())
+		}
+	}
+}
+
+func TestRenderDerivativesCachedAndEvicted(t *testing.T) {
+	dalle.SetupTest(t, dalle.SetupTestOptions{Series: []string{"empty"}})
+	UseStore(nil, defaultPresignTTL)
+	t.Cleanup(func() { UseStore(nil, defaultPresignTTL) })
+	const series, address = "empty", "0x6666666666666666666666666666666666666666"
+	src, _ := mockImagePNG("harbor", 64, 64)
+	local := filepath.Join(storage.OutputDir(), series, "annotated", address+".png")
+	_ = os.MkdirAll(filepath.Dir(local), 0o750)
+	_ = os.WriteFile(local, src, 0o600)
+
+	engine, _ := dalle.New(dalle.Config{})
+	dir := filepath.Join(storage.OutputDir(), "derivatives")
+	app := &App{Engine: engine, Derivatives: NewDerivativeCache(dir, 0)}
+	render := func(query string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		app.handleV1Image(rr, httptest.NewRequest(http.MethodGet, "/v1/images/"+series+":"+address+"/render"+query, nil))
+		return rr
+	}
+
+	before := GetMetricsCollector().GetMetrics()
+	rr := render("?w=16&format=webp")
+	if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != "image/webp" {
+		t.Fatalf("webp render: %d %s", rr.Code, rr.Body.String())
+	}
+	if img, err := webp.Decode(rr.Body); err != nil || img.Bounds().Dx() != 16 || img.Bounds().Dy() != 16 {
+		t.Fatalf("webp thumbnail: %v", err)
+	}
+	if rr := render("?w=16&format=webp"); rr.Code != http.StatusOK {
+		t.Fatalf("cached render: %d", rr.Code)
+	}
+	rr = render("?w=32&format=jpg&quality=50")
+	if img, err := jpeg.Decode(rr.Body); err != nil || img.Bounds().Dx() != 32 || rr.Header().Get("Content-Type") != "image/jpeg" {
+		t.Fatalf("jpeg render: %v", err)
+	}
+	// Larger than the source is served at the source's size
+	rr = render("?w=1024&format=png")
+	if img, err := png.Decode(rr.Body); err != nil || img.Bounds().Dx() != 64 {
+		t.Fatalf("png render: %v", err)
+	}
+	after := GetMetricsCollector().GetMetrics()
+	if after.DerivativeHits != before.DerivativeHits+1 || after.DerivativeMisses != before.DerivativeMisses+3 {
+		t.Fatalf("metrics: before %+v after %+v", before, after)
+	}
+
+	for query, code := range map[string]int{"?w=0": 400, "?w=abc": 400, "?format=gif": 400, "?format=jpeg&quality=101": 400} {
+		if rr := render(query); rr.Code != code {
+			t.Fatalf("%s: got %d, want %d", query, rr.Code, code)
+		}
+	}
+	rr = httptest.NewRecorder()
+	app.handleV1Image(rr, httptest.NewRequest(http.MethodGet, "/v1/images/"+series+":0x0/render", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("missing source: %d", rr.Code)
+	}
+	rr = httptest.NewRecorder()
+	app.handleV1Image(rr, httptest.NewRequest(http.MethodGet, "/v1/images/no-such-image/render", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("unknown image id: %d", rr.Code)
+	}
+
+	// Touch the first render, then shrink the cap below the total: the least recently
+	// used (the jpeg) goes first
+	render("?w=16&format=webp")
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	c := app.Derivatives
+	c.mu.Lock()
+	c.maxBytes = c.size - 1
+	c.evictLocked("")
+	c.mu.Unlock()
+	remaining, _ := filepath.Glob(filepath.Join(dir, "*"))
+	if len(remaining) != len(files)-1 {
+		t.Fatalf("expected one eviction, %d files became %d", len(files), len(remaining))
+	}
+	for _, f := range remaining {
+		if strings.HasSuffix(f, ".jpeg") {
+			t.Fatalf("least recently used derivative survived: %s", f)
+		}
+	}
+	if got := GetMetricsCollector().GetMetrics().DerivativeEvictions; got != after.DerivativeEvictions+1 {
+		t.Fatalf("evictions: %d", got)
+	}
+
+	// The cache picks its files back up after a restart
+	if _, count := NewDerivativeCache(dir, 0).Size(); count != len(remaining) {
+		t.Fatalf("reopened cache holds %d derivatives, want %d", count, len(remaining))
+	}
+
+	// A regenerated source gets fresh derivatives
+	regenerated, _ := mockImagePNG("lighthouse", 64, 64)
+	_ = os.WriteFile(local, regenerated, 0o600)
+	before = GetMetricsCollector().GetMetrics()
+	if rr := render("?w=16&format=webp"); rr.Code != http.StatusOK {
+		t.Fatalf("render after regeneration: %d", rr.Code)
+	}
+	if GetMetricsCollector().GetMetrics().DerivativeMisses != before.DerivativeMisses+1 {
+		t.Fatalf("a regenerated source was served a stale derivative")
+	}
+}
@@ -0,0 +1,609 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	dalle "github.com/TrueBlocks/trueblocks-dalle/v6"
+	"github.com/google/uuid"
+)
+
+// JobState represents the lifecycle state of a generation job
+type JobState string
+
+const (
+	JobQueued    JobState = "queued"
+	JobRunning   JobState = "running"
+	JobSucceeded JobState = "succeeded"
+	JobFailed    JobState = "failed"
+	JobCancelled JobState = "cancelled"
+)
+
+// IsTerminal reports whether the job will not change state again
+func (s JobState) IsTerminal() bool {
+	return s == JobSucceeded || s == JobFailed || s == JobCancelled
+}
+
+// JobKind identifies which code path executes a job
+type JobKind string
+
+const (
+	JobKindDalle    JobKind = "dalle"    // legacy /dalle/<series>/<address>?generate=1
+	JobKindGenerate JobKind = "generate" // POST /v1/images/generate
+)
+
+// jobRetention is how long finished job records are kept in memory and on disk
+const jobRetention = 7 * 24 * time.Hour
+
+// jobSweepInterval is how often finished jobs past jobRetention are evicted
+var jobSweepInterval = time.Hour
+
+// errJobCancelled is recorded on jobs stopped through the cancellation endpoints
+var errJobCancelled = errors.New("generation cancelled")
+
+// errJobNotCancellable is returned when cancelling a job that already finished
+var errJobNotCancellable = errors.New("job already finished")
+
+// Job is the persisted record of a single unit of generation work
+type Job struct {
+	ID        string                 `json:"id"`
+	Kind      JobKind                `json:"kind"`
+	State     JobState               `json:"state"`
+	Series    string                 `json:"series,omitempty"`
+	Address   string                 `json:"address,omitempty"`
+	Request   *dalle.GenerateRequest `json:"request,omitempty"`
+	RequestID string                 `json:"request_id,omitempty"`
+	BatchID   string                 `json:"batch_id,omitempty"`
+	Callbacks []string               `json:"callbacks,omitempty"` // webhook URLs notified when the job finishes
+	Priority  PriorityClass          `json:"priority,omitempty"`
+	Client    string                 `json:"client,omitempty"` // caller identity used for fair queuing
+	Attempts  int                    `json:"attempts"`
+	// CancelRequested is set on a running job whose cancellation waits for its runner to return
+	CancelRequested bool            `json:"cancel_requested,omitempty"`
+	Error           string          `json:"error,omitempty"`
+	ErrorCode       string          `json:"error_code,omitempty"`
+	Result          json.RawMessage `json:"result,omitempty"`
+	CreatedAt       time.Time       `json:"created_at"`
+	StartedAt       *time.Time      `json:"started_at,omitempty"`
+	FinishedAt      *time.Time      `json:"finished_at,omitempty"`
+}
+
+// class returns the job's priority class, treating unset as interactive
+func (j *Job) class() PriorityClass {
+	if j.Priority == "" {
+		return PriorityInteractive
+	}
+	return j.Priority
+}
+
+// flow groups jobs from the same caller and series for round-robin within a class
+func (j *Job) flow() string {
+	return j.Client + "|" + j.Series
+}
+
+// key returns the dedup key for jobs bound to a (series, address) pair
+func (j *Job) key() string {
+	if j.Kind != JobKindDalle {
+		return ""
+	}
+	return j.Series + ":" + j.Address
+}
+
+// JobStore persists job records as one JSON file per job
+type JobStore struct {
+	dir     string
+	fileOps *RobustFileOperations
+}
+
+// NewJobStore creates a store rooted at dir
+func NewJobStore(dir string) *JobStore {
+	return &JobStore{dir: dir, fileOps: NewRobustFileOperations()}
+}
+
+func (s *JobStore) path(id string) string {
+	return filepath.Join(s.dir, id+".json")
+}
+
+// Save writes the job record atomically
+func (s *JobStore) Save(job *Job) error {
+	data, err := json.MarshalIndent(job, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal job %s: %w", job.ID, err)
+	}
+	return s.fileOps.WriteFile(s.path(job.ID), data, job.RequestID)
+}
+
+// Delete removes the job record
+func (s *JobStore) Delete(id string) error {
+	return s.fileOps.RemoveFile(s.path(id), id)
+}
+
+// LoadAll reads every job record in the store, oldest first
+func (s *JobStore) LoadAll() ([]*Job, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	jobs := make([]*Job, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(s.dir, entry.Name())) // #nosec G304 - names come from ReadDir
+		if err != nil {
+			logWarn(fmt.Sprintf("[jobs] unable to read %s: %v", entry.Name(), err))
+			continue
+		}
+		var job Job
+		if err := json.Unmarshal(data, &job); err != nil || job.ID == "" {
+			logWarn(fmt.Sprintf("[jobs] skipping malformed job file %s", entry.Name()))
+			continue
+		}
+		jobs = append(jobs, &job)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].CreatedAt.Before(jobs[j].CreatedAt) })
+	return jobs, nil
+}
+
+// JobRunner executes a job and returns a JSON-serializable result. The context is
+// cancelled when the job is cancelled; runners should return promptly when it is.
+type JobRunner func(ctx context.Context, job *Job) (interface{}, error)
+
+// defaultMaxQueuedJobs bounds the number of jobs waiting for a worker unless --max-queue is set
+const defaultMaxQueuedJobs = 100
+
+// errQueueFull is returned by Enqueue when the wait queue is at capacity; callers shed the
+// request (429) rather than recording a failed job
+var errQueueFull = errors.New("job queue is full")
+
+// JobQueue runs persisted jobs on a bounded pool of workers
+type JobQueue struct {
+	mu      sync.Mutex
+	store   *JobStore
+	run     JobRunner
+	workers int
+	sched   *Scheduler
+	jobs    map[string]*Job
+	active  map[string]string // dedup key -> job id
+	waiters map[string][]chan struct{}
+	cancels map[string]context.CancelFunc
+	started sync.Once
+
+	// OnFinish, when set, is called with a copy of each job as it reaches a terminal state
+	OnFinish func(job *Job)
+
+	// Admit, when set, may refuse a new job before it is queued; joining an unfinished
+	// job for the same key is always allowed because it costs nothing extra
+	Admit func(job *Job) error
+}
+
+// NewJobQueue creates a queue; call Start to launch the workers
+func NewJobQueue(store *JobStore, workers int, run JobRunner) *JobQueue {
+	if workers <= 0 {
+		workers = 1
+	}
+	return &JobQueue{
+		store:   store,
+		run:     run,
+		workers: workers,
+		sched:   NewScheduler(defaultMaxQueuedJobs, defaultClassCaps(workers)),
+		jobs:    make(map[string]*Job),
+		active:  make(map[string]string),
+		waiters: make(map[string][]chan struct{}),
+		cancels: make(map[string]context.CancelFunc),
+	}
+}
+
+// SetClassCaps overrides per-class concurrency limits; zero means no limit beyond the pool
+func (q *JobQueue) SetClassCaps(caps map[PriorityClass]int) {
+	q.sched.SetLimits(caps)
+}
+
+// SetMaxQueued changes how many jobs may wait for a worker before new work is shed
+func (q *JobQueue) SetMaxQueued(n int) {
+	if n > 0 {
+		q.sched.SetCapacity(n)
+	}
+}
+
+// Queues reports per-class queue depth and running counts
+func (q *JobQueue) Queues() []ClassStatus {
+	return q.sched.Status()
+}
+
+// Start launches the worker pool (idempotent)
+func (q *JobQueue) Start() {
+	q.started.Do(func() {
+		for i := 0; i < q.workers; i++ {
+			go q.worker()
+		}
+		go q.sweep(jobSweepInterval)
+		logInfo(fmt.Sprintf("[jobs] started %d workers", q.workers))
+	})
+}
+
+// Recover reloads persisted jobs and requeues any that did not finish before the last shutdown
+func (q *JobQueue) Recover() error {
+	jobs, err := q.store.LoadAll()
+	if err != nil {
+		return err
+	}
+	requeued := 0
+	for _, job := range jobs {
+		if job.State.IsTerminal() {
+			if expired(job, time.Now()) {
+				_ = q.store.Delete(job.ID)
+				continue
+			}
+			q.mu.Lock()
+			q.jobs[job.ID] = job
+			q.mu.Unlock()
+			continue
+		}
+		if job.CancelRequested {
+			// The shutdown interrupted the run the caller had already cancelled
+			now := time.Now()
+			job.State, job.Error, job.FinishedAt = JobCancelled, errJobCancelled.Error(), &now
+			_ = q.store.Save(job)
+			q.mu.Lock()
+			q.jobs[job.ID] = job
+			q.mu.Unlock()
+			continue
+		}
+		job.State = JobQueued
+		job.StartedAt = nil
+		if err := q.submit(job, true); err != nil {
+			logWarn(fmt.Sprintf("[jobs] unable to requeue %s: %v", job.ID, err))
+			continue
+		}
+		requeued++
+	}
+	logInfo(fmt.Sprintf("[jobs] recovered %d jobs (%d requeued)", len(jobs), requeued))
+	return nil
+}
+
+// expired reports whether a finished job is past jobRetention
+func expired(job *Job, now time.Time) bool {
+	return job.State.IsTerminal() && job.FinishedAt != nil && now.Sub(*job.FinishedAt) > jobRetention
+}
+
+// sweep evicts expired jobs every interval for the life of the process
+func (q *JobQueue) sweep(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if n := q.Prune(time.Now()); n > 0 {
+			logInfo(fmt.Sprintf("[jobs] evicted %d finished jobs older than %s", n, jobRetention))
+		}
+	}
+}
+
+// Prune forgets finished jobs that were past jobRetention at now, in memory and on disk,
+// and returns how many it removed
+func (q *JobQueue) Prune(now time.Time) int {
+	q.mu.Lock()
+	var ids []string
+	for id, job := range q.jobs {
+		if expired(job, now) {
+			ids = append(ids, id)
+			delete(q.jobs, id)
+		}
+	}
+	q.mu.Unlock()
+	for _, id := range ids {
+		if err := q.store.Delete(id); err != nil {
+			logWarn(fmt.Sprintf("[jobs] unable to remove expired job %s: %v", id, err))
+		}
+	}
+	return len(ids)
+}
+
+// NewJob builds a queued job record
+func NewJob(kind JobKind, requestID string) *Job {
+	return &Job{
+		ID:        uuid.New().String(),
+		Kind:      kind,
+		State:     JobQueued,
+		RequestID: requestID,
+		CreatedAt: time.Now(),
+	}
+}
+
+// Enqueue persists the job and schedules it. If an unfinished job already exists for the
+// same (series, address) the existing job is returned instead and nothing new is queued.
+// When the wait queue is full the job is not recorded and errQueueFull is returned.
+func (q *JobQueue) Enqueue(job *Job) (*Job, error) {
+	if job.Kind == JobKindDalle {
+		if existing := q.join(job); existing != nil {
+			return existing, nil
+		}
+	}
+	if q.Admit != nil {
+		if err := q.Admit(job); err != nil {
+			return nil, err
+		}
+	}
+	if q.sched.Full(job.class()) {
+		return nil, errQueueFull
+	}
+	if err := q.submit(job, false); err != nil {
+		return nil, err
+	}
+	return q.Get(job.ID), nil
+}
+
+// join returns the unfinished job for job's key, adding job's callbacks to it, or nil.
+// A queued job joined by a more important request is promoted to that request's class.
+func (q *JobQueue) join(job *Job) *Job {
+	q.mu.Lock()
+	id, ok := q.active[job.key()]
+	existing := q.jobs[id]
+	if !ok || existing == nil {
+		q.mu.Unlock()
+		return nil
+	}
+	existing.Callbacks = append(existing.Callbacks, job.Callbacks...)
+	promoted := existing.State == JobQueued && job.class().rank() < existing.class().rank()
+	if promoted {
+		existing.Priority = job.class()
+	}
+	snapshot := *existing
+	q.mu.Unlock()
+	if promoted && !q.sched.Promote(id, job.class()) {
+		// A worker took the job between the check and the move; it runs in its old class
+		logInfo(fmt.Sprintf("[%s] job %s started before it could be promoted", job.RequestID, id))
+	}
+	if len(job.Callbacks) > 0 || promoted {
+		if err := q.store.Save(&snapshot); err != nil {
+			logWarn(fmt.Sprintf("[%s] unable to persist joined job %s: %v", job.RequestID, id, err))
+		}
+	}
+	return &snapshot
+}
+
+// RunInline persists and executes the job on the calling goroutine (used when debugging)
+func (q *JobQueue) RunInline(job *Job) *Job {
+	if err := q.track(job); err != nil {
+		logError(fmt.Sprintf("[%s] unable to persist job %s: %v", job.RequestID, job.ID, err))
+	}
+	q.execute(job.ID)
+	return q.Get(job.ID)
+}
+
+// submit tracks and schedules a job. New jobs that find the queue full are forgotten and
+// errQueueFull is returned; recovered jobs were accepted before and always fit.
+func (q *JobQueue) submit(job *Job, recovered bool) error {
+	if err := q.track(job); err != nil {
+		q.finish(job.ID, nil, err)
+		return err
+	}
+	if err := q.sched.push(job.ID, job.class(), job.flow(), recovered); err != nil {
+		q.untrack(job)
+		return err
+	}
+	return nil
+}
+
+// untrack drops a job that was never scheduled
+func (q *JobQueue) untrack(job *Job) {
+	q.mu.Lock()
+	delete(q.jobs, job.ID)
+	if k := job.key(); k != "" && q.active[k] == job.ID {
+		delete(q.active, k)
+	}
+	q.mu.Unlock()
+	_ = q.store.Delete(job.ID)
+}
+
+// track registers the job in memory and persists it; the in-memory record is kept even
+// when the disk write fails so the job can still run to completion
+func (q *JobQueue) track(job *Job) error {
+	q.mu.Lock()
+	q.jobs[job.ID] = job
+	if k := job.key(); k != "" {
+		q.active[k] = job.ID
+	}
+	snapshot := *job
+	q.mu.Unlock()
+	return q.store.Save(&snapshot)
+}
+
+func (q *JobQueue) worker() {
+	for {
+		id, class := q.sched.Next()
+		q.execute(id)
+		q.sched.Done(class)
+	}
+}
+
+func (q *JobQueue) execute(id string) {
+	q.mu.Lock()
+	job := q.jobs[id]
+	if job == nil || job.State != JobQueued {
+		q.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	job.State = JobRunning
+	job.StartedAt = &now
+	job.Attempts++
+	ctx, cancel := context.WithCancel(context.Background())
+	q.cancels[id] = cancel
+	snapshot := *job
+	q.mu.Unlock()
+
+	if err := q.store.Save(&snapshot); err != nil {
+		logWarn(fmt.Sprintf("[%s] unable to persist running job %s: %v", job.RequestID, id, err))
+	}
+
+	result, err := q.safeRun(ctx, &snapshot)
+	q.finish(id, result, err)
+}
+
+// safeRun shields the worker pool from panics inside a runner
+func (q *JobQueue) safeRun(ctx context.Context, job *Job) (result interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("job panicked: %v", r)
+		}
+	}()
+	return q.run(ctx, job)
+}
+
+// Cancel stops a queued or running job. Queued jobs never start and are cancelled at once.
+// Running jobs have their context cancelled and keep their state and key until the runner
+// returns, so a job is never reported cancelled while its provider call is still in flight.
+// A runner that finishes anyway records its real outcome.
+func (q *JobQueue) Cancel(id string) (*Job, error) {
+	q.mu.Lock()
+	job := q.jobs[id]
+	if job == nil {
+		q.mu.Unlock()
+		return nil, fmt.Errorf("job %s not found", id)
+	}
+	if job.State.IsTerminal() {
+		cp := *job
+		q.mu.Unlock()
+		return &cp, errJobNotCancellable
+	}
+	if cancel := q.cancels[id]; cancel != nil {
+		job.CancelRequested = true
+		snapshot := *job
+		// Saved under the lock so the runner's final record cannot be overwritten by this one
+		if err := q.store.Save(&snapshot); err != nil {
+			logWarn(fmt.Sprintf("[%s] unable to persist cancelling job %s: %v", snapshot.RequestID, id, err))
+		}
+		q.mu.Unlock()
+		cancel()
+		return &snapshot, nil
+	}
+	q.mu.Unlock()
+
+	// A worker that popped the job meanwhile finds it cancelled and skips it
+	q.sched.Remove(id)
+	q.finish(id, nil, errJobCancelled)
+	return q.Get(id), nil
+}
+
+func (q *JobQueue) finish(id string, result interface{}, runErr error) {
+	q.mu.Lock()
+	job := q.jobs[id]
+	if job == nil || job.State.IsTerminal() {
+		q.mu.Unlock()
+		return
+	}
+	if cancel := q.cancels[id]; cancel != nil {
+		cancel()
+		delete(q.cancels, id)
+	}
+	now := time.Now()
+	job.FinishedAt = &now
+	if errors.Is(runErr, errJobCancelled) || errors.Is(runErr, context.Canceled) {
+		job.State = JobCancelled
+		job.Error = errJobCancelled.Error()
+	} else if runErr != nil {
+		job.State = JobFailed
+		job.Error = runErr.Error()
+		job.ErrorCode = string(dalle.ErrorCodeOf(runErr))
+	} else {
+		job.State = JobSucceeded
+		if result != nil {
+			if encoded, err := json.Marshal(result); err == nil {
+				job.Result = encoded
+			}
+		}
+	}
+	if k := job.key(); k != "" && q.active[k] == id {
+		delete(q.active, k)
+	}
+	waiters := q.waiters[id]
+	delete(q.waiters, id)
+	snapshot := *job
+	q.mu.Unlock()
+
+	if err := q.store.Save(&snapshot); err != nil {
+		logWarn(fmt.Sprintf("[%s] unable to persist finished job %s: %v", snapshot.RequestID, id, err))
+	}
+	for _, ch := range waiters {
+		close(ch)
+	}
+	if q.OnFinish != nil {
+		q.OnFinish(&snapshot)
+	}
+}
+
+// Get returns a copy of the job with the given id, or nil
+func (q *JobQueue) Get(id string) *Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if job := q.jobs[id]; job != nil {
+		cp := *job
+		return &cp
+	}
+	return nil
+}
+
+// ActiveFor returns the unfinished job for (series, address), or nil
+func (q *JobQueue) ActiveFor(series, address string) *Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if id, ok := q.active[series+":"+address]; ok {
+		if job := q.jobs[id]; job != nil {
+			cp := *job
+			return &cp
+		}
+	}
+	return nil
+}
+
+// List returns copies of all known jobs, newest first, optionally filtered by state
+func (q *JobQueue) List(state JobState) []*Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	out := make([]*Job, 0, len(q.jobs))
+	for _, job := range q.jobs {
+		if state != "" && job.State != state {
+			continue
+		}
+		cp := *job
+		out = append(out, &cp)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.After(out[j].CreatedAt) })
+	return out
+}
+
+// Wait blocks until the job reaches a terminal state or ctx is done
+func (q *JobQueue) Wait(ctx context.Context, id string) (*Job, error) {
+	q.mu.Lock()
+	job := q.jobs[id]
+	if job == nil {
+		q.mu.Unlock()
+		return nil, fmt.Errorf("job %s not found", id)
+	}
+	if job.State.IsTerminal() {
+		cp := *job
+		q.mu.Unlock()
+		return &cp, nil
+	}
+	ch := make(chan struct{})
+	q.waiters[id] = append(q.waiters[id], ch)
+	q.mu.Unlock()
+
+	select {
+	case <-ch:
+		return q.Get(id), nil
+	case <-ctx.Done():
+		return q.Get(id), ctx.Err()
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func waitForJob(t *testing.T, q *JobQueue, id string) *Job {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	job, err := q.Wait(ctx, id)
+	if err != nil {
+		t.Fatalf("wait for job %s: %v", id, err)
+	}
+	return job
+}
+
+func TestJobQueueRunsAndPersists(t *testing.T) {
+	store := NewJobStore(t.TempDir())
+	q := NewJobQueue(store, 2, func(_ context.Context, job *Job) (interface{}, error) {
+		if job.Address == "0xbad" {
+			return nil, fmt.Errorf("forced failure")
+		}
+		return map[string]string{"path": job.Series + "/" + job.Address}, nil
+	})
+	q.Start()
+
+	ok := NewJob(JobKindDalle, "req-ok")
+	ok.Series, ok.Address = "empty", "0xgood"
+	bad := NewJob(JobKindDalle, "req-bad")
+	bad.Series, bad.Address = "empty", "0xbad"
+	for _, job := range []*Job{ok, bad} {
+		if _, err := q.Enqueue(job); err != nil {
+			t.Fatalf("enqueue: %v", err)
+		}
+	}
+
+	if got := waitForJob(t, q, ok.ID); got.State != JobSucceeded || string(got.Result) != `{"path":"empty/0xgood"}` {
+		t.Fatalf("unexpected successful job: %#v", got)
+	}
+	if got := waitForJob(t, q, bad.ID); got.State != JobFailed || got.Error != "forced failure" {
+		t.Fatalf("unexpected failed job: %#v", got)
+	}
+
+	persisted, err := store.LoadAll()
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if len(persisted) != 2 {
+		t.Fatalf("expected 2 persisted jobs, got %d", len(persisted))
+	}
+	for _, job := range persisted {
+		if !job.State.IsTerminal() || job.FinishedAt == nil {
+			t.Fatalf("expected persisted terminal job, got %#v", job)
+		}
+	}
+}
+
+func TestJobQueueDeduplicatesActiveKey(t *testing.T) {
+	release := make(chan struct{})
+	var runs int32
+	q := NewJobQueue(NewJobStore(t.TempDir()), 2, func(_ context.Context, job *Job) (interface{}, error) {
+		atomic.AddInt32(&runs, 1)
+		<-release
+		return nil, nil
+	})
+	q.Start()
+
+	first := NewJob(JobKindDalle, "a")
+	first.Series, first.Address = "empty", "0x1"
+	second := NewJob(JobKindDalle, "b")
+	second.Series, second.Address = "empty", "0x1"
+	queued1, _ := q.Enqueue(first)
+	queued2, _ := q.Enqueue(second)
+	if queued1.ID != queued2.ID {
+		t.Fatalf("expected duplicate request to join job %s, got %s", queued1.ID, queued2.ID)
+	}
+	close(release)
+	waitForJob(t, q, queued1.ID)
+	if n := atomic.LoadInt32(&runs); n != 1 {
+		t.Fatalf("expected one run, got %d", n)
+	}
+	if q.ActiveFor("empty", "0x1") != nil {
+		t.Fatalf("expected no active job after completion")
+	}
+}
+
+func TestJobQueueRecoversUnfinishedJobs(t *testing.T) {
+	dir := t.TempDir()
+	store := NewJobStore(dir)
+
+	running := NewJob(JobKindDalle, "r")
+	running.Series, running.Address = "empty", "0x2"
+	running.State = JobRunning
+	queued := NewJob(JobKindDalle, "q")
+	queued.Series, queued.Address = "empty", "0x3"
+	old := NewJob(JobKindDalle, "o")
+	old.State = JobSucceeded
+	finishedAt := time.Now().Add(-2 * jobRetention)
+	old.FinishedAt = &finishedAt
+	for _, job := range []*Job{running, queued, old} {
+		if err := store.Save(job); err != nil {
+			t.Fatalf("save: %v", err)
+		}
+	}
+
+	var runs int32
+	q := NewJobQueue(NewJobStore(dir), 1, func(_ context.Context, job *Job) (interface{}, error) {
+		atomic.AddInt32(&runs, 1)
+		return nil, nil
+	})
+	if err := q.Recover(); err != nil {
+		t.Fatalf("recover: %v", err)
+	}
+	q.Start()
+
+	for _, id := range []string{running.ID, queued.ID} {
+		if got := waitForJob(t, q, id); got.State != JobSucceeded || got.Attempts != 1 {
+			t.Fatalf("expected recovered job to succeed: %#v", got)
+		}
+	}
+	if n := atomic.LoadInt32(&runs); n != 2 {
+		t.Fatalf("expected 2 recovered runs, got %d", n)
+	}
+	if q.Get(old.ID) != nil {
+		t.Fatalf("expected expired job to be pruned")
+	}
+}
+
+func TestJobQueueSweepsExpiredJobs(t *testing.T) {
+	saved := jobSweepInterval
+	jobSweepInterval = 10 * time.Millisecond
+	t.Cleanup(func() { jobSweepInterval = saved })
+	dir := t.TempDir()
+	release := make(chan struct{})
+	q := NewJobQueue(NewJobStore(dir), 2, func(ctx context.Context, job *Job) (interface{}, error) {
+		if job.RequestID == "long" {
+			<-release
+		}
+		return nil, nil
+	})
+	defer close(release)
+	q.Start()
+
+	done, _ := q.Enqueue(NewJob(JobKindGenerate, "done"))
+	waitForJob(t, q, done.ID)
+	long, _ := q.Enqueue(NewJob(JobKindGenerate, "long"))
+	if n := q.Prune(time.Now()); n != 0 {
+		t.Fatalf("pruned %d jobs inside the retention window", n)
+	}
+
+	// Age the finished job past retention and let the sweep find it
+	q.mu.Lock()
+	finishedAt := time.Now().Add(-2 * jobRetention)
+	q.jobs[done.ID].FinishedAt = &finishedAt
+	q.mu.Unlock()
+	deadline := time.Now().Add(5 * time.Second)
+	for q.Get(done.ID) != nil && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if q.Get(done.ID) != nil {
+		t.Fatalf("expected the expired job to be evicted")
+	}
+	if _, err := os.Stat(q.store.path(done.ID)); !os.IsNotExist(err) {
+		t.Fatalf("expected the expired job's record removed, got %v", err)
+	}
+	if q.Get(long.ID) == nil {
+		t.Fatalf("an unfinished job was evicted")
+	}
+}
+
+func TestJobQueueCancel(t *testing.T) {
+	started := make(chan struct{})
+	q := NewJobQueue(NewJobStore(t.TempDir()), 1, func(ctx context.Context, job *Job) (interface{}, error) {
+		close(started)
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	q.Start()
+
+	running := NewJob(JobKindDalle, "run")
+	running.Series, running.Address = "empty", "0x4"
+	waiting := NewJob(JobKindDalle, "wait")
+	waiting.Series, waiting.Address = "empty", "0x5"
+	_, _ = q.Enqueue(running)
+	_, _ = q.Enqueue(waiting)
+	<-started
+
+	if job, err := q.Cancel(waiting.ID); err != nil || job.State != JobCancelled {
+		t.Fatalf("expected the queued job cancelled at once, got %#v %v", job, err)
+	}
+	// A running job stays running until its runner returns
+	if job, err := q.Cancel(running.ID); err != nil || job.State != JobRunning || !job.CancelRequested {
+		t.Fatalf("expected the running job to await its runner, got %#v %v", job, err)
+	}
+	if got := waitForJob(t, q, running.ID); got.State != JobCancelled || got.Error != errJobCancelled.Error() {
+		t.Fatalf("unexpected running job after cancel: %#v", got)
+	}
+	if _, err := q.Cancel(running.ID); err != errJobNotCancellable {
+		t.Fatalf("expected errJobNotCancellable, got %v", err)
+	}
+	if q.ActiveFor("empty", "0x4") != nil || q.ActiveFor("empty", "0x5") != nil {
+		t.Fatalf("expected cancelled jobs to release their keys")
+	}
+}
+
+func TestJobQueueCancelFreesQueueSpace(t *testing.T) {
+	release := make(chan struct{})
+	var runs atomic.Int32
+	q := NewJobQueue(NewJobStore(t.TempDir()), 1, func(ctx context.Context, job *Job) (interface{}, error) {
+		if runs.Add(1) == 1 {
+			<-release
+		}
+		return nil, nil
+	})
+	q.SetMaxQueued(2)
+	q.Start()
+
+	blocker, _ := q.Enqueue(NewJob(JobKindGenerate, "blocker"))
+	deadline := time.Now().Add(5 * time.Second)
+	for q.Get(blocker.ID).State != JobRunning && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	var queued []*Job
+	for i := 0; i < 2; i++ {
+		job, err := q.Enqueue(NewJob(JobKindGenerate, fmt.Sprintf("queued-%d", i)))
+		if err != nil {
+			t.Fatalf("enqueue %d: %v", i, err)
+		}
+		queued = append(queued, job)
+	}
+	if _, err := q.Enqueue(NewJob(JobKindGenerate, "shed")); err != errQueueFull {
+		t.Fatalf("expected a full queue, got %v", err)
+	}
+
+	// Cancelled jobs give their places back while the only worker is still busy
+	for _, job := range queued {
+		if _, err := q.Cancel(job.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if q.sched.Size() != 0 {
+		t.Fatalf("cancelled jobs still waiting: %d", q.sched.Size())
+	}
+	next, err := q.Enqueue(NewJob(JobKindGenerate, "next"))
+	if err != nil {
+		t.Fatalf("submit after cancelling: %v", err)
+	}
+	close(release)
+	if got := waitForJob(t, q, next.ID); got.State != JobSucceeded || runs.Load() != 2 {
+		t.Fatalf("expected only the blocker and the new job to run, got %d runs, %#v", runs.Load(), got)
+	}
+}
@@ -42,32 +42,60 @@ func fileExists(path string) bool {
 func main() {
 	app := NewApp()
 
-	// Fail fast if required OpenAI key missing (before starting server)
+	// Fail fast if required OpenAI key missing (before starting server); the mock provider supplies its own
 	if os.Getenv("OPENAI_API_KEY") == "" {
 		panic("OPENAI_API_KEY is required but not set. Please configure your OpenAI API key and try again.")
 	}
 
-	// Initialize circuit breaker for OpenAI
-	circuitBreaker := NewCircuitBreaker(5, 30*time.Second)
+	// The middleware and the openai health component follow the chat completions breaker;
+	// every registered breaker is reported as the circuit_breakers component
+	circuitBreaker := GetBreakerRegistry().Get(BreakerChat)
 
-	// Initialize health checker with circuit breaker
+	// Initialize health checker with circuit breakers
 	GetHealthChecker().SetCircuitBreaker(circuitBreaker)
+	GetHealthChecker().SetBreakers(GetBreakerRegistry())
+	GetHealthChecker().SetRetention(app.Retention)
 
-	printStartupReport()
+	printStartupReport(app)
+
+	if err := app.Jobs.Recover(); err != nil {
+		logWarn(fmt.Sprintf("Unable to recover persisted jobs: %v", err))
+	}
+	if err := app.Batches.Recover(); err != nil {
+		logWarn(fmt.Sprintf("Unable to recover persisted batches: %v", err))
+	}
+	if n := app.Idempotency.Prune(); n > 0 {
+		logInfo(fmt.Sprintf("Pruned %d expired idempotency records", n))
+	}
 
 	mux := http.NewServeMux()
 
 	// Apply middleware to all handlers
 	mux.HandleFunc("/", WrapWithMiddleware(app.handleDefault, circuitBreaker))
-	mux.HandleFunc("/v1/images/generate", WrapWithMiddleware(app.handleV1ImagesGenerate, circuitBreaker))
+	mux.HandleFunc("/v1/images/generate", WrapWithMiddleware(app.withIdempotency(app.handleV1ImagesGenerate), circuitBreaker))
 	mux.HandleFunc("/v1/images/preview", WrapWithMiddleware(app.handleV1ImagesPreview, circuitBreaker))
-	mux.HandleFunc("/v1/images/", WrapWithMiddleware(app.handleV1Image, circuitBreaker))
+	mux.HandleFunc("/v1/images/", WrapWithMiddleware(app.withIdempotency(app.handleV1Image), circuitBreaker))
 	mux.HandleFunc("/v1/images", WrapWithMiddleware(app.handleV1Images, circuitBreaker))
+	mux.HandleFunc("/v1/blobs/", WrapWithMiddleware(app.handleV1Blob, circuitBreaker))
+	mux.HandleFunc("/v1/dress/", WrapWithMiddleware(app.handleV1Dress, circuitBreaker))
+	mux.HandleFunc("/v1/batches/", WrapWithMiddleware(app.handleV1Batch, circuitBreaker))
+	mux.HandleFunc("/v1/batches", WrapWithMiddleware(app.handleV1Batches, circuitBreaker))
+	mux.HandleFunc("/v1/webhooks/", WrapWithMiddleware(app.handleV1Webhook, circuitBreaker))
+	mux.HandleFunc("/v1/webhooks", WrapWithMiddleware(app.handleV1Webhooks, circuitBreaker))
+	mux.HandleFunc("/v1/jobs/", WrapWithMiddleware(app.handleV1Job, circuitBreaker))
+	mux.HandleFunc("/v1/jobs", WrapWithMiddleware(app.handleV1Jobs, circuitBreaker))
+	mux.HandleFunc("/v1/progress/", WrapWithMiddleware(app.handleV1Progress, circuitBreaker))
+	mux.HandleFunc("/v1/ws", WrapWithMiddleware(app.handleV1WS, circuitBreaker))
 	mux.HandleFunc("/v1/series/", WrapWithMiddleware(app.handleV1SeriesItem, circuitBreaker))
 	mux.HandleFunc("/v1/series", WrapWithMiddleware(app.handleV1Series, circuitBreaker))
 	mux.HandleFunc("/v1/databases/", WrapWithMiddleware(app.handleV1Database, circuitBreaker))
 	mux.HandleFunc("/v1/databases", WrapWithMiddleware(app.handleV1Databases, circuitBreaker))
 	mux.HandleFunc("/v1/validate", WrapWithMiddleware(app.handleV1Validate, circuitBreaker))
+	mux.HandleFunc("/v1/usage", WrapWithMiddleware(app.handleV1Usage, circuitBreaker))
+	mux.HandleFunc("/v1/admin/breakers/", WrapWithMiddleware(app.handleV1AdminBreaker, circuitBreaker))
+	mux.HandleFunc("/v1/admin/breakers", WrapWithMiddleware(app.handleV1AdminBreakers, circuitBreaker))
+	mux.HandleFunc("/v1/admin/retention/", WrapWithMiddleware(app.handleV1AdminRetention, circuitBreaker))
+	mux.HandleFunc("/v1/admin/retention", WrapWithMiddleware(app.handleV1AdminRetention, circuitBreaker))
 	mux.HandleFunc("/dalle/", WrapWithMiddleware(app.handleDalleDress, circuitBreaker))
 	mux.HandleFunc("/series", WrapWithMiddleware(app.handleSeries, circuitBreaker))
 	mux.HandleFunc("/series/", WrapWithMiddleware(app.handleSeries, circuitBreaker))
@@ -75,7 +103,7 @@ func main() {
 	mux.HandleFunc("/metrics", WrapWithMiddleware(app.handleMetrics, circuitBreaker))
 	mux.HandleFunc("/preview", WrapWithMiddleware(app.handlePreview, circuitBreaker))
 	mux.HandleFunc("/errors", WrapWithMiddleware(handleErrors, circuitBreaker))
-	mux.Handle("/files/", http.StripPrefix("/files/", http.FileServer(http.Dir(storage.OutputDir()))))
+	mux.HandleFunc("/files/", app.handleFiles)
 
 	startStatusPrinter(0)
 
@@ -105,6 +133,7 @@ func main() {
 	if err := srv.Shutdown(ctx); err != nil {
 		_ = srv.Close()
 	}
+	app.Retention.Stop()
 }
 
 func getPort() string {
@@ -133,7 +162,7 @@ var (
 )
 
 // printStartupReport displays build and runtime information when the server starts
-func printStartupReport() {
+func printStartupReport(app *App) {
 	logInfo("=== TrueBlocks DALLE Server Startup Report ===")
 	logInfo(fmt.Sprintf("Version: %s", Version))
 	logInfo(fmt.Sprintf("Build Time: %s", BuildTime))
@@ -142,6 +171,51 @@ func printStartupReport() {
 	logInfo(fmt.Sprintf("Go Version: %s", runtime.Version()))
 	logInfo(fmt.Sprintf("Go OS/Arch: %s/%s", runtime.GOOS, runtime.GOARCH))
 	logInfo(fmt.Sprintf("Start Time: %s", time.Now().Format("2006-01-02 15:04:05 MST")))
+	provider := CurrentProvider()
+	logInfo(fmt.Sprintf("Provider: %s (chat %s, images %s)", provider.Name(), provider.ChatURL(), provider.ImageURL()))
+	deployment := defaultEnhancementSettings().Merge(app.Config.Enhancement)
+	logInfo(fmt.Sprintf("Enhancement: %s (endpoint %s, streamed, idle timeout %s)", deployment, deployment.ChatURL(provider), enhanceIdleTimeout))
+	for i, fallback := range app.Config.EnhancementFallbacks {
+		logInfo(fmt.Sprintf("Enhancement fallback %d: %s", i+1, fallback))
+	}
+	for _, series := range app.ValidSeries {
+		if over, err := seriesEnhancement(series); err == nil && over != (EnhancementSettings{}) {
+			logInfo(fmt.Sprintf("Enhancement [%s]: %s", series, app.enhancementFor(series)))
+		}
+	}
+	for _, b := range GetBreakerRegistry().Snapshot() {
+		trip := fmt.Sprintf("failure threshold %d", b.FailureThreshold)
+		if w := b.Window; w != nil {
+			trip = fmt.Sprintf("window %s, min calls %d, failure rate %.0f%%, slow calls (>= %s) %.0f%%", w.Window, w.MinCalls, w.FailureRateThreshold, w.SlowCallDuration, w.SlowCallRateThreshold)
+		}
+		logInfo(fmt.Sprintf("Circuit breaker %s (%s): %s, reset %s, success threshold %d, half-open probes %d", b.Name, b.Mode, trip, b.ResetTimeout, b.SuccessThreshold, b.HalfOpenProbes))
+	}
+	pace := "provider rate-limit headers"
+	if app.Config.RequestsPerMinute > 0 {
+		pace = fmt.Sprintf("%d requests/minute", app.Config.RequestsPerMinute)
+	}
+	retryBudget := "unlimited"
+	if app.Config.RetryBudget > 0 {
+		retryBudget = fmt.Sprintf("%.0f%% of provider calls", app.Config.RetryBudget*100)
+	}
+	logInfo(fmt.Sprintf("Rate limits: chat paced by %s, retry budget %s", pace, retryBudget))
+	hedge := "off"
+	if app.Config.DownloadHedge > 0 {
+		hedge = fmt.Sprintf("after p%g of recent downloads", app.Config.DownloadHedge)
+	}
+	logInfo(fmt.Sprintf("Image downloads: hedge %s, up to %d MiB, resumed up to %d times", hedge, app.Config.DownloadMaxBytes>>20, maxDownloadResumes))
+	artifacts := "local, in the output directory"
+	if s3, ok := CurrentStore().(*S3Store); ok {
+		artifacts = s3.Describe()
+		if app.Config.PresignTTL > 0 {
+			artifacts += fmt.Sprintf(", redirecting to presigned URLs valid %v", app.Config.PresignTTL)
+		}
+	}
+	logInfo("Storage: " + artifacts)
+	cached, count := app.Derivatives.Size()
+	logInfo(fmt.Sprintf("Derivatives: %d cached (%d of %d MiB)", count, cached>>20, app.Config.DerivativeCacheBytes>>20))
+	logInfo(fmt.Sprintf("Budgets: daily %s, monthly %s", formatBudget(app.Config.DailyBudget), formatBudget(app.Config.MonthlyBudget)))
+	logInfo("Retention: " + formatRetention(app.Config.Retention))
 
 	logInfo("--- Database Information ---")
 	cm := storage.GetCacheManager()
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"path/filepath"
+	"sort"
+	"time"
+
+	dalle "github.com/TrueBlocks/trueblocks-dalle/v6"
+	"github.com/TrueBlocks/trueblocks-dalle/v6/pkg/storage"
+)
+
+const (
+	// blobsPrefix holds artifacts by content, "blobs/<sha256[:2]>/<sha256>.<ext>"
+	blobsPrefix = "blobs"
+	// manifestsPrefix holds one manifest per generation,
+	// "manifests/<series>/<address>/<id>.json"
+	manifestsPrefix = "manifests"
+	// manifestIDLayout makes manifest IDs sort in the order they were recorded
+	manifestIDLayout = "20060102T150405.000000000Z"
+)
+
+// manifestTextKinds are the artifacts whose digests are also listed as prompt hashes
+var manifestTextKinds = map[string]bool{"data": true, "title": true, "terse": true, "prompt": true, "enhanced": true}
+
+// ManifestArtifact is one artifact of a generation, by kind (the directory the library
+// writes it to, "annotated", "selector" for the DalleDress, "prompt", ...) and by content
+type ManifestArtifact struct {
+	Kind        string `json:"kind"`
+	Digest      string `json:"digest"`
+	Size        int64  `json:"size"`
+	ContentType string `json:"content_type"`
+	URL         string `json:"url"`
+}
+
+// Manifest records what a generation produced and what it was produced from. Its
+// artifacts live in the blob store, so a manifest keeps describing readable content after
+// the image is regenerated.
+type Manifest struct {
+	ID                  string             `json:"id"`
+	Series              string             `json:"series"`
+	Address             string             `json:"address"`
+	JobID               string             `json:"job_id,omitempty"`
+	RequestID           string             `json:"request_id,omitempty"`
+	Provider            string             `json:"provider"`
+	EnhancementProvider string             `json:"enhancement_provider,omitempty"`
+	DatabaseVersions    map[string]string  `json:"database_versions,omitempty"`
+	PromptHashes        map[string]string  `json:"prompt_hashes,omitempty"`
+	StartedAt           time.Time          `json:"started_at"`
+	FinishedAt          time.Time          `json:"finished_at"`
+	Artifacts           []ManifestArtifact `json:"artifacts"`
+}
+
+// blobKey is the store key of the content with digest sum
+func blobKey(sum, ext string) string {
+	return artifactKey(blobsPrefix, sum[:2], sum+ext)
+}
+
+// blobURLFor is the immutable URL of the blob with digest sum
+func blobURLFor(sum, ext string) string {
+	return "/v1/blobs/" + sum + ext
+}
+
+// manifestPrefix is the key prefix of every manifest recorded for (series, address)
+func manifestPrefix(series, address string) string {
+	return artifactKey(manifestsPrefix, series, address) + "/"
+}
+
+// storeBlob writes data to the blob store under its digest, unless the store already
+// holds that content (from this or any other series)
+func storeBlob(ctx context.Context, store ArtifactStore, data []byte, ext, requestID string) (string, error) {
+	sum := sha256Hex(data)
+	key := blobKey(sum, ext)
+	info, err := store.Stat(ctx, key)
+	if err == nil && info.Size == int64(len(data)) {
+		GetMetricsCollector().RecordBlob(true)
+		return sum, nil
+	}
+	if err != nil && !errors.Is(err, ErrArtifactNotFound) {
+		return "", err
+	}
+	if err := GetFileOperations().PutArtifact(store, key, data, requestID); err != nil {
+		return "", err
+	}
+	GetMetricsCollector().RecordBlob(false)
+	return sum, nil
+}
+
+// recordManifest copies the artifacts of a finished generation into the blob store and
+// records its manifest. The files under the series stay as they are: the library rewrites
+// them in place on the next run, so they cannot share storage with a blob that must never
+// change. Until then each is a second copy, reported as copy_bytes by the janitor.
+func recordManifest(job *Job, started, finished time.Time) (*Manifest, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), artifactOpTimeout)
+	defer cancel()
+	store := CurrentStore()
+	m := &Manifest{
+		ID:                  finished.UTC().Format(manifestIDLayout),
+		Series:              job.Series,
+		Address:             job.Address,
+		JobID:               job.ID,
+		RequestID:           job.RequestID,
+		Provider:            CurrentProvider().Name(),
+		EnhancementProvider: enhancementProviderFor(job.Series, job.Address),
+		DatabaseVersions:    databaseVersions(),
+		PromptHashes:        map[string]string{},
+		StartedAt:           started.UTC(),
+		FinishedAt:          finished.UTC(),
+		Artifacts:           []ManifestArtifact{},
+	}
+	for _, key := range artifactPaths(job.Series, job.Address) {
+		local := filepath.Join(storage.OutputDir(), filepath.FromSlash(key))
+		if !fileExists(local) {
+			continue
+		}
+		data, err := GetFileOperations().ReadFile(local, job.RequestID)
+		if err != nil {
+			return nil, err
+		}
+		kind, ext := path.Base(path.Dir(key)), path.Ext(key)
+		sum, err := storeBlob(ctx, store, data, ext, job.RequestID)
+		if err != nil {
+			return nil, err
+		}
+		m.Artifacts = append(m.Artifacts, ManifestArtifact{
+			Kind:        kind,
+			Digest:      sum,
+			Size:        int64(len(data)),
+			ContentType: contentTypeFor(key),
+			URL:         blobURLFor(sum, ext),
+		})
+		if manifestTextKinds[kind] {
+			m.PromptHashes[kind] = sum
+		}
+	}
+	if len(m.Artifacts) == 0 {
+		return nil, fmt.Errorf("no artifacts for %s/%s", job.Series, job.Address)
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := GetFileOperations().PutArtifact(store, manifestPrefix(job.Series, job.Address)+m.ID+".json", data, job.RequestID); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// listManifests returns the manifests recorded for (series, address), newest first
+func listManifests(ctx context.Context, series, address string) ([]Manifest, error) {
+	return readManifests(ctx, series, address, 0)
+}
+
+// latestManifest returns the newest manifest for (series, address), or nil when there is none
+func latestManifest(ctx context.Context, series, address string) (*Manifest, error) {
+	manifests, err := readManifests(ctx, series, address, 1)
+	if err != nil || len(manifests) == 0 {
+		return nil, err
+	}
+	return &manifests[0], nil
+}
+
+// readManifests reads up to limit manifests for (series, address), newest first; 0 reads all
+func readManifests(ctx context.Context, series, address string, limit int) ([]Manifest, error) {
+	store := CurrentStore()
+	infos, err := store.List(ctx, manifestPrefix(series, address))
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Key > infos[j].Key })
+	manifests := make([]Manifest, 0, len(infos))
+	for _, info := range infos {
+		if path.Ext(info.Key) != ".json" {
+			continue
+		}
+		body, _, err := store.Open(ctx, info.Key)
+		if err != nil {
+			if errors.Is(err, ErrArtifactNotFound) {
+				continue
+			}
+			return nil, err
+		}
+		data, err := io.ReadAll(body)
+		_ = body.Close()
+		if err != nil {
+			return nil, err
+		}
+		var m Manifest
+		if err := json.Unmarshal(data, &m); err != nil {
+			logError(fmt.Sprintf("manifests: skipping unreadable %s: %v", info.Key, err))
+			continue
+		}
+		manifests = append(manifests, m)
+		if limit > 0 && len(manifests) == limit {
+			break
+		}
+	}
+	return manifests, nil
+}
+
+// handleV1ImageManifests serves GET /v1/images/<id>/manifest (the latest generation's
+// manifest) and /v1/images/<id>/manifests (every one, newest first)
+func (a *App) handleV1ImageManifests(w http.ResponseWriter, r *http.Request, id string, latest bool, requestID string) {
+	src, err := a.resolveRenderSource(id)
+	if err != nil {
+		if dalle.ErrorCodeOf(err) != "" {
+			writeV1EngineError(w, requestID, err)
+		} else {
+			writeV1Error(w, requestID, http.StatusBadRequest, dalle.ErrInvalidInput, err.Error())
+		}
+		return
+	}
+	series, address, ok := annotatedKey(src.Key)
+	if !ok {
+		writeV1Error(w, requestID, http.StatusNotFound, dalle.ErrArtifactMissing, "no manifest for "+id)
+		return
+	}
+	manifests, err := listManifests(r.Context(), series, address)
+	if err != nil {
+		writeArtifactError(w, manifestPrefix(series, address), err)
+		return
+	}
+	if !latest {
+		WriteSuccessResponse(w, manifests, requestID)
+		return
+	}
+	if len(manifests) == 0 {
+		writeV1Error(w, requestID, http.StatusNotFound, dalle.ErrArtifactMissing, "no manifest for "+id)
+		return
+	}
+	WriteSuccessResponse(w, manifests[0], requestID)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	dalle "github.com/TrueBlocks/trueblocks-dalle/v6"
+	"github.com/TrueBlocks/trueblocks-dalle/v6/pkg/storage"
+)
+
+func TestManifestsDeduplicateAndOutliveRegeneration(t *testing.T) {
+	dalle.SetupTest(t, dalle.SetupTestOptions{Series: []string{"empty"}})
+	UseStore(nil, defaultPresignTTL)
+	t.Cleanup(func() { UseStore(nil, defaultPresignTTL) })
+
+	const address = "0x8888888888888888888888888888888888888888"
+	png, _ := mockImagePNG("harbor", 16, 16)
+	write := func(series, dir, ext string, data []byte) {
+		local := filepath.Join(storage.OutputDir(), series, dir, address+ext)
+		_ = os.MkdirAll(filepath.Dir(local), 0o750)
+		_ = os.WriteFile(local, data, 0o600)
+	}
+	for _, series := range []string{"empty", "other"} {
+		write(series, "annotated", ".png", png)
+		write(series, "selector", ".json", []byte(`{"seed":"harbor"}`))
+		write(series, "prompt", ".txt", []byte("a harbor at dusk"))
+	}
+
+	before := GetMetricsCollector().GetMetrics()
+	started := time.Now()
+	first, err := recordManifest(&Job{ID: "job-1", Series: "empty", Address: address, RequestID: "req-1"}, started, started.Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(first.Artifacts) != 3 || first.PromptHashes["prompt"] != sha256Hex([]byte("a harbor at dusk")) || first.Provider != CurrentProvider().Name() {
+		t.Fatalf("manifest: %+v", first)
+	}
+	// The same content in another series is stored once
+	if _, err := recordManifest(&Job{ID: "job-2", Series: "other", Address: address}, started, started.Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	after := GetMetricsCollector().GetMetrics()
+	if after.BlobsStored != before.BlobsStored+3 || after.BlobsDeduplicated != before.BlobsDeduplicated+3 {
+		t.Fatalf("blobs: before %+v after %+v", before, after)
+	}
+
+	app := &App{}
+	get := func(handler http.HandlerFunc, path string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		handler(rr, httptest.NewRequest(http.MethodGet, path, nil))
+		return rr
+	}
+	manifests := func(suffix string, into interface{}) int {
+		rr := get(app.handleV1Image, "/v1/images/empty:"+address+suffix)
+		var body struct {
+			Data json.RawMessage `json:"data"`
+		}
+		_ = json.Unmarshal(rr.Body.Bytes(), &body)
+		_ = json.Unmarshal(body.Data, into)
+		return rr.Code
+	}
+
+	// A regeneration records a new manifest; the old one still resolves to the old image
+	regenerated, _ := mockImagePNG("lighthouse", 16, 16)
+	write("empty", "annotated", ".png", regenerated)
+	if _, err := recordManifest(&Job{ID: "job-3", Series: "empty", Address: address}, started, started.Add(2*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	var latest Manifest
+	if code := manifests("/manifest", &latest); code != http.StatusOK || latest.JobID != "job-3" {
+		t.Fatalf("latest manifest: %d %+v", code, latest)
+	}
+	var history []Manifest
+	if code := manifests("/manifests", &history); code != http.StatusOK || len(history) != 2 || history[1].ID != first.ID {
+		t.Fatalf("manifest history: %d %+v", code, history)
+	}
+	for _, artifact := range history[1].Artifacts {
+		rr := get(app.handleV1Blob, artifact.URL)
+		if rr.Code != http.StatusOK || rr.Header().Get("Cache-Control") != blobCacheControl {
+			t.Fatalf("%s blob: %d", artifact.Kind, rr.Code)
+		}
+		if artifact.Kind == "annotated" && !bytes.Equal(rr.Body.Bytes(), png) {
+			t.Fatalf("the first manifest's image changed after a regeneration")
+		}
+	}
+
+	const unknown = "/v1/images/empty:0x0"
+	if rr := get(app.handleV1Image, unknown+"/manifest"); rr.Code != http.StatusNotFound {
+		t.Fatalf("missing manifest: %d", rr.Code)
+	}
+	if rr := get(app.handleV1Image, unknown+"/manifests"); rr.Code != http.StatusOK {
+		t.Fatalf("empty history: %d", rr.Code)
+	}
+	rr := httptest.NewRecorder()
+	app.handleV1Image(rr, httptest.NewRequest(http.MethodPost, "/v1/images/empty:"+address+"/manifest", nil))
+	if rr.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("POST manifest: %d", rr.Code)
+	}
+}
@@ -21,6 +21,9 @@ type ErrorMetrics struct {
 	CircuitBreakerFailures  int64  `json:"circuit_breaker_failures"`
 	CircuitBreakerSuccesses int64  `json:"circuit_breaker_successes"`
 
+	// Every registered breaker, refreshed from the registry before metrics are served
+	CircuitBreakers []BreakerStatus `json:"circuit_breakers"`
+
 	// Retry metrics
 	TotalRetries       int64            `json:"total_retries"`
 	RetriesByOperation map[string]int64 `json:"retries_by_operation"`
@@ -37,6 +40,64 @@ type ErrorMetrics struct {
 	FileOperations      int64 `json:"file_operations"`
 	FileOperationErrors int64 `json:"file_operation_errors"`
 
+	// Generation cancellations
+	Cancellations int64 `json:"cancellations"`
+
+	// Open progress event streams
+	ProgressStreams int64 `json:"progress_streams"`
+
+	// Connected WebSocket clients
+	WebSocketClients int64 `json:"websocket_clients"`
+
+	// Webhook deliveries
+	WebhookDeliveries int64 `json:"webhook_deliveries"`
+	WebhookFailures   int64 `json:"webhook_failures"`
+
+	// Scheduler queues by priority class
+	QueueClasses map[string]*QueueClassMetrics `json:"queue_classes"`
+
+	// Requests rejected with 429 because the generation queue was full
+	LoadShed int64 `json:"load_shed"`
+
+	// Provider pacing: requests held by the client-side rate limiter, and provider retries
+	// refused because the retry budget was spent
+	RateLimitWaits       int64 `json:"rate_limit_waits"`
+	RateLimitWaitMs      int64 `json:"rate_limit_wait_ms"`
+	RetryBudgetExhausted int64 `json:"retry_budget_exhausted"`
+
+	// Image downloads: hedged requests sent and won, bodies resumed with a Range request,
+	// and downloads refused for their status, type or size
+	DownloadHedges     int64 `json:"download_hedges"`
+	DownloadHedgeWins  int64 `json:"download_hedge_wins"`
+	DownloadResumes    int64 `json:"download_resumes"`
+	DownloadRejections int64 `json:"download_rejections"`
+
+	// Image derivatives: renders served from the disk cache, renders produced, and cached
+	// renders evicted to stay under the size cap
+	DerivativeHits      int64 `json:"derivative_hits"`
+	DerivativeMisses    int64 `json:"derivative_misses"`
+	DerivativeEvictions int64 `json:"derivative_evictions"`
+
+	// Content-addressed blobs: artifacts written to the blob store, and artifacts whose
+	// content it already held
+	BlobsStored       int64 `json:"blobs_stored"`
+	BlobsDeduplicated int64 `json:"blobs_deduplicated"`
+
+	// Retention: bytes and artifacts the janitor deleted or archived, and generations
+	// refused because the output directory reached its hard quota
+	RetentionBytesReclaimed   int64 `json:"retention_bytes_reclaimed"`
+	RetentionArtifactsRemoved int64 `json:"retention_artifacts_removed"`
+	QuotaRejections           int64 `json:"quota_rejections"`
+
+	// Provider spend and usage, and requests refused by a spending budget
+	Usage            *UsageMetrics `json:"usage"`
+	BudgetRejections int64         `json:"budget_rejections"`
+
+	// Prompt enhancements by the provider that served them ("none" when degraded), and
+	// failed attempts by provider before moving down the list
+	EnhancementsByProvider        map[string]int64 `json:"enhancements_by_provider"`
+	EnhancementFailuresByProvider map[string]int64 `json:"enhancement_failures_by_provider"`
+
 	LastUpdated time.Time `json:"last_updated"`
 }
 
@@ -52,6 +113,9 @@ type ErrorMetricsSnapshot struct {
 	CircuitBreakerFailures  int64  `json:"circuit_breaker_failures"`
 	CircuitBreakerSuccesses int64  `json:"circuit_breaker_successes"`
 
+	// Every registered breaker, refreshed from the registry before metrics are served
+	CircuitBreakers []BreakerStatus `json:"circuit_breakers"`
+
 	// Retry metrics
 	TotalRetries       int64            `json:"total_retries"`
 	RetriesByOperation map[string]int64 `json:"retries_by_operation"`
@@ -68,6 +132,64 @@ type ErrorMetricsSnapshot struct {
 	FileOperations      int64 `json:"file_operations"`
 	FileOperationErrors int64 `json:"file_operation_errors"`
 
+	// Generation cancellations
+	Cancellations int64 `json:"cancellations"`
+
+	// Open progress event streams
+	ProgressStreams int64 `json:"progress_streams"`
+
+	// Connected WebSocket clients
+	WebSocketClients int64 `json:"websocket_clients"`
+
+	// Webhook deliveries
+	WebhookDeliveries int64 `json:"webhook_deliveries"`
+	WebhookFailures   int64 `json:"webhook_failures"`
+
+	// Scheduler queues by priority class
+	QueueClasses map[string]*QueueClassMetrics `json:"queue_classes"`
+
+	// Requests rejected with 429 because the generation queue was full
+	LoadShed int64 `json:"load_shed"`
+
+	// Provider pacing: requests held by the client-side rate limiter, and provider retries
+	// refused because the retry budget was spent
+	RateLimitWaits       int64 `json:"rate_limit_waits"`
+	RateLimitWaitMs      int64 `json:"rate_limit_wait_ms"`
+	RetryBudgetExhausted int64 `json:"retry_budget_exhausted"`
+
+	// Image downloads: hedged requests sent and won, bodies resumed with a Range request,
+	// and downloads refused for their status, type or size
+	DownloadHedges     int64 `json:"download_hedges"`
+	DownloadHedgeWins  int64 `json:"download_hedge_wins"`
+	DownloadResumes    int64 `json:"download_resumes"`
+	DownloadRejections int64 `json:"download_rejections"`
+
+	// Image derivatives: renders served from the disk cache, renders produced, and cached
+	// renders evicted to stay under the size cap
+	DerivativeHits      int64 `json:"derivative_hits"`
+	DerivativeMisses    int64 `json:"derivative_misses"`
+	DerivativeEvictions int64 `json:"derivative_evictions"`
+
+	// Content-addressed blobs: artifacts written to the blob store, and artifacts whose
+	// content it already held
+	BlobsStored       int64 `json:"blobs_stored"`
+	BlobsDeduplicated int64 `json:"blobs_deduplicated"`
+
+	// Retention: bytes and artifacts the janitor deleted or archived, and generations
+	// refused because the output directory reached its hard quota
+	RetentionBytesReclaimed   int64 `json:"retention_bytes_reclaimed"`
+	RetentionArtifactsRemoved int64 `json:"retention_artifacts_removed"`
+	QuotaRejections           int64 `json:"quota_rejections"`
+
+	// Provider spend and usage, and requests refused by a spending budget
+	Usage            *UsageMetrics `json:"usage"`
+	BudgetRejections int64         `json:"budget_rejections"`
+
+	// Prompt enhancements by the provider that served them ("none" when degraded), and
+	// failed attempts by provider before moving down the list
+	EnhancementsByProvider        map[string]int64 `json:"enhancements_by_provider"`
+	EnhancementFailuresByProvider map[string]int64 `json:"enhancement_failures_by_provider"`
+
 	LastUpdated time.Time `json:"last_updated"`
 }
 
@@ -85,6 +207,26 @@ type ResponseTimeMetrics struct {
 	samples []int64
 }
 
+// QueueClassMetrics tracks one priority class in the generation scheduler
+type QueueClassMetrics struct {
+	Depth      int64 `json:"depth"`
+	Running    int64 `json:"running"`
+	Dispatched int64 `json:"dispatched"`
+	WaitSumMs  int64 `json:"wait_sum_ms"`
+	WaitMaxMs  int64 `json:"wait_max_ms"`
+}
+
+// UsageMetrics tracks priced provider usage since the server started
+type UsageMetrics struct {
+	CostBySeries     map[string]float64 `json:"cost_by_series"`
+	PromptTokens     int64              `json:"prompt_tokens"`
+	CompletionTokens int64              `json:"completion_tokens"`
+	ImagesBySize     map[string]int64   `json:"images_by_size"`
+	// UnpricedByModel counts chat completions and images the rate table has no price for,
+	// which were recorded at $0 and so escape the budgets
+	UnpricedByModel map[string]int64 `json:"unpriced_by_model"`
+}
+
 // MetricsCollector manages all error and performance metrics
 type MetricsCollector struct {
 	metrics ErrorMetrics
@@ -94,9 +236,13 @@ type MetricsCollector struct {
 func NewMetricsCollector() *MetricsCollector {
 	return &MetricsCollector{
 		metrics: ErrorMetrics{
-			ErrorsByCode:       make(map[string]int64),
-			ErrorsByEndpoint:   make(map[string]int64),
-			RetriesByOperation: make(map[string]int64),
+			ErrorsByCode:                  make(map[string]int64),
+			ErrorsByEndpoint:              make(map[string]int64),
+			RetriesByOperation:            make(map[string]int64),
+			QueueClasses:                  newQueueClassMetrics(),
+			Usage:                         &UsageMetrics{CostBySeries: make(map[string]float64), ImagesBySize: make(map[string]int64), UnpricedByModel: make(map[string]int64)},
+			EnhancementsByProvider:        make(map[string]int64),
+			EnhancementFailuresByProvider: make(map[string]int64),
 			ResponseTimes: &ResponseTimeMetrics{
 				Min:     int64(^uint64(0) >> 1), // Max int64
 				samples: make([]int64, 0, 1000), // Keep last 1000 samples
@@ -192,6 +338,259 @@ func (mc *MetricsCollector) RecordFileOperation(success bool, requestID string)
 	mc.metrics.LastUpdated = time.Now()
 }
 
+// RecordCancellation records a cancelled generation
+func (mc *MetricsCollector) RecordCancellation(endpoint, requestID string) {
+	mc.metrics.mu.Lock()
+	defer mc.metrics.mu.Unlock()
+
+	mc.metrics.Cancellations++
+	mc.metrics.LastUpdated = time.Now()
+
+	logInfo(fmt.Sprintf("[%s] Cancellation recorded on %s", requestID, endpoint))
+}
+
+// RecordProgressStream adjusts the number of open progress event streams by delta
+func (mc *MetricsCollector) RecordProgressStream(delta int64) {
+	mc.metrics.mu.Lock()
+	defer mc.metrics.mu.Unlock()
+
+	mc.metrics.ProgressStreams += delta
+	mc.metrics.LastUpdated = time.Now()
+}
+
+// RecordWebSocketClient adjusts the number of connected WebSocket clients by delta
+func (mc *MetricsCollector) RecordWebSocketClient(delta int64) {
+	mc.metrics.mu.Lock()
+	defer mc.metrics.mu.Unlock()
+
+	mc.metrics.WebSocketClients += delta
+	mc.metrics.LastUpdated = time.Now()
+}
+
+// RecordWebhookDelivery records the final outcome of a webhook delivery
+func (mc *MetricsCollector) RecordWebhookDelivery(success bool, requestID string) {
+	mc.metrics.mu.Lock()
+	defer mc.metrics.mu.Unlock()
+
+	mc.metrics.WebhookDeliveries++
+	if !success {
+		mc.metrics.WebhookFailures++
+	}
+	mc.metrics.LastUpdated = time.Now()
+}
+
+func newQueueClassMetrics() map[string]*QueueClassMetrics {
+	out := make(map[string]*QueueClassMetrics, len(priorityClasses))
+	for _, class := range priorityClasses {
+		out[string(class)] = &QueueClassMetrics{}
+	}
+	return out
+}
+
+func (mc *MetricsCollector) queueClassLocked(class string) *QueueClassMetrics {
+	m := mc.metrics.QueueClasses[class]
+	if m == nil {
+		m = &QueueClassMetrics{}
+		mc.metrics.QueueClasses[class] = m
+	}
+	return m
+}
+
+// RecordQueueDepth records the waiting and running job counts for a priority class
+func (mc *MetricsCollector) RecordQueueDepth(class string, depth, running int) {
+	mc.metrics.mu.Lock()
+	defer mc.metrics.mu.Unlock()
+
+	m := mc.queueClassLocked(class)
+	m.Depth = int64(depth)
+	m.Running = int64(running)
+	mc.metrics.LastUpdated = time.Now()
+}
+
+// RecordQueueWait records how long a job waited in its class queue before starting
+func (mc *MetricsCollector) RecordQueueWait(class string, wait time.Duration) {
+	mc.metrics.mu.Lock()
+	defer mc.metrics.mu.Unlock()
+
+	m := mc.queueClassLocked(class)
+	ms := wait.Milliseconds()
+	m.Dispatched++
+	m.WaitSumMs += ms
+	if ms > m.WaitMaxMs {
+		m.WaitMaxMs = ms
+	}
+	mc.metrics.LastUpdated = time.Now()
+}
+
+// RecordLoadShed records a request rejected because the generation queue was full
+func (mc *MetricsCollector) RecordLoadShed(endpoint, requestID string) {
+	mc.metrics.mu.Lock()
+	defer mc.metrics.mu.Unlock()
+
+	mc.metrics.LoadShed++
+	mc.metrics.LastUpdated = time.Now()
+}
+
+// RecordRateLimitWait records a provider request held back by the client-side rate limiter
+func (mc *MetricsCollector) RecordRateLimitWait(wait time.Duration) {
+	mc.metrics.mu.Lock()
+	defer mc.metrics.mu.Unlock()
+
+	mc.metrics.RateLimitWaits++
+	mc.metrics.RateLimitWaitMs += wait.Milliseconds()
+	mc.metrics.LastUpdated = time.Now()
+}
+
+// RecordRetryBudgetExhausted records a provider retry refused by the retry budget
+func (mc *MetricsCollector) RecordRetryBudgetExhausted() {
+	mc.metrics.mu.Lock()
+	defer mc.metrics.mu.Unlock()
+
+	mc.metrics.RetryBudgetExhausted++
+	mc.metrics.LastUpdated = time.Now()
+}
+
+// RecordDownloadHedge records a second request sent for a slow image download
+func (mc *MetricsCollector) RecordDownloadHedge() {
+	mc.metrics.mu.Lock()
+	defer mc.metrics.mu.Unlock()
+
+	mc.metrics.DownloadHedges++
+	mc.metrics.LastUpdated = time.Now()
+}
+
+// RecordDownloadHedgeWin records a hedged image download finishing before the original
+func (mc *MetricsCollector) RecordDownloadHedgeWin() {
+	mc.metrics.mu.Lock()
+	defer mc.metrics.mu.Unlock()
+
+	mc.metrics.DownloadHedgeWins++
+	mc.metrics.LastUpdated = time.Now()
+}
+
+// RecordDownloadResume records an image download resumed after its body was cut short
+func (mc *MetricsCollector) RecordDownloadResume() {
+	mc.metrics.mu.Lock()
+	defer mc.metrics.mu.Unlock()
+
+	mc.metrics.DownloadResumes++
+	mc.metrics.LastUpdated = time.Now()
+}
+
+// RecordDownloadRejection records an image download refused for its status, type or size
+func (mc *MetricsCollector) RecordDownloadRejection() {
+	mc.metrics.mu.Lock()
+	defer mc.metrics.mu.Unlock()
+
+	mc.metrics.DownloadRejections++
+	mc.metrics.LastUpdated = time.Now()
+}
+
+// RecordDerivative records an image render served from the derivative cache (hit) or produced fresh
+func (mc *MetricsCollector) RecordDerivative(hit bool) {
+	mc.metrics.mu.Lock()
+	defer mc.metrics.mu.Unlock()
+
+	if hit {
+		mc.metrics.DerivativeHits++
+	} else {
+		mc.metrics.DerivativeMisses++
+	}
+	mc.metrics.LastUpdated = time.Now()
+}
+
+// RecordDerivativeEviction records a cached image render removed to stay under the size cap
+func (mc *MetricsCollector) RecordDerivativeEviction() {
+	mc.metrics.mu.Lock()
+	defer mc.metrics.mu.Unlock()
+
+	mc.metrics.DerivativeEvictions++
+	mc.metrics.LastUpdated = time.Now()
+}
+
+// RecordBlob records an artifact written to the blob store, or deduplicated against a blob already there
+func (mc *MetricsCollector) RecordBlob(deduplicated bool) {
+	mc.metrics.mu.Lock()
+	defer mc.metrics.mu.Unlock()
+
+	if deduplicated {
+		mc.metrics.BlobsDeduplicated++
+	} else {
+		mc.metrics.BlobsStored++
+	}
+	mc.metrics.LastUpdated = time.Now()
+}
+
+// RecordUsage records priced provider usage; size is empty for chat completions
+func (mc *MetricsCollector) RecordUsage(series string, costUSD float64, promptTokens, completionTokens int64, size string) {
+	mc.metrics.mu.Lock()
+	defer mc.metrics.mu.Unlock()
+
+	u := mc.metrics.Usage
+	u.CostBySeries[series] += costUSD
+	u.PromptTokens += promptTokens
+	u.CompletionTokens += completionTokens
+	if size != "" {
+		u.ImagesBySize[size]++
+	}
+	mc.metrics.LastUpdated = time.Now()
+}
+
+// RecordUnpricedUsage records a chat completion or image the rate table has no price for
+func (mc *MetricsCollector) RecordUnpricedUsage(model string) {
+	mc.metrics.mu.Lock()
+	defer mc.metrics.mu.Unlock()
+
+	mc.metrics.Usage.UnpricedByModel[model]++
+	mc.metrics.LastUpdated = time.Now()
+}
+
+// RecordBudgetRejection records a generation refused because a spending budget was used up
+func (mc *MetricsCollector) RecordBudgetRejection(endpoint, requestID string) {
+	mc.metrics.mu.Lock()
+	defer mc.metrics.mu.Unlock()
+
+	mc.metrics.BudgetRejections++
+	mc.metrics.LastUpdated = time.Now()
+}
+
+// RecordRetention records artifacts the retention janitor removed and the bytes they held
+func (mc *MetricsCollector) RecordRetention(artifacts int, bytes int64) {
+	mc.metrics.mu.Lock()
+	defer mc.metrics.mu.Unlock()
+
+	mc.metrics.RetentionArtifactsRemoved += int64(artifacts)
+	mc.metrics.RetentionBytesReclaimed += bytes
+	mc.metrics.LastUpdated = time.Now()
+}
+
+// RecordQuotaRejection records a generation refused because the storage quota was reached
+func (mc *MetricsCollector) RecordQuotaRejection(endpoint, requestID string) {
+	mc.metrics.mu.Lock()
+	defer mc.metrics.mu.Unlock()
+
+	mc.metrics.QuotaRejections++
+	mc.metrics.LastUpdated = time.Now()
+}
+
+// RecordEnhancement records which provider served a prompt enhancement
+func (mc *MetricsCollector) RecordEnhancement(provider, requestID string) {
+	mc.metrics.mu.Lock()
+	defer mc.metrics.mu.Unlock()
+
+	mc.metrics.EnhancementsByProvider[provider]++
+	mc.metrics.LastUpdated = time.Now()
+}
+
+// RecordEnhancementFailure records a provider failing an enhancement, retries included
+func (mc *MetricsCollector) RecordEnhancementFailure(provider, requestID string) {
+	mc.metrics.mu.Lock()
+	defer mc.metrics.mu.Unlock()
+
+	mc.metrics.EnhancementFailuresByProvider[provider]++
+	mc.metrics.LastUpdated = time.Now()
+}
+
 // UpdateCircuitBreakerMetrics updates circuit breaker state
 func (mc *MetricsCollector) UpdateCircuitBreakerMetrics(metrics CircuitBreakerMetrics) {
 	mc.metrics.mu.Lock()
@@ -203,6 +602,15 @@ func (mc *MetricsCollector) UpdateCircuitBreakerMetrics(metrics CircuitBreakerMe
 	mc.metrics.LastUpdated = time.Now()
 }
 
+// UpdateBreakerMetrics replaces the per-breaker snapshot
+func (mc *MetricsCollector) UpdateBreakerMetrics(breakers []BreakerStatus) {
+	mc.metrics.mu.Lock()
+	defer mc.metrics.mu.Unlock()
+
+	mc.metrics.CircuitBreakers = append([]BreakerStatus(nil), breakers...)
+	mc.metrics.LastUpdated = time.Now()
+}
+
 // GetMetrics returns a copy of current metrics
 func (mc *MetricsCollector) GetMetrics() ErrorMetricsSnapshot {
 	mc.metrics.mu.RLock()
@@ -224,6 +632,38 @@ func (mc *MetricsCollector) GetMetrics() ErrorMetricsSnapshot {
 		retriesByOperation[k] = v
 	}
 
+	queueClasses := make(map[string]*QueueClassMetrics, len(mc.metrics.QueueClasses))
+	for k, v := range mc.metrics.QueueClasses {
+		cp := *v
+		queueClasses[k] = &cp
+	}
+
+	usage := &UsageMetrics{
+		CostBySeries:     make(map[string]float64, len(mc.metrics.Usage.CostBySeries)),
+		PromptTokens:     mc.metrics.Usage.PromptTokens,
+		CompletionTokens: mc.metrics.Usage.CompletionTokens,
+		ImagesBySize:     make(map[string]int64, len(mc.metrics.Usage.ImagesBySize)),
+		UnpricedByModel:  make(map[string]int64, len(mc.metrics.Usage.UnpricedByModel)),
+	}
+	for k, v := range mc.metrics.Usage.CostBySeries {
+		usage.CostBySeries[k] = v
+	}
+	for k, v := range mc.metrics.Usage.ImagesBySize {
+		usage.ImagesBySize[k] = v
+	}
+	for k, v := range mc.metrics.Usage.UnpricedByModel {
+		usage.UnpricedByModel[k] = v
+	}
+
+	enhancements := make(map[string]int64, len(mc.metrics.EnhancementsByProvider))
+	for k, v := range mc.metrics.EnhancementsByProvider {
+		enhancements[k] = v
+	}
+	enhancementFailures := make(map[string]int64, len(mc.metrics.EnhancementFailuresByProvider))
+	for k, v := range mc.metrics.EnhancementFailuresByProvider {
+		enhancementFailures[k] = v
+	}
+
 	// Deep copy response times
 	rt := &ResponseTimeMetrics{
 		Count: mc.metrics.ResponseTimes.Count,
@@ -236,21 +676,48 @@ func (mc *MetricsCollector) GetMetrics() ErrorMetricsSnapshot {
 	}
 
 	return ErrorMetricsSnapshot{
-		TotalErrors:             mc.metrics.TotalErrors,
-		ErrorsByCode:            errorsByCode,
-		ErrorsByEndpoint:        errorsByEndpoint,
-		CircuitBreakerState:     mc.metrics.CircuitBreakerState,
-		CircuitBreakerFailures:  mc.metrics.CircuitBreakerFailures,
-		CircuitBreakerSuccesses: mc.metrics.CircuitBreakerSuccesses,
-		TotalRetries:            mc.metrics.TotalRetries,
-		RetriesByOperation:      retriesByOperation,
-		ResponseTimes:           rt,
-		OpenAIRequests:          mc.metrics.OpenAIRequests,
-		OpenAIErrors:            mc.metrics.OpenAIErrors,
-		OpenAITimeouts:          mc.metrics.OpenAITimeouts,
-		FileOperations:          mc.metrics.FileOperations,
-		FileOperationErrors:     mc.metrics.FileOperationErrors,
-		LastUpdated:             mc.metrics.LastUpdated,
+		TotalErrors:                   mc.metrics.TotalErrors,
+		ErrorsByCode:                  errorsByCode,
+		ErrorsByEndpoint:              errorsByEndpoint,
+		CircuitBreakerState:           mc.metrics.CircuitBreakerState,
+		CircuitBreakerFailures:        mc.metrics.CircuitBreakerFailures,
+		CircuitBreakerSuccesses:       mc.metrics.CircuitBreakerSuccesses,
+		CircuitBreakers:               append([]BreakerStatus(nil), mc.metrics.CircuitBreakers...),
+		TotalRetries:                  mc.metrics.TotalRetries,
+		RetriesByOperation:            retriesByOperation,
+		ResponseTimes:                 rt,
+		OpenAIRequests:                mc.metrics.OpenAIRequests,
+		OpenAIErrors:                  mc.metrics.OpenAIErrors,
+		OpenAITimeouts:                mc.metrics.OpenAITimeouts,
+		FileOperations:                mc.metrics.FileOperations,
+		FileOperationErrors:           mc.metrics.FileOperationErrors,
+		Cancellations:                 mc.metrics.Cancellations,
+		ProgressStreams:               mc.metrics.ProgressStreams,
+		WebSocketClients:              mc.metrics.WebSocketClients,
+		WebhookDeliveries:             mc.metrics.WebhookDeliveries,
+		WebhookFailures:               mc.metrics.WebhookFailures,
+		QueueClasses:                  queueClasses,
+		LoadShed:                      mc.metrics.LoadShed,
+		RateLimitWaits:                mc.metrics.RateLimitWaits,
+		RateLimitWaitMs:               mc.metrics.RateLimitWaitMs,
+		RetryBudgetExhausted:          mc.metrics.RetryBudgetExhausted,
+		DownloadHedges:                mc.metrics.DownloadHedges,
+		DownloadHedgeWins:             mc.metrics.DownloadHedgeWins,
+		DownloadResumes:               mc.metrics.DownloadResumes,
+		DownloadRejections:            mc.metrics.DownloadRejections,
+		DerivativeHits:                mc.metrics.DerivativeHits,
+		DerivativeMisses:              mc.metrics.DerivativeMisses,
+		DerivativeEvictions:           mc.metrics.DerivativeEvictions,
+		BlobsStored:                   mc.metrics.BlobsStored,
+		BlobsDeduplicated:             mc.metrics.BlobsDeduplicated,
+		RetentionBytesReclaimed:       mc.metrics.RetentionBytesReclaimed,
+		RetentionArtifactsRemoved:     mc.metrics.RetentionArtifactsRemoved,
+		QuotaRejections:               mc.metrics.QuotaRejections,
+		Usage:                         usage,
+		BudgetRejections:              mc.metrics.BudgetRejections,
+		EnhancementsByProvider:        enhancements,
+		EnhancementFailuresByProvider: enhancementFailures,
+		LastUpdated:                   mc.metrics.LastUpdated,
 	}
 }
 
@@ -295,6 +762,62 @@ func (mc *MetricsCollector) PrometheusMetrics() string {
 	result += fmt.Sprintf("dalleserver_openai_timeouts_total %d\n", metrics.OpenAITimeouts)
 	result += fmt.Sprintf("dalleserver_file_operations_total %d\n", metrics.FileOperations)
 	result += fmt.Sprintf("dalleserver_file_operation_errors_total %d\n", metrics.FileOperationErrors)
+	result += fmt.Sprintf("dalleserver_cancellations_total %d\n", metrics.Cancellations)
+	result += fmt.Sprintf("dalleserver_progress_streams_active %d\n", metrics.ProgressStreams)
+	result += fmt.Sprintf("dalleserver_websocket_clients_active %d\n", metrics.WebSocketClients)
+	result += fmt.Sprintf("dalleserver_webhook_deliveries_total %d\n", metrics.WebhookDeliveries)
+	result += fmt.Sprintf("dalleserver_webhook_failures_total %d\n", metrics.WebhookFailures)
+	result += fmt.Sprintf("dalleserver_load_shed_total %d\n", metrics.LoadShed)
+	result += fmt.Sprintf("dalleserver_rate_limit_waits_total %d\n", metrics.RateLimitWaits)
+	result += fmt.Sprintf("dalleserver_rate_limit_wait_ms_total %d\n", metrics.RateLimitWaitMs)
+	result += fmt.Sprintf("dalleserver_retry_budget_exhausted_total %d\n", metrics.RetryBudgetExhausted)
+	result += fmt.Sprintf("dalleserver_download_hedges_total %d\n", metrics.DownloadHedges)
+	result += fmt.Sprintf("dalleserver_download_hedge_wins_total %d\n", metrics.DownloadHedgeWins)
+	result += fmt.Sprintf("dalleserver_download_resumes_total %d\n", metrics.DownloadResumes)
+	result += fmt.Sprintf("dalleserver_download_rejections_total %d\n", metrics.DownloadRejections)
+	result += fmt.Sprintf("dalleserver_derivative_hits_total %d\n", metrics.DerivativeHits)
+	result += fmt.Sprintf("dalleserver_derivative_misses_total %d\n", metrics.DerivativeMisses)
+	result += fmt.Sprintf("dalleserver_derivative_evictions_total %d\n", metrics.DerivativeEvictions)
+	result += fmt.Sprintf("dalleserver_blobs_stored_total %d\n", metrics.BlobsStored)
+	result += fmt.Sprintf("dalleserver_blobs_deduplicated_total %d\n", metrics.BlobsDeduplicated)
+	result += fmt.Sprintf("dalleserver_retention_bytes_reclaimed_total %d\n", metrics.RetentionBytesReclaimed)
+	result += fmt.Sprintf("dalleserver_retention_artifacts_removed_total %d\n", metrics.RetentionArtifactsRemoved)
+	result += fmt.Sprintf("dalleserver_quota_rejections_total %d\n", metrics.QuotaRejections)
+	result += fmt.Sprintf("dalleserver_budget_rejections_total %d\n", metrics.BudgetRejections)
+
+	// Provider usage
+	result += fmt.Sprintf("dalleserver_usage_tokens_total{type=\"prompt\"} %d\n", metrics.Usage.PromptTokens)
+	result += fmt.Sprintf("dalleserver_usage_tokens_total{type=\"completion\"} %d\n", metrics.Usage.CompletionTokens)
+	for series, cost := range metrics.Usage.CostBySeries {
+		result += fmt.Sprintf("dalleserver_usage_cost_usd_total{series=\"%s\"} %.6f\n", strings.ReplaceAll(series, "\"", ""), cost)
+	}
+	for size, count := range metrics.Usage.ImagesBySize {
+		result += fmt.Sprintf("dalleserver_usage_images_total{size=\"%s\"} %d\n", size, count)
+	}
+	for model, count := range metrics.Usage.UnpricedByModel {
+		result += fmt.Sprintf("dalleserver_usage_unpriced_total{model=\"%s\"} %d\n", strings.ReplaceAll(model, "\"", ""), count)
+	}
+
+	// Prompt enhancement by provider
+	for provider, count := range metrics.EnhancementsByProvider {
+		result += fmt.Sprintf("dalleserver_enhancements_total{provider=\"%s\"} %d\n", strings.ReplaceAll(provider, "\"", ""), count)
+	}
+	for provider, count := range metrics.EnhancementFailuresByProvider {
+		result += fmt.Sprintf("dalleserver_enhancement_failures_total{provider=\"%s\"} %d\n", strings.ReplaceAll(provider, "\"", ""), count)
+	}
+
+	// Scheduler queues by priority class
+	for _, class := range priorityClasses {
+		q := metrics.QueueClasses[string(class)]
+		if q == nil {
+			continue
+		}
+		result += fmt.Sprintf("dalleserver_queue_depth{class=\"%s\"} %d\n", class, q.Depth)
+		result += fmt.Sprintf("dalleserver_queue_running{class=\"%s\"} %d\n", class, q.Running)
+		result += fmt.Sprintf("dalleserver_queue_wait_ms_sum{class=\"%s\"} %d\n", class, q.WaitSumMs)
+		result += fmt.Sprintf("dalleserver_queue_wait_ms_count{class=\"%s\"} %d\n", class, q.Dispatched)
+		result += fmt.Sprintf("dalleserver_queue_wait_ms_max{class=\"%s\"} %d\n", class, q.WaitMaxMs)
+	}
 
 	// Circuit breaker state (1 for current state, 0 for others)
 	states := []string{"CLOSED", "OPEN", "HALF_OPEN"}
@@ -305,6 +828,30 @@ func (mc *MetricsCollector) PrometheusMetrics() string {
 		}
 		result += fmt.Sprintf("dalleserver_circuit_breaker_state{state=\"%s\"} %d\n", state, value)
 	}
+	for _, b := range metrics.CircuitBreakers {
+		name := strings.ReplaceAll(b.Name, "\"", "")
+		for _, state := range states {
+			value := 0
+			if b.State == state {
+				value = 1
+			}
+			result += fmt.Sprintf("dalleserver_breaker_state{breaker=\"%s\",state=\"%s\"} %d\n", name, state, value)
+		}
+		forced := 0
+		if b.Forced {
+			forced = 1
+		}
+		result += fmt.Sprintf("dalleserver_breaker_forced{breaker=\"%s\"} %d\n", name, forced)
+		result += fmt.Sprintf("dalleserver_breaker_failures_total{breaker=\"%s\"} %d\n", name, b.TotalFailures)
+		result += fmt.Sprintf("dalleserver_breaker_successes_total{breaker=\"%s\"} %d\n", name, b.TotalSuccesses)
+		result += fmt.Sprintf("dalleserver_breaker_rejections_total{breaker=\"%s\"} %d\n", name, b.TotalRejections)
+		if w := b.Window; w != nil {
+			result += fmt.Sprintf("dalleserver_breaker_slow_calls_total{breaker=\"%s\"} %d\n", name, b.TotalSlowCalls)
+			result += fmt.Sprintf("dalleserver_breaker_window_calls{breaker=\"%s\"} %d\n", name, w.Calls)
+			result += fmt.Sprintf("dalleserver_breaker_window_failure_rate{breaker=\"%s\"} %.2f\n", name, w.FailureRate)
+			result += fmt.Sprintf("dalleserver_breaker_window_slow_call_rate{breaker=\"%s\"} %.2f\n", name, w.SlowCallRate)
+		}
+	}
 
 	// Response time metrics
 	if metrics.ResponseTimes.Count > 0 {
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"bufio"
 	"fmt"
+	"net"
 	"net/http"
 	"strings"
 	"time"
@@ -25,6 +27,21 @@ func (rw *ResponseWriterWrapper) Write(b []byte) (int, error) {
 	return size, err
 }
 
+// Unwrap exposes the underlying writer so http.ResponseController can reach Flush and deadlines
+func (rw *ResponseWriterWrapper) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+// Hijack lets WebSocket upgrades take over the connection through the wrapper
+func (rw *ResponseWriterWrapper) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := rw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response writer does not support hijacking")
+	}
+	rw.statusCode = http.StatusSwitchingProtocols
+	return hijacker.Hijack()
+}
+
 // MetricsMiddleware wraps HTTP handlers to collect metrics
 func MetricsMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -142,6 +159,10 @@ func getEndpointName(path string) string {
 		return "dalle"
 	} else if strings.HasPrefix(path, "/series") {
 		return "series"
+	} else if strings.HasPrefix(path, "/v1/progress/") {
+		return "progress"
+	} else if path == "/v1/ws" {
+		return "ws"
 	} else if strings.HasPrefix(path, "/health") {
 		return "health"
 	} else if strings.HasPrefix(path, "/metrics") {
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// mockAPIKey is exported to the library when the mock provider is active; the library
+// skips enhancement and image requests when no key is set
+const mockAPIKey = "sk-mock-provider"
+
+// maxMockImages bounds the generated images the mock provider keeps for download
+const maxMockImages = 256
+
+// mockStreamInterval spaces the words of a streamed mock completion so partial text can be
+// watched arriving
+var mockStreamInterval = 10 * time.Millisecond
+
+// MockProvider is a local stand-in for OpenAI. It answers chat completions with a
+// deterministic rewrite of the prompt, streamed a word at a time when asked, and image
+// generations with a PNG derived from a hash of the prompt, served back from its own
+// /v1/files/ endpoint.
+type MockProvider struct {
+	server   *http.Server
+	listener net.Listener
+	baseURL  string
+
+	mu     sync.Mutex
+	images map[string][]byte
+	order  []string
+}
+
+// StartMockProvider listens on addr (use "127.0.0.1:0" for a free port) and serves the
+// mock API until Close
+func StartMockProvider(addr string) (*MockProvider, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	m := &MockProvider{
+		listener: listener,
+		baseURL:  "http://" + listener.Addr().String() + "/v1",
+		images:   make(map[string][]byte),
+	}
+	m.server = &http.Server{Handler: m, ReadHeaderTimeout: 5 * time.Second}
+	go func() { _ = m.server.Serve(listener) }()
+	return m, nil
+}
+
+// Close stops the mock server
+func (m *MockProvider) Close() error { return m.server.Close() }
+
+// BaseURL is the API root, e.g. http://127.0.0.1:40123/v1
+func (m *MockProvider) BaseURL() string { return m.baseURL }
+
+func (m *MockProvider) Name() string     { return ProviderMock }
+func (m *MockProvider) ChatURL() string  { return m.baseURL + "/chat/completions" }
+func (m *MockProvider) ImageURL() string { return m.baseURL + "/images/generations" }
+func (m *MockProvider) APIKey() string   { return mockAPIKey }
+
+// ServeHTTP routes the three endpoints a generation touches
+func (m *MockProvider) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/v1/chat/completions":
+		m.handleChat(w, r)
+	case r.URL.Path == "/v1/images/generations":
+		m.handleImages(w, r)
+	case strings.HasPrefix(r.URL.Path, "/v1/files/"):
+		m.handleFile(w, r)
+	default:
+		writeMockError(w, http.StatusNotFound, "not_found", "unknown endpoint "+r.URL.Path)
+	}
+}
+
+type mockChatRequest struct {
+	Model    string `json:"model"`
+	Messages []struct {
+		Role    string `json:"role"`
+		Content string `json:"content"`
+	} `json:"messages"`
+	Stream        bool `json:"stream"`
+	StreamOptions struct {
+		IncludeUsage bool `json:"include_usage"`
+	} `json:"stream_options"`
+}
+
+func (m *MockProvider) handleChat(w http.ResponseWriter, r *http.Request) {
+	if !m.authorized(w, r) {
+		return
+	}
+	var req mockChatRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Messages) == 0 {
+		writeMockError(w, http.StatusBadRequest, "invalid_request_error", "messages are required")
+		return
+	}
+	var system, user []string
+	promptTokens := 0
+	for _, msg := range req.Messages {
+		promptTokens += len(strings.Fields(msg.Content))
+		if msg.Role == "system" {
+			system = append(system, msg.Content)
+		} else {
+			user = append(user, msg.Content)
+		}
+	}
+	// The rewrite keeps the original text so annotation and prompts stay recognisable
+	content := strings.TrimSpace(strings.Join(user, "\n"))
+	if content == "" {
+		content = strings.TrimSpace(strings.Join(system, "\n"))
+	}
+	content = "A vivid, richly detailed rendering. " + content
+	completionTokens := len(strings.Fields(content))
+	usage := map[string]int{
+		"prompt_tokens":     promptTokens,
+		"completion_tokens": completionTokens,
+		"total_tokens":      promptTokens + completionTokens,
+	}
+
+	if req.Stream {
+		var usageChunk map[string]int
+		if req.StreamOptions.IncludeUsage {
+			usageChunk = usage
+		}
+		streamMockChat(w, r, "chatcmpl-mock-"+shortHash(content), req.Model, content, usageChunk)
+		return
+	}
+
+	writeMockJSON(w, map[string]interface{}{
+		"id":      "chatcmpl-mock-" + shortHash(content),
+		"object":  "chat.completion",
+		"created": time.Now().Unix(),
+		"model":   req.Model,
+		"choices": []map[string]interface{}{{
+			"index":         0,
+			"message":       map[string]string{"role": "assistant", "content": content},
+			"finish_reason": "stop",
+		}},
+		"usage": usage,
+	})
+}
+
+// streamMockChat sends content as server-sent chat.completion.chunk events, one word per
+// event, followed by the usage (when given) and [DONE]
+func streamMockChat(w http.ResponseWriter, r *http.Request, id, model, content string, usage map[string]int) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	rc := http.NewResponseController(w)
+	send := func(chunk map[string]interface{}) bool {
+		chunk["id"], chunk["object"], chunk["model"] = id, "chat.completion.chunk", model
+		data, _ := json.Marshal(chunk)
+		if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+			return false
+		}
+		return rc.Flush() == nil
+	}
+	words := strings.SplitAfter(content, " ")
+	for i, word := range words {
+		if i > 0 {
+			select {
+			case <-time.After(mockStreamInterval):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		if !send(map[string]interface{}{"choices": []map[string]interface{}{{"index": 0, "delta": map[string]string{"content": word}}}}) {
+			return
+		}
+	}
+	if !send(map[string]interface{}{"choices": []map[string]interface{}{{"index": 0, "delta": map[string]string{}, "finish_reason": "stop"}}}) {
+		return
+	}
+	if usage != nil && !send(map[string]interface{}{"choices": []interface{}{}, "usage": usage}) {
+		return
+	}
+	_, _ = fmt.Fprint(w, "data: [DONE]\n\n")
+	_ = rc.Flush()
+}
+
+type mockImageRequest struct {
+	Prompt         string `json:"prompt"`
+	Model          string `json:"model"`
+	Size           string `json:"size"`
+	ResponseFormat string `json:"response_format"`
+}
+
+func (m *MockProvider) handleImages(w http.ResponseWriter, r *http.Request) {
+	if !m.authorized(w, r) {
+		return
+	}
+	var req mockImageRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Prompt) == "" {
+		writeMockError(w, http.StatusBadRequest, "invalid_request_error", "prompt is required")
+		return
+	}
+	width, height := parseImageSize(req.Size)
+	data, err := mockImagePNG(req.Prompt, width, height)
+	if err != nil {
+		writeMockError(w, http.StatusInternalServerError, "server_error", err.Error())
+		return
+	}
+
+	item := map[string]string{"revised_prompt": req.Prompt}
+	if req.ResponseFormat == "b64_json" {
+		item["b64_json"] = base64.StdEncoding.EncodeToString(data)
+	} else {
+		id := shortHash(req.Prompt + "|" + req.Size)
+		m.store(id, data)
+		item["url"] = m.baseURL + "/files/" + id + ".png"
+	}
+	writeMockJSON(w, map[string]interface{}{
+		"created": time.Now().Unix(),
+		"data":    []map[string]string{item},
+	})
+}
+
+func (m *MockProvider) handleFile(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/v1/files/"), ".png")
+	m.mu.Lock()
+	data, ok := m.images[id]
+	m.mu.Unlock()
+	if !ok {
+		writeMockError(w, http.StatusNotFound, "not_found", "no such file")
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	_, _ = w.Write(data)
+}
+
+// store keeps a generated image for download, dropping the oldest past maxMockImages
+func (m *MockProvider) store(id string, data []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.images[id]; !ok {
+		m.order = append(m.order, id)
+	}
+	m.images[id] = data
+	for len(m.order) > maxMockImages {
+		delete(m.images, m.order[0])
+		m.order = m.order[1:]
+	}
+}
+
+func (m *MockProvider) authorized(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodPost {
+		writeMockError(w, http.StatusMethodNotAllowed, "invalid_request_error", "method not allowed")
+		return false
+	}
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+		writeMockError(w, http.StatusUnauthorized, "invalid_api_key", "missing bearer token")
+		return false
+	}
+	return true
+}
+
+// parseImageSize reads "WxH", defaulting to 1024x1024
+func parseImageSize(size string) (int, int) {
+	w, h, ok := strings.Cut(size, "x")
+	width, errW := strconv.Atoi(w)
+	height, errH := strconv.Atoi(h)
+	if !ok || errW != nil || errH != nil || width <= 0 || height <= 0 || width > 4096 || height > 4096 {
+		return 1024, 1024
+	}
+	return width, height
+}
+
+// mockImagePNG draws an 8x8 grid of colours taken from the SHA-256 of the prompt, so the
+// same prompt always yields the same image
+func mockImagePNG(prompt string, width, height int) ([]byte, error) {
+	sum := sha256.Sum256([]byte(prompt))
+	palette := make([]color.RGBA, 8)
+	for i := range palette {
+		palette[i] = color.RGBA{R: sum[i*3], G: sum[i*3+1], B: sum[i*3+2], A: 0xff}
+	}
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		row := y * 8 / height
+		for x := 0; x < width; x++ {
+			col := x * 8 / width
+			img.SetRGBA(x, y, palette[int(sum[(row*8+col)%len(sum)])%len(palette)])
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func shortHash(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:8])
+}
+
+func writeMockJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// writeMockError answers in OpenAI's error envelope
+func writeMockError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]string{"message": message, "type": code, "code": code},
+	})
+}
+
+var _ Provider = (*MockProvider)(nil)
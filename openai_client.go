@@ -1,12 +1,17 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/TrueBlocks/trueblocks-dalle/v6/pkg/prompt"
@@ -15,6 +20,8 @@ import (
 // Enhanced timeout constants
 var (
 	enhanceDeadline = 60 * time.Second
+	// enhanceIdleTimeout abandons a streamed enhancement that goes this long without data
+	enhanceIdleTimeout = 15 * time.Second
 )
 
 // OpenAIClient provides resilient OpenAI API operations
@@ -22,93 +29,166 @@ type OpenAIClient struct {
 	httpClient     *http.Client
 	circuitBreaker *CircuitBreaker
 	retryConfig    RetryConfig
-	apiKey         string
+	limiter        *TokenBucket // paces requests by the provider's rate-limit headers
+	provider       Provider
+	fallback       *EnhancementFallback // set on clients for fallback providers
 }
 
-// NewOpenAIClient creates a new resilient OpenAI client
-func NewOpenAIClient(apiKey string) *OpenAIClient {
+// NewOpenAIClient creates a new resilient client for the provider's chat endpoint
+func NewOpenAIClient(provider Provider) *OpenAIClient {
 	return &OpenAIClient{
 		httpClient: &http.Client{
 			Timeout: enhanceDeadline + 10*time.Second, // Buffer beyond context timeout
 		},
 		circuitBreaker: DefaultOpenAICircuitBreaker,
 		retryConfig:    OpenAIRetryConfig,
-		apiKey:         apiKey,
+		limiter:        NewTokenBucket(chatRequestsPerMinute),
+		provider:       provider,
 	}
 }
 
-// EnhancePromptWithResilience enhances a prompt with retry and circuit breaker protection
-func (c *OpenAIClient) EnhancePromptWithResilience(prmt, authorType, requestID string) (string, error) {
-	var result string
+// ChatUsage is the token usage a provider reported for one chat completion
+type ChatUsage struct {
+	Provider         string // the provider that served the completion
+	Model            string
+	PromptTokens     int
+	CompletionTokens int
+}
+
+// enhancementDegraded labels enhancements that fell back to the original prompt
+const enhancementDegraded = "none"
+
+// EnhancePromptWithResilience enhances a prompt with the client's provider and then with each
+// configured fallback in order, every one behind its own retries and circuit breaker. When all
+// of them fail the original prompt is returned (graceful degradation) with a zero usage.
+func (c *OpenAIClient) EnhancePromptWithResilience(settings EnhancementSettings, prmt, authorType, series, requestID string) (string, ChatUsage, error) {
+	return c.EnhancePromptStreaming(settings, prmt, authorType, series, requestID, nil)
+}
 
-	operation := func() error {
-		enhanced, err := c.enhancePromptAttempt(prmt, authorType, requestID)
-		if err != nil {
-			return err
+// EnhancePromptStreaming is EnhancePromptWithResilience reporting the enhanced text received
+// so far to onPartial (when set) as the provider streams it. A retry or fallback starts the
+// text over.
+func (c *OpenAIClient) EnhancePromptStreaming(settings EnhancementSettings, prmt, authorType, series, requestID string, onPartial func(string)) (string, ChatUsage, error) {
+	system, err := settings.RenderSystemPrompt(authorType, series)
+	if err != nil {
+		logInfo(fmt.Sprintf("[%s] invalid enhancement system prompt, using original prompt", requestID), "error", err)
+		GetMetricsCollector().RecordEnhancement(enhancementDegraded, requestID)
+		return prmt, ChatUsage{}, nil
+	}
+
+	routes := []*OpenAIClient{c}
+	if c.fallback == nil {
+		routes = append(routes, currentFallbacks()...)
+	}
+	for i, route := range routes {
+		name := route.provider.Name()
+		enhanced, usage, err := route.enhanceWithBreaker(route.routeSettings(settings), system, prmt, requestID, onPartial)
+		if err == nil {
+			usage.Provider = name
+			GetMetricsCollector().RecordEnhancement(name, requestID)
+			return enhanced, usage, nil
+		}
+		GetMetricsCollector().RecordEnhancementFailure(name, requestID)
+		next := "using original prompt"
+		if i+1 < len(routes) {
+			next = "trying " + routes[i+1].provider.Name()
+		}
+		if cbErr, ok := err.(*CircuitBreakerError); ok && cbErr.IsCircuitBreakerOpen() {
+			logInfo(fmt.Sprintf("[%s] %s circuit breaker is open, %s", requestID, name, next))
+		} else {
+			logInfo(fmt.Sprintf("[%s] %s enhancement failed, %s", requestID, name, next), "error", err)
 		}
-		result = enhanced
-		return nil
 	}
 
-	// Execute with circuit breaker
+	// Graceful degradation
+	GetMetricsCollector().RecordEnhancement(enhancementDegraded, requestID)
+	return prmt, ChatUsage{}, nil
+}
+
+// routeSettings points the request settings at a fallback's endpoint and model; the primary
+// uses them unchanged
+func (c *OpenAIClient) routeSettings(settings EnhancementSettings) EnhancementSettings {
+	if c.fallback != nil {
+		return c.fallback.apply(settings)
+	}
+	return settings
+}
+
+// enhanceWithBreaker runs enhancement attempts with retries inside the client's circuit breaker
+func (c *OpenAIClient) enhanceWithBreaker(settings EnhancementSettings, system, prmt, requestID string, onPartial func(string)) (string, ChatUsage, error) {
+	var result string
+	var usage ChatUsage
 	err := c.circuitBreaker.Execute(func() error {
-		// Execute with retry logic
 		return RetryableHTTPOperation(c.retryConfig, requestID, func() (int, error) {
-			if err := operation(); err != nil {
+			enhanced, used, err := c.enhancePromptAttempt(settings, system, prmt, requestID, onPartial)
+			if err != nil {
 				// Extract status code if available
-				if apiErr, ok := err.(*prompt.OpenAIAPIError); ok {
+				var apiErr *prompt.OpenAIAPIError
+				if errors.As(err, &apiErr) {
 					return apiErr.StatusCode, err
 				}
 				return 0, err
 			}
+			result, usage = enhanced, used
 			return 200, nil
 		})
 	})
-
-	if err != nil {
-		// Check if circuit breaker blocked the request
-		if cbErr, ok := err.(*CircuitBreakerError); ok && cbErr.IsCircuitBreakerOpen() {
-			logInfo(fmt.Sprintf("[%s] OpenAI circuit breaker is open, using non-enhanced prompt", requestID))
-			return prmt, nil // Graceful degradation
-		}
-
-		// Log error but return original prompt for graceful degradation
-		logInfo(fmt.Sprintf("[%s] OpenAI enhancement failed, using original prompt", requestID), "error", err)
-		return prmt, nil
-	}
-
-	return result, nil
+	return result, usage, err
 }
 
-// enhancePromptAttempt performs a single attempt to enhance a prompt
-func (c *OpenAIClient) enhancePromptAttempt(prmt, authorType, requestID string) (string, error) {
-	_ = authorType // delint
-	url := "https://api.openai.com/v1/chat/completions"
+// enhancePromptAttempt performs a single attempt to enhance a prompt. The completion is
+// requested as a stream; providers that answer with a plain JSON body are read as before.
+func (c *OpenAIClient) enhancePromptAttempt(settings EnhancementSettings, system, prmt, requestID string, onPartial func(string)) (string, ChatUsage, error) {
+	url := settings.ChatURL(c.provider)
 
 	payload := map[string]interface{}{
-		"model":       "gpt-4",
-		"temperature": 0.2,
-		"seed":        1337,
+		"model": settings.Model,
 		"messages": []map[string]string{
-			{"role": "system", "content": prmt},
+			{"role": "system", "content": system},
+			{"role": "user", "content": prmt},
 		},
+		"stream":         true,
+		"stream_options": map[string]bool{"include_usage": true},
+	}
+	if settings.Temperature != nil {
+		payload["temperature"] = *settings.Temperature
+	}
+	if settings.Seed != nil {
+		payload["seed"] = *settings.Seed
+	}
+	if settings.MaxTokens > 0 {
+		payload["max_tokens"] = settings.MaxTokens
 	}
 
 	payloadBytes, err := json.Marshal(payload)
 	if err != nil {
-		return "", fmt.Errorf("marshal request: %w", err)
+		return "", ChatUsage{}, fmt.Errorf("marshal request: %w", err)
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), enhanceDeadline)
 	defer cancel()
 
+	// Hold the request until the provider's rate limits have room for it
+	if waited, err := c.limiter.Wait(ctx); err != nil {
+		return "", ChatUsage{}, &prompt.OpenAIAPIError{
+			Message:    fmt.Sprintf("client-side rate limit: %v", err),
+			StatusCode: http.StatusTooManyRequests,
+			RequestID:  requestID,
+		}
+	} else if waited > 0 {
+		GetMetricsCollector().RecordRateLimitWait(waited)
+		logInfo(fmt.Sprintf("[%s] OpenAI enhance request paced by rate limit", requestID), "waitMs", waited.Milliseconds())
+	}
+
 	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(payloadBytes))
 	if err != nil {
-		return "", fmt.Errorf("create request: %w", err)
+		return "", ChatUsage{}, fmt.Errorf("create request: %w", err)
 	}
 
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+c.apiKey)
+	if key := c.provider.APIKey(); key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
 	req.Header.Set("X-Request-ID", requestID)
 
 	start := time.Now()
@@ -118,7 +198,7 @@ func (c *OpenAIClient) enhancePromptAttempt(prmt, authorType, requestID string)
 	if err != nil {
 		GetMetricsCollector().RecordOpenAIRequest(false, false, requestID)
 		GetMetricsCollector().RecordError("OPENAI_ERROR", "openai_chat_completions", requestID)
-		return "", &prompt.OpenAIAPIError{
+		return "", ChatUsage{}, &prompt.OpenAIAPIError{
 			Message:    fmt.Sprintf("HTTP request failed: %v", err),
 			StatusCode: 0,
 			RequestID:  requestID,
@@ -130,12 +210,18 @@ func (c *OpenAIClient) enhancePromptAttempt(prmt, authorType, requestID string)
 			_ = err
 		}
 	}()
+	limits := ParseRateLimitHeaders(resp.Header, time.Now())
+	c.limiter.Observe(limits)
+
+	if resp.StatusCode == http.StatusOK && strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		return c.readEnhancementStream(resp, cancel, settings, prmt, requestID, start, onPartial)
+	}
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
 		GetMetricsCollector().RecordOpenAIRequest(false, false, requestID)
 		GetMetricsCollector().RecordError("OPENAI_ERROR", "openai_chat_completions", requestID)
-		return "", &prompt.OpenAIAPIError{
+		return "", ChatUsage{}, &prompt.OpenAIAPIError{
 			Message:    fmt.Sprintf("read response body: %v", err),
 			StatusCode: resp.StatusCode,
 			RequestID:  requestID,
@@ -154,11 +240,15 @@ func (c *OpenAIClient) enhancePromptAttempt(prmt, authorType, requestID string)
 		}
 		GetMetricsCollector().RecordOpenAIRequest(false, resp.StatusCode == http.StatusGatewayTimeout, requestID)
 		GetMetricsCollector().RecordError("OPENAI_ERROR", "openai_chat_completions", requestID)
-		return "", &prompt.OpenAIAPIError{
+		apiErr := &prompt.OpenAIAPIError{
 			Message:    fmt.Sprintf("OpenAI API error: %s", errorBody),
 			StatusCode: resp.StatusCode,
 			RequestID:  requestID,
 		}
+		if wait := limits.Wait(); wait > 0 {
+			return "", ChatUsage{}, &RetryAfterError{Err: apiErr, Wait: wait}
+		}
+		return "", ChatUsage{}, apiErr
 	}
 
 	// Parse response
@@ -168,6 +258,11 @@ func (c *OpenAIClient) enhancePromptAttempt(prmt, authorType, requestID string)
 				Content string `json:"content"`
 			} `json:"message"`
 		} `json:"choices"`
+		Model string `json:"model"`
+		Usage struct {
+			PromptTokens     int `json:"prompt_tokens"`
+			CompletionTokens int `json:"completion_tokens"`
+		} `json:"usage"`
 		Error *struct {
 			Message string `json:"message"`
 			Type    string `json:"type"`
@@ -179,7 +274,7 @@ func (c *OpenAIClient) enhancePromptAttempt(prmt, authorType, requestID string)
 	if err := json.Unmarshal(body, &response); err != nil {
 		GetMetricsCollector().RecordOpenAIRequest(false, false, requestID)
 		GetMetricsCollector().RecordError("OPENAI_ERROR", "openai_chat_completions", requestID)
-		return "", &prompt.OpenAIAPIError{
+		return "", ChatUsage{}, &prompt.OpenAIAPIError{
 			Message:    fmt.Sprintf("parse response: %v", err),
 			StatusCode: resp.StatusCode,
 			RequestID:  requestID,
@@ -194,29 +289,145 @@ func (c *OpenAIClient) enhancePromptAttempt(prmt, authorType, requestID string)
 			errorCode = "OPENAI_ERROR"
 		}
 		GetMetricsCollector().RecordError(errorCode, "openai_chat_completions", requestID)
-		return "", &prompt.OpenAIAPIError{
+		return "", ChatUsage{}, &prompt.OpenAIAPIError{
 			Message:    fmt.Sprintf("OpenAI API error: %s", response.Error.Message),
 			StatusCode: resp.StatusCode,
 			RequestID:  requestID,
 		}
 	}
 
+	usage := ChatUsage{Model: response.Model, PromptTokens: response.Usage.PromptTokens, CompletionTokens: response.Usage.CompletionTokens}
+	if usage.Model == "" {
+		usage.Model = settings.Model
+	}
+
 	if len(response.Choices) == 0 {
 		logInfo(fmt.Sprintf("[%s] OpenAI returned no choices", requestID))
-		return prmt, nil // Return original
+		return prmt, usage, nil // Return original
 	}
 
 	content := response.Choices[0].Message.Content
 	if content == "" {
 		logInfo(fmt.Sprintf("[%s] OpenAI returned empty content", requestID))
-		return prmt, nil // Return original
+		return prmt, usage, nil // Return original
 	}
 
 	logInfo(fmt.Sprintf("[%s] OpenAI enhancement successful", requestID),
 		"originalLen", len(prmt), "enhancedLen", len(content))
 	GetMetricsCollector().RecordOpenAIRequest(true, false, requestID)
 
-	return content, nil
+	return content, usage, nil
+}
+
+// chatStreamChunk is one server-sent event of a streamed chat completion. The last chunk
+// before [DONE] carries the usage and no choices.
+type chatStreamChunk struct {
+	Model   string `json:"model"`
+	Choices []struct {
+		Delta struct {
+			Content string `json:"content"`
+		} `json:"delta"`
+		FinishReason string `json:"finish_reason"`
+	} `json:"choices"`
+	Usage *struct {
+		PromptTokens     int `json:"prompt_tokens"`
+		CompletionTokens int `json:"completion_tokens"`
+	} `json:"usage"`
+	Error *struct {
+		Message string `json:"message"`
+		Code    string `json:"code"`
+	} `json:"error,omitempty"`
+}
+
+// readEnhancementStream reads a streamed chat completion, passing the text so far to
+// onPartial as deltas arrive. A stream that goes enhanceIdleTimeout without data is cut off
+// (by cancelling the request) rather than left to run out the whole deadline, and one that
+// ends before [DONE] or a finish reason counts as truncated.
+func (c *OpenAIClient) readEnhancementStream(resp *http.Response, cancel context.CancelFunc, settings EnhancementSettings, prmt, requestID string, start time.Time, onPartial func(string)) (string, ChatUsage, error) {
+	idle := enhanceIdleTimeout
+	var stalled atomic.Bool
+	timer := time.AfterFunc(idle, func() {
+		stalled.Store(true)
+		cancel()
+	})
+	defer timer.Stop()
+
+	fail := func(status int, timeout bool, code, message string) (string, ChatUsage, error) {
+		GetMetricsCollector().RecordOpenAIRequest(false, timeout, requestID)
+		GetMetricsCollector().RecordError(code, "openai_chat_completions", requestID)
+		return "", ChatUsage{}, &prompt.OpenAIAPIError{Message: message, StatusCode: status, RequestID: requestID}
+	}
+
+	var text strings.Builder
+	usage := ChatUsage{Model: settings.Model}
+	finished, finishReason := false, false
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		timer.Reset(idle)
+		// Blank lines, comments and event names carry no data
+		data, ok := strings.CutPrefix(scanner.Text(), "data:")
+		if !ok {
+			continue
+		}
+		data = strings.TrimSpace(data)
+		if data == "[DONE]" {
+			finished = true
+			break
+		}
+		var chunk chatStreamChunk
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return fail(resp.StatusCode, false, "OPENAI_ERROR", fmt.Sprintf("parse stream chunk: %v", err))
+		}
+		if chunk.Error != nil {
+			code := chunk.Error.Code
+			if code == "" {
+				code = "OPENAI_ERROR"
+			}
+			return fail(resp.StatusCode, false, code, fmt.Sprintf("OpenAI API error: %s", chunk.Error.Message))
+		}
+		if chunk.Model != "" {
+			usage.Model = chunk.Model
+		}
+		if chunk.Usage != nil {
+			usage.PromptTokens, usage.CompletionTokens = chunk.Usage.PromptTokens, chunk.Usage.CompletionTokens
+		}
+		for _, choice := range chunk.Choices {
+			finishReason = finishReason || choice.FinishReason != ""
+			if choice.Delta.Content != "" {
+				text.WriteString(choice.Delta.Content)
+				if onPartial != nil {
+					onPartial(text.String())
+				}
+			}
+		}
+	}
+	// A finish reason without [DONE] still completes the text; only the usage chunk may be lost
+	finished = finished || (finishReason && scanner.Err() == nil)
+
+	duration := time.Since(start)
+	logInfo(fmt.Sprintf("[%s] OpenAI enhance stream completed", requestID),
+		"durMs", duration.Milliseconds(), "streamedLen", text.Len())
+	switch {
+	case stalled.Load():
+		return fail(0, true, "OPENAI_ERROR", fmt.Sprintf("stream stalled: no data for %v", idle))
+	case scanner.Err() != nil:
+		return fail(resp.StatusCode, false, "OPENAI_ERROR", fmt.Sprintf("read response stream: %v", scanner.Err()))
+	case !finished:
+		return fail(resp.StatusCode, false, "OPENAI_ERROR", "read response stream: stream ended before completion")
+	}
+
+	content := text.String()
+	if content == "" {
+		logInfo(fmt.Sprintf("[%s] OpenAI returned empty content", requestID))
+		return prmt, usage, nil // Return original
+	}
+
+	logInfo(fmt.Sprintf("[%s] OpenAI enhancement successful", requestID),
+		"originalLen", len(prmt), "enhancedLen", len(content))
+	GetMetricsCollector().RecordOpenAIRequest(true, false, requestID)
+
+	return content, usage, nil
 }
 
 // GetCircuitBreakerMetrics returns current circuit breaker metrics
@@ -230,20 +441,24 @@ func (c *OpenAIClient) ResetCircuitBreaker() {
 }
 
 // Global OpenAI client instance
-var globalOpenAIClient *OpenAIClient
+var (
+	globalOpenAIClient   *OpenAIClient
+	globalOpenAIClientMu sync.Mutex
+)
 
-// GetOpenAIClient returns the global OpenAI client, creating it if necessary
+// GetOpenAIClient returns the global client for the current provider, creating it if necessary
 func GetOpenAIClient() *OpenAIClient {
+	globalOpenAIClientMu.Lock()
+	defer globalOpenAIClientMu.Unlock()
 	if globalOpenAIClient == nil {
-		apiKey := getOpenAIAPIKey() // Need to implement this
-		globalOpenAIClient = NewOpenAIClient(apiKey)
+		globalOpenAIClient = NewOpenAIClient(CurrentProvider())
 	}
 	return globalOpenAIClient
 }
 
-// getOpenAIAPIKey safely retrieves the OpenAI API key
-func getOpenAIAPIKey() string {
-	// This will be imported from environment or config
-	// For now, return empty - the client will handle missing keys gracefully
-	return ""
+// resetOpenAIClient drops the global client so the next call picks up a new provider
+func resetOpenAIClient() {
+	globalOpenAIClientMu.Lock()
+	defer globalOpenAIClientMu.Unlock()
+	globalOpenAIClient = nil
 }
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/TrueBlocks/trueblocks-dalle/v6/pkg/progress"
+	"github.com/TrueBlocks/trueblocks-dalle/v6/pkg/storage"
+)
+
+// progressPollInterval is how often a watched key's progress snapshot is sampled
+var progressPollInterval = 250 * time.Millisecond
+
+// Progress event types
+const (
+	ProgressEventPhase     = "phase"
+	ProgressEventCompleted = "completed"
+	ProgressEventFailed    = "failed"
+)
+
+// ProgressEvent is a single phase transition (or terminal outcome) for a generation
+type ProgressEvent struct {
+	Type       string         `json:"type"`
+	Series     string         `json:"series"`
+	Address    string         `json:"address"`
+	Phase      progress.Phase `json:"phase"`
+	Percent    float64        `json:"percent"`
+	ETASeconds float64        `json:"etaSeconds"`
+	CacheHit   bool           `json:"cacheHit,omitempty"`
+	// EnhancementProvider names the provider that enhanced the prompt ("none" when it fell
+	// back to the original prompt)
+	EnhancementProvider string `json:"enhancementProvider,omitempty"`
+	// EnhancedPromptPartial is the enhanced prompt streamed so far, while the provider is
+	// still writing it
+	EnhancedPromptPartial string `json:"enhancedPromptPartial,omitempty"`
+	ImageURL              string `json:"imageUrl,omitempty"`
+	// BlobURL is the immutable URL of the finished image, safe to cache forever
+	BlobURL string `json:"blobUrl,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// IsTerminal reports whether no further events follow this one
+func (e ProgressEvent) IsTerminal() bool {
+	return e.Type == ProgressEventCompleted || e.Type == ProgressEventFailed
+}
+
+// ProgressBroker fans progress events out to subscribers. The library only exposes
+// snapshots, so each watched key is sampled by a single goroutine no matter how many
+// clients are listening, and events are emitted only when the phase (or the streamed
+// enhanced prompt) changes.
+type ProgressBroker struct {
+	mu      sync.Mutex
+	watches map[string]*progressWatch
+}
+
+type progressWatch struct {
+	series  string
+	address string
+	subs    map[chan ProgressEvent]struct{}
+	stop    chan struct{}
+	exited  chan struct{} // closed when the sampling goroutine returns
+	last    *ProgressEvent
+}
+
+var (
+	progressBroker     *ProgressBroker
+	progressBrokerOnce sync.Once
+)
+
+// GetProgressBroker returns the global progress broker
+func GetProgressBroker() *ProgressBroker {
+	progressBrokerOnce.Do(func() {
+		progressBroker = &ProgressBroker{watches: make(map[string]*progressWatch)}
+	})
+	return progressBroker
+}
+
+// Subscribe returns a channel of events for (series, address) and a function that
+// releases the subscription. The channel is closed after the terminal event.
+func (b *ProgressBroker) Subscribe(series, address string) (<-chan ProgressEvent, func()) {
+	ch := make(chan ProgressEvent, 16)
+	key := series + ":" + address
+
+	b.mu.Lock()
+	w := b.watches[key]
+	if w == nil {
+		w = &progressWatch{series: series, address: address, subs: make(map[chan ProgressEvent]struct{}), stop: make(chan struct{}), exited: make(chan struct{})}
+		b.watches[key] = w
+		go b.watch(key, w)
+	}
+	w.subs[ch] = struct{}{}
+	if w.last != nil {
+		// Late subscribers start from the most recent phase rather than waiting for the next one
+		ch <- *w.last
+	}
+	b.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() { b.unsubscribe(key, w, ch) })
+	}
+}
+
+func (b *ProgressBroker) unsubscribe(key string, w *progressWatch, ch chan ProgressEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := w.subs[ch]; !ok {
+		return
+	}
+	delete(w.subs, ch)
+	close(ch)
+	if len(w.subs) == 0 && b.watches[key] == w {
+		delete(b.watches, key)
+		close(w.stop)
+	}
+}
+
+func (b *ProgressBroker) watch(key string, w *progressWatch) {
+	defer close(w.exited)
+	ticker := time.NewTicker(progressPollInterval)
+	defer ticker.Stop()
+	for {
+		if ev, ok := sampleProgress(w.series, w.address); ok {
+			if b.publish(key, w, ev) {
+				return
+			}
+		}
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// publish delivers ev if it differs from the last event and reports whether the watch ended
+func (b *ProgressBroker) publish(key string, w *progressWatch, ev ProgressEvent) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if w.last != nil && w.last.Type == ev.Type && w.last.Phase == ev.Phase && w.last.EnhancedPromptPartial == ev.EnhancedPromptPartial {
+		return false
+	}
+	w.last = &ev
+	for ch := range w.subs {
+		select {
+		case ch <- ev:
+		default:
+			// A stalled subscriber misses intermediate phases but still gets the terminal event below
+			// The subscriber may drain the channel meanwhile, so neither step may block
+			if ev.IsTerminal() {
+				select {
+				case <-ch:
+				default:
+				}
+				select {
+				case ch <- ev:
+				default:
+				}
+			}
+		}
+	}
+	if !ev.IsTerminal() {
+		return false
+	}
+	for ch := range w.subs {
+		close(ch)
+		delete(w.subs, ch)
+	}
+	if b.watches[key] == w {
+		delete(b.watches, key)
+	}
+	return true
+}
+
+// sampleProgress converts the current snapshot for (series, address) into an event
+func sampleProgress(series, address string) (ProgressEvent, bool) {
+	pr := progress.GetProgress(series, address)
+	if pr == nil {
+		annotated := filepath.Join(storage.OutputDir(), series, "annotated", address+".png")
+		if fileExists(annotated) {
+			return ProgressEvent{
+				Type:     ProgressEventCompleted,
+				Series:   series,
+				Address:  address,
+				Phase:    progress.PhaseCompleted,
+				Percent:  100,
+				CacheHit: true,
+				ImageURL: annotatedImageURL(series, address),
+				BlobURL:  annotatedBlobURL(series, address),
+			}, true
+		}
+		// Enhancement runs before the library's report exists
+		if partial := partialEnhancementFor(series, address); partial != "" {
+			return ProgressEvent{
+				Type:                  ProgressEventPhase,
+				Series:                series,
+				Address:               address,
+				Phase:                 progress.PhaseEnhance,
+				EnhancedPromptPartial: partial,
+			}, true
+		}
+		return ProgressEvent{}, false
+	}
+	ev := ProgressEvent{
+		Type:                ProgressEventPhase,
+		Series:              series,
+		Address:             address,
+		Phase:               pr.Current,
+		Percent:             pr.Percent,
+		ETASeconds:          pr.ETASeconds,
+		CacheHit:            pr.CacheHit,
+		EnhancementProvider: enhancementProviderFor(series, address),
+	}
+	if pr.Done {
+		if pr.Error != "" {
+			ev.Type = ProgressEventFailed
+			ev.Error = pr.Error
+		} else {
+			ev.Type = ProgressEventCompleted
+			ev.Percent = 100
+			ev.ETASeconds = 0
+			ev.EnhancementProvider = finishedEnhancementProvider(series, address)
+			ev.ImageURL = annotatedImageURL(series, address)
+			ev.BlobURL = annotatedBlobURL(series, address)
+		}
+	}
+	return ev, true
+}
+
+// annotatedImageURL is the /files/ URL of the annotated PNG for (series, address)
+func annotatedImageURL(series, address string) string {
+	return "/files/" + series + "/annotated/" + address + ".png"
+}
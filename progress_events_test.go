@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	dalle "github.com/TrueBlocks/trueblocks-dalle/v6"
+	"github.com/TrueBlocks/trueblocks-dalle/v6/pkg/model"
+	"github.com/TrueBlocks/trueblocks-dalle/v6/pkg/progress"
+)
+
+type sseEvent struct {
+	event string
+	data  string
+}
+
+func readSSEEvent(t *testing.T, reader *bufio.Reader) sseEvent {
+	t.Helper()
+	var ev sseEvent
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("read event stream: %v", err)
+		}
+		line = strings.TrimRight(line, "\n")
+		switch {
+		case line == "":
+			if ev.event != "" {
+				return ev
+			}
+		case strings.HasPrefix(line, "event: "):
+			ev.event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			ev.data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+func TestProgressEventStream(t *testing.T) {
+	dalle.SetupTest(t, dalle.SetupTestOptions{Series: []string{"empty"}})
+	app := NewApp()
+
+	originalPoll, originalHeartbeat := progressPollInterval, sseHeartbeatInterval
+	progressPollInterval, sseHeartbeatInterval = 5*time.Millisecond, 20*time.Millisecond
+	defer func() { progressPollInterval, sseHeartbeatInterval = originalPoll, originalHeartbeat }()
+
+	addr := "0x7777777777777777777777777777777777777777"
+	pm := progress.GetProgressManager()
+	pm.StartRun("empty", addr, &model.DalleDress{})
+
+	server := httptest.NewServer(http.HandlerFunc(app.handleV1Progress))
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/v1/progress/empty/" + addr + "/events")
+	if err != nil {
+		t.Fatalf("GET events: %v", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("expected text/event-stream, got %q", ct)
+	}
+	reader := bufio.NewReader(resp.Body)
+
+	if ev := readSSEEvent(t, reader); ev.event != ProgressEventPhase || !strings.Contains(ev.data, `"phase":"setup"`) {
+		t.Fatalf("expected setup phase event, got %#v", ev)
+	}
+	pm.Transition("empty", addr, progress.PhaseBasePrompts)
+	if ev := readSSEEvent(t, reader); !strings.Contains(ev.data, `"phase":"base_prompts"`) {
+		t.Fatalf("expected base_prompts phase event, got %#v", ev)
+	}
+
+	// An idle stream still receives heartbeats
+	time.Sleep(3 * sseHeartbeatInterval)
+	pm.Complete("empty", addr)
+	ev := readSSEEvent(t, reader)
+	if ev.event != ProgressEventCompleted {
+		t.Fatalf("expected completed event, got %#v", ev)
+	}
+	var final ProgressEvent
+	if err := json.Unmarshal([]byte(ev.data), &final); err != nil {
+		t.Fatalf("decode terminal event: %v", err)
+	}
+	if final.ImageURL != annotatedImageURL("empty", addr) {
+		t.Fatalf("unexpected image url %q", final.ImageURL)
+	}
+}
+
+func TestProgressEventStreamInvalidPath(t *testing.T) {
+	dalle.SetupTest(t, dalle.SetupTestOptions{Series: []string{"empty"}})
+	app := NewApp()
+	for _, path := range []string{"/v1/progress/empty/0x1234/events", "/v1/progress/empty/events"} {
+		recorder := httptest.NewRecorder()
+		app.handleV1Progress(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+		if recorder.Code != http.StatusBadRequest {
+			t.Fatalf("%s: expected 400, got %d", path, recorder.Code)
+		}
+	}
+}
+
+func TestProgressBrokerSharesWatch(t *testing.T) {
+	broker := &ProgressBroker{watches: make(map[string]*progressWatch)}
+	_, release1 := broker.Subscribe("empty", "0x8888888888888888888888888888888888888888")
+	_, release2 := broker.Subscribe("empty", "0x8888888888888888888888888888888888888888")
+	if len(broker.watches) != 1 {
+		t.Fatalf("expected a single shared watch, got %d", len(broker.watches))
+	}
+	var watch *progressWatch
+	for _, w := range broker.watches {
+		watch = w
+	}
+	release1()
+	release2()
+	release2()
+	if len(broker.watches) != 0 {
+		t.Fatalf("expected watch to stop after last subscriber left")
+	}
+	select {
+	case <-watch.exited:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("sampling goroutine did not exit")
+	}
+}
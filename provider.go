@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Provider is an image and prompt-enhancement backend speaking the OpenAI wire format.
+// The library reads its enhancement endpoint and API key from the environment and takes
+// the image endpoint per call, so a provider is described by those three values.
+type Provider interface {
+	Name() string
+	// ChatURL is the chat-completions endpoint used for prompt enhancement
+	ChatURL() string
+	// ImageURL is the image-generations endpoint
+	ImageURL() string
+	// APIKey is sent as the bearer token on both endpoints
+	APIKey() string
+}
+
+const (
+	ProviderOpenAI = "openai"
+	ProviderMock   = "mock"
+	ProviderRecord = "record"
+	ProviderReplay = "replay"
+)
+
+const (
+	openAIChatURL  = "https://api.openai.com/v1/chat/completions"
+	openAIImageURL = "https://api.openai.com/v1/images/generations"
+)
+
+// OpenAIProvider targets api.openai.com, or the endpoints in TB_DALLE_ENHANCEMENT_URL and
+// TB_DALLE_IMAGE_URL when set
+type OpenAIProvider struct{}
+
+func (OpenAIProvider) Name() string { return ProviderOpenAI }
+
+func (OpenAIProvider) ChatURL() string {
+	if url := os.Getenv("TB_DALLE_ENHANCEMENT_URL"); url != "" {
+		return url
+	}
+	return openAIChatURL
+}
+
+func (OpenAIProvider) ImageURL() string {
+	if url := os.Getenv("TB_DALLE_IMAGE_URL"); url != "" {
+		return url
+	}
+	return openAIImageURL
+}
+
+func (OpenAIProvider) APIKey() string { return os.Getenv("OPENAI_API_KEY") }
+
+var activeProvider = struct {
+	sync.RWMutex
+	p Provider
+}{p: OpenAIProvider{}}
+
+// CurrentProvider returns the provider generations are sent to
+func CurrentProvider() Provider {
+	activeProvider.RLock()
+	defer activeProvider.RUnlock()
+	return activeProvider.p
+}
+
+// UseProvider routes generations to p. The library reads the enhancement endpoint and
+// key from the environment on every call, so they are exported there as well.
+func UseProvider(p Provider) {
+	activeProvider.Lock()
+	activeProvider.p = p
+	activeProvider.Unlock()
+	_ = os.Setenv("TB_DALLE_ENHANCEMENT_URL", p.ChatURL())
+	if key := p.APIKey(); key != "" {
+		_ = os.Setenv("OPENAI_API_KEY", key)
+	}
+	resetOpenAIClient()
+}
+
+// startProvider creates the provider named in the configuration. The mock, record and
+// replay providers run in-process on a loopback port for the life of the server.
+func startProvider(cfg Config) (Provider, error) {
+	switch strings.ToLower(cfg.Provider) {
+	case "", ProviderOpenAI:
+		return OpenAIProvider{}, nil
+	case ProviderMock:
+		mock, err := StartMockProvider("127.0.0.1:0")
+		if err != nil {
+			return nil, fmt.Errorf("start mock provider: %w", err)
+		}
+		logInfo(fmt.Sprintf("Using mock image provider at %s", mock.BaseURL()))
+		return mock, nil
+	case ProviderRecord, ProviderReplay:
+		replay, err := StartReplayProvider("127.0.0.1:0", cfg.Provider, cfg.FixturesDir, cfg.ReplayUpstream, cfg.Faults)
+		if err != nil {
+			return nil, fmt.Errorf("start %s provider: %w", cfg.Provider, err)
+		}
+		logInfo(fmt.Sprintf("Using %s provider at %s (fixtures in %s)", cfg.Provider, replay.BaseURL(), cfg.FixturesDir))
+		return replay, nil
+	}
+	return nil, fmt.Errorf("unknown provider %q (expected openai, mock, record or replay)", cfg.Provider)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image/png"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	dalle "github.com/TrueBlocks/trueblocks-dalle/v6"
+	"github.com/TrueBlocks/trueblocks-dalle/v6/pkg/storage"
+)
+
+// useMockProvider starts a mock provider for one test and restores the previous provider
+// and environment afterwards
+func useMockProvider(t *testing.T) *MockProvider {
+	t.Helper()
+	mock, err := StartMockProvider("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("start mock: %v", err)
+	}
+	previous := CurrentProvider()
+	t.Setenv("OPENAI_API_KEY", "")
+	t.Setenv("TB_DALLE_ENHANCEMENT_URL", "")
+	UseProvider(mock)
+	t.Cleanup(func() {
+		UseProvider(previous)
+		_ = mock.Close()
+	})
+	return mock
+}
+
+func TestMockProviderWireFormat(t *testing.T) {
+	mock := useMockProvider(t)
+
+	enhanced, usage, err := GetOpenAIClient().EnhancePromptWithResilience(defaultEnhancementSettings(), "a smiling aardvark", "a poet", "empty", "req-1")
+	if err != nil || !strings.Contains(enhanced, "a smiling aardvark") || enhanced == "a smiling aardvark" {
+		t.Fatalf("enhance: %q %v", enhanced, err)
+	}
+	if usage.PromptTokens == 0 || usage.CompletionTokens == 0 || usage.Model == "" {
+		t.Fatalf("usage not reported: %+v", usage)
+	}
+
+	post := func(body string, auth bool) *http.Response {
+		req, _ := http.NewRequest(http.MethodPost, mock.ImageURL(), strings.NewReader(body))
+		if auth {
+			req.Header.Set("Authorization", "Bearer "+mock.APIKey())
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("post: %v", err)
+		}
+		return resp
+	}
+	if resp := post(`{"prompt":"x"}`, false); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("missing key: %d", resp.StatusCode)
+	}
+
+	resp := post(`{"prompt":"a smiling aardvark","size":"64x32"}`, true)
+	var result struct {
+		Data []struct {
+			URL string `json:"url"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil || len(result.Data) != 1 {
+		t.Fatalf("decode: %v", err)
+	}
+	_ = resp.Body.Close()
+	download, err := http.Get(result.Data[0].URL)
+	if err != nil {
+		t.Fatalf("download: %v", err)
+	}
+	defer func() { _ = download.Body.Close() }()
+	img, err := png.Decode(download.Body)
+	if err != nil || img.Bounds().Dx() != 64 || img.Bounds().Dy() != 32 {
+		t.Fatalf("png: %v %v", err, img)
+	}
+
+	first, _ := mockImagePNG("same prompt", 16, 16)
+	second, _ := mockImagePNG("same prompt", 16, 16)
+	if !bytes.Equal(first, second) {
+		t.Fatalf("mock images are not deterministic")
+	}
+}
+
+func TestEndToEndGenerationWithMockProvider(t *testing.T) {
+	dalle.SetupTest(t, dalle.SetupTestOptions{Series: []string{"empty"}})
+	useMockProvider(t)
+	t.Setenv("TB_DALLE_SKIP_IMAGE", "")
+	t.Setenv("TB_DALLE_NO_ENHANCE", "")
+
+	series, address := "empty", "0x1f98431c8ad98523631ae4a59f267346ea31f984"
+
+	app := &App{Config: Config{LockTTL: time.Minute}, Dresses: NewDressBuilder()}
+	job := NewJob(JobKindDalle, "e2e")
+	job.Series, job.Address = series, address
+	result, err := app.runDalleJob(context.Background(), job)
+	if err != nil {
+		t.Fatalf("generation failed: %v", err)
+	}
+	path := result.(map[string]string)["path"]
+	info, err := os.Stat(path)
+	if err != nil || info.Size() == 0 {
+		t.Fatalf("annotated image missing or empty at %s: %v", path, err)
+	}
+	enhanced, err := os.ReadFile(filepath.Join(storage.OutputDir(), series, "enhanced", address+".txt"))
+	if err != nil || !strings.HasPrefix(string(enhanced), "A vivid, richly detailed rendering.") {
+		t.Fatalf("enhancement did not come from the mock provider: %q %v", enhanced, err)
+	}
+	// The job's in-memory record is gone; the manifest still names the provider
+	if enhancementProviderFor(series, address) != "" || finishedEnhancementProvider(series, address) != ProviderMock {
+		t.Fatalf("enhancement provider after the job: %q / %q", enhancementProviderFor(series, address), finishedEnhancementProvider(series, address))
+	}
+}
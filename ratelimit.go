@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Retry budget defaults: retries may add a fifth to provider traffic over a minute, and
+// a handful per minute are always allowed
+const (
+	defaultRetryBudget    = 0.2
+	retryBudgetWindow     = 60 * time.Second
+	retryBudgetMinRetries = 10
+)
+
+// RateLimitInfo is what a provider response says about its rate limits. Counts are -1 and
+// durations 0 when the header is absent.
+type RateLimitInfo struct {
+	// RetryAfter comes from retry-after-ms, else Retry-After (seconds or an HTTP date)
+	RetryAfter        time.Duration
+	LimitRequests     int
+	RemainingRequests int
+	RemainingTokens   int
+	ResetRequests     time.Duration
+	ResetTokens       time.Duration
+}
+
+// ParseRateLimitHeaders reads Retry-After and OpenAI's x-ratelimit-* headers. Reset times
+// use Go duration syntax ("1s", "6m0s", "20ms"); unparseable values count as absent.
+func ParseRateLimitHeaders(h http.Header, now time.Time) RateLimitInfo {
+	info := RateLimitInfo{
+		LimitRequests:     headerCount(h, "x-ratelimit-limit-requests"),
+		RemainingRequests: headerCount(h, "x-ratelimit-remaining-requests"),
+		RemainingTokens:   headerCount(h, "x-ratelimit-remaining-tokens"),
+		ResetRequests:     parsePositiveDuration(h.Get("x-ratelimit-reset-requests")),
+		ResetTokens:       parsePositiveDuration(h.Get("x-ratelimit-reset-tokens")),
+	}
+	if ms, err := strconv.ParseFloat(h.Get("retry-after-ms"), 64); err == nil && ms > 0 {
+		info.RetryAfter = time.Duration(ms * float64(time.Millisecond))
+	} else if raw := strings.TrimSpace(h.Get("Retry-After")); raw != "" {
+		if secs, err := strconv.ParseFloat(raw, 64); err == nil {
+			info.RetryAfter = time.Duration(math.Max(0, secs) * float64(time.Second))
+		} else if at, err := http.ParseTime(raw); err == nil && at.After(now) {
+			info.RetryAfter = at.Sub(now)
+		}
+	}
+	return info
+}
+
+// headerCount parses a non-negative count header, returning -1 when it is absent or invalid
+func headerCount(h http.Header, key string) int {
+	n, err := strconv.Atoi(strings.TrimSpace(h.Get(key)))
+	if err != nil || n < 0 {
+		return -1
+	}
+	return n
+}
+
+// Wait is how long the provider asked us to hold off: Retry-After when it was sent,
+// otherwise the reset of whichever limit is exhausted
+func (i RateLimitInfo) Wait() time.Duration {
+	if i.RetryAfter > 0 {
+		return i.RetryAfter
+	}
+	var wait time.Duration
+	if i.RemainingRequests == 0 {
+		wait = i.ResetRequests
+	}
+	if i.RemainingTokens == 0 && i.ResetTokens > wait {
+		wait = i.ResetTokens
+	}
+	return wait
+}
+
+// RetryAfterError is a provider error that came with instructions on when to try again
+type RetryAfterError struct {
+	Err  error
+	Wait time.Duration
+}
+
+func (r *RetryAfterError) Error() string {
+	return fmt.Sprintf("%v (retry after %v)", r.Err, r.Wait)
+}
+
+func (r *RetryAfterError) Unwrap() error {
+	return r.Err
+}
+
+// TokenBucket paces the requests sent to one provider. It starts from the configured
+// requests per minute, if any, and then follows the provider's headers: the request limit
+// sets the refill rate (capped by the configured one), the remaining count caps the tokens
+// on hand, and an exhausted limit or a Retry-After holds every request until the reset.
+// Until a limit is known only the holds apply.
+type TokenBucket struct {
+	mu        sync.Mutex
+	perMinute int // configured limit; 0 takes the provider's
+	capacity  float64
+	tokens    float64
+	rate      float64 // tokens per second
+	last      time.Time
+	heldUntil time.Time
+}
+
+// NewTokenBucket creates a bucket allowing perMinute requests a minute; 0 waits to learn
+// the limit from the provider
+func NewTokenBucket(perMinute int) *TokenBucket {
+	b := &TokenBucket{perMinute: perMinute, last: time.Now()}
+	if perMinute > 0 {
+		b.setLimit(perMinute)
+		b.tokens = b.capacity
+	}
+	return b
+}
+
+func (b *TokenBucket) setLimit(perMinute int) {
+	b.capacity = float64(perMinute)
+	b.rate = float64(perMinute) / 60
+}
+
+// refill adds the tokens earned since the last update
+func (b *TokenBucket) refill(now time.Time) {
+	if b.rate > 0 {
+		b.tokens = math.Min(b.capacity, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	}
+	b.last = now
+}
+
+// reserve takes a token and returns how long to wait before using it. Tokens may go
+// negative, which queues later callers behind earlier ones.
+func (b *TokenBucket) reserve(now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(now)
+	var wait time.Duration
+	if now.Before(b.heldUntil) {
+		wait = b.heldUntil.Sub(now)
+	}
+	if b.rate <= 0 {
+		return wait
+	}
+	b.tokens--
+	if b.tokens < 0 {
+		if debt := time.Duration(-b.tokens / b.rate * float64(time.Second)); debt > wait {
+			wait = debt
+		}
+	}
+	return wait
+}
+
+// release returns a reserved token that will not be used
+func (b *TokenBucket) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rate > 0 {
+		b.tokens = math.Min(b.capacity, b.tokens+1)
+	}
+}
+
+// Wait blocks until the bucket lets a request through and reports how long that took. It
+// gives up at once, without sending, when ctx would expire before the wait is over.
+func (b *TokenBucket) Wait(ctx context.Context) (time.Duration, error) {
+	if b == nil {
+		return 0, nil
+	}
+	wait := b.reserve(time.Now())
+	if wait <= 0 {
+		return 0, nil
+	}
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+		b.release()
+		return 0, fmt.Errorf("rate limited for another %v", wait.Round(time.Millisecond))
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return wait, nil
+	case <-ctx.Done():
+		b.release()
+		return 0, ctx.Err()
+	}
+}
+
+// Observe updates the bucket from a provider response's rate-limit headers
+func (b *TokenBucket) Observe(info RateLimitInfo) {
+	if b == nil {
+		return
+	}
+	now := time.Now()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(now)
+	if limit := info.LimitRequests; limit > 0 {
+		if b.perMinute > 0 && b.perMinute < limit {
+			limit = b.perMinute
+		}
+		if float64(limit) != b.capacity {
+			if b.rate <= 0 {
+				b.tokens = float64(limit)
+			}
+			b.setLimit(limit)
+		}
+	}
+	if b.rate > 0 && info.RemainingRequests >= 0 && float64(info.RemainingRequests) < b.tokens {
+		b.tokens = float64(info.RemainingRequests)
+	}
+	if hold := info.Wait(); hold > 0 && now.Add(hold).After(b.heldUntil) {
+		b.heldUntil = now.Add(hold)
+	}
+}
+
+// RetryBudget keeps provider retries to a fraction of provider calls over a rolling window,
+// so a failing provider sees about (1 + ratio) times normal traffic rather than MaxAttempts
+// times. A few retries per window are always allowed so a quiet server still rides out the
+// occasional blip.
+type RetryBudget struct {
+	mu         sync.Mutex
+	ratio      float64 // 0 disables the budget
+	minRetries int
+	window     *slidingWindow // calls counts every attempt, failures the retries among them
+}
+
+// NewRetryBudget creates a budget allowing retries up to ratio of first attempts over window
+func NewRetryBudget(ratio float64, window time.Duration, minRetries int) *RetryBudget {
+	return &RetryBudget{ratio: ratio, minRetries: minRetries, window: newSlidingWindow(window)}
+}
+
+// SetRatio changes the fraction of first attempts that may be retried; 0 disables the budget
+func (b *RetryBudget) SetRatio(ratio float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.ratio = math.Max(0, ratio)
+}
+
+// recordCall counts a first attempt
+func (b *RetryBudget) recordCall() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.window.record(time.Now(), false, false)
+}
+
+// allowRetry reports whether the budget has room for another retry, counting it if so
+func (b *RetryBudget) allowRetry() bool {
+	if b == nil {
+		return true
+	}
+	now := time.Now()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.ratio > 0 {
+		calls, retries, _ := b.window.totals(now)
+		if retries >= b.minRetries && float64(retries+1) > b.ratio*float64(calls-retries) {
+			return false
+		}
+	}
+	b.window.record(now, true, false)
+	return true
+}
+
+// providerRetryBudget is shared by every provider client, so it bounds retries server-wide
+var providerRetryBudget = NewRetryBudget(defaultRetryBudget, retryBudgetWindow, retryBudgetMinRetries)
+
+// chatRequestsPerMinute is the configured pace for the primary provider's chat endpoint
+var chatRequestsPerMinute int
+
+// UseRateLimits applies the configured request pace and retry budget; the pace takes
+// effect for clients created afterwards
+func UseRateLimits(requestsPerMinute int, retryBudget float64) {
+	chatRequestsPerMinute = requestsPerMinute
+	providerRetryBudget.SetRatio(retryBudget)
+	resetOpenAIClient()
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseRateLimitHeaders(t *testing.T) {
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	h := http.Header{}
+	h.Set("x-ratelimit-limit-requests", "60")
+	h.Set("x-ratelimit-remaining-requests", "0")
+	h.Set("x-ratelimit-remaining-tokens", "1500")
+	h.Set("x-ratelimit-reset-requests", "6m0s")
+	h.Set("x-ratelimit-reset-tokens", "20ms")
+	info := ParseRateLimitHeaders(h, now)
+	if info.LimitRequests != 60 || info.RemainingRequests != 0 || info.RemainingTokens != 1500 || info.ResetRequests != 6*time.Minute || info.ResetTokens != 20*time.Millisecond {
+		t.Fatalf("parse: %+v", info)
+	}
+	if info.Wait() != 6*time.Minute {
+		t.Fatalf("exhausted requests should wait for their reset, got %v", info.Wait())
+	}
+
+	h.Set("Retry-After", now.Add(3*time.Second).Format(http.TimeFormat))
+	if got := ParseRateLimitHeaders(h, now).Wait(); got != 3*time.Second {
+		t.Fatalf("Retry-After date: %v", got)
+	}
+	h.Set("retry-after-ms", "250")
+	if got := ParseRateLimitHeaders(h, now).Wait(); got != 250*time.Millisecond {
+		t.Fatalf("retry-after-ms should win: %v", got)
+	}
+	if info := ParseRateLimitHeaders(http.Header{"Retry-After": {"soon"}}, now); info.Wait() != 0 || info.RemainingRequests != -1 {
+		t.Fatalf("absent headers: %+v", info)
+	}
+}
+
+func TestTokenBucketPacesByProviderHeaders(t *testing.T) {
+	// Without a known limit nothing is held
+	b := NewTokenBucket(0)
+	if d := b.reserve(time.Now()); d != 0 {
+		t.Fatalf("unknown limit should not wait, got %v", d)
+	}
+
+	// 600 a minute is one every 100ms; the provider says only one is left
+	b.Observe(RateLimitInfo{LimitRequests: 600, RemainingRequests: 1, RemainingTokens: -1})
+	now := time.Now()
+	if d := b.reserve(now); d != 0 {
+		t.Fatalf("first request should go at once, waited %v", d)
+	}
+	if d := b.reserve(now); d < 90*time.Millisecond || d > 110*time.Millisecond {
+		t.Fatalf("second request should wait for a refill, got %v", d)
+	}
+
+	// A Retry-After holds every request, and a caller whose deadline is sooner gives up
+	b.Observe(RateLimitInfo{RetryAfter: time.Hour, RemainingRequests: -1, RemainingTokens: -1})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	start := time.Now()
+	if _, err := b.Wait(ctx); err == nil || time.Since(start) > 100*time.Millisecond {
+		t.Fatalf("expected an immediate error, got %v after %v", err, time.Since(start))
+	}
+}
+
+func TestRetryBudgetCapsRetries(t *testing.T) {
+	budget := NewRetryBudget(0.5, time.Minute, 2)
+	for i := 0; i < 4; i++ {
+		budget.recordCall()
+	}
+	allowed := 0
+	for i := 0; i < 10; i++ {
+		if budget.allowRetry() {
+			allowed++
+		}
+	}
+	if allowed != 2 {
+		t.Fatalf("expected 2 retries for 4 calls at 50%%, got %d", allowed)
+	}
+	budget.SetRatio(0)
+	if !budget.allowRetry() {
+		t.Fatalf("a zero ratio should not limit retries")
+	}
+
+	// An exhausted budget stops RetryWithBackoff before its attempts run out
+	budget = NewRetryBudget(0.1, time.Minute, 1)
+	config := RetryConfig{MaxAttempts: 5, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond, BackoffFactor: 1, Budget: budget}
+	calls := 0
+	before := GetMetricsCollector().GetMetrics().RetryBudgetExhausted
+	_ = RetryWithBackoff(config, func() error { calls++; return errors.New("boom") })
+	if calls != 2 || GetMetricsCollector().GetMetrics().RetryBudgetExhausted != before+1 {
+		t.Fatalf("expected one budgeted retry, got %d calls", calls)
+	}
+}
+
+func TestEnhancementWaitsAsInstructed(t *testing.T) {
+	t.Setenv("OPENAI_API_KEY", "sk-test")
+	var hits atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hits.Add(1) == 1 {
+			w.Header().Set("retry-after-ms", "150")
+			writeMockError(w, http.StatusTooManyRequests, "rate_limit_exceeded", "slow down")
+			return
+		}
+		w.Header().Set("x-ratelimit-limit-requests", "6000")
+		writeMockJSON(w, map[string]interface{}{
+			"choices": []map[string]interface{}{{"message": map[string]string{"role": "assistant", "content": "enhanced"}}},
+		})
+	}))
+	defer server.Close()
+
+	// Exponential backoff alone would retry after a millisecond
+	client := replayClient(OpenAIProvider{}, 2, 5)
+	settings := defaultEnhancementSettings()
+	settings.BaseURL = server.URL + "/v1"
+	start := time.Now()
+	got, _, _ := client.EnhancePromptWithResilience(settings, "a harbor", "", "s", "ra-1")
+	if got != "enhanced" || hits.Load() != 2 {
+		t.Fatalf("enhancement: %q after %d requests", got, hits.Load())
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Fatalf("retried after %v, before the provider's retry-after-ms", elapsed)
+	}
+}
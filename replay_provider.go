@@ -0,0 +1,439 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// replayAPIKey is exported to the library in replay mode, where no real key is needed
+const replayAPIKey = "sk-replay-provider"
+
+// replayBaseURL stands in for the provider's own address inside recorded bodies, so image
+// URLs recorded on one port still resolve when replayed on another
+const replayBaseURL = "http://replay.invalid/v1"
+
+// redacted replaces the API key wherever it appears in a fixture
+const redacted = "[REDACTED]"
+
+// defaultReplayUpstream is the API root requests are forwarded to while recording
+const defaultReplayUpstream = "https://api.openai.com"
+
+// defaultFixturesDir holds the fixtures committed with the repo (see its README)
+const defaultFixturesDir = "testdata/openai"
+
+// ReplayFixture is one recorded exchange, stored as <hash>.json in the fixtures directory
+type ReplayFixture struct {
+	Hash           string            `json:"hash"`
+	Method         string            `json:"method"`
+	Path           string            `json:"path"`
+	RequestHeaders map[string]string `json:"request_headers,omitempty"`
+	Request        json.RawMessage   `json:"request,omitempty"`
+	Status         int               `json:"status"`
+	ContentType    string            `json:"content_type,omitempty"`
+	Body           string            `json:"body,omitempty"`
+	BodyBase64     string            `json:"body_base64,omitempty"` // binary bodies such as downloaded images
+	RecordedAt     time.Time         `json:"recorded_at"`
+	// Synthetic marks a fixture written by hand in the provider's wire format rather than
+	// recorded from it; RecordedAt is unset
+	Synthetic bool `json:"synthetic,omitempty"`
+}
+
+// body returns the recorded response body with the provider's address filled in
+func (f *ReplayFixture) body(baseURL string) ([]byte, error) {
+	if f.BodyBase64 != "" {
+		return base64.StdEncoding.DecodeString(f.BodyBase64)
+	}
+	return []byte(strings.ReplaceAll(f.Body, replayBaseURL, baseURL)), nil
+}
+
+// fixtureHash identifies a request by method, path and body. JSON bodies are re-encoded
+// first so key order and whitespace do not matter; headers, including the key, are ignored.
+func fixtureHash(method, path string, body []byte) string {
+	canonical := body
+	var v interface{}
+	if len(body) > 0 && json.Unmarshal(body, &v) == nil {
+		if out, err := json.Marshal(v); err == nil {
+			canonical = out
+		}
+	}
+	sum := sha256.Sum256([]byte(method + " " + path + "\n" + string(canonical)))
+	return hex.EncodeToString(sum[:16])
+}
+
+// FaultKind is a failure the replay provider can inject in place of a response
+type FaultKind string
+
+const (
+	FaultNone        FaultKind = "none"
+	FaultRateLimit   FaultKind = "429"
+	FaultServerError FaultKind = "5xx"
+	FaultTruncate    FaultKind = "truncate"
+)
+
+// Faults configures random fault injection. Rates are the share of requests, from 0 to 1,
+// that get each fault; Latency is added before every response.
+type Faults struct {
+	Latency     time.Duration
+	RateLimit   float64
+	ServerError float64
+	Truncate    float64
+	Seed        int64
+}
+
+// ParseFaults reads "latency=200ms,429=0.1,5xx=0.05,truncate=0.02,seed=7"
+func ParseFaults(spec string) (Faults, error) {
+	var f Faults
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(part, "=")
+		if !ok {
+			return Faults{}, fmt.Errorf("fault %q is not key=value", part)
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		switch key {
+		case "latency":
+			d, err := time.ParseDuration(value)
+			if err != nil || d < 0 {
+				return Faults{}, fmt.Errorf("invalid latency %q", value)
+			}
+			f.Latency = d
+		case "seed":
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return Faults{}, fmt.Errorf("invalid seed %q", value)
+			}
+			f.Seed = n
+		case string(FaultRateLimit), string(FaultServerError), string(FaultTruncate):
+			rate, err := strconv.ParseFloat(value, 64)
+			if err != nil || rate < 0 || rate > 1 {
+				return Faults{}, fmt.Errorf("invalid %s rate %q (expected 0..1)", key, value)
+			}
+			switch FaultKind(key) {
+			case FaultRateLimit:
+				f.RateLimit = rate
+			case FaultServerError:
+				f.ServerError = rate
+			default:
+				f.Truncate = rate
+			}
+		default:
+			return Faults{}, fmt.Errorf("unknown fault %q", key)
+		}
+	}
+	return f, nil
+}
+
+// ReplayProvider records OpenAI traffic to fixture files or serves it back. In record mode
+// it forwards each request upstream and saves the exchange with the API key redacted; image
+// URLs in responses are downloaded and rewritten to its own /v1/files/ endpoint so replays
+// need no network. In replay mode it answers from the fixtures, matched by fixtureHash, and
+// 404s requests it has no fixture for. Faults can be injected in either mode.
+type ReplayProvider struct {
+	mode     string
+	dir      string
+	upstream string
+	server   *http.Server
+	listener net.Listener
+	baseURL  string
+	client   *http.Client
+
+	mu       sync.Mutex
+	faults   Faults
+	rng      *rand.Rand
+	queued   []FaultKind
+	requests int
+}
+
+// StartReplayProvider serves mode ("record" or "replay") for fixtures in dir on addr. The
+// upstream API root is only used when recording; empty means api.openai.com.
+func StartReplayProvider(addr, mode, dir, upstream string, faults Faults) (*ReplayProvider, error) {
+	if mode != ProviderRecord && mode != ProviderReplay {
+		return nil, fmt.Errorf("unknown replay mode %q", mode)
+	}
+	if upstream == "" {
+		upstream = defaultReplayUpstream
+	}
+	if mode == ProviderRecord {
+		if err := os.MkdirAll(dir, 0o750); err != nil {
+			return nil, err
+		}
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	p := &ReplayProvider{
+		mode:     mode,
+		dir:      dir,
+		upstream: strings.TrimRight(upstream, "/"),
+		listener: listener,
+		baseURL:  "http://" + listener.Addr().String() + "/v1",
+		client:   &http.Client{Timeout: enhanceDeadline + 10*time.Second},
+	}
+	p.SetFaults(faults)
+	p.server = &http.Server{Handler: p, ReadHeaderTimeout: 5 * time.Second}
+	go func() { _ = p.server.Serve(listener) }()
+	return p, nil
+}
+
+// Close stops the server
+func (p *ReplayProvider) Close() error { return p.server.Close() }
+
+// BaseURL is the API root, e.g. http://127.0.0.1:40123/v1
+func (p *ReplayProvider) BaseURL() string { return p.baseURL }
+
+func (p *ReplayProvider) Name() string     { return p.mode }
+func (p *ReplayProvider) ChatURL() string  { return p.baseURL + "/chat/completions" }
+func (p *ReplayProvider) ImageURL() string { return p.baseURL + "/images/generations" }
+
+// APIKey is the real key while recording and a placeholder while replaying
+func (p *ReplayProvider) APIKey() string {
+	if p.mode == ProviderRecord {
+		return os.Getenv("OPENAI_API_KEY")
+	}
+	return replayAPIKey
+}
+
+// SetFaults replaces the random fault configuration
+func (p *ReplayProvider) SetFaults(f Faults) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.faults = f
+	p.rng = rand.New(rand.NewSource(f.Seed)) //nolint:gosec // reproducible fault patterns, not security
+}
+
+// InjectFaults queues faults for the next requests, in order, ahead of the random ones;
+// FaultNone lets a request through
+func (p *ReplayProvider) InjectFaults(kinds ...FaultKind) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.queued = append(p.queued, kinds...)
+}
+
+// Requests returns how many requests the provider has received
+func (p *ReplayProvider) Requests() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.requests
+}
+
+// nextFault picks the fault for one request
+func (p *ReplayProvider) nextFault() (FaultKind, time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.requests++
+	if len(p.queued) > 0 {
+		kind := p.queued[0]
+		p.queued = p.queued[1:]
+		return kind, p.faults.Latency
+	}
+	roll := p.rng.Float64()
+	switch {
+	case roll < p.faults.RateLimit:
+		return FaultRateLimit, p.faults.Latency
+	case roll < p.faults.RateLimit+p.faults.ServerError:
+		return FaultServerError, p.faults.Latency
+	case roll < p.faults.RateLimit+p.faults.ServerError+p.faults.Truncate:
+		return FaultTruncate, p.faults.Latency
+	}
+	return FaultNone, p.faults.Latency
+}
+
+func (p *ReplayProvider) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fault, latency := p.nextFault()
+	if latency > 0 {
+		select {
+		case <-time.After(latency):
+		case <-r.Context().Done():
+			return
+		}
+	}
+	switch fault {
+	case FaultRateLimit:
+		w.Header().Set("Retry-After", "1")
+		w.Header().Set("retry-after-ms", "50")
+		writeMockError(w, http.StatusTooManyRequests, "rate_limit_exceeded", "injected rate limit")
+		return
+	case FaultServerError:
+		writeMockError(w, http.StatusInternalServerError, "server_error", "injected server error")
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeMockError(w, http.StatusBadRequest, "invalid_request_error", "unreadable body")
+		return
+	}
+	var fixture *ReplayFixture
+	if p.mode == ProviderRecord && !strings.HasPrefix(r.URL.Path, "/v1/files/") {
+		fixture, err = p.record(r, body)
+		if err != nil {
+			writeMockError(w, http.StatusBadGateway, "upstream_error", err.Error())
+			return
+		}
+	} else {
+		fixture, err = p.load(fixtureHash(r.Method, r.URL.Path, body))
+		if err != nil {
+			writeMockError(w, http.StatusNotFound, "fixture_not_found",
+				fmt.Sprintf("no fixture for %s %s (hash %s)", r.Method, r.URL.Path, fixtureHash(r.Method, r.URL.Path, body)))
+			return
+		}
+	}
+
+	out, err := fixture.body(p.baseURL)
+	if err != nil {
+		writeMockError(w, http.StatusInternalServerError, "server_error", err.Error())
+		return
+	}
+	if fixture.ContentType != "" {
+		w.Header().Set("Content-Type", fixture.ContentType)
+	}
+	// A truncated body still announces its full length, so clients see an unexpected EOF
+	w.Header().Set("Content-Length", strconv.Itoa(len(out)))
+	w.WriteHeader(fixture.Status)
+	if fault == FaultTruncate {
+		out = out[:len(out)/2]
+	}
+	_, _ = w.Write(out)
+}
+
+// record forwards a request upstream and saves the exchange
+func (p *ReplayProvider) record(r *http.Request, body []byte) (*ReplayFixture, error) {
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, p.upstream+r.URL.Path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for _, h := range []string{"Content-Type", "Authorization", "X-Request-ID"} {
+		if v := r.Header.Get(h); v != "" {
+			req.Header.Set(h, v)
+		}
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if r.URL.Path == "/v1/images/generations" && resp.StatusCode == http.StatusOK {
+		if respBody, err = p.localizeImages(r, respBody); err != nil {
+			return nil, err
+		}
+	}
+
+	key := os.Getenv("OPENAI_API_KEY")
+	redact := func(s string) string {
+		if key == "" {
+			return s
+		}
+		return strings.ReplaceAll(s, key, redacted)
+	}
+	fixture := &ReplayFixture{
+		Hash:        fixtureHash(r.Method, r.URL.Path, body),
+		Method:      r.Method,
+		Path:        r.URL.Path,
+		Status:      resp.StatusCode,
+		ContentType: resp.Header.Get("Content-Type"),
+		Body:        redact(string(respBody)),
+		RecordedAt:  time.Now().UTC(),
+	}
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		fixture.RequestHeaders = map[string]string{"Authorization": "Bearer " + redacted}
+	}
+	if json.Valid(body) {
+		fixture.Request = json.RawMessage(redact(string(body)))
+	}
+	if err := p.save(fixture); err != nil {
+		return nil, err
+	}
+	return fixture, nil
+}
+
+// localizeImages downloads every image URL in an image-generation response, saves each as
+// a fixture for GET /v1/files/<hash>.png and points the response at it
+func (p *ReplayProvider) localizeImages(r *http.Request, body []byte) ([]byte, error) {
+	var resp map[string]interface{}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return body, nil
+	}
+	items, _ := resp["data"].([]interface{})
+	for _, raw := range items {
+		item, _ := raw.(map[string]interface{})
+		url, _ := item["url"].(string)
+		if url == "" {
+			continue
+		}
+		req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, url, nil)
+		if err != nil {
+			return nil, err
+		}
+		dl, err := p.client.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("download recorded image: %w", err)
+		}
+		data, err := io.ReadAll(dl.Body)
+		_ = dl.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("download recorded image: %w", err)
+		}
+		path := "/v1/files/" + shortHash(url) + ".png"
+		if err := p.save(&ReplayFixture{
+			Hash:        fixtureHash(http.MethodGet, path, nil),
+			Method:      http.MethodGet,
+			Path:        path,
+			Status:      dl.StatusCode,
+			ContentType: dl.Header.Get("Content-Type"),
+			BodyBase64:  base64.StdEncoding.EncodeToString(data),
+			RecordedAt:  time.Now().UTC(),
+		}); err != nil {
+			return nil, err
+		}
+		item["url"] = replayBaseURL + strings.TrimPrefix(path, "/v1")
+	}
+	return json.Marshal(resp)
+}
+
+func (p *ReplayProvider) save(f *ReplayFixture) error {
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(p.dir, f.Hash+".json"), data, 0o600)
+}
+
+func (p *ReplayProvider) load(hash string) (*ReplayFixture, error) {
+	data, err := os.ReadFile(filepath.Join(p.dir, hash+".json"))
+	if err != nil {
+		return nil, err
+	}
+	var f ReplayFixture
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, err
+	}
+	if f.Status == 0 {
+		return nil, errors.New("fixture has no status")
+	}
+	return &f, nil
+}
+
+var _ Provider = (*ReplayProvider)(nil)
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseFaults(t *testing.T) {
+	f, err := ParseFaults("latency=20ms, 429=0.1,5xx=0.05,truncate=0.02,seed=7")
+	if err != nil || f.Latency != 20*time.Millisecond || f.RateLimit != 0.1 || f.ServerError != 0.05 || f.Truncate != 0.02 || f.Seed != 7 {
+		t.Fatalf("parse: %+v %v", f, err)
+	}
+	for _, bad := range []string{"429=2", "latency=soon", "jitter=1", "5xx"} {
+		if _, err := ParseFaults(bad); err == nil {
+			t.Fatalf("expected error for %q", bad)
+		}
+	}
+}
+
+// replayClient builds an enhancement client for p with fast retries and its own breaker
+func replayClient(p Provider, attempts, threshold int) *OpenAIClient {
+	client := NewOpenAIClient(p)
+	client.circuitBreaker = NewCircuitBreaker(threshold, time.Hour).WithFaultFilter(IsProviderFault)
+	client.retryConfig = RetryConfig{MaxAttempts: attempts, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond, BackoffFactor: 1}
+	return client
+}
+
+func TestRecordThenReplayEnhancement(t *testing.T) {
+	const secret = "sk-test-secret"
+	t.Setenv("OPENAI_API_KEY", secret)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req mockChatRequest
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		reply := "upstream: " + req.Messages[len(req.Messages)-1].Content + " (key " + strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ") + ")"
+		writeMockJSON(w, map[string]interface{}{
+			"model":   req.Model,
+			"choices": []map[string]interface{}{{"message": map[string]string{"role": "assistant", "content": reply}}},
+		})
+	}))
+	dir := t.TempDir()
+
+	recorder, err := StartReplayProvider("127.0.0.1:0", ProviderRecord, dir, upstream.URL, Faults{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorded, _, _ := replayClient(recorder, 1, 5).EnhancePromptWithResilience(defaultEnhancementSettings(), "a quiet harbor", "", "s", "rec-1")
+	_ = recorder.Close()
+	upstream.Close()
+	if !strings.HasPrefix(recorded, "upstream: a quiet harbor") {
+		t.Fatalf("recorded enhancement: %q", recorded)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	if len(files) != 1 {
+		t.Fatalf("expected one fixture, got %v", files)
+	}
+	data, _ := os.ReadFile(files[0])
+	if bytes.Contains(data, []byte(secret)) || !bytes.Contains(data, []byte(redacted)) {
+		t.Fatalf("fixture not redacted: %s", data)
+	}
+
+	// Replay offline, surviving a 429, a 500 and a truncated body on the way
+	replay, err := StartReplayProvider("127.0.0.1:0", ProviderReplay, dir, "", Faults{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = replay.Close() })
+	client := replayClient(replay, 4, 2)
+	replay.InjectFaults(FaultRateLimit, FaultServerError, FaultTruncate)
+	replayed, _, _ := client.EnhancePromptWithResilience(defaultEnhancementSettings(), "a quiet harbor", "", "s", "rep-1")
+	if replayed != recorded || replay.Requests() != 4 {
+		t.Fatalf("replay: %q after %d requests", replayed, replay.Requests())
+	}
+
+	// Unrecorded requests 404, which degrades without counting against the breaker
+	if got, _, _ := client.EnhancePromptWithResilience(defaultEnhancementSettings(), "an unrecorded prompt", "", "s", "rep-2"); got != "an unrecorded prompt" {
+		t.Fatalf("unrecorded prompt: %q", got)
+	}
+	if m := client.GetCircuitBreakerMetrics(); m.State != CircuitClosed {
+		t.Fatalf("breaker after 404: %s", m.State)
+	}
+
+	// Sustained 5xx opens the breaker, after which the provider is no longer called
+	replay.SetFaults(Faults{ServerError: 1})
+	for i := 0; i < 2; i++ {
+		if got, _, _ := client.EnhancePromptWithResilience(defaultEnhancementSettings(), "a quiet harbor", "", "s", "rep-3"); got != "a quiet harbor" {
+			t.Fatalf("expected degraded prompt, got %q", got)
+		}
+	}
+	before := replay.Requests()
+	client.EnhancePromptWithResilience(defaultEnhancementSettings(), "a quiet harbor", "", "s", "rep-4")
+	if m := client.GetCircuitBreakerMetrics(); m.State != CircuitOpen || replay.Requests() != before {
+		t.Fatalf("breaker %s, requests %d -> %d", m.State, before, replay.Requests())
+	}
+}
+
+// TestReplayCommittedFixtures replays the synthetic fixtures committed under
+// testdata/openai, so a change to the enhancement request that orphans them fails here
+// rather than in replay mode
+func TestReplayCommittedFixtures(t *testing.T) {
+	files, _ := filepath.Glob(filepath.Join(defaultFixturesDir, "*.json"))
+	streamed := 0
+	for _, file := range files {
+		data, _ := os.ReadFile(file)
+		var fixture ReplayFixture
+		if err := json.Unmarshal(data, &fixture); err != nil || fixture.Hash+".json" != filepath.Base(file) {
+			t.Fatalf("%s: unreadable or misnamed fixture: %v", file, err)
+		}
+		if !fixture.Synthetic && fixture.RecordedAt.IsZero() {
+			t.Fatalf("%s: neither recorded nor marked synthetic", file)
+		}
+		if strings.HasPrefix(fixture.ContentType, "text/event-stream") {
+			streamed++
+		}
+	}
+	if len(files) != 2 || streamed != 1 {
+		t.Fatalf("expected two fixtures, one streamed: %v (%d streamed)", files, streamed)
+	}
+
+	replay, err := StartReplayProvider("127.0.0.1:0", ProviderReplay, defaultFixturesDir, "", Faults{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = replay.Close() })
+	client := replayClient(replay, 2, 5)
+
+	// The harbor answer is an event stream, read only by readEnhancementStream; the
+	// aardvark answer is a plain completion
+	cases := []struct{ prompt, authorType, want string }{
+		{"a quiet harbor at dawn", "", "A quiet harbor at dawn, fishing boats resting on glassy water while pale gold light spills over weathered piers and gulls circle the masts."},
+		{"a smiling aardvark", "a poet", "A smiling aardvark in a sunlit meadow, its long snout raised toward drifting dandelion seeds, rendered like a gentle verse in soft watercolor."},
+	}
+	for _, c := range cases {
+		got, usage, err := client.EnhancePromptWithResilience(defaultEnhancementSettings(), c.prompt, c.authorType, "empty", "fixture")
+		if err != nil || got != c.want || usage.Model != "gpt-4-0613" || usage.CompletionTokens != 31 {
+			t.Fatalf("%q: got %q %+v, %v", c.prompt, got, usage, err)
+		}
+	}
+
+	// A rate limit on the way still lands on the fixture's answer
+	replay.InjectFaults(FaultRateLimit)
+	got, _, _ := client.EnhancePromptWithResilience(defaultEnhancementSettings(), "a quiet harbor at dawn", "", "empty", "fixture")
+	if got != cases[0].want || replay.Requests() != 4 {
+		t.Fatalf("after 429: %q after %d requests", got, replay.Requests())
+	}
+}
+
+func TestRecordAndReplayImageDownloads(t *testing.T) {
+	t.Setenv("OPENAI_API_KEY", "sk-test-secret")
+	png, _ := mockImagePNG("harbor", 16, 16)
+	var upstream *httptest.Server
+	upstream = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/cdn/harbor.png" {
+			w.Header().Set("Content-Type", "image/png")
+			_, _ = w.Write(png)
+			return
+		}
+		writeMockJSON(w, map[string]interface{}{"data": []map[string]string{{"url": upstream.URL + "/cdn/harbor.png"}}})
+	}))
+	dir := t.TempDir()
+
+	generate := func(p *ReplayProvider) []byte {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodPost, p.ImageURL(), strings.NewReader(`{"prompt":"harbor","size":"1024x1024"}`))
+		req.Header.Set("Authorization", "Bearer "+p.APIKey())
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body struct {
+			Data []struct {
+				URL string `json:"url"`
+			} `json:"data"`
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&body)
+		_ = resp.Body.Close()
+		if len(body.Data) != 1 || !strings.HasPrefix(body.Data[0].URL, p.BaseURL()+"/files/") {
+			t.Fatalf("image URL not localized: %+v", body)
+		}
+		dl, err := http.Get(body.Data[0].URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = dl.Body.Close() }()
+		data, _ := io.ReadAll(dl.Body)
+		return data
+	}
+
+	recorder, err := StartReplayProvider("127.0.0.1:0", ProviderRecord, dir, upstream.URL, Faults{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := generate(recorder); !bytes.Equal(got, png) {
+		t.Fatalf("recorded download differs")
+	}
+	_ = recorder.Close()
+	upstream.Close()
+
+	replay, err := StartReplayProvider("127.0.0.1:0", ProviderReplay, dir, "", Faults{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = replay.Close() }()
+	if got := generate(replay); !bytes.Equal(got, png) {
+		t.Fatalf("replayed download differs")
+	}
+}
@@ -0,0 +1,700 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	dalle "github.com/TrueBlocks/trueblocks-dalle/v6"
+	"github.com/TrueBlocks/trueblocks-dalle/v6/pkg/storage"
+)
+
+const (
+	defaultRetentionInterval = time.Hour
+	// retentionUsageTTL is how long a measurement of the store's size is trusted by the
+	// quota check before the store is listed again
+	retentionUsageTTL = time.Minute
+	// retentionBlobGrace spares unreferenced blobs this young, which may belong to a
+	// manifest still being recorded
+	retentionBlobGrace = 10 * time.Minute
+)
+
+// Reasons a retention candidate is removed
+const (
+	RetentionMaxAge       = "max_age"
+	RetentionKeepVersions = "keep_versions"
+	RetentionMaxBytes     = "max_bytes"
+	RetentionUnreferenced = "unreferenced"
+)
+
+// generationDirs are the per-address artifact directories under each series
+var generationDirs = map[string]bool{
+	"annotated": true, "selector": true, "generated": true, "audio": true,
+	"data": true, "title": true, "terse": true, "prompt": true, "enhanced": true,
+}
+
+// serverStateDirs hold the server's own state under the output directory. The janitor can
+// never remove them, so they count neither toward usage nor the quota.
+var serverStateDirs = map[string]bool{
+	"derivatives": true, "jobs": true, "idempotency": true, "usage": true,
+	"webhooks": true, "batches": true, "retention": true,
+}
+
+// retainedKey reports whether key is an artifact the retention rules govern: a
+// generation's file, a manifest or a blob
+func retainedKey(key string) bool {
+	parts := strings.Split(key, "/")
+	switch {
+	case parts[0] == blobsPrefix || parts[0] == manifestsPrefix:
+		return true
+	case serverStateDirs[parts[0]]:
+		return false
+	default:
+		return len(parts) == 3 && generationDirs[parts[1]] && path.Ext(key) != ""
+	}
+}
+
+// RetentionConfig limits what the artifact store keeps. Zero values switch a rule off.
+type RetentionConfig struct {
+	// MaxBytes is the size the janitor brings the store back under, removing the least
+	// recently served generations and manifest versions first
+	MaxBytes int64
+	// QuotaBytes is the hard limit: at or above it new generations are refused
+	QuotaBytes int64
+	// MaxAge removes generations and manifest versions older than this, by series; "*"
+	// applies to series not listed
+	MaxAge map[string]time.Duration
+	// KeepVersions keeps this many manifests per address, newest first
+	KeepVersions int
+	// Interval is how often the janitor runs
+	Interval time.Duration
+	// ArchiveDir, when set, receives removed artifacts instead of deleting them
+	ArchiveDir string
+}
+
+// ParseRetentionAges parses a --retention-max-age value: a duration for every series
+// ("720h") or "series=duration" pairs with "*" as the default ("*=720h,scratch=24h")
+func ParseRetentionAges(spec string) (map[string]time.Duration, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return nil, nil
+	}
+	if !strings.Contains(spec, "=") {
+		spec = "*=" + spec
+	}
+	pairs, err := ParseClassMap(spec)
+	if err != nil {
+		return nil, err
+	}
+	ages := make(map[string]time.Duration, len(pairs))
+	for series, value := range pairs {
+		d := parsePositiveDuration(value)
+		if d == 0 {
+			return nil, fmt.Errorf("invalid age %q for %s", value, series)
+		}
+		ages[series] = d
+	}
+	return ages, nil
+}
+
+// maxAge returns the age limit for series, or 0 when it has none
+func (c RetentionConfig) maxAge(series string) time.Duration {
+	if d, ok := c.MaxAge[series]; ok {
+		return d
+	}
+	return c.MaxAge["*"]
+}
+
+// reclaims reports whether any rule removes artifacts
+func (c RetentionConfig) reclaims() bool {
+	return c.MaxBytes > 0 || len(c.MaxAge) > 0 || c.KeepVersions > 0
+}
+
+// ServedIndex remembers when each artifact was last served, so the janitor can remove the
+// least recently served first
+type ServedIndex struct {
+	mu sync.Mutex
+	at map[string]time.Time
+}
+
+// NewServedIndex creates an empty index
+func NewServedIndex() *ServedIndex {
+	return &ServedIndex{at: map[string]time.Time{}}
+}
+
+var servedIndex = NewServedIndex()
+
+// Touch records that key was served now
+func (si *ServedIndex) Touch(key string) {
+	si.mu.Lock()
+	defer si.mu.Unlock()
+	si.at[key] = time.Now()
+}
+
+// Last returns when key was last served
+func (si *ServedIndex) Last(key string) (time.Time, bool) {
+	si.mu.Lock()
+	defer si.mu.Unlock()
+	t, ok := si.at[key]
+	return t, ok
+}
+
+func (si *ServedIndex) forget(keys ...string) {
+	si.mu.Lock()
+	defer si.mu.Unlock()
+	for _, key := range keys {
+		delete(si.at, key)
+	}
+}
+
+// load merges the times saved in file, keeping any newer ones already recorded
+func (si *ServedIndex) load(file string) {
+	data, err := os.ReadFile(file) // #nosec G304 - under the output directory
+	if err != nil {
+		return
+	}
+	var saved map[string]time.Time
+	if json.Unmarshal(data, &saved) != nil {
+		return
+	}
+	si.mu.Lock()
+	defer si.mu.Unlock()
+	for key, t := range saved {
+		if t.After(si.at[key]) {
+			si.at[key] = t
+		}
+	}
+}
+
+func (si *ServedIndex) save(fileOps *RobustFileOperations, file string) error {
+	si.mu.Lock()
+	data, err := json.Marshal(si.at)
+	si.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return fileOps.WriteFile(file, data, "")
+}
+
+// RetentionCandidate is a generation (an address's current artifacts), a manifest version
+// or an unreferenced blob the janitor removes, with the blobs only it used
+type RetentionCandidate struct {
+	Kind       string    `json:"kind"` // "generation", "version" or "blob"
+	Series     string    `json:"series,omitempty"`
+	Address    string    `json:"address,omitempty"`
+	ManifestID string    `json:"manifest_id,omitempty"`
+	Reason     string    `json:"reason"`
+	Keys       []string  `json:"keys"`
+	Bytes      int64     `json:"bytes"`
+	LastServed time.Time `json:"last_served"`
+}
+
+// RetentionReport describes one janitor pass, or what a pass would do when DryRun is set
+type RetentionReport struct {
+	DryRun     bool      `json:"dry_run"`
+	StartedAt  time.Time `json:"started_at"`
+	UsageBytes int64     `json:"usage_bytes"`
+	// CopyBytes is the part of UsageBytes held by series files that are copies of their
+	// address's newest blobs (see recordManifest)
+	CopyBytes    int64                `json:"copy_bytes"`
+	MaxBytes     int64                `json:"max_bytes,omitempty"`
+	QuotaBytes   int64                `json:"quota_bytes,omitempty"`
+	Candidates   []RetentionCandidate `json:"candidates"`
+	ReclaimBytes int64                `json:"reclaim_bytes"`
+	AfterBytes   int64                `json:"after_bytes"`
+	Archived     bool                 `json:"archived,omitempty"`
+	Removed      int                  `json:"removed"`
+	Errors       []string             `json:"errors,omitempty"`
+}
+
+// QuotaError refuses a generation because the store reached its hard quota
+type QuotaError struct {
+	UsedBytes  int64
+	QuotaBytes int64
+	RetryAfter time.Duration
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("storage quota of %d MiB reached (%d MiB used)", e.QuotaBytes>>20, e.UsedBytes>>20)
+}
+
+// writeQuotaExceeded answers 507, with a Retry-After pointing at the next janitor pass
+// when one may free space
+func writeQuotaExceeded(w http.ResponseWriter, err *QuotaError, endpoint, requestID string) {
+	if err.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(max(1, int(math.Ceil(err.RetryAfter.Seconds())))))
+	}
+	GetMetricsCollector().RecordQuotaRejection(endpoint, requestID)
+	logWarn(fmt.Sprintf("[%s] refusing generation on %s: %v", requestID, endpoint, err))
+	WriteErrorResponse(w, NewAPIError(
+		ErrorQuotaExceeded,
+		"Storage quota reached",
+		err.Error(),
+	).WithRequestID(requestID), http.StatusInsufficientStorage)
+}
+
+// Janitor applies the retention rules to the artifact store: periodically, on demand, or
+// as a dry run that only reports
+type Janitor struct {
+	cfg        RetentionConfig
+	servedFile string
+	fileOps    *RobustFileOperations
+	now        func() time.Time
+
+	runMu sync.Mutex // one pass at a time
+
+	mu       sync.Mutex
+	usage    int64
+	measured time.Time
+	nextRun  time.Time
+	stop     chan struct{}
+}
+
+// NewJanitor creates a janitor keeping its served times under dir
+func NewJanitor(cfg RetentionConfig, dir string) *Janitor {
+	if cfg.Interval <= 0 {
+		cfg.Interval = defaultRetentionInterval
+	}
+	j := &Janitor{
+		cfg:        cfg,
+		servedFile: filepath.Join(dir, "served.json"),
+		fileOps:    NewRobustFileOperations(),
+		now:        time.Now,
+	}
+	servedIndex.load(j.servedFile)
+	return j
+}
+
+// Start runs a pass every interval until Stop, when any rule removes artifacts
+func (j *Janitor) Start() {
+	if !j.cfg.reclaims() {
+		return
+	}
+	j.mu.Lock()
+	j.stop = make(chan struct{})
+	j.nextRun = j.now().Add(j.cfg.Interval)
+	stop := j.stop
+	j.mu.Unlock()
+	go func() {
+		ticker := time.NewTicker(j.cfg.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				j.mu.Lock()
+				j.nextRun = j.now().Add(j.cfg.Interval)
+				j.mu.Unlock()
+				report, err := j.Run(context.Background(), false)
+				if err != nil {
+					logError("retention: " + err.Error())
+				} else if report.Removed > 0 {
+					logInfo(fmt.Sprintf("retention: removed %d artifacts, reclaimed %d bytes", report.Removed, report.ReclaimBytes))
+				}
+			}
+		}
+	}()
+}
+
+// Stop ends the periodic passes
+func (j *Janitor) Stop() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.stop != nil {
+		close(j.stop)
+		j.stop = nil
+	}
+}
+
+// Usage returns the bytes held by the store's generations, manifests and blobs, listing it
+// when the last measurement is older than retentionUsageTTL
+func (j *Janitor) Usage(ctx context.Context) (int64, error) {
+	j.mu.Lock()
+	usage, fresh := j.usage, !j.measured.IsZero() && j.now().Sub(j.measured) < retentionUsageTTL
+	j.mu.Unlock()
+	if fresh {
+		return usage, nil
+	}
+	infos, err := CurrentStore().List(ctx, "")
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, info := range infos {
+		if retainedKey(info.Key) {
+			total += info.Size
+		}
+	}
+	j.setUsage(total)
+	return total, nil
+}
+
+func (j *Janitor) setUsage(total int64) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.usage = total
+	j.measured = j.now()
+}
+
+// CheckQuota returns a *QuotaError when the store is at or above the hard quota
+func (j *Janitor) CheckQuota(ctx context.Context) error {
+	if j == nil || j.cfg.QuotaBytes <= 0 {
+		return nil
+	}
+	used, err := j.Usage(ctx)
+	if err != nil {
+		// Refusing every generation because the store could not be listed helps no one
+		logWarn("retention: unable to measure the store for the quota: " + err.Error())
+		return nil
+	}
+	if used < j.cfg.QuotaBytes {
+		return nil
+	}
+	quotaErr := &QuotaError{UsedBytes: used, QuotaBytes: j.cfg.QuotaBytes}
+	j.mu.Lock()
+	if !j.nextRun.IsZero() {
+		quotaErr.RetryAfter = j.nextRun.Sub(j.now())
+	}
+	j.mu.Unlock()
+	return quotaErr
+}
+
+// retentionUnit is a generation or manifest version that may be removed as a whole
+type retentionUnit struct {
+	RetentionCandidate
+	modTime time.Time        // when it was produced, for the age rule
+	blobs   []string         // blob keys a version refers to
+	sizes   map[string]int64 // artifact size by kind, for a version
+	removed bool
+}
+
+// Run makes one pass over the store. A dry run returns what would be removed and leaves
+// the store alone.
+func (j *Janitor) Run(ctx context.Context, dryRun bool) (RetentionReport, error) {
+	j.runMu.Lock()
+	defer j.runMu.Unlock()
+	store := CurrentStore()
+	now := j.now()
+	report := RetentionReport{DryRun: dryRun, StartedAt: now, MaxBytes: j.cfg.MaxBytes, QuotaBytes: j.cfg.QuotaBytes, Candidates: []RetentionCandidate{}}
+
+	infos, err := store.List(ctx, "")
+	if err != nil {
+		return report, err
+	}
+	generations := map[string]*retentionUnit{}
+	versions := map[string][]*retentionUnit{}
+	blobSizes := map[string]ArtifactInfo{}
+	generationFiles := map[string]ArtifactInfo{}
+	for _, info := range infos {
+		if !retainedKey(info.Key) {
+			continue
+		}
+		report.UsageBytes += info.Size
+		parts := strings.Split(info.Key, "/")
+		switch {
+		case parts[0] == blobsPrefix:
+			blobSizes[info.Key] = info
+		case parts[0] == manifestsPrefix && len(parts) == 4 && path.Ext(info.Key) == ".json":
+			unit, err := j.versionUnit(ctx, store, info)
+			if err != nil {
+				report.Errors = append(report.Errors, err.Error())
+				continue
+			}
+			id := unit.Series + ":" + unit.Address
+			versions[id] = append(versions[id], unit)
+		case parts[0] != manifestsPrefix:
+			address := strings.TrimSuffix(parts[2], path.Ext(parts[2]))
+			id := parts[0] + ":" + address
+			unit := generations[id]
+			if unit == nil {
+				unit = &retentionUnit{RetentionCandidate: RetentionCandidate{Kind: "generation", Series: parts[0], Address: address}}
+				generations[id] = unit
+			}
+			generationFiles[info.Key] = info
+			unit.Keys = append(unit.Keys, info.Key)
+			unit.Bytes += info.Size
+			if info.ModTime.After(unit.modTime) {
+				unit.modTime = info.ModTime
+			}
+		}
+	}
+	j.setUsage(report.UsageBytes)
+
+	// Blob references across every manifest; a blob is freed when its last one goes
+	refs := map[string]int{}
+	var units []*retentionUnit
+	for id, unit := range generations {
+		inflightGenerations.Lock()
+		_, busy := inflightGenerations.items[id]
+		inflightGenerations.Unlock()
+		if busy {
+			continue
+		}
+		unit.LastServed = lastServed(unit.Keys, unit.modTime)
+		units = append(units, unit)
+	}
+	for _, list := range versions {
+		sort.Slice(list, func(a, b int) bool { return list[a].ManifestID > list[b].ManifestID })
+		// The series files of the newest version are the copies its blobs were made from
+		for _, key := range artifactPaths(list[0].Series, list[0].Address) {
+			info, ok := generationFiles[key]
+			if size, recorded := list[0].sizes[path.Base(path.Dir(key))]; ok && recorded && info.Size == size {
+				report.CopyBytes += size
+			}
+		}
+		for _, unit := range list {
+			for _, blob := range unit.blobs {
+				refs[blob]++
+			}
+			unit.LastServed = lastServed(unit.blobs, unit.modTime)
+			units = append(units, unit)
+		}
+	}
+	// Oldest first, so equal rules pick the same victims on every pass
+	sort.Slice(units, func(a, b int) bool {
+		if !units[a].LastServed.Equal(units[b].LastServed) {
+			return units[a].LastServed.Before(units[b].LastServed)
+		}
+		return units[a].Keys[0] < units[b].Keys[0]
+	})
+
+	remaining := report.UsageBytes
+	remove := func(unit *retentionUnit, reason string) {
+		unit.removed = true
+		unit.Reason = reason
+		for _, blob := range unit.blobs {
+			if refs[blob]--; refs[blob] == 0 {
+				if info, ok := blobSizes[blob]; ok {
+					unit.Keys = append(unit.Keys, blob)
+					unit.Bytes += info.Size
+				}
+			}
+		}
+		remaining -= unit.Bytes
+		report.Candidates = append(report.Candidates, unit.RetentionCandidate)
+	}
+	if j.cfg.KeepVersions > 0 {
+		for _, list := range versions {
+			for _, unit := range list[min(j.cfg.KeepVersions, len(list)):] {
+				remove(unit, RetentionKeepVersions)
+			}
+		}
+	}
+	for _, unit := range units {
+		if maxAge := j.cfg.maxAge(unit.Series); !unit.removed && maxAge > 0 && now.Sub(unit.modTime) > maxAge {
+			remove(unit, RetentionMaxAge)
+		}
+	}
+	// Stops once the store fits or nothing reclaimable is left
+	for _, unit := range units {
+		if j.cfg.MaxBytes <= 0 || remaining <= j.cfg.MaxBytes {
+			break
+		}
+		if !unit.removed {
+			remove(unit, RetentionMaxBytes)
+		}
+	}
+	for key, info := range blobSizes {
+		if _, referenced := refs[key]; !referenced && now.Sub(info.ModTime) > retentionBlobGrace {
+			unit := &retentionUnit{RetentionCandidate: RetentionCandidate{Kind: "blob", Keys: []string{key}, Bytes: info.Size, LastServed: lastServed([]string{key}, info.ModTime)}}
+			remove(unit, RetentionUnreferenced)
+		}
+	}
+	for _, c := range report.Candidates {
+		report.ReclaimBytes += c.Bytes
+	}
+	report.AfterBytes = report.UsageBytes - report.ReclaimBytes
+	if dryRun {
+		return report, nil
+	}
+
+	report.Archived = j.cfg.ArchiveDir != ""
+	var reclaimed int64
+	for _, c := range report.Candidates {
+		for _, key := range c.Keys {
+			size, err := j.removeKey(ctx, store, key)
+			if err != nil {
+				report.Errors = append(report.Errors, err.Error())
+				continue
+			}
+			report.Removed++
+			reclaimed += size
+			servedIndex.forget(key)
+		}
+		if c.Kind == "generation" {
+			// The annotated image's copy on disk would otherwise still be served
+			removeLocalGeneration(store, c.Keys)
+		}
+	}
+	GetMetricsCollector().RecordRetention(report.Removed, reclaimed)
+	j.setUsage(report.UsageBytes - reclaimed)
+	if err := servedIndex.save(j.fileOps, j.servedFile); err != nil {
+		report.Errors = append(report.Errors, err.Error())
+	}
+	return report, nil
+}
+
+// versionUnit reads a manifest into a removable unit
+func (j *Janitor) versionUnit(ctx context.Context, store ArtifactStore, info ArtifactInfo) (*retentionUnit, error) {
+	body, _, err := store.Open(ctx, info.Key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(body)
+	_ = body.Close()
+	if err != nil {
+		return nil, err
+	}
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("unreadable manifest %s: %w", info.Key, err)
+	}
+	unit := &retentionUnit{
+		RetentionCandidate: RetentionCandidate{Kind: "version", Series: m.Series, Address: m.Address, ManifestID: m.ID, Keys: []string{info.Key}, Bytes: info.Size},
+		modTime:            m.FinishedAt,
+		sizes:              map[string]int64{},
+	}
+	for _, artifact := range m.Artifacts {
+		unit.blobs = append(unit.blobs, blobKey(artifact.Digest, path.Ext(artifact.URL)))
+		unit.sizes[artifact.Kind] = artifact.Size
+	}
+	return unit, nil
+}
+
+// lastServed is the latest time any of keys was served, or fallback when none was
+func lastServed(keys []string, fallback time.Time) time.Time {
+	latest := fallback
+	for _, key := range keys {
+		if t, ok := servedIndex.Last(key); ok && t.After(latest) {
+			latest = t
+		}
+	}
+	return latest
+}
+
+// removeKey deletes key from store, copying it to the archive directory first when one is
+// configured, and returns the bytes it held
+func (j *Janitor) removeKey(ctx context.Context, store ArtifactStore, key string) (int64, error) {
+	info, err := store.Stat(ctx, key)
+	if errors.Is(err, ErrArtifactNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if j.cfg.ArchiveDir != "" {
+		body, _, err := store.Open(ctx, key)
+		if err != nil {
+			return 0, err
+		}
+		data, err := io.ReadAll(body)
+		_ = body.Close()
+		if err != nil {
+			return 0, err
+		}
+		if err := j.fileOps.WriteFile(filepath.Join(j.cfg.ArchiveDir, filepath.FromSlash(key)), data, ""); err != nil {
+			return 0, err
+		}
+	}
+	if err := GetFileOperations().RemoveArtifact(store, key, ""); err != nil {
+		return 0, err
+	}
+	return info.Size, nil
+}
+
+// removeLocalGeneration deletes the output directory's copies of a generation kept in
+// another store
+func removeLocalGeneration(store ArtifactStore, keys []string) {
+	if storeIsOutputDir(store) {
+		return
+	}
+	for _, key := range keys {
+		_ = os.Remove(filepath.Join(storage.OutputDir(), filepath.FromSlash(key)))
+	}
+}
+
+// formatRetention renders the retention rules for the startup report
+func formatRetention(c RetentionConfig) string {
+	limit := func(bytes int64) string {
+		if bytes <= 0 {
+			return "unlimited"
+		}
+		return fmt.Sprintf("%d MiB", bytes>>20)
+	}
+	parts := []string{"max " + limit(c.MaxBytes), "quota " + limit(c.QuotaBytes)}
+	if len(c.MaxAge) > 0 {
+		series := make([]string, 0, len(c.MaxAge))
+		for name, d := range c.MaxAge {
+			series = append(series, name+"="+d.String())
+		}
+		sort.Strings(series)
+		parts = append(parts, "max age "+strings.Join(series, ","))
+	}
+	if c.KeepVersions > 0 {
+		parts = append(parts, fmt.Sprintf("keep %d versions", c.KeepVersions))
+	}
+	if c.reclaims() {
+		parts = append(parts, "every "+c.Interval.String())
+		if c.ArchiveDir != "" {
+			parts = append(parts, "archiving to "+c.ArchiveDir)
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// checkQuota reports a reached storage quota, or nil when generations may proceed
+func (a *App) checkQuota() *QuotaError {
+	var quotaErr *QuotaError
+	if errors.As(a.Retention.CheckQuota(context.Background()), &quotaErr) {
+		return quotaErr
+	}
+	return nil
+}
+
+// handleV1AdminRetention serves GET /v1/admin/retention, a dry run of the retention rules,
+// and POST /v1/admin/retention/run, which applies them now
+func (a *App) handleV1AdminRetention(w http.ResponseWriter, r *http.Request) {
+	requestID := GenerateRequestID()
+	if !a.authorizeAdmin(w, r, requestID) {
+		return
+	}
+	dryRun := true
+	switch strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/v1/admin/retention"), "/") {
+	case "":
+		if r.Method != http.MethodGet {
+			writeV1Error(w, requestID, http.StatusMethodNotAllowed, dalle.ErrInvalidInput, "method not allowed")
+			return
+		}
+	case "/run":
+		if r.Method != http.MethodPost {
+			writeV1Error(w, requestID, http.StatusMethodNotAllowed, dalle.ErrInvalidInput, "method not allowed")
+			return
+		}
+		dryRun = false
+	default:
+		WriteErrorResponse(w, NewAPIError(ErrorInvalidRequest, "Unknown retention action", "want GET /v1/admin/retention or POST /v1/admin/retention/run").WithRequestID(requestID), http.StatusNotFound)
+		return
+	}
+	report, err := a.Retention.Run(r.Context(), dryRun)
+	if err != nil {
+		writeArtifactError(w, "", err)
+		return
+	}
+	if !dryRun {
+		logInfo(fmt.Sprintf("[%s] retention pass by %s removed %d artifacts, reclaimed %d bytes", requestID, getClientIP(r), report.Removed, report.ReclaimBytes))
+	}
+	WriteSuccessResponse(w, report, requestID)
+}
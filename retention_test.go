@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	dalle "github.com/TrueBlocks/trueblocks-dalle/v6"
+	"github.com/TrueBlocks/trueblocks-dalle/v6/pkg/storage"
+)
+
+func TestParseRetentionAges(t *testing.T) {
+	if ages, err := ParseRetentionAges("720h"); err != nil || ages["*"] != 720*time.Hour {
+		t.Fatalf("single age: %v %v", ages, err)
+	}
+	ages, err := ParseRetentionAges("*=720h, scratch=24h")
+	if err != nil || (RetentionConfig{MaxAge: ages}).maxAge("scratch") != 24*time.Hour || (RetentionConfig{MaxAge: ages}).maxAge("other") != 720*time.Hour {
+		t.Fatalf("per-series ages: %v %v", ages, err)
+	}
+	if _, err := ParseRetentionAges("scratch=soon"); err == nil {
+		t.Fatalf("expected an invalid age to be rejected")
+	}
+}
+
+func TestRetentionJanitorAndQuota(t *testing.T) {
+	dalle.SetupTest(t, dalle.SetupTestOptions{Series: []string{"empty"}})
+	UseStore(nil, defaultPresignTTL)
+	saved := servedIndex
+	servedIndex = NewServedIndex()
+	t.Cleanup(func() { UseStore(nil, defaultPresignTTL); servedIndex = saved })
+
+	const series = "empty"
+	const old, kept, idle = "0xaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa", "0xbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb", "0xcccccccccccccccccccccccccccccccccccccccc"
+	write := func(address, dir, ext string, data []byte, modTime time.Time) {
+		local := filepath.Join(storage.OutputDir(), series, dir, address+ext)
+		_ = os.MkdirAll(filepath.Dir(local), 0o750)
+		_ = os.WriteFile(local, data, 0o600)
+		_ = os.Chtimes(local, modTime, modTime)
+	}
+	now := time.Now()
+	png, _ := mockImagePNG("harbor", 16, 16)
+	write(old, "annotated", ".png", png, now.Add(-48*time.Hour))
+	write(old, "prompt", ".txt", []byte("an old harbor"), now.Add(-48*time.Hour))
+	write(idle, "annotated", ".png", png, now.Add(-2*time.Hour))
+
+	// Three generations of one address, sharing their prompt
+	write(kept, "prompt", ".txt", []byte("a kept harbor"), now)
+	var versions []*Manifest
+	var copied int64 // the newest version's series files, copies of its blobs
+	for i, seed := range []string{"dawn", "noon", "dusk"} {
+		img, _ := mockImagePNG(seed, 16, 16)
+		write(kept, "annotated", ".png", img, now)
+		copied = int64(len(img) + len("a kept harbor"))
+		finished := now.Add(time.Duration(i-3) * time.Hour)
+		m, err := recordManifest(&Job{ID: seed, Series: series, Address: kept}, finished, finished)
+		if err != nil {
+			t.Fatal(err)
+		}
+		versions = append(versions, m)
+	}
+	blobOf := func(m *Manifest, kind string) string {
+		for _, a := range m.Artifacts {
+			if a.Kind == kind {
+				return a.URL
+			}
+		}
+		t.Fatalf("manifest %s has no %s", m.ID, kind)
+		return ""
+	}
+
+	ctx := context.Background()
+	janitor := NewJanitor(RetentionConfig{MaxAge: map[string]time.Duration{"*": 24 * time.Hour}, KeepVersions: 1}, t.TempDir())
+	dry, err := janitor.Run(ctx, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reasons := map[string]int{}
+	for _, c := range dry.Candidates {
+		reasons[c.Kind+"/"+c.Reason]++
+	}
+	if len(dry.Candidates) != 3 || reasons["generation/max_age"] != 1 || reasons["version/keep_versions"] != 2 {
+		t.Fatalf("dry run: %+v", dry.Candidates)
+	}
+	if !fileExists(filepath.Join(storage.OutputDir(), series, "annotated", old+".png")) || dry.AfterBytes != dry.UsageBytes-dry.ReclaimBytes || dry.CopyBytes != copied {
+		t.Fatalf("dry run touched the store or miscounted: %+v", dry)
+	}
+
+	before := GetMetricsCollector().GetMetrics()
+	report, err := janitor.Run(ctx, false)
+	if err != nil || len(report.Errors) != 0 {
+		t.Fatalf("run: %v %v", err, report.Errors)
+	}
+	// Each old version took its manifest and its own image; the shared prompt stays
+	if report.Removed != 6 || report.ReclaimBytes != dry.ReclaimBytes {
+		t.Fatalf("run removed %d artifacts, %d bytes (dry run said %d)", report.Removed, report.ReclaimBytes, dry.ReclaimBytes)
+	}
+	after := GetMetricsCollector().GetMetrics()
+	if after.RetentionBytesReclaimed != before.RetentionBytesReclaimed+report.ReclaimBytes || after.RetentionArtifactsRemoved != before.RetentionArtifactsRemoved+6 {
+		t.Fatalf("metrics: before %+v after %+v", before, after)
+	}
+	if fileExists(filepath.Join(storage.OutputDir(), series, "annotated", old+".png")) {
+		t.Fatalf("an expired generation survived")
+	}
+	app := &App{}
+	blob := func(url string) int {
+		rr := httptest.NewRecorder()
+		app.handleV1Blob(rr, httptest.NewRequest(http.MethodGet, url, nil))
+		return rr.Code
+	}
+	if blob(blobOf(versions[0], "annotated")) != http.StatusNotFound || blob(blobOf(versions[2], "annotated")) != http.StatusOK || blob(blobOf(versions[2], "prompt")) != http.StatusOK {
+		t.Fatalf("blobs after pruning old versions")
+	}
+	if history, _ := listManifests(ctx, series, kept); len(history) != 1 || history[0].ID != versions[2].ID {
+		t.Fatalf("manifests after pruning: %+v", history)
+	}
+
+	// Over the size limit the least recently served goes first: the idle image, not the
+	// one just viewed
+	servedIndex.Touch(artifactKey(series, "annotated", kept+".png"))
+	lru := NewJanitor(RetentionConfig{}, t.TempDir())
+	used, err := lru.Usage(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lru.cfg.MaxBytes = used - 1
+	report, err = lru.Run(ctx, false)
+	if err != nil || len(report.Candidates) != 1 || report.Candidates[0].Address != idle || report.Candidates[0].Reason != RetentionMaxBytes {
+		t.Fatalf("size limit: %v %+v", err, report.Candidates)
+	}
+	if fileExists(filepath.Join(storage.OutputDir(), series, "annotated", idle+".png")) || !fileExists(filepath.Join(storage.OutputDir(), series, "annotated", kept+".png")) {
+		t.Fatalf("size limit removed the wrong generation")
+	}
+
+	// At the hard quota generations are refused without queueing anything
+	quota := NewJanitor(RetentionConfig{QuotaBytes: 1}, t.TempDir())
+	q := NewJobQueue(NewJobStore(t.TempDir()), 1, func(ctx context.Context, job *Job) (interface{}, error) {
+		return nil, nil
+	})
+	q.Admit = func(*Job) error { return quota.CheckQuota(ctx) }
+	app = &App{Jobs: q, Retention: quota}
+	rejections := GetMetricsCollector().GetMetrics().QuotaRejections
+	rr := httptest.NewRecorder()
+	app.handleV1ImagesGenerate(rr, httptest.NewRequest(http.MethodPost, "/v1/images/generate?async=1", bytes.NewBufferString(`{"input":"Person Tour Coordinates"}`)))
+	if rr.Code != http.StatusInsufficientStorage {
+		t.Fatalf("expected 507, got %d %s", rr.Code, rr.Body.String())
+	}
+	if response := decodeAPIResponse(t, rr); response.Error == nil || response.Error.Code != ErrorQuotaExceeded {
+		t.Fatalf("unexpected error body: %s", rr.Body.String())
+	}
+	if len(q.List("")) != 0 || GetMetricsCollector().GetMetrics().QuotaRejections != rejections+1 {
+		t.Fatalf("refused generation was queued or not counted")
+	}
+
+	app.Config.AdminToken = "s3cret"
+	admin := func(method, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", "Bearer s3cret")
+		rr := httptest.NewRecorder()
+		app.handleV1AdminRetention(rr, req)
+		return rr
+	}
+	rr = admin(http.MethodGet, "/v1/admin/retention")
+	var body struct {
+		Data RetentionReport `json:"data"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil || rr.Code != http.StatusOK || !body.Data.DryRun || body.Data.QuotaBytes != 1 {
+		t.Fatalf("dry-run report: %d %s", rr.Code, rr.Body.String())
+	}
+	// Deleting artifacts needs the admin token, and without a configured one nobody may
+	for _, token := range []string{"", "wrong"} {
+		for _, configured := range []string{"", "s3cret"} {
+			req := httptest.NewRequest(http.MethodPost, "/v1/admin/retention/run", nil)
+			if token != "" {
+				req.Header.Set("Authorization", "Bearer "+token)
+			}
+			rr := httptest.NewRecorder()
+			(&App{Config: Config{AdminToken: configured}, Retention: quota}).handleV1AdminRetention(rr, req)
+			if rr.Code != http.StatusUnauthorized && rr.Code != http.StatusForbidden {
+				t.Fatalf("retention run with token %q (configured %q): got %d", token, configured, rr.Code)
+			}
+		}
+	}
+	if !fileExists(filepath.Join(storage.OutputDir(), series, "annotated", kept+".png")) {
+		t.Fatalf("a refused retention run removed artifacts")
+	}
+	for path, code := range map[string]int{"/v1/admin/retention": 405, "/v1/admin/retention/run": 200, "/v1/admin/retention/purge": 404} {
+		if rr := admin(http.MethodPost, path); rr.Code != code {
+			t.Fatalf("POST %s: got %d, want %d", path, rr.Code, code)
+		}
+	}
+}
+
+// The server's own state is neither measured nor removed, so a full derivative cache
+// cannot push the store over its limits
+func TestRetentionIgnoresServerState(t *testing.T) {
+	dalle.SetupTest(t, dalle.SetupTestOptions{Series: []string{"empty"}})
+	UseStore(nil, defaultPresignTTL)
+	t.Cleanup(func() { UseStore(nil, defaultPresignTTL) })
+
+	const address = "0xaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	png, _ := mockImagePNG("harbor", 16, 16)
+	annotated := filepath.Join(storage.OutputDir(), "empty", "annotated", address+".png")
+	_ = os.MkdirAll(filepath.Dir(annotated), 0o750)
+	_ = os.WriteFile(annotated, png, 0o600)
+	derivative := filepath.Join(storage.OutputDir(), "derivatives", "0123abcd-w64.webp")
+	_ = os.MkdirAll(filepath.Dir(derivative), 0o750)
+	_ = os.WriteFile(derivative, bytes.Repeat([]byte{1}, 1<<20), 0o600)
+	job := filepath.Join(storage.OutputDir(), "jobs", "job-1.json")
+	_ = os.MkdirAll(filepath.Dir(job), 0o750)
+	_ = os.WriteFile(job, []byte(`{"id":"job-1"}`), 0o600)
+
+	ctx := context.Background()
+	limit := int64(len(png)) + 1
+	janitor := NewJanitor(RetentionConfig{MaxBytes: limit, QuotaBytes: limit}, t.TempDir())
+	if used, err := janitor.Usage(ctx); err != nil || used != int64(len(png)) {
+		t.Fatalf("usage counted server state: %d %v", used, err)
+	}
+	if err := janitor.CheckQuota(ctx); err != nil {
+		t.Fatalf("quota refused with only the derivative cache over it: %v", err)
+	}
+	report, err := janitor.Run(ctx, false)
+	if err != nil || len(report.Candidates) != 0 || !fileExists(annotated) {
+		t.Fatalf("run under the limit removed %+v: %v", report.Candidates, err)
+	}
+
+	// Over the limit only the generation goes; the pass stops there
+	janitor.cfg.MaxBytes = 1
+	report, err = janitor.Run(ctx, false)
+	if err != nil || len(report.Candidates) != 1 || report.Candidates[0].Address != address || report.AfterBytes != 0 {
+		t.Fatalf("run over the limit: %+v %v", report, err)
+	}
+	if !fileExists(derivative) || !fileExists(job) {
+		t.Fatalf("retention removed server state")
+	}
+}
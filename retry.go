@@ -2,6 +2,7 @@ package main
 
 import (
 	"crypto/rand"
+	"errors"
 	"fmt"
 	"math"
 	"time"
@@ -15,6 +16,8 @@ type RetryConfig struct {
 	BaseDelay     time.Duration `json:"base_delay"`
 	MaxDelay      time.Duration `json:"max_delay"`
 	BackoffFactor float64       `json:"backoff_factor"`
+	// Budget, when set, refuses retries once they exceed its share of recent calls
+	Budget *RetryBudget `json:"-"`
 }
 
 // DefaultRetryConfig provides sensible defaults for retry operations
@@ -31,6 +34,7 @@ var OpenAIRetryConfig = RetryConfig{
 	BaseDelay:     2 * time.Second,
 	MaxDelay:      60 * time.Second,
 	BackoffFactor: 2.0,
+	Budget:        providerRetryBudget,
 }
 
 // RetryableError represents an error that can be retried
@@ -48,11 +52,20 @@ func (r *RetryableError) Unwrap() error {
 	return r.Err
 }
 
-// RetryWithBackoff executes a function with exponential backoff retry logic
+// RetryWithBackoff executes a function with exponential backoff retry logic. Errors carrying
+// a RetryAfterError wait as long as the provider asked instead, up to MaxDelay.
 func RetryWithBackoff(config RetryConfig, operation func() error) error {
 	var lastErr error
 
 	for attempt := 1; attempt <= config.MaxAttempts; attempt++ {
+		if attempt == 1 {
+			config.Budget.recordCall()
+		} else if !config.Budget.allowRetry() {
+			GetMetricsCollector().RecordRetryBudgetExhausted()
+			fmt.Printf("Retry budget exhausted, not retrying after error: %v\n", lastErr)
+			return fmt.Errorf("operation failed after %d attempts (retry budget exhausted): %w", attempt-1, lastErr)
+		}
+
 		err := operation()
 		if err == nil {
 			return nil // Success
@@ -67,6 +80,10 @@ func RetryWithBackoff(config RetryConfig, operation func() error) error {
 
 		// Calculate delay with exponential backoff and jitter
 		delay := calculateBackoffDelay(config, attempt)
+		var limited *RetryAfterError
+		if errors.As(err, &limited) && limited.Wait > 0 {
+			delay = min(limited.Wait, config.MaxDelay)
+		}
 
 		// Log retry attempt
 		fmt.Printf("Retry attempt %d/%d after error: %v (waiting %v)\n",
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PriorityClass selects how a job competes for generation workers
+type PriorityClass string
+
+const (
+	PriorityInteractive PriorityClass = "interactive" // UI and single requests
+	PriorityBatch       PriorityClass = "batch"       // /v1/batches
+	PriorityBackfill    PriorityClass = "backfill"    // bulk catch-up work
+)
+
+// priorityClasses lists the classes from highest to lowest priority
+var priorityClasses = []PriorityClass{PriorityInteractive, PriorityBatch, PriorityBackfill}
+
+// classWeights sets each class's share of dispatches when several classes have work queued
+var classWeights = map[PriorityClass]int{
+	PriorityInteractive: 8,
+	PriorityBatch:       3,
+	PriorityBackfill:    1,
+}
+
+// rank orders classes; lower is more important
+func (c PriorityClass) rank() int {
+	for i, p := range priorityClasses {
+		if p == c {
+			return i
+		}
+	}
+	return len(priorityClasses)
+}
+
+// ParsePriorityClass validates a class name; empty selects def
+func ParsePriorityClass(value string, def PriorityClass) (PriorityClass, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	if value == "" {
+		return def, nil
+	}
+	for _, c := range priorityClasses {
+		if string(c) == value {
+			return c, nil
+		}
+	}
+	return "", fmt.Errorf("unknown priority %q (expected interactive, batch or backfill)", value)
+}
+
+// ParseClassMap parses "class=value,..." pairs such as "batch=3,backfill=1"
+func ParseClassMap(spec string) (map[string]string, error) {
+	out := make(map[string]string)
+	for _, pair := range strings.Split(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(pair, "=")
+		if !ok || strings.TrimSpace(k) == "" {
+			return nil, fmt.Errorf("invalid entry %q (expected name=value)", pair)
+		}
+		out[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+	return out, nil
+}
+
+// ParseClassCaps parses a --class-caps value into per-class concurrency limits
+func ParseClassCaps(spec string) (map[PriorityClass]int, error) {
+	pairs, err := ParseClassMap(spec)
+	if err != nil {
+		return nil, err
+	}
+	caps := make(map[PriorityClass]int, len(pairs))
+	for name, value := range pairs {
+		class, err := ParsePriorityClass(name, "")
+		if err != nil {
+			return nil, err
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid cap %q for %s", value, name)
+		}
+		caps[class] = n
+	}
+	return caps, nil
+}
+
+// defaultClassCaps keeps at least one worker free of batch work and limits backfill to a
+// quarter of the pool so interactive requests always find a worker soon
+func defaultClassCaps(workers int) map[PriorityClass]int {
+	return map[PriorityClass]int{
+		PriorityInteractive: workers,
+		PriorityBatch:       max(1, workers-1),
+		PriorityBackfill:    max(1, workers/4),
+	}
+}
+
+// requestClient identifies the caller for fair queuing: a short hash of the API key when
+// one is sent, otherwise the client IP
+func requestClient(r *http.Request) string {
+	if key := r.Header.Get(APIKeyHeader); key != "" {
+		sum := sha256.Sum256([]byte(key))
+		return "key:" + hex.EncodeToString(sum[:4])
+	}
+	return getClientIP(r)
+}
+
+// APIKeyHeader carries the caller's API key for priority policy
+const APIKeyHeader = "X-API-Key"
+
+// requestPriority resolves the class for a request: the requested class (or def), lowered
+// to the ceiling configured for the caller's API key, if any
+func (a *App) requestPriority(r *http.Request, requested string, def PriorityClass) (PriorityClass, *APIError) {
+	class, err := ParsePriorityClass(requested, def)
+	if err != nil {
+		return "", NewAPIError(ErrorInvalidRequest, "Invalid priority", err.Error())
+	}
+	if ceiling, ok := a.Config.APIKeyClasses[r.Header.Get(APIKeyHeader)]; ok && class.rank() < ceiling.rank() {
+		class = ceiling
+	}
+	return class, nil
+}
+
+// queuedEntry is a job waiting in a class queue
+type queuedEntry struct {
+	id       string
+	enqueued time.Time
+}
+
+// classQueue holds one class's waiting jobs, one FIFO per flow (client and series),
+// served round-robin so no single caller or series monopolises the class
+type classQueue struct {
+	weight  int
+	limit   int
+	running int
+	depth   int
+	pass    float64 // stride-scheduling virtual time; the lowest eligible pass runs next
+	flows   map[string][]queuedEntry
+	ring    []string
+	next    int
+}
+
+func (c *classQueue) push(flow string, e queuedEntry) {
+	if _, ok := c.flows[flow]; !ok {
+		c.ring = append(c.ring, flow)
+	}
+	c.flows[flow] = append(c.flows[flow], e)
+	c.depth++
+}
+
+func (c *classQueue) pop() queuedEntry {
+	if c.next >= len(c.ring) {
+		c.next = 0
+	}
+	flow := c.ring[c.next]
+	entries := c.flows[flow]
+	e := entries[0]
+	if len(entries) == 1 {
+		delete(c.flows, flow)
+		c.ring = append(c.ring[:c.next:c.next], c.ring[c.next+1:]...)
+	} else {
+		c.flows[flow] = entries[1:]
+		c.next++
+	}
+	c.depth--
+	return e
+}
+
+// remove drops the entry for id from flow, reporting whether it was there
+func (c *classQueue) remove(flow, id string) bool {
+	entries := c.flows[flow]
+	for i, e := range entries {
+		if e.id != id {
+			continue
+		}
+		if len(entries) > 1 {
+			c.flows[flow] = append(entries[:i:i], entries[i+1:]...)
+		} else {
+			delete(c.flows, flow)
+			for r, name := range c.ring {
+				if name == flow {
+					c.ring = append(c.ring[:r:r], c.ring[r+1:]...)
+					if r < c.next {
+						c.next--
+					}
+					break
+				}
+			}
+		}
+		c.depth--
+		return true
+	}
+	return false
+}
+
+// queuedRef locates a waiting job's entry
+type queuedRef struct {
+	class PriorityClass
+	flow  string
+}
+
+// Scheduler hands queued jobs to workers using weighted fair queuing across priority
+// classes, per-class concurrency limits, and round-robin across flows within a class
+type Scheduler struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	classes  map[PriorityClass]*classQueue
+	queued   map[string]queuedRef // waiting job id -> where its entry is
+	capacity int
+	size     int
+	vtime    float64
+}
+
+// NewScheduler creates a scheduler holding at most capacity waiting jobs
+func NewScheduler(capacity int, caps map[PriorityClass]int) *Scheduler {
+	s := &Scheduler{classes: make(map[PriorityClass]*classQueue), queued: make(map[string]queuedRef), capacity: capacity}
+	s.cond = sync.NewCond(&s.mu)
+	for _, class := range priorityClasses {
+		s.classes[class] = &classQueue{weight: classWeights[class], limit: caps[class], flows: make(map[string][]queuedEntry)}
+	}
+	return s
+}
+
+// SetLimits replaces the per-class concurrency limits; zero means unlimited
+func (s *Scheduler) SetLimits(caps map[PriorityClass]int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for class, n := range caps {
+		if c := s.classes[class]; c != nil {
+			c.limit = n
+		}
+	}
+	s.cond.Broadcast()
+}
+
+// Push queues a job id under class and flow, failing with errQueueFull when the wait
+// queue is at capacity. Only interactive work may use the last quarter of the queue.
+func (s *Scheduler) Push(id string, class PriorityClass, flow string) error {
+	return s.push(id, class, flow, false)
+}
+
+// push queues a job; force bypasses the capacity check for jobs accepted before a restart
+func (s *Scheduler) push(id string, class PriorityClass, flow string, force bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.classes[class]
+	if c == nil {
+		c = s.classes[PriorityInteractive]
+		class = PriorityInteractive
+	}
+	if !force && s.size >= s.limitFor(class) {
+		return errQueueFull
+	}
+	if c.depth == 0 && c.pass < s.vtime {
+		// A class returning from idle does not get credit for the time it had no work
+		c.pass = s.vtime
+	}
+	c.push(flow, queuedEntry{id: id, enqueued: time.Now()})
+	s.queued[id] = queuedRef{class: class, flow: flow}
+	s.size++
+	GetMetricsCollector().RecordQueueDepth(string(class), c.depth, c.running)
+	s.cond.Signal()
+	return nil
+}
+
+// Next blocks until a job may start and returns its id and class. Callers must call
+// Done with the class when the job finishes.
+func (s *Scheduler) Next() (string, PriorityClass) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		if class, c := s.pick(); c != nil {
+			e := c.pop()
+			delete(s.queued, e.id)
+			c.running++
+			c.pass += 1 / float64(c.weight)
+			s.vtime = c.pass
+			s.size--
+			GetMetricsCollector().RecordQueueDepth(string(class), c.depth, c.running)
+			GetMetricsCollector().RecordQueueWait(string(class), time.Since(e.enqueued))
+			return e.id, class
+		}
+		s.cond.Wait()
+	}
+}
+
+// Remove takes a waiting job out of its queue, so a cancelled job frees its place at once
+// and never reaches a worker. It reports false when the job is not waiting.
+func (s *Scheduler) Remove(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ref, ok := s.queued[id]
+	if !ok {
+		return false
+	}
+	delete(s.queued, id)
+	c := s.classes[ref.class]
+	if !c.remove(ref.flow, id) {
+		return false
+	}
+	s.size--
+	GetMetricsCollector().RecordQueueDepth(string(ref.class), c.depth, c.running)
+	return true
+}
+
+// Promote moves a waiting job to a more important class, keeping its flow and its place
+// in the wait-time metrics. It reports false when the job is not waiting or already ranks
+// at least as high.
+func (s *Scheduler) Promote(id string, class PriorityClass) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ref, ok := s.queued[id]
+	to := s.classes[class]
+	if !ok || to == nil || class.rank() >= ref.class.rank() {
+		return false
+	}
+	from := s.classes[ref.class]
+	var entry queuedEntry
+	for _, e := range from.flows[ref.flow] {
+		if e.id == id {
+			entry = e
+		}
+	}
+	if !from.remove(ref.flow, id) {
+		return false
+	}
+	if to.depth == 0 && to.pass < s.vtime {
+		to.pass = s.vtime
+	}
+	to.push(ref.flow, entry)
+	s.queued[id] = queuedRef{class: class, flow: ref.flow}
+	GetMetricsCollector().RecordQueueDepth(string(ref.class), from.depth, from.running)
+	GetMetricsCollector().RecordQueueDepth(string(class), to.depth, to.running)
+	s.cond.Signal()
+	return true
+}
+
+// pick returns the eligible class with the lowest pass, breaking ties by rank
+func (s *Scheduler) pick() (PriorityClass, *classQueue) {
+	var best PriorityClass
+	var bestQ *classQueue
+	for _, class := range priorityClasses {
+		c := s.classes[class]
+		if c.depth == 0 || (c.limit > 0 && c.running >= c.limit) {
+			continue
+		}
+		if bestQ == nil || c.pass < bestQ.pass {
+			best, bestQ = class, c
+		}
+	}
+	return best, bestQ
+}
+
+// Full reports whether a new job of class would be refused by Push
+func (s *Scheduler) Full(class PriorityClass) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size >= s.limitFor(class)
+}
+
+// limitFor returns the queue size at which pushes of class are refused
+func (s *Scheduler) limitFor(class PriorityClass) int {
+	if class == PriorityInteractive {
+		return s.capacity
+	}
+	return s.capacity - s.capacity/4
+}
+
+// Size reports how many jobs are waiting for a worker
+func (s *Scheduler) Size() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size
+}
+
+// SetCapacity changes the maximum number of waiting jobs
+func (s *Scheduler) SetCapacity(capacity int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.capacity = capacity
+}
+
+// Done releases the concurrency slot taken by Next
+func (s *Scheduler) Done(class PriorityClass) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c := s.classes[class]; c != nil && c.running > 0 {
+		c.running--
+		GetMetricsCollector().RecordQueueDepth(string(class), c.depth, c.running)
+	}
+	s.cond.Broadcast()
+}
+
+// ClassStatus is a point-in-time view of one class queue
+type ClassStatus struct {
+	Class   PriorityClass `json:"class"`
+	Weight  int           `json:"weight"`
+	Limit   int           `json:"limit"`
+	Queued  int           `json:"queued"`
+	Running int           `json:"running"`
+	Flows   int           `json:"flows"`
+}
+
+// Status reports every class queue, highest priority first
+func (s *Scheduler) Status() []ClassStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]ClassStatus, 0, len(s.classes))
+	for class, c := range s.classes {
+		out = append(out, ClassStatus{Class: class, Weight: c.weight, Limit: c.limit, Queued: c.depth, Running: c.running, Flows: len(c.ring)})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Class.rank() < out[j].Class.rank() })
+	return out
+}
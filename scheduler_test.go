@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSchedulerInteractiveNotStarvedByBackfill(t *testing.T) {
+	s := NewScheduler(100, map[PriorityClass]int{})
+	for i := 0; i < 20; i++ {
+		if err := s.Push("backfill-"+string(rune('a'+i)), PriorityBackfill, "bulk|s"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 4; i++ {
+		_ = s.Push("ui-"+string(rune('a'+i)), PriorityInteractive, "ui|s")
+	}
+
+	// With weights 8:1 every interactive job is dispatched before the second backfill job
+	backfill := 0
+	for i := 0; i < 5; i++ {
+		id, class := s.Next()
+		s.Done(class)
+		if class == PriorityBackfill {
+			backfill++
+		} else if !strings.HasPrefix(id, "ui-") {
+			t.Fatalf("unexpected id %s in %s", id, class)
+		}
+	}
+	if backfill > 1 {
+		t.Fatalf("backfill took %d of the first 5 slots", backfill)
+	}
+}
+
+func TestSchedulerRoundRobinAcrossFlows(t *testing.T) {
+	s := NewScheduler(100, map[PriorityClass]int{})
+	for i := 0; i < 3; i++ {
+		_ = s.Push("a", PriorityBatch, "client-a|series")
+	}
+	_ = s.Push("b", PriorityBatch, "client-b|series")
+	_ = s.Push("c", PriorityBatch, "client-a|other")
+
+	var got []string
+	for i := 0; i < 5; i++ {
+		id, class := s.Next()
+		s.Done(class)
+		got = append(got, id)
+	}
+	if strings.Join(got[:3], "") != "abc" {
+		t.Fatalf("flows not interleaved: %v", got)
+	}
+}
+
+func TestSchedulerClassCap(t *testing.T) {
+	s := NewScheduler(100, map[PriorityClass]int{PriorityBackfill: 1})
+	_ = s.Push("b1", PriorityBackfill, "x")
+	_ = s.Push("b2", PriorityBackfill, "x")
+
+	_, class := s.Next()
+	if class != PriorityBackfill {
+		t.Fatalf("class = %s", class)
+	}
+	next := make(chan string, 1)
+	go func() {
+		id, _ := s.Next()
+		next <- id
+	}()
+	select {
+	case id := <-next:
+		t.Fatalf("%s started while backfill was at its cap", id)
+	case <-time.After(50 * time.Millisecond):
+	}
+	s.Done(PriorityBackfill)
+	select {
+	case id := <-next:
+		if id != "b2" {
+			t.Fatalf("got %s, want b2", id)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("second backfill job never started")
+	}
+	s.Done(PriorityBackfill)
+
+	m := GetMetricsCollector().GetMetrics().QueueClasses[string(PriorityBackfill)]
+	if m == nil || m.Dispatched < 2 {
+		t.Fatalf("queue metrics not recorded: %+v", m)
+	}
+	if !strings.Contains(GetMetricsCollector().PrometheusMetrics(), `dalleserver_queue_depth{class="backfill"}`) {
+		t.Fatalf("prometheus output missing queue depth")
+	}
+}
+
+func TestJobQueuePromotesJoinedJob(t *testing.T) {
+	store := NewJobStore(filepath.Join(t.TempDir(), "jobs"))
+	release := make(chan struct{})
+	var mu sync.Mutex
+	var order []string
+	q := NewJobQueue(store, 1, func(ctx context.Context, job *Job) (interface{}, error) {
+		mu.Lock()
+		order = append(order, job.Address)
+		mu.Unlock()
+		if job.Address == "blocker" {
+			<-release
+		}
+		return nil, nil
+	})
+	q.Start()
+
+	blocker := NewJob(JobKindDalle, "r0")
+	blocker.Series, blocker.Address = "s", "blocker"
+	_, _ = q.Enqueue(blocker)
+	deadline := time.Now().Add(2 * time.Second)
+	for q.Get(blocker.ID).State != JobRunning && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	for _, addr := range []string{"b1", "b2", "target"} {
+		job := NewJob(JobKindDalle, "r1")
+		job.Series, job.Address, job.Priority = "s", addr, PriorityBackfill
+		_, _ = q.Enqueue(job)
+	}
+	ui := NewJob(JobKindDalle, "r2")
+	ui.Series, ui.Address, ui.Priority = "s", "target", PriorityInteractive
+	joined, _ := q.Enqueue(ui)
+	if joined.ID == ui.ID || joined.Priority != PriorityInteractive {
+		t.Fatalf("expected promotion of the queued job, got %+v", joined)
+	}
+	// The job moved between classes rather than being queued twice
+	depth := map[PriorityClass]int{}
+	for _, status := range q.Queues() {
+		depth[status.Class] = status.Queued
+	}
+	if q.sched.Size() != 3 || depth[PriorityInteractive] != 1 || depth[PriorityBackfill] != 2 {
+		t.Fatalf("after promotion: size %d, depths %v", q.sched.Size(), depth)
+	}
+
+	close(release)
+	deadline = time.Now().Add(2 * time.Second)
+	for len(q.List(JobSucceeded)) < 4 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(order) != 4 || order[1] != "target" {
+		t.Fatalf("run order = %v, want target right after blocker", order)
+	}
+}
+
+func TestRequestPriorityAPIKeyCeiling(t *testing.T) {
+	app := &App{Config: Config{APIKeyClasses: parseAPIKeyClasses("bulk-key=backfill,ui-key=interactive")}}
+
+	req := httptest.NewRequest("GET", "/dalle/s/a?priority=interactive", nil)
+	req.Header.Set(APIKeyHeader, "bulk-key")
+	if class, _ := app.requestPriority(req, "interactive", PriorityInteractive); class != PriorityBackfill {
+		t.Fatalf("bulk key got %s, want backfill", class)
+	}
+	req.Header.Set(APIKeyHeader, "ui-key")
+	if class, _ := app.requestPriority(req, "batch", PriorityInteractive); class != PriorityBatch {
+		t.Fatalf("ui key asking for batch got %s", class)
+	}
+	if _, apiErr := app.requestPriority(req, "urgent", PriorityInteractive); apiErr == nil {
+		t.Fatalf("expected error for unknown priority")
+	}
+	if requestClient(req) == "" || strings.Contains(requestClient(req), "ui-key") {
+		t.Fatalf("client identity should be a hash of the key, got %q", requestClient(req))
+	}
+}
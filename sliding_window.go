@@ -0,0 +1,108 @@
+package main
+
+import "time"
+
+// Breaker modes: count trips on consecutive failures, window on the failure and slow-call
+// rates over a rolling time window
+const (
+	BreakerModeCount  = "count"
+	BreakerModeWindow = "window"
+)
+
+// Window-mode defaults, following Resilience4j's time-based sliding window
+const (
+	defaultWindowSize            = 60 * time.Second
+	defaultWindowMinCalls        = 10
+	defaultFailureRateThreshold  = 50
+	defaultSlowCallDuration      = 60 * time.Second
+	defaultSlowCallRateThreshold = 100
+)
+
+// windowBuckets is how many slices the rolling window is kept in; outcomes age out one
+// slice at a time
+const windowBuckets = 10
+
+// slidingWindow counts calls, failures and slow calls over a rolling period without keeping
+// every call: outcomes land in the bucket for their slice of time, and buckets older than
+// the window are ignored and then reused
+type slidingWindow struct {
+	size    time.Duration
+	buckets [windowBuckets]windowBucket
+}
+
+type windowBucket struct {
+	start    int64 // UnixNano start of the slice this bucket holds
+	calls    int
+	failures int
+	slow     int
+}
+
+func newSlidingWindow(size time.Duration) *slidingWindow {
+	return &slidingWindow{size: size}
+}
+
+// bucketWidth is the slice of time each bucket covers
+func (w *slidingWindow) bucketWidth() int64 {
+	if width := int64(w.size) / windowBuckets; width > 0 {
+		return width
+	}
+	return 1
+}
+
+// record adds one call's outcome at now
+func (w *slidingWindow) record(now time.Time, failed, slow bool) {
+	width := w.bucketWidth()
+	slice := now.UnixNano() / width
+	b := &w.buckets[slice%windowBuckets]
+	if start := slice * width; b.start != start {
+		*b = windowBucket{start: start}
+	}
+	b.calls++
+	if failed {
+		b.failures++
+	}
+	if slow {
+		b.slow++
+	}
+}
+
+// totals sums the buckets still inside the window at now
+func (w *slidingWindow) totals(now time.Time) (calls, failures, slow int) {
+	cutoff := now.UnixNano() - int64(w.size)
+	for _, b := range w.buckets {
+		if b.calls > 0 && b.start > cutoff {
+			calls += b.calls
+			failures += b.failures
+			slow += b.slow
+		}
+	}
+	return calls, failures, slow
+}
+
+// reset forgets every outcome
+func (w *slidingWindow) reset() {
+	w.buckets = [windowBuckets]windowBucket{}
+}
+
+// percent returns n as a percentage of calls
+func percent(n, calls int) float64 {
+	if calls == 0 {
+		return 0
+	}
+	return float64(n) * 100 / float64(calls)
+}
+
+// WindowStats reports a window-mode breaker's rolling window and the thresholds it is
+// compared against. Rates are percentages.
+type WindowStats struct {
+	Window                time.Duration `json:"window"`
+	Calls                 int           `json:"calls"`
+	Failures              int           `json:"failures"`
+	SlowCalls             int           `json:"slow_calls"`
+	FailureRate           float64       `json:"failure_rate"`
+	SlowCallRate          float64       `json:"slow_call_rate"`
+	MinCalls              int           `json:"min_calls"`
+	FailureRateThreshold  float64       `json:"failure_rate_threshold"`
+	SlowCallDuration      time.Duration `json:"slow_call_duration"`
+	SlowCallRateThreshold float64       `json:"slow_call_rate_threshold"`
+}
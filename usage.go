@@ -0,0 +1,429 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/png" // register the decoder used to read generated image sizes
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ChatRate prices a chat model in USD per thousand tokens
+type ChatRate struct {
+	InputPer1K  float64 `json:"input_per_1k"`
+	OutputPer1K float64 `json:"output_per_1k"`
+}
+
+// RateTable prices provider usage. Image prices are per image, keyed by
+// "model/quality/size", "model/size", "model/quality" or "model", most specific first.
+type RateTable struct {
+	Chat   map[string]ChatRate `json:"chat"`
+	Images map[string]float64  `json:"images"`
+}
+
+// defaultRateTable holds OpenAI list prices for the models the library uses
+func defaultRateTable() RateTable {
+	return RateTable{
+		Chat: map[string]ChatRate{
+			"gpt-4":       {InputPer1K: 0.03, OutputPer1K: 0.06},
+			"gpt-4o":      {InputPer1K: 0.0025, OutputPer1K: 0.01},
+			"gpt-4o-mini": {InputPer1K: 0.00015, OutputPer1K: 0.0006},
+		},
+		Images: map[string]float64{
+			"dall-e-3/standard/1024x1024": 0.04,
+			"dall-e-3/standard":           0.08,
+			"dall-e-3/hd/1024x1024":       0.08,
+			"dall-e-3/hd":                 0.12,
+			"gpt-image-1/high/1024x1024":  0.167,
+			"gpt-image-1/high":            0.25,
+		},
+	}
+}
+
+// LoadRateTable overlays the JSON rate table at path on the defaults
+func LoadRateTable(path string) (RateTable, error) {
+	rates := defaultRateTable()
+	if path == "" {
+		return rates, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return rates, err
+	}
+	var custom RateTable
+	if err := json.Unmarshal(data, &custom); err != nil {
+		return rates, fmt.Errorf("parse %s: %w", path, err)
+	}
+	for model, rate := range custom.Chat {
+		rates.Chat[model] = rate
+	}
+	for key, price := range custom.Images {
+		rates.Images[key] = price
+	}
+	return rates, nil
+}
+
+// chatRate returns the price of model. Providers often answer with a dated snapshot such
+// as gpt-4-0613, which is priced as the longest priced name it extends.
+func (r RateTable) chatRate(model string) (ChatRate, bool) {
+	if rate, ok := r.Chat[model]; ok {
+		return rate, true
+	}
+	var rate ChatRate
+	matched := ""
+	for name, candidate := range r.Chat {
+		if strings.HasPrefix(model, name+"-") && len(name) > len(matched) {
+			rate, matched = candidate, name
+		}
+	}
+	return rate, matched != ""
+}
+
+// ChatCost prices one chat completion; unknown models cost nothing
+func (r RateTable) ChatCost(model string, promptTokens, completionTokens int) float64 {
+	rate, _ := r.chatRate(model)
+	return float64(promptTokens)/1000*rate.InputPer1K + float64(completionTokens)/1000*rate.OutputPer1K
+}
+
+// imagePrice returns the price of one image
+func (r RateTable) imagePrice(model, quality, size string) (float64, bool) {
+	for _, key := range []string{model + "/" + quality + "/" + size, model + "/" + size, model + "/" + quality, model} {
+		if price, ok := r.Images[key]; ok {
+			return price, true
+		}
+	}
+	return 0, false
+}
+
+// ImageCost prices one generated image; unknown models cost nothing
+func (r RateTable) ImageCost(model, quality, size string) float64 {
+	price, _ := r.imagePrice(model, quality, size)
+	return price
+}
+
+// UsageTotals accumulates spend and the usage behind it
+type UsageTotals struct {
+	CostUSD          float64          `json:"cost_usd"`
+	PromptTokens     int64            `json:"prompt_tokens"`
+	CompletionTokens int64            `json:"completion_tokens"`
+	Images           int64            `json:"images"`
+	ImagesBySize     map[string]int64 `json:"images_by_size,omitempty"`
+}
+
+func (t *UsageTotals) add(other UsageTotals) {
+	t.CostUSD += other.CostUSD
+	t.PromptTokens += other.PromptTokens
+	t.CompletionTokens += other.CompletionTokens
+	t.Images += other.Images
+	for size, n := range other.ImagesBySize {
+		if t.ImagesBySize == nil {
+			t.ImagesBySize = make(map[string]int64)
+		}
+		t.ImagesBySize[size] += n
+	}
+}
+
+// UsagePeriod is the usage for one UTC day ("2006-01-02") or month ("2006-01"), in total
+// and broken down by series and by API key
+type UsagePeriod struct {
+	Period string `json:"period"`
+	UsageTotals
+	BySeries map[string]*UsageTotals `json:"by_series"`
+	ByKey    map[string]*UsageTotals `json:"by_key"`
+}
+
+func newUsagePeriod(period string) *UsagePeriod {
+	return &UsagePeriod{Period: period, BySeries: make(map[string]*UsageTotals), ByKey: make(map[string]*UsageTotals)}
+}
+
+func (p *UsagePeriod) add(series, key string, delta UsageTotals) {
+	p.UsageTotals.add(delta)
+	mergeTotals(p.BySeries, map[string]*UsageTotals{series: &delta})
+	mergeTotals(p.ByKey, map[string]*UsageTotals{key: &delta})
+}
+
+// BudgetError is returned once a spending budget is used up
+type BudgetError struct {
+	Period   string // "daily" or "monthly"
+	LimitUSD float64
+	SpentUSD float64
+	ResetAt  time.Time
+}
+
+func (e *BudgetError) Error() string {
+	return fmt.Sprintf("%s budget of $%.2f exhausted ($%.2f spent); resets at %s", e.Period, e.LimitUSD, e.SpentUSD, e.ResetAt.Format(time.RFC3339))
+}
+
+// writeBudgetExceeded answers 429 with a Retry-After pointing at the budget reset
+func writeBudgetExceeded(w http.ResponseWriter, err *BudgetError, endpoint, requestID string) {
+	seconds := max(1, int(math.Ceil(time.Until(err.ResetAt).Seconds())))
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	GetMetricsCollector().RecordBudgetRejection(endpoint, requestID)
+	logWarn(fmt.Sprintf("[%s] refusing generation on %s: %v", requestID, endpoint, err))
+	WriteErrorResponse(w, NewAPIError(
+		ErrorBudgetExceeded,
+		"Spending budget exhausted",
+		err.Error(),
+	).WithRequestID(requestID), http.StatusTooManyRequests)
+}
+
+// UsageLedger prices and records provider usage, keeping one file of totals per UTC day
+// under dir, and enforces the daily and monthly budgets
+type UsageLedger struct {
+	mu      sync.Mutex
+	dir     string
+	rates   RateTable
+	daily   float64
+	monthly float64
+	days    map[string]*UsagePeriod
+	fileOps *RobustFileOperations
+	now     func() time.Time
+
+	unpriced sync.Map // models already warned about
+}
+
+// NewUsageLedger creates a ledger rooted at dir; zero budgets are unlimited
+func NewUsageLedger(dir string, rates RateTable, daily, monthly float64) *UsageLedger {
+	return &UsageLedger{
+		dir:     dir,
+		rates:   rates,
+		daily:   daily,
+		monthly: monthly,
+		days:    make(map[string]*UsagePeriod),
+		fileOps: NewRobustFileOperations(),
+		now:     func() time.Time { return time.Now().UTC() },
+	}
+}
+
+// usageKey labels a job's client for the per-key breakdown; callers without an API key
+// are grouped together rather than listed by IP
+func usageKey(client string) string {
+	if strings.HasPrefix(client, "key:") {
+		return client
+	}
+	return "anonymous"
+}
+
+// RecordChat prices and records a chat completion
+func (l *UsageLedger) RecordChat(series, client, model string, promptTokens, completionTokens int) {
+	if _, ok := l.rates.chatRate(model); !ok {
+		l.recordUnpriced("chat model", model)
+	}
+	cost := l.rates.ChatCost(model, promptTokens, completionTokens)
+	l.record(series, client, UsageTotals{CostUSD: cost, PromptTokens: int64(promptTokens), CompletionTokens: int64(completionTokens)})
+	GetMetricsCollector().RecordUsage(series, cost, int64(promptTokens), int64(completionTokens), "")
+}
+
+// RecordImage prices and records one generated image
+func (l *UsageLedger) RecordImage(series, client, model, quality, size string) {
+	if _, ok := l.rates.imagePrice(model, quality, size); !ok {
+		l.recordUnpriced("image model", model)
+	}
+	cost := l.rates.ImageCost(model, quality, size)
+	l.record(series, client, UsageTotals{CostUSD: cost, Images: 1, ImagesBySize: map[string]int64{size: 1}})
+	GetMetricsCollector().RecordUsage(series, cost, 0, 0, size)
+}
+
+// recordUnpriced counts usage recorded at $0 for want of a rate, warning once per model
+func (l *UsageLedger) recordUnpriced(kind, model string) {
+	GetMetricsCollector().RecordUnpricedUsage(model)
+	if _, warned := l.unpriced.LoadOrStore(model, true); !warned {
+		logWarn(fmt.Sprintf("usage: no rate for %s %q; its usage is recorded at $0 and does not count toward the budgets (add it with --rate-table)", kind, model))
+	}
+}
+
+func (l *UsageLedger) record(series, client string, delta UsageTotals) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	day := l.dayLocked(l.now().Format("2006-01-02"))
+	day.add(series, usageKey(client), delta)
+	data, err := json.MarshalIndent(day, "", "  ")
+	if err == nil {
+		err = l.fileOps.WriteFile(filepath.Join(l.dir, day.Period+".json"), data, "usage")
+	}
+	if err != nil {
+		logWarn(fmt.Sprintf("unable to persist usage for %s: %v", day.Period, err))
+	}
+}
+
+// dayLocked returns the totals for date, loading them from disk the first time
+func (l *UsageLedger) dayLocked(date string) *UsagePeriod {
+	if day, ok := l.days[date]; ok {
+		return day
+	}
+	day := newUsagePeriod(date)
+	if data, err := os.ReadFile(filepath.Join(l.dir, date+".json")); err == nil {
+		if err := json.Unmarshal(data, day); err != nil {
+			logWarn(fmt.Sprintf("ignoring unreadable usage file for %s: %v", date, err))
+			day = newUsagePeriod(date)
+		}
+	}
+	l.days[date] = day
+	return day
+}
+
+// Day returns a copy of the totals for a UTC date such as 2025-01-31
+func (l *UsageLedger) Day(date string) UsagePeriod {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := newUsagePeriod(date)
+	l.addPeriodLocked(out, l.dayLocked(date))
+	return *out
+}
+
+// Month sums the daily totals for a month such as 2025-01
+func (l *UsageLedger) Month(month string) UsagePeriod {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.monthLocked(month)
+}
+
+func (l *UsageLedger) monthLocked(month string) UsagePeriod {
+	out := newUsagePeriod(month)
+	start, err := time.Parse("2006-01", month)
+	if err != nil {
+		return *out
+	}
+	for d := start; d.Format("2006-01") == month; d = d.AddDate(0, 0, 1) {
+		date := d.Format("2006-01-02")
+		if _, loaded := l.days[date]; !loaded && !fileExists(filepath.Join(l.dir, date+".json")) {
+			continue
+		}
+		l.addPeriodLocked(out, l.dayLocked(date))
+	}
+	return *out
+}
+
+func (l *UsageLedger) addPeriodLocked(dst, src *UsagePeriod) {
+	dst.UsageTotals.add(src.UsageTotals)
+	mergeTotals(dst.BySeries, src.BySeries)
+	mergeTotals(dst.ByKey, src.ByKey)
+}
+
+func mergeTotals(dst, src map[string]*UsageTotals) {
+	for name, t := range src {
+		if dst[name] == nil {
+			dst[name] = &UsageTotals{}
+		}
+		dst[name].add(*t)
+	}
+}
+
+// CheckBudget returns a *BudgetError when today's or this month's spend has reached its budget
+func (l *UsageLedger) CheckBudget() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	if l.daily > 0 {
+		if spent := l.dayLocked(now.Format("2006-01-02")).CostUSD; spent >= l.daily {
+			reset := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+			return &BudgetError{Period: "daily", LimitUSD: l.daily, SpentUSD: spent, ResetAt: reset}
+		}
+	}
+	if l.monthly > 0 {
+		if spent := l.monthLocked(now.Format("2006-01")).CostUSD; spent >= l.monthly {
+			reset := time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+			return &BudgetError{Period: "monthly", LimitUSD: l.monthly, SpentUSD: spent, ResetAt: reset}
+		}
+	}
+	return nil
+}
+
+// BudgetStatus reports the configured budgets and what remains of each
+type BudgetStatus struct {
+	DailyUSD            float64  `json:"daily_usd,omitempty"`
+	DailyRemainingUSD   *float64 `json:"daily_remaining_usd,omitempty"`
+	MonthlyUSD          float64  `json:"monthly_usd,omitempty"`
+	MonthlyRemainingUSD *float64 `json:"monthly_remaining_usd,omitempty"`
+}
+
+// Budgets reports the budgets against today's and this month's spend
+func (l *UsageLedger) Budgets() BudgetStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	status := BudgetStatus{DailyUSD: l.daily, MonthlyUSD: l.monthly}
+	if l.daily > 0 {
+		left := math.Max(0, l.daily-l.dayLocked(now.Format("2006-01-02")).CostUSD)
+		status.DailyRemainingUSD = &left
+	}
+	if l.monthly > 0 {
+		left := math.Max(0, l.monthly-l.monthLocked(now.Format("2006-01")).CostUSD)
+		status.MonthlyRemainingUSD = &left
+	}
+	return status
+}
+
+// libraryImageSettings returns the image model and quality the library will request,
+// read from the same environment variables it uses
+func libraryImageSettings() (model, quality string) {
+	model = os.Getenv("TB_DALLE_IMAGE_MODEL")
+	if model == "" {
+		model = "dall-e-3"
+	}
+	quality = os.Getenv("TB_DALLE_IMAGE_QUALITY")
+	if quality == "" {
+		quality = "hd"
+	}
+	if model == "gpt-image-1" {
+		quality = "high" // the library always asks gpt-image-1 for high quality
+	}
+	return model, quality
+}
+
+// imageSize reads the dimensions of a generated PNG as "WxH"
+func imageSize(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = f.Close() }()
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%dx%d", cfg.Width, cfg.Height), nil
+}
+
+// recordImage prices the image a job produced at path; nothing is recorded when no image
+// was written, as when generation was skipped or another request held the lock
+func (a *App) recordImage(job *Job, series, path string) {
+	if a.Usage == nil || path == "" || !fileExists(path) {
+		return
+	}
+	size, err := imageSize(path)
+	if err != nil {
+		logWarn(fmt.Sprintf("[%s] unable to read image size of %s: %v", job.RequestID, path, err))
+		size = "unknown"
+	}
+	model, quality := libraryImageSettings()
+	a.Usage.RecordImage(series, job.Client, model, quality, size)
+}
+
+// checkBudget reports an exhausted spending budget, or nil when generations may proceed
+func (a *App) checkBudget() *BudgetError {
+	if a.Usage == nil {
+		return nil
+	}
+	var budgetErr *BudgetError
+	if errors.As(a.Usage.CheckBudget(), &budgetErr) {
+		return budgetErr
+	}
+	return nil
+}
+
+// formatBudget renders a budget for the startup report
+func formatBudget(usd float64) string {
+	if usd <= 0 {
+		return "unlimited"
+	}
+	return fmt.Sprintf("$%.2f", usd)
+}
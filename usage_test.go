@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	dalle "github.com/TrueBlocks/trueblocks-dalle/v6"
+)
+
+func TestUsageLedgerTotalsAndBudgets(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Date(2025, 3, 14, 22, 0, 0, 0, time.UTC)
+	ledger := NewUsageLedger(dir, defaultRateTable(), 0.15, 0)
+	ledger.now = func() time.Time { return now }
+
+	ledger.RecordChat("five", "key:abc", "gpt-4-0613", 1000, 500)        // 0.03 + 0.03
+	ledger.RecordImage("five", "key:abc", "dall-e-3", "hd", "1792x1024") // 0.12
+	if err := ledger.CheckBudget(); err == nil {
+		t.Fatalf("expected the daily budget to be exhausted")
+	} else {
+		var budgetErr *BudgetError
+		if !errors.As(err, &budgetErr) || budgetErr.Period != "daily" || !budgetErr.ResetAt.Equal(time.Date(2025, 3, 15, 0, 0, 0, 0, time.UTC)) {
+			t.Fatalf("unexpected budget error: %v", err)
+		}
+	}
+	ledger.RecordImage("six", "ip:10.0.0.1", "dall-e-3", "standard", "1024x1024") // 0.04
+
+	day := ledger.Day("2025-03-14")
+	if math.Abs(day.CostUSD-0.22) > 1e-9 || day.PromptTokens != 1000 || day.Images != 2 || day.ImagesBySize["1792x1024"] != 1 {
+		t.Fatalf("day totals: %+v", day.UsageTotals)
+	}
+	if day.ByKey["key:abc"].Images != 1 || day.ByKey["anonymous"].Images != 1 || math.Abs(day.BySeries["six"].CostUSD-0.04) > 1e-9 {
+		t.Fatalf("breakdowns: series=%v keys=%v", day.BySeries, day.ByKey)
+	}
+
+	// A fresh ledger reads the persisted day back; the next day is under budget again
+	reloaded := NewUsageLedger(dir, defaultRateTable(), 0.15, 0.20)
+	reloaded.now = func() time.Time { return now.Add(4 * time.Hour) }
+	if month := reloaded.Month("2025-03"); math.Abs(month.CostUSD-0.22) > 1e-9 || month.ByKey["key:abc"] == nil {
+		t.Fatalf("month: %+v", month)
+	}
+	var budgetErr *BudgetError
+	if err := reloaded.CheckBudget(); !errors.As(err, &budgetErr) || budgetErr.Period != "monthly" {
+		t.Fatalf("expected monthly budget error, got %v", err)
+	}
+	if status := reloaded.Budgets(); *status.DailyRemainingUSD != 0.15 || *status.MonthlyRemainingUSD != 0 {
+		t.Fatalf("budgets: %+v", status)
+	}
+}
+
+func TestLoadRateTableOverridesDefaults(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rates.json")
+	custom := `{"chat":{"llama3":{"input_per_1k":0,"output_per_1k":0.001}},"images":{"dall-e-3/hd":0.2}}`
+	if err := os.WriteFile(path, []byte(custom), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	rates, err := LoadRateTable(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := rates.ChatCost("llama3", 500, 2000); got != 0.002 {
+		t.Fatalf("llama3 cost = %v", got)
+	}
+	if got := rates.ImageCost("dall-e-3", "hd", "1024x1792"); got != 0.2 {
+		t.Fatalf("overridden image cost = %v", got)
+	}
+	if got := rates.ImageCost("dall-e-3", "hd", "1024x1024"); got != 0.08 {
+		t.Fatalf("default image cost = %v", got)
+	}
+	if got := rates.ChatCost("unknown-model", 1000, 1000); got != 0 {
+		t.Fatalf("unknown model cost = %v", got)
+	}
+}
+
+func TestGenerateRefusedWhenBudgetExhausted(t *testing.T) {
+	q := NewJobQueue(NewJobStore(t.TempDir()), 1, func(ctx context.Context, job *Job) (interface{}, error) {
+		return nil, nil
+	})
+	ledger := NewUsageLedger(t.TempDir(), defaultRateTable(), 0.01, 0)
+	q.Admit = func(*Job) error { return ledger.CheckBudget() }
+	app := &App{Jobs: q, Usage: ledger}
+
+	ledger.RecordImage("five", "", "dall-e-3", "hd", "1024x1024")
+	before := GetMetricsCollector().GetMetrics().BudgetRejections
+	rr := httptest.NewRecorder()
+	body := bytes.NewBufferString(`{"input":"Person Tour Coordinates"}`)
+	app.handleV1ImagesGenerate(rr, httptest.NewRequest(http.MethodPost, "/v1/images/generate?async=1", body))
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429, got %d %s", rr.Code, rr.Body.String())
+	}
+	if secs, err := strconv.Atoi(rr.Header().Get("Retry-After")); err != nil || secs < 1 || secs > 86400 {
+		t.Fatalf("Retry-After = %q", rr.Header().Get("Retry-After"))
+	}
+	if response := decodeAPIResponse(t, rr); response.Error == nil || response.Error.Code != ErrorBudgetExceeded {
+		t.Fatalf("unexpected error body: %s", rr.Body.String())
+	}
+	if len(q.List("")) != 0 {
+		t.Fatalf("refused request left a job record")
+	}
+	if GetMetricsCollector().GetMetrics().BudgetRejections != before+1 {
+		t.Fatalf("budget rejection not counted")
+	}
+
+	rr = httptest.NewRecorder()
+	app.handleV1Usage(rr, httptest.NewRequest(http.MethodGet, "/v1/usage", nil))
+	var report struct {
+		Data UsageReport `json:"data"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &report); err != nil || rr.Code != http.StatusOK {
+		t.Fatalf("usage: %d %s", rr.Code, rr.Body.String())
+	}
+	if report.Data.Day.Images != 1 || report.Data.Month.CostUSD != 0.08 || *report.Data.Budgets.DailyRemainingUSD != 0 {
+		t.Fatalf("usage report: %+v", report.Data)
+	}
+	if !strings.Contains(GetMetricsCollector().PrometheusMetrics(), `dalleserver_usage_images_total{size="1024x1024"}`) {
+		t.Fatalf("usage missing from Prometheus output")
+	}
+}
+
+func TestUnpricedUsageAndBudgetRecheck(t *testing.T) {
+	ledger := NewUsageLedger(t.TempDir(), defaultRateTable(), 0.01, 0)
+	before := GetMetricsCollector().GetMetrics().Usage.UnpricedByModel["llama3"]
+	ledger.RecordChat("five", "", "llama3", 1000, 1000)
+	ledger.RecordChat("five", "", "llama3", 1000, 1000)
+	if day := ledger.Day(ledger.now().UTC().Format("2006-01-02")); day.CostUSD != 0 {
+		t.Fatalf("unpriced chat cost %v", day.CostUSD)
+	}
+	if got := GetMetricsCollector().GetMetrics().Usage.UnpricedByModel["llama3"]; got != before+2 {
+		t.Fatalf("unpriced usage: %d -> %d", before, got)
+	}
+	if _, ok := ledger.rates.chatRate("gpt-4-0613"); !ok {
+		t.Fatalf("dated snapshot not priced")
+	}
+	if !strings.Contains(GetMetricsCollector().PrometheusMetrics(), `dalleserver_usage_unpriced_total{model="llama3"}`) {
+		t.Fatalf("unpriced usage missing from Prometheus output")
+	}
+
+	// A job admitted while there was budget left is refused before the image call once it
+	// has run out; the nil engine would panic if it were reached
+	t.Setenv("TB_DALLE_SKIP_IMAGE", "")
+	app := &App{Usage: ledger}
+	ledger.RecordImage("five", "", "dall-e-3", "hd", "1024x1024")
+	job := NewJob(JobKindGenerate, "late")
+	job.Request = &dalle.GenerateRequest{Input: "Person Tour Coordinates"}
+	rejections := GetMetricsCollector().GetMetrics().BudgetRejections
+	var budgetErr *BudgetError
+	if _, err := app.runJob(context.Background(), job); !errors.As(err, &budgetErr) || budgetErr.Period != "daily" {
+		t.Fatalf("expected the daily budget error, got %v", err)
+	}
+	if GetMetricsCollector().GetMetrics().BudgetRejections != rejections+1 {
+		t.Fatalf("late budget rejection not counted")
+	}
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// WebhookRetryConfig controls redelivery of failed webhook POSTs
+var WebhookRetryConfig = RetryConfig{
+	MaxAttempts:   5,
+	BaseDelay:     2 * time.Second,
+	MaxDelay:      60 * time.Second,
+	BackoffFactor: 2.0,
+}
+
+// maxWebhookDeliveries bounds the in-memory delivery log
+const maxWebhookDeliveries = 1000
+
+// Webhook event names
+const (
+	WebhookJobSucceeded = "job.succeeded"
+	WebhookJobFailed    = "job.failed"
+	WebhookJobCancelled = "job.cancelled"
+)
+
+// Webhook delivery states
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+// WebhookSubscription receives every job event (or the listed ones) server-wide
+type WebhookSubscription struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (s WebhookSubscription) wants(event string) bool {
+	if len(s.Events) == 0 {
+		return true
+	}
+	for _, e := range s.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookPayload is the JSON body POSTed to a webhook receiver
+type WebhookPayload struct {
+	Event      string          `json:"event"`
+	DeliveryID string          `json:"delivery_id"`
+	JobID      string          `json:"job_id"`
+	Kind       JobKind         `json:"kind"`
+	State      JobState        `json:"state"`
+	Series     string          `json:"series,omitempty"`
+	Address    string          `json:"address,omitempty"`
+	BatchID    string          `json:"batch_id,omitempty"`
+	ImageURL   string          `json:"image_url,omitempty"`
+	BlobURL    string          `json:"blob_url,omitempty"` // immutable URL of the finished image
+	Error      string          `json:"error,omitempty"`
+	ErrorCode  string          `json:"error_code,omitempty"`
+	Result     json.RawMessage `json:"result,omitempty"`
+	FinishedAt *time.Time      `json:"finished_at,omitempty"`
+}
+
+// WebhookDelivery records one payload sent (or being sent) to one URL
+type WebhookDelivery struct {
+	ID             string     `json:"id"`
+	Event          string     `json:"event"`
+	JobID          string     `json:"job_id"`
+	URL            string     `json:"url"`
+	SubscriptionID string     `json:"subscription_id,omitempty"`
+	State          string     `json:"state"`
+	Attempts       int        `json:"attempts"`
+	LastStatus     int        `json:"last_status,omitempty"`
+	LastError      string     `json:"last_error,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	DeliveredAt    *time.Time `json:"delivered_at,omitempty"`
+}
+
+// WebhookDispatcher signs and delivers job events to per-request callback URLs and
+// server-wide subscriptions, keeping a bounded log of deliveries
+type WebhookDispatcher struct {
+	mu            sync.Mutex
+	secret        []byte
+	client        *http.Client
+	retry         RetryConfig
+	subsFile      string
+	fileOps       *RobustFileOperations
+	subscriptions []WebhookSubscription
+	deliveries    []*WebhookDelivery // oldest first
+	// allowPrivate lets tests deliver to loopback receivers; the server never sets it
+	allowPrivate bool
+}
+
+// NewWebhookDispatcher creates a dispatcher persisting subscriptions under dir. Payloads
+// are signed only when secret is non-empty.
+func NewWebhookDispatcher(dir string, secret string) *WebhookDispatcher {
+	d := &WebhookDispatcher{
+		secret:   []byte(secret),
+		retry:    WebhookRetryConfig,
+		subsFile: filepath.Join(dir, "subscriptions.json"),
+		fileOps:  NewRobustFileOperations(),
+	}
+	// Receivers are checked where the connection is made, so a hostname that resolves to
+	// (or is later re-pointed at) an internal address is refused as well. No proxy is used,
+	// since the check would then only see the proxy.
+	dialer := &net.Dialer{Timeout: 10 * time.Second, Control: func(network, address string, _ syscall.RawConn) error {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		if ip := net.ParseIP(host); ip == nil || (!d.allowPrivate && !isPublicIP(ip)) {
+			return fmt.Errorf("webhook receiver %s: %w", host, errPrivateWebhookAddress)
+		}
+		return nil
+	}}
+	d.client = &http.Client{Timeout: 10 * time.Second, Transport: &http.Transport{
+		DialContext:         dialer.DialContext,
+		ForceAttemptHTTP2:   true,
+		MaxIdleConns:        100,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}}
+	d.loadSubscriptions()
+	return d
+}
+
+func (d *WebhookDispatcher) loadSubscriptions() {
+	data, err := os.ReadFile(d.subsFile)
+	if err != nil {
+		return
+	}
+	var subs []WebhookSubscription
+	if err := json.Unmarshal(data, &subs); err != nil {
+		logWarn(fmt.Sprintf("[webhooks] ignoring malformed %s: %v", d.subsFile, err))
+		return
+	}
+	d.subscriptions = subs
+}
+
+func (d *WebhookDispatcher) saveSubscriptionsLocked() error {
+	data, err := json.MarshalIndent(d.subscriptions, "", "  ")
+	if err != nil {
+		return err
+	}
+	return d.fileOps.WriteFile(d.subsFile, data, "webhooks")
+}
+
+// errPrivateWebhookAddress refuses webhook receivers on loopback, private or link-local
+// addresses, which would let callers reach the server's own network
+var errPrivateWebhookAddress = errors.New("address is not publicly routable")
+
+// cgnatRange is the shared address space of RFC 6598, which net.IP.IsPrivate leaves out
+var cgnatRange = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// isPublicIP reports whether ip may receive webhooks
+func isPublicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || cgnatRange.Contains(ip))
+}
+
+// ValidateWebhookURL accepts absolute http(s) URLs whose host is not a loopback, private or
+// link-local address. Hostnames are checked again after resolution, when delivering.
+func ValidateWebhookURL(raw string) error {
+	return validateWebhookURL(raw, false)
+}
+
+func validateWebhookURL(raw string, allowPrivate bool) error {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return fmt.Errorf("callback URL %q must be an absolute http or https URL", raw)
+	}
+	if allowPrivate {
+		return nil
+	}
+	host := strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return fmt.Errorf("callback URL %q: %w", raw, errPrivateWebhookAddress)
+	}
+	if ip := net.ParseIP(host); ip != nil && !isPublicIP(ip) {
+		return fmt.Errorf("callback URL %q: %w", raw, errPrivateWebhookAddress)
+	}
+	return nil
+}
+
+// Subscribe registers a server-wide webhook
+func (d *WebhookDispatcher) Subscribe(rawURL string, events []string) (*WebhookSubscription, error) {
+	if err := validateWebhookURL(rawURL, d.allowPrivate); err != nil {
+		return nil, err
+	}
+	for _, e := range events {
+		if e != WebhookJobSucceeded && e != WebhookJobFailed && e != WebhookJobCancelled {
+			return nil, fmt.Errorf("unknown webhook event %q", e)
+		}
+	}
+	sub := WebhookSubscription{ID: uuid.New().String(), URL: rawURL, Events: events, CreatedAt: time.Now()}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.subscriptions = append(d.subscriptions, sub)
+	if err := d.saveSubscriptionsLocked(); err != nil {
+		d.subscriptions = d.subscriptions[:len(d.subscriptions)-1]
+		return nil, err
+	}
+	return &sub, nil
+}
+
+// Unsubscribe removes a server-wide webhook and reports whether it existed
+func (d *WebhookDispatcher) Unsubscribe(id string) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for i, sub := range d.subscriptions {
+		if sub.ID == id {
+			d.subscriptions = append(d.subscriptions[:i:i], d.subscriptions[i+1:]...)
+			return true, d.saveSubscriptionsLocked()
+		}
+	}
+	return false, nil
+}
+
+// Subscriptions returns the registered server-wide webhooks
+func (d *WebhookDispatcher) Subscriptions() []WebhookSubscription {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]WebhookSubscription(nil), d.subscriptions...)
+}
+
+// Deliveries returns logged deliveries, newest first, optionally filtered by job and state
+func (d *WebhookDispatcher) Deliveries(jobID, state string) []WebhookDelivery {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	out := make([]WebhookDelivery, 0, len(d.deliveries))
+	for i := len(d.deliveries) - 1; i >= 0; i-- {
+		del := d.deliveries[i]
+		if (jobID != "" && del.JobID != jobID) || (state != "" && del.State != state) {
+			continue
+		}
+		out = append(out, *del)
+	}
+	return out
+}
+
+// Sign returns the hex HMAC-SHA256 of body under the configured secret
+func (d *WebhookDispatcher) Sign(body []byte) string {
+	mac := hmac.New(sha256.New, d.secret)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookEvent maps a terminal job state to its event name
+func webhookEvent(state JobState) string {
+	switch state {
+	case JobSucceeded:
+		return WebhookJobSucceeded
+	case JobCancelled:
+		return WebhookJobCancelled
+	default:
+		return WebhookJobFailed
+	}
+}
+
+// JobFinished queues deliveries for a job that reached a terminal state
+func (d *WebhookDispatcher) JobFinished(job *Job) {
+	event := webhookEvent(job.State)
+	type target struct{ url, subID string }
+	var targets []target
+	for _, callback := range job.Callbacks {
+		targets = append(targets, target{url: callback})
+	}
+	for _, sub := range d.Subscriptions() {
+		if sub.wants(event) {
+			targets = append(targets, target{url: sub.URL, subID: sub.ID})
+		}
+	}
+	for _, t := range targets {
+		payload := WebhookPayload{
+			Event:      event,
+			DeliveryID: uuid.New().String(),
+			JobID:      job.ID,
+			Kind:       job.Kind,
+			State:      job.State,
+			Series:     job.Series,
+			Address:    job.Address,
+			BatchID:    job.BatchID,
+			Error:      job.Error,
+			ErrorCode:  job.ErrorCode,
+			Result:     job.Result,
+			FinishedAt: job.FinishedAt,
+		}
+		if job.Kind == JobKindDalle && job.State == JobSucceeded {
+			payload.ImageURL = annotatedImageURL(job.Series, job.Address)
+			payload.BlobURL = annotatedBlobURL(job.Series, job.Address)
+		}
+		delivery := &WebhookDelivery{
+			ID:             payload.DeliveryID,
+			Event:          event,
+			JobID:          job.ID,
+			URL:            t.url,
+			SubscriptionID: t.subID,
+			State:          DeliveryPending,
+			CreatedAt:      time.Now(),
+		}
+		d.record(delivery)
+		go d.deliver(delivery, payload, job.RequestID)
+	}
+}
+
+func (d *WebhookDispatcher) record(delivery *WebhookDelivery) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.deliveries = append(d.deliveries, delivery)
+	if over := len(d.deliveries) - maxWebhookDeliveries; over > 0 {
+		d.deliveries = append([]*WebhookDelivery(nil), d.deliveries[over:]...)
+	}
+}
+
+// deliver POSTs the signed payload, retrying with backoff until it is accepted
+func (d *WebhookDispatcher) deliver(delivery *WebhookDelivery, payload WebhookPayload, requestID string) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		d.mu.Lock()
+		delivery.State = DeliveryFailed
+		delivery.LastError = err.Error()
+		d.mu.Unlock()
+		return
+	}
+
+	err = RetryWithBackoff(d.retry, func() error {
+		req, err := http.NewRequest(http.MethodPost, delivery.URL, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Dalle-Event", payload.Event)
+		req.Header.Set("X-Dalle-Delivery", delivery.ID)
+		if len(d.secret) > 0 {
+			req.Header.Set("X-Dalle-Signature", "sha256="+d.Sign(body))
+		}
+
+		resp, err := d.client.Do(req)
+		status := 0
+		if resp != nil {
+			status = resp.StatusCode
+			_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+			_ = resp.Body.Close()
+		}
+		if err == nil && (status < 200 || status >= 300) {
+			err = fmt.Errorf("receiver responded %d", status)
+		}
+
+		d.mu.Lock()
+		delivery.Attempts++
+		attempts := delivery.Attempts
+		delivery.LastStatus = status
+		delivery.LastError = ""
+		if err != nil {
+			delivery.LastError = err.Error()
+		}
+		d.mu.Unlock()
+		if err != nil && attempts < d.retry.MaxAttempts {
+			GetMetricsCollector().RecordRetry("webhook", requestID)
+		}
+		return err
+	})
+
+	d.mu.Lock()
+	if err != nil {
+		delivery.State = DeliveryFailed
+	} else {
+		now := time.Now()
+		delivery.State = DeliveryDelivered
+		delivery.DeliveredAt = &now
+	}
+	snapshot := *delivery
+	d.mu.Unlock()
+
+	GetMetricsCollector().RecordWebhookDelivery(err == nil, requestID)
+	if err != nil {
+		logWarn(fmt.Sprintf("[%s] webhook %s to %s failed after %d attempts: %v", requestID, snapshot.Event, snapshot.URL, snapshot.Attempts, err))
+	} else {
+		logInfo(fmt.Sprintf("[%s] webhook %s delivered to %s (attempt %d)", requestID, snapshot.Event, snapshot.URL, snapshot.Attempts))
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type webhookReceiver struct {
+	mu       sync.Mutex
+	failures int
+	bodies   [][]byte
+	headers  []http.Header
+	got      chan struct{}
+}
+
+func newWebhookReceiver(t *testing.T, failures int) (*webhookReceiver, *httptest.Server) {
+	t.Helper()
+	rec := &webhookReceiver{failures: failures, got: make(chan struct{}, 16)}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		rec.mu.Lock()
+		defer rec.mu.Unlock()
+		if rec.failures > 0 {
+			rec.failures--
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		rec.bodies = append(rec.bodies, body)
+		rec.headers = append(rec.headers, r.Header.Clone())
+		rec.got <- struct{}{}
+	}))
+	t.Cleanup(server.Close)
+	return rec, server
+}
+
+func (rec *webhookReceiver) wait(t *testing.T) (WebhookPayload, http.Header, []byte) {
+	t.Helper()
+	select {
+	case <-rec.got:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("webhook not received")
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	body := rec.bodies[len(rec.bodies)-1]
+	var payload WebhookPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		t.Fatalf("decode payload: %v", err)
+	}
+	return payload, rec.headers[len(rec.headers)-1], body
+}
+
+func newTestDispatcher(t *testing.T, secret string) *WebhookDispatcher {
+	t.Helper()
+	d := NewWebhookDispatcher(t.TempDir(), secret)
+	d.allowPrivate = true // the receivers are httptest servers on loopback
+	d.retry = RetryConfig{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond, BackoffFactor: 2}
+	return d
+}
+
+func TestWebhookCallbackRetriesAndSigns(t *testing.T) {
+	rec, server := newWebhookReceiver(t, 1)
+	d := newTestDispatcher(t, "s3cret")
+	q := NewJobQueue(NewJobStore(t.TempDir()), 1, func(_ context.Context, job *Job) (interface{}, error) {
+		return map[string]string{"path": "x"}, nil
+	})
+	q.OnFinish = d.JobFinished
+	q.Start()
+
+	job := NewJob(JobKindDalle, "req-hook")
+	job.Series, job.Address = "empty", "0xabc"
+	job.Callbacks = []string{server.URL}
+	if _, err := q.Enqueue(job); err != nil {
+		t.Fatalf("enqueue: %v", err)
+	}
+
+	payload, headers, body := rec.wait(t)
+	if payload.Event != WebhookJobSucceeded || payload.JobID != job.ID || payload.ImageURL != annotatedImageURL("empty", "0xabc") {
+		t.Fatalf("unexpected payload %#v", payload)
+	}
+	if got, want := headers.Get("X-Dalle-Signature"), "sha256="+d.Sign(body); got != want {
+		t.Fatalf("signature mismatch: got %q want %q", got, want)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		deliveries := d.Deliveries(job.ID, DeliveryDelivered)
+		if len(deliveries) == 1 {
+			if deliveries[0].Attempts != 2 || deliveries[0].LastStatus != http.StatusOK {
+				t.Fatalf("unexpected delivery record %#v", deliveries[0])
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("delivery never logged as delivered: %#v", d.Deliveries("", ""))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestWebhookSubscriptionReceivesCancellation(t *testing.T) {
+	rec, server := newWebhookReceiver(t, 0)
+	d := newTestDispatcher(t, "")
+	if _, err := d.Subscribe(server.URL, []string{WebhookJobCancelled}); err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+	if _, err := d.Subscribe("ftp://nope", nil); err == nil {
+		t.Fatalf("expected non-http subscription to be rejected")
+	}
+
+	started := make(chan struct{})
+	q := NewJobQueue(NewJobStore(t.TempDir()), 1, func(ctx context.Context, job *Job) (interface{}, error) {
+		if job.Address == "0xslow" {
+			close(started)
+			<-ctx.Done()
+		}
+		return nil, ctx.Err()
+	})
+	q.OnFinish = d.JobFinished
+	q.Start()
+
+	fast := NewJob(JobKindDalle, "req-fast")
+	fast.Series, fast.Address = "empty", "0xfast"
+	_, _ = q.Enqueue(fast)
+	waitForJob(t, q, fast.ID)
+
+	slow := NewJob(JobKindDalle, "req-slow")
+	slow.Series, slow.Address = "empty", "0xslow"
+	_, _ = q.Enqueue(slow)
+	<-started
+	if _, err := q.Cancel(slow.ID); err != nil {
+		t.Fatalf("cancel: %v", err)
+	}
+
+	payload, headers, _ := rec.wait(t)
+	if payload.Event != WebhookJobCancelled || payload.JobID != slow.ID {
+		t.Fatalf("expected only the cancellation event, got %#v", payload)
+	}
+	if headers.Get("X-Dalle-Signature") != "" {
+		t.Fatalf("expected unsigned payload without a secret")
+	}
+
+	// Subscriptions survive a restart
+	reloaded := NewWebhookDispatcher(filepath.Dir(d.subsFile), "")
+	if len(reloaded.Subscriptions()) != 1 {
+		t.Fatalf("expected persisted subscription, got %#v", reloaded.Subscriptions())
+	}
+}
+
+func TestHandleV1ImagesGenerateCallbackURL(t *testing.T) {
+	app := newV1TestApp(t)
+	body := bytes.NewBufferString(`{"input":"Person Tour Coordinates","callback_url":"not a url"}`)
+	recorder := httptest.NewRecorder()
+	app.handleV1ImagesGenerate(recorder, httptest.NewRequest(http.MethodPost, "/v1/images/generate", body))
+	if recorder.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for invalid callback_url, got %d", recorder.Code)
+	}
+}
+
+func TestWebhookReceiversMustBePublic(t *testing.T) {
+	for _, raw := range []string{"http://127.0.0.1:8080/v1/admin/breakers/images/open", "http://169.254.169.254/latest/meta-data", "http://10.0.0.7/", "http://[::1]/", "http://localhost/", "https://100.64.1.1/"} {
+		if err := ValidateWebhookURL(raw); !errors.Is(err, errPrivateWebhookAddress) {
+			t.Fatalf("%s: expected a private address to be refused, got %v", raw, err)
+		}
+	}
+	if err := ValidateWebhookURL("https://hooks.example.com/dalle"); err != nil {
+		t.Fatalf("public URL refused: %v", err)
+	}
+
+	// Delivery checks the resolved address again when dialling
+	_, server := newWebhookReceiver(t, 0)
+	strict := NewWebhookDispatcher(t.TempDir(), "")
+	if _, err := strict.Subscribe(server.URL, nil); !errors.Is(err, errPrivateWebhookAddress) {
+		t.Fatalf("expected a loopback subscription to be refused, got %v", err)
+	}
+	if resp, err := strict.client.Get(server.URL); err == nil || !errors.Is(err, errPrivateWebhookAddress) {
+		if resp != nil {
+			resp.Body.Close()
+		}
+		t.Fatalf("expected the dialer to refuse a loopback receiver, got %v", err)
+	}
+
+	// Subscriptions see every job, so they are admin-only
+	app := &App{Webhooks: strict}
+	for _, r := range []*http.Request{
+		httptest.NewRequest(http.MethodPost, "/v1/webhooks", strings.NewReader(`{"url":"https://hooks.example.com/dalle"}`)),
+		httptest.NewRequest(http.MethodGet, "/v1/webhooks", nil),
+	} {
+		rr := httptest.NewRecorder()
+		app.handleV1Webhooks(rr, r)
+		if rr.Code != http.StatusForbidden {
+			t.Fatalf("%s %s without an admin token: got %d", r.Method, r.URL.Path, rr.Code)
+		}
+	}
+	app.Config.AdminToken = "s3cret"
+	rr := httptest.NewRecorder()
+	app.handleV1Webhook(rr, httptest.NewRequest(http.MethodDelete, "/v1/webhooks/someone-elses", nil))
+	if rr.Code != http.StatusUnauthorized {
+		t.Fatalf("anonymous unsubscribe: got %d", rr.Code)
+	}
+}
@@ -0,0 +1,585 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/draw"
+	"io"
+	"sort"
+)
+
+// The standard library and golang.org/x/image decode WebP but cannot write it, so
+// derivatives are encoded here. The encoder is lossless (VP8L) and deliberately simple:
+// the subtract-green and per-tile predictor transforms, then Huffman-coded pixels with
+// backward references to the pixel on the left or above. That covers the flat regions of
+// an annotated image well without the size of a full libwebp port.
+
+const (
+	vp8lSignature      = 0x2f
+	vp8lMaxDimension   = 1 << 14
+	vp8lPredictorBits  = 5 // 32x32 predictor tiles
+	vp8lMaxCodeLength  = 15
+	vp8lMaxCLLength    = 7
+	vp8lLiteralCodes   = 256
+	vp8lLengthCodes    = 24
+	vp8lDistanceCodes  = 40
+	vp8lMaxMatchLength = 4096
+	vp8lMinMatchLength = 3
+	vp8lDistanceAbove  = 1 // plane code for the pixel one row up
+	vp8lDistanceLeft   = 2 // plane code for the previous pixel
+)
+
+// vp8lCodeLengthOrder is the order code-length code lengths are written in
+var vp8lCodeLengthOrder = [19]uint8{17, 18, 0, 1, 2, 3, 4, 5, 16, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+// encodeWebP writes img to w as a lossless WebP
+func encodeWebP(w io.Writer, img image.Image) error {
+	b := img.Bounds()
+	width, height := b.Dx(), b.Dy()
+	if width < 1 || height < 1 || width > vp8lMaxDimension || height > vp8lMaxDimension {
+		return fmt.Errorf("webp: cannot encode a %dx%d image", width, height)
+	}
+	nrgba, ok := img.(*image.NRGBA)
+	if !ok || nrgba.Stride != 4*width || b.Min != (image.Point{}) {
+		nrgba = image.NewNRGBA(image.Rect(0, 0, width, height))
+		draw.Draw(nrgba, nrgba.Bounds(), img, b.Min, draw.Src)
+	}
+	pix := make([]byte, len(nrgba.Pix))
+	copy(pix, nrgba.Pix)
+
+	bw := &vp8lBitWriter{}
+	bw.write(vp8lSignature, 8)
+	bw.write(uint32(width-1), 14)
+	bw.write(uint32(height-1), 14)
+	bw.write(boolBit(hasAlpha(pix)), 1)
+	bw.write(0, 3) // version
+
+	// Transforms are undone in reverse, so subtract-green is written first
+	subtractGreen(pix)
+	bw.write(1, 1)
+	bw.write(2, 2)
+	modes, residuals := predict(pix, width, height)
+	bw.write(1, 1)
+	bw.write(0, 2)
+	bw.write(vp8lPredictorBits-2, 3)
+	tilesX := (width + 1<<vp8lPredictorBits - 1) >> vp8lPredictorBits
+	if err := writeEntropyImage(bw, modes, tilesX, false); err != nil {
+		return err
+	}
+	bw.write(0, 1) // no more transforms
+	if err := writeEntropyImage(bw, residuals, width, true); err != nil {
+		return err
+	}
+	data := bw.bytes()
+
+	padded := len(data) + len(data)&1
+	header := make([]byte, 20)
+	copy(header[0:4], "RIFF")
+	binary.LittleEndian.PutUint32(header[4:8], uint32(4+8+padded))
+	copy(header[8:12], "WEBP")
+	copy(header[12:16], "VP8L")
+	binary.LittleEndian.PutUint32(header[16:20], uint32(len(data)))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	if len(data) != padded {
+		data = append(data, 0)
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+func boolBit(b bool) uint32 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func hasAlpha(pix []byte) bool {
+	for p := 3; p < len(pix); p += 4 {
+		if pix[p] != 0xff {
+			return true
+		}
+	}
+	return false
+}
+
+func subtractGreen(pix []byte) {
+	for p := 0; p < len(pix); p += 4 {
+		pix[p+0] -= pix[p+1]
+		pix[p+2] -= pix[p+1]
+	}
+}
+
+// predict picks the predictor mode that leaves the smallest residuals in each tile and
+// returns the tile modes (in green, as the format stores them) and the residual pixels
+func predict(pix []byte, width, height int) (modes, residuals []byte) {
+	tilesX := (width + 1<<vp8lPredictorBits - 1) >> vp8lPredictorBits
+	tilesY := (height + 1<<vp8lPredictorBits - 1) >> vp8lPredictorBits
+	modes = make([]byte, 4*tilesX*tilesY)
+	for ty := 0; ty < tilesY; ty++ {
+		for tx := 0; tx < tilesX; tx++ {
+			best, bestCost := 0, -1
+			for mode := 0; mode < 14; mode++ {
+				cost := 0
+				forTile(tx, ty, width, height, func(p, top int) {
+					pred := predictPixel(mode, pix, p, top)
+					for c := 0; c < 4; c++ {
+						cost += residualCost(pix[p+c] - pred[c])
+					}
+				})
+				if bestCost < 0 || cost < bestCost {
+					best, bestCost = mode, cost
+				}
+			}
+			q := 4 * (ty*tilesX + tx)
+			modes[q+1], modes[q+3] = byte(best), 0xff
+		}
+	}
+
+	residuals = make([]byte, len(pix))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			p := 4 * (y*width + x)
+			var pred [4]byte
+			switch {
+			case x == 0 && y == 0:
+				pred = [4]byte{0, 0, 0, 0xff}
+			case y == 0:
+				copy(pred[:], pix[p-4:p])
+			case x == 0:
+				copy(pred[:], pix[p-4*width:p-4*width+4])
+			default:
+				mode := int(modes[4*((y>>vp8lPredictorBits)*tilesX+(x>>vp8lPredictorBits))+1])
+				pred = predictPixel(mode, pix, p, p-4*width)
+			}
+			for c := 0; c < 4; c++ {
+				residuals[p+c] = pix[p+c] - pred[c]
+			}
+		}
+	}
+	return modes, residuals
+}
+
+// forTile calls fn for the pixels of a tile that use the tile's predictor, skipping the
+// first row and column, whose predictors are fixed
+func forTile(tx, ty, width, height int, fn func(p, top int)) {
+	for y := max(ty<<vp8lPredictorBits, 1); y < min((ty+1)<<vp8lPredictorBits, height); y++ {
+		for x := max(tx<<vp8lPredictorBits, 1); x < min((tx+1)<<vp8lPredictorBits, width); x++ {
+			p := 4 * (y*width + x)
+			fn(p, p-4*width)
+		}
+	}
+}
+
+func residualCost(r byte) int {
+	if r < 128 {
+		return int(r)
+	}
+	return 256 - int(r)
+}
+
+// predictPixel computes a predictor mode's guess for the pixel at p from its neighbors,
+// exactly as the decoder will. top is the offset of the pixel above.
+func predictPixel(mode int, pix []byte, p, top int) [4]byte {
+	var out [4]byte
+	if mode == 11 {
+		var l, t int
+		for c := 0; c < 4; c++ {
+			l += absInt(int(pix[top-4+c]) - int(pix[top+c]))
+			t += absInt(int(pix[top-4+c]) - int(pix[p-4+c]))
+		}
+		if l < t {
+			copy(out[:], pix[p-4:p])
+		} else {
+			copy(out[:], pix[top:top+4])
+		}
+		return out
+	}
+	for c := 0; c < 4; c++ {
+		left, above, aboveRight, aboveLeft := pix[p-4+c], pix[top+c], pix[top+4+c], pix[top-4+c]
+		switch mode {
+		case 0:
+			if c == 3 {
+				out[c] = 0xff
+			}
+		case 1:
+			out[c] = left
+		case 2:
+			out[c] = above
+		case 3:
+			out[c] = aboveRight
+		case 4:
+			out[c] = aboveLeft
+		case 5:
+			out[c] = average2(average2(left, aboveRight), above)
+		case 6:
+			out[c] = average2(left, aboveLeft)
+		case 7:
+			out[c] = average2(left, above)
+		case 8:
+			out[c] = average2(aboveLeft, above)
+		case 9:
+			out[c] = average2(above, aboveRight)
+		case 10:
+			out[c] = average2(average2(left, aboveLeft), average2(above, aboveRight))
+		case 12:
+			out[c] = clampByte(int(left) + int(above) - int(aboveLeft))
+		case 13:
+			a := average2(left, above)
+			out[c] = clampByte(int(a) + (int(a)-int(aboveLeft))/2)
+		}
+	}
+	return out
+}
+
+func average2(a, b byte) byte { return byte((int(a) + int(b)) / 2) }
+
+func clampByte(x int) byte {
+	if x < 0 {
+		return 0
+	}
+	if x > 255 {
+		return 255
+	}
+	return byte(x)
+}
+
+func absInt(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+// vp8lToken is a literal pixel or a backward reference
+type vp8lToken struct {
+	pixel    [4]byte // RGBA, for literals
+	length   int     // 0 for literals
+	distance int     // plane code for references
+}
+
+// tokenize finds runs that repeat the previous pixel or the row above
+func tokenize(pix []byte, width int) []vp8lToken {
+	n := len(pix) / 4
+	same := func(a, b int) bool {
+		return pix[4*a] == pix[4*b] && pix[4*a+1] == pix[4*b+1] && pix[4*a+2] == pix[4*b+2] && pix[4*a+3] == pix[4*b+3]
+	}
+	run := func(i, dist int) int {
+		if i < dist {
+			return 0
+		}
+		k := 0
+		for i+k < n && k < vp8lMaxMatchLength && same(i+k, i+k-dist) {
+			k++
+		}
+		return k
+	}
+	var tokens []vp8lToken
+	for i := 0; i < n; {
+		left, above := run(i, 1), run(i, width)
+		switch {
+		case left >= above && left >= vp8lMinMatchLength:
+			tokens = append(tokens, vp8lToken{length: left, distance: vp8lDistanceLeft})
+			i += left
+		case above > left && above >= vp8lMinMatchLength:
+			tokens = append(tokens, vp8lToken{length: above, distance: vp8lDistanceAbove})
+			i += above
+		default:
+			var px [4]byte
+			copy(px[:], pix[4*i:4*i+4])
+			tokens = append(tokens, vp8lToken{pixel: px})
+			i++
+		}
+	}
+	return tokens
+}
+
+// prefixEncode splits a length or distance into its prefix symbol and extra bits
+func prefixEncode(v int) (symbol int, extraBits uint, extra uint32) {
+	d := v - 1
+	if d < 4 {
+		return d, 0, 0
+	}
+	h := 0
+	for d>>(h+1) != 0 {
+		h++
+	}
+	second := (d >> (h - 1)) & 1
+	return 2*h + second, uint(h - 1), uint32(d & (1<<(h-1) - 1))
+}
+
+// writeEntropyImage writes pixels as the format's entropy-coded image: no color cache,
+// a single group of Huffman codes, and the tokens
+func writeEntropyImage(bw *vp8lBitWriter, pix []byte, width int, topLevel bool) error {
+	bw.write(0, 1) // no color cache
+	if topLevel {
+		bw.write(0, 1) // no meta Huffman codes
+	}
+	tokens := tokenize(pix, width)
+	green := make([]int, vp8lLiteralCodes+vp8lLengthCodes)
+	red := make([]int, 256)
+	blue := make([]int, 256)
+	alpha := make([]int, 256)
+	dist := make([]int, vp8lDistanceCodes)
+	for _, t := range tokens {
+		if t.length == 0 {
+			red[t.pixel[0]]++
+			green[t.pixel[1]]++
+			blue[t.pixel[2]]++
+			alpha[t.pixel[3]]++
+			continue
+		}
+		ls, _, _ := prefixEncode(t.length)
+		ds, _, _ := prefixEncode(t.distance)
+		green[vp8lLiteralCodes+ls]++
+		dist[ds]++
+	}
+	codes := make([]*prefixCode, 0, 5)
+	for _, counts := range [][]int{green, red, blue, alpha, dist} {
+		code, err := writeHuffmanCode(bw, counts)
+		if err != nil {
+			return err
+		}
+		codes = append(codes, code)
+	}
+	for _, t := range tokens {
+		if t.length == 0 {
+			codes[0].write(bw, int(t.pixel[1]))
+			codes[1].write(bw, int(t.pixel[0]))
+			codes[2].write(bw, int(t.pixel[2]))
+			codes[3].write(bw, int(t.pixel[3]))
+			continue
+		}
+		ls, lbits, lextra := prefixEncode(t.length)
+		codes[0].write(bw, vp8lLiteralCodes+ls)
+		bw.write(lextra, lbits)
+		ds, dbits, dextra := prefixEncode(t.distance)
+		codes[4].write(bw, ds)
+		bw.write(dextra, dbits)
+	}
+	return nil
+}
+
+// prefixCode holds canonical Huffman codes, bit-reversed for the LSB-first stream
+type prefixCode struct {
+	bits []uint16
+	lens []uint8
+}
+
+func (c *prefixCode) write(bw *vp8lBitWriter, symbol int) {
+	bw.write(uint32(c.bits[symbol]), uint(c.lens[symbol]))
+}
+
+// writeHuffmanCode writes the code for counts and returns it for writing symbols
+func writeHuffmanCode(bw *vp8lBitWriter, counts []int) (*prefixCode, error) {
+	lengths := huffmanLengths(counts, vp8lMaxCodeLength)
+	used := 0
+	symbol := 0
+	for s, l := range lengths {
+		if l != 0 {
+			used++
+			symbol = s
+		}
+	}
+	if used <= 1 {
+		// A simple code with one symbol, which then takes no bits
+		if symbol > 255 {
+			return nil, fmt.Errorf("webp: lone symbol %d cannot use a simple code", symbol)
+		}
+		bw.write(1, 1)
+		bw.write(0, 1)
+		if symbol < 2 {
+			bw.write(0, 1)
+			bw.write(uint32(symbol), 1)
+		} else {
+			bw.write(1, 1)
+			bw.write(uint32(symbol), 8)
+		}
+		return &prefixCode{bits: make([]uint16, len(counts)), lens: make([]uint8, len(counts))}, nil
+	}
+
+	// Code lengths, with runs of zeros folded into symbols 17 (3-10) and 18 (11-138)
+	type clToken struct {
+		symbol    int
+		extraBits uint
+		extra     uint32
+	}
+	var clTokens []clToken
+	clCounts := make([]int, len(vp8lCodeLengthOrder))
+	for i := 0; i < len(lengths); {
+		if lengths[i] != 0 {
+			clTokens = append(clTokens, clToken{symbol: int(lengths[i])})
+			clCounts[lengths[i]]++
+			i++
+			continue
+		}
+		run := 0
+		for i+run < len(lengths) && lengths[i+run] == 0 && run < 138 {
+			run++
+		}
+		switch {
+		case run >= 11:
+			clTokens = append(clTokens, clToken{symbol: 18, extraBits: 7, extra: uint32(run - 11)})
+			clCounts[18]++
+		case run >= 3:
+			clTokens = append(clTokens, clToken{symbol: 17, extraBits: 3, extra: uint32(run - 3)})
+			clCounts[17]++
+		default:
+			for k := 0; k < run; k++ {
+				clTokens = append(clTokens, clToken{symbol: 0})
+				clCounts[0]++
+			}
+		}
+		i += run
+	}
+	clLengths := huffmanLengths(clCounts, vp8lMaxCLLength)
+	nCodes := 4
+	for i, s := range vp8lCodeLengthOrder {
+		if clLengths[s] != 0 && i+1 > nCodes {
+			nCodes = i + 1
+		}
+	}
+	bw.write(0, 1)
+	bw.write(uint32(nCodes-4), 4)
+	for _, s := range vp8lCodeLengthOrder[:nCodes] {
+		bw.write(uint32(clLengths[s]), 3)
+	}
+	bw.write(0, 1) // every symbol's length follows
+	clCode := canonicalCode(clLengths)
+	for _, t := range clTokens {
+		clCode.write(bw, t.symbol)
+		bw.write(t.extra, t.extraBits)
+	}
+	return canonicalCode(lengths), nil
+}
+
+// huffmanLengths returns code lengths for counts no longer than maxLen. Counts are halved
+// until the tree fits, which keeps every used symbol and flattens the tree.
+func huffmanLengths(counts []int, maxLen int) []uint8 {
+	weights := make([]int, len(counts))
+	copy(weights, counts)
+	for {
+		lengths, longest := buildHuffman(weights)
+		if longest <= maxLen {
+			return lengths
+		}
+		for i, w := range weights {
+			if w > 0 {
+				weights[i] = (w + 1) / 2
+			}
+		}
+	}
+}
+
+// buildHuffman computes optimal code lengths with the two-queue method
+func buildHuffman(weights []int) ([]uint8, int) {
+	lengths := make([]uint8, len(weights))
+	var leaves []int
+	for s, w := range weights {
+		if w > 0 {
+			leaves = append(leaves, s)
+		}
+	}
+	if len(leaves) == 0 {
+		return lengths, 0
+	}
+	if len(leaves) == 1 {
+		lengths[leaves[0]] = 1
+		return lengths, 1
+	}
+	sort.SliceStable(leaves, func(i, j int) bool { return weights[leaves[i]] < weights[leaves[j]] })
+
+	// Nodes 0..len(leaves)-1 are leaves in weight order; internal nodes follow
+	nodeWeight := make([]int, 0, 2*len(leaves))
+	parent := make([]int, 2*len(leaves))
+	for _, s := range leaves {
+		nodeWeight = append(nodeWeight, weights[s])
+	}
+	nextLeaf, nextInternal := 0, len(leaves)
+	pick := func() int {
+		if nextLeaf < len(leaves) && (nextInternal >= len(nodeWeight) || nodeWeight[nextLeaf] <= nodeWeight[nextInternal]) {
+			nextLeaf++
+			return nextLeaf - 1
+		}
+		nextInternal++
+		return nextInternal - 1
+	}
+	for len(nodeWeight) < 2*len(leaves)-1 {
+		a, b := pick(), pick()
+		parent[a], parent[b] = len(nodeWeight), len(nodeWeight)
+		nodeWeight = append(nodeWeight, nodeWeight[a]+nodeWeight[b])
+	}
+	root := len(nodeWeight) - 1
+	depth := make([]int, len(nodeWeight))
+	longest := 0
+	for n := root - 1; n >= 0; n-- {
+		depth[n] = depth[parent[n]] + 1
+		if n < len(leaves) {
+			lengths[leaves[n]] = uint8(depth[n])
+			longest = max(longest, depth[n])
+		}
+	}
+	return lengths, longest
+}
+
+// canonicalCode assigns canonical codes to lengths. A code with a single symbol takes no
+// bits, as the decoder reads it.
+func canonicalCode(lengths []uint8) *prefixCode {
+	code := &prefixCode{bits: make([]uint16, len(lengths)), lens: make([]uint8, len(lengths))}
+	var count [vp8lMaxCodeLength + 1]int
+	used := 0
+	for _, l := range lengths {
+		if l != 0 {
+			count[l]++
+			used++
+		}
+	}
+	if used <= 1 {
+		return code
+	}
+	var next [vp8lMaxCodeLength + 2]int
+	for l := 1; l <= vp8lMaxCodeLength; l++ {
+		next[l+1] = (next[l] + count[l]) << 1
+	}
+	for s, l := range lengths {
+		if l == 0 {
+			continue
+		}
+		c := next[l]
+		next[l]++
+		var reversed uint16
+		for i := uint8(0); i < l; i++ {
+			reversed = reversed<<1 | uint16(c>>i&1)
+		}
+		code.bits[s], code.lens[s] = reversed, l
+	}
+	return code
+}
+
+// vp8lBitWriter packs bits least-significant first
+type vp8lBitWriter struct {
+	buf   []byte
+	acc   uint64
+	nbits uint
+}
+
+func (bw *vp8lBitWriter) write(v uint32, n uint) {
+	bw.acc |= uint64(v&(1<<n-1)) << bw.nbits
+	bw.nbits += n
+	for bw.nbits >= 8 {
+		bw.buf = append(bw.buf, byte(bw.acc))
+		bw.acc >>= 8
+		bw.nbits -= 8
+	}
+}
+
+func (bw *vp8lBitWriter) bytes() []byte {
+	if bw.nbits > 0 {
+		bw.buf = append(bw.buf, byte(bw.acc))
+		bw.acc, bw.nbits = 0, 0
+	}
+	return bw.buf
+}